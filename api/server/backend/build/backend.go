@@ -3,14 +3,18 @@ package build // import "github.com/docker/docker/api/server/backend/build"
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
+	imagetypes "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/builder"
 	buildkit "github.com/docker/docker/builder/builder-next"
 	"github.com/docker/docker/builder/fscache"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/opts"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -20,6 +24,10 @@ import (
 type ImageComponent interface {
 	SquashImage(from string, to string) (string, error)
 	TagImageWithReference(image.ID, reference.Named) error
+	ExportImage(names []string, outStream io.Writer) error
+	LoadImage(inTar io.ReadCloser, outStream io.Writer, quiet bool) error
+	GetImage(refOrID string) (*image.Image, error)
+	ImageHistory(name string) ([]*imagetypes.HistoryResponseItem, error)
 }
 
 // Builder defines interface for running a build
@@ -40,15 +48,101 @@ func NewBackend(components ImageComponent, builder Builder, fsCache *fscache.FSC
 	return &Backend{imageComponent: components, builder: builder, fsCache: fsCache, buildkit: buildkit}, nil
 }
 
+// classicBuilderOption is a build option that is only implemented by the
+// classic builder, with whether it is set for a build.
+type classicBuilderOption struct {
+	name string
+	set  bool
+}
+
+// classicBuilderOptions returns the build options that BuildKit does not
+// support, by the name of their client flag, so that a BuildKit build that
+// sets one of them fails instead of silently ignoring it.
+func classicBuilderOptions(options *types.ImageBuildOptions) []classicBuilderOption {
+	return []classicBuilderOption{
+		{"assert-labels", options.AssertLabels != nil},
+		{"squash-stages", options.SquashStages},
+		{"error-on-deprecated", options.ErrorOnDeprecated},
+		{"cache-stats", options.CacheStats},
+		{"require-cmd", options.RequireCmd},
+		{"rm=on-failure", options.KeepOnFailure},
+		{"list-stages", options.ListStages},
+		{"skip-onbuild", len(options.SkipOnBuild) > 0},
+		{"tag-by-digest", len(options.TagByDigest) > 0},
+		{"max-parallelism", options.MaxParallelism != 0},
+		{"quiet-steps", options.QuietSteps},
+		{"cpus", options.NanoCPUs != 0},
+		{"inline-cache", options.InlineCache},
+		{"label-schema", options.LabelSchema},
+		{"explain-ignore", options.ExplainIgnore != ""},
+		{"strict-build-args", options.StrictBuildArgs},
+		{"lazy-context", options.LazyContext},
+		{"cache-to", options.CacheTo},
+		{"output-history", options.OutputHistory},
+		{"strict-case", options.StrictCase},
+		{"created", options.Created != ""},
+		{"tag-stage", len(options.TagStages) > 0},
+		{"lint", options.Lint},
+		{"arg-to-env-prefix", options.ArgToEnvPrefix != ""},
+		{"redact-args", len(options.RedactArgs) > 0},
+		{"warnings", options.Warnings != ""},
+		{"warn-overwrite", len(options.WarnOverwrite) > 0},
+		{"base-args", options.BaseArgs},
+		{"require-runnable", options.RequireRunnable},
+		{"no-cache-filter", len(options.NoCacheFilter) > 0},
+		{"sbom", options.SBOM},
+		{"run-readonly", options.RunReadonly},
+		{"max-steps", options.MaxSteps != 0},
+		{"mode-normalize", options.ModeNormalize},
+		{"export-stages", options.ExportStages},
+		{"pull-retries", options.PullRetries != 0 || options.PullRetryDelay != 0},
+		{"assert-ports", options.AssertPorts != nil},
+		{"max-files-per-layer", options.MaxFilesPerLayer != 0},
+		{"debug-on-failure", options.DebugOnFailure},
+		{"provenance", options.Provenance},
+		{"dns", len(options.DNS) > 0 || len(options.DNSSearch) > 0 || len(options.DNSOptions) > 0},
+		{"allow-mutable-tags", options.AllowMutableTags},
+		{"warn-missing-dockerignore", options.WarnMissingDockerignore != 0 || options.StrictMissingDockerignore},
+	}
+}
+
 // Build builds an image from a Source
 func (b *Backend) Build(ctx context.Context, config backend.BuildConfig) (string, error) {
 	options := config.Options
 	useBuildKit := options.Version == types.BuilderBuildKit
 
-	tagger, err := NewTagger(b.imageComponent, config.ProgressWriter.StdoutFormatter, options.Tags)
+	if useBuildKit {
+		for _, opt := range classicBuilderOptions(options) {
+			if opt.set {
+				return "", errdefs.InvalidParameter(errors.Errorf("%s is not supported with BuildKit", opt.name))
+			}
+		}
+	}
+
+	tagger, err := NewTagger(b.imageComponent, config.ProgressWriter.StdoutFormatter, options.Tags, options.TagByDigest, options.TagStages)
 	if err != nil {
 		return "", err
 	}
+	if options.PullRetries < 0 || options.PullRetryDelay < 0 {
+		return "", errdefs.InvalidParameter(errors.New("invalid pull-retries: the number of retries and the delay must not be negative"))
+	}
+	if options.MaxFilesPerLayer < 0 {
+		return "", errdefs.InvalidParameter(errors.Errorf("invalid max-files-per-layer %d: must not be negative", options.MaxFilesPerLayer))
+	}
+	if options.DebugOnFailure && options.ForceRemove {
+		return "", errdefs.InvalidParameter(errors.New("debug-on-failure cannot be used with force-rm"))
+	}
+	if len(options.DNS) > 0 || len(options.DNSSearch) > 0 {
+		if err := validateDNS(options.DNS, options.DNSSearch); err != nil {
+			return "", err
+		}
+	}
+	if options.WarnMissingDockerignore < 0 {
+		return "", errdefs.InvalidParameter(errors.Errorf("invalid warn-missing-dockerignore %d: must not be negative", options.WarnMissingDockerignore))
+	}
+	if options.StrictMissingDockerignore && options.WarnMissingDockerignore == 0 {
+		return "", errdefs.InvalidParameter(errors.New("strict-missing-dockerignore requires warn-missing-dockerignore"))
+	}
 
 	var build *builder.Result
 	if useBuildKit {
@@ -68,7 +162,7 @@ func (b *Backend) Build(ctx context.Context, config backend.BuildConfig) (string
 	}
 
 	var imageID = build.ImageID
-	if options.Squash {
+	if options.Squash || options.SquashStages {
 		if imageID, err = squashBuild(build, b.imageComponent); err != nil {
 			return "", err
 		}
@@ -83,6 +177,25 @@ func (b *Backend) Build(ctx context.Context, config backend.BuildConfig) (string
 		stdout := config.ProgressWriter.StdoutFormatter
 		fmt.Fprintf(stdout, "Successfully built %s\n", stringid.TruncateID(imageID))
 		err = tagger.TagImages(image.ID(imageID))
+		if err == nil {
+			err = tagger.TagStageImages(build.StageImageIDs)
+		}
+		if err == nil && options.CacheTo && config.ProgressWriter.AuxFormatter != nil {
+			// the layers of a squashed image cannot be used as a cache
+			err = config.ProgressWriter.AuxFormatter.Emit("moby.cache.images", localCacheImages(build))
+		}
+		if err == nil && options.ExportStages && config.ProgressWriter.AuxFormatter != nil {
+			err = config.ProgressWriter.AuxFormatter.Emit("moby.build.stages", exportedStages(build.StageImages, options.ExportAllStages))
+		}
+		if err == nil && options.OutputHistory && config.ProgressWriter.AuxFormatter != nil {
+			var history []types.BuildHistoryItem
+			if history, err = buildHistory(b.imageComponent, imageID); err == nil {
+				err = config.ProgressWriter.AuxFormatter.Emit("moby.image.history", history)
+			}
+		}
+		if err == nil && options.SBOM && config.ProgressWriter.AuxFormatter != nil {
+			err = config.ProgressWriter.AuxFormatter.Emit("moby.image.sbom", build.SBOM)
+		}
 	}
 	return imageID, err
 }
@@ -123,6 +236,33 @@ func (b *Backend) Cancel(ctx context.Context, id string) error {
 	return b.buildkit.Cancel(ctx, id)
 }
 
+// buildHistory returns the history of the image, oldest layer first, with
+// the size of each layer
+func buildHistory(imageComponent ImageComponent, imageID string) ([]types.BuildHistoryItem, error) {
+	img, err := imageComponent.GetImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+	// the image history is newest layer first
+	layers, err := imageComponent.ImageHistory(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) != len(img.History) {
+		return nil, errors.Errorf("inconsistent history for image %s", imageID)
+	}
+	history := make([]types.BuildHistoryItem, len(img.History))
+	for i, h := range img.History {
+		history[i] = types.BuildHistoryItem{
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			Size:       layers[len(layers)-1-i].Size,
+			EmptyLayer: h.EmptyLayer,
+		}
+	}
+	return history, nil
+}
+
 func squashBuild(build *builder.Result, imageComponent ImageComponent) (string, error) {
 	var fromID string
 	if build.FromImage != nil {
@@ -134,3 +274,19 @@ func squashBuild(build *builder.Result, imageComponent ImageComponent) (string,
 	}
 	return imageID, nil
 }
+
+// validateDNS returns an error if one of the DNS servers is not an IP
+// address or one of the search domains is not a valid domain
+func validateDNS(servers, searches []string) error {
+	for _, server := range servers {
+		if _, err := opts.ValidateIPAddress(server); err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid dns"))
+		}
+	}
+	for _, search := range searches {
+		if _, err := opts.ValidateDNSSearch(search); err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid dns-search"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/backend"
+	imagetypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type fakeHistoryImageComponent struct {
+	ImageComponent
+	img    *image.Image
+	layers []*imagetypes.HistoryResponseItem
+}
+
+func (c *fakeHistoryImageComponent) GetImage(refOrID string) (*image.Image, error) {
+	return c.img, nil
+}
+
+func (c *fakeHistoryImageComponent) ImageHistory(name string) ([]*imagetypes.HistoryResponseItem, error) {
+	return c.layers, nil
+}
+
+func TestBuildHistory(t *testing.T) {
+	imageComponent := &fakeHistoryImageComponent{
+		img: &image.Image{
+			History: []image.History{
+				{CreatedBy: "/bin/sh -c #(nop) ADD file:abcd in / "},
+				{CreatedBy: "/bin/sh -c #(nop)  ENV FOO=bar", EmptyLayer: true},
+				{CreatedBy: "/bin/sh -c echo foo > /foo", Comment: "foo"},
+			},
+		},
+		// newest layer first
+		layers: []*imagetypes.HistoryResponseItem{{Size: 4}, {Size: 0}, {Size: 1024}},
+	}
+	history, err := buildHistory(imageComponent, "sha256:abcd")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]types.BuildHistoryItem{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:abcd in / ", Size: 1024},
+		{CreatedBy: "/bin/sh -c #(nop)  ENV FOO=bar", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c echo foo > /foo", Comment: "foo", Size: 4},
+	}, history))
+
+	imageComponent.layers = imageComponent.layers[1:]
+	_, err = buildHistory(imageComponent, "sha256:abcd")
+	assert.Check(t, is.ErrorContains(err, "inconsistent history for image sha256:abcd"))
+}
+
+func TestBuildKitRejectsClassicBuilderOptions(t *testing.T) {
+	testCases := []struct {
+		options  types.ImageBuildOptions
+		expected string
+	}{
+		{options: types.ImageBuildOptions{AssertLabels: map[string]string{"a": "b"}}, expected: "assert-labels"},
+		{options: types.ImageBuildOptions{SquashStages: true}, expected: "squash-stages"},
+		{options: types.ImageBuildOptions{ErrorOnDeprecated: true}, expected: "error-on-deprecated"},
+		{options: types.ImageBuildOptions{CacheStats: true}, expected: "cache-stats"},
+		{options: types.ImageBuildOptions{RequireCmd: true}, expected: "require-cmd"},
+		{options: types.ImageBuildOptions{KeepOnFailure: true}, expected: "rm=on-failure"},
+		{options: types.ImageBuildOptions{ListStages: true}, expected: "list-stages"},
+		{options: types.ImageBuildOptions{SkipOnBuild: []string{"dev"}}, expected: "skip-onbuild"},
+		{options: types.ImageBuildOptions{TagByDigest: []string{"example.com/app"}}, expected: "tag-by-digest"},
+		{options: types.ImageBuildOptions{TagByDigest: []string{"example.com/app:tag"}}, expected: "tag-by-digest"},
+		{options: types.ImageBuildOptions{MaxParallelism: 2}, expected: "max-parallelism"},
+		{options: types.ImageBuildOptions{QuietSteps: true}, expected: "quiet-steps"},
+		{options: types.ImageBuildOptions{NanoCPUs: 1e9}, expected: "cpus"},
+		{options: types.ImageBuildOptions{InlineCache: true}, expected: "inline-cache"},
+		{options: types.ImageBuildOptions{LabelSchema: true}, expected: "label-schema"},
+		{options: types.ImageBuildOptions{ExplainIgnore: "file"}, expected: "explain-ignore"},
+		{options: types.ImageBuildOptions{StrictBuildArgs: true}, expected: "strict-build-args"},
+		{options: types.ImageBuildOptions{LazyContext: true}, expected: "lazy-context"},
+		{options: types.ImageBuildOptions{StrictCase: true}, expected: "strict-case"},
+	}
+	b := &Backend{}
+	for _, tc := range testCases {
+		options := tc.options
+		options.Version = types.BuilderBuildKit
+		_, err := b.Build(context.Background(), backend.BuildConfig{Options: &options})
+		assert.Check(t, is.Error(err, tc.expected+" is not supported with BuildKit"))
+		assert.Check(t, errdefs.IsInvalidParameter(err))
+	}
+}
@@ -0,0 +1,26 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"github.com/docker/docker/builder"
+)
+
+// localCacheImages returns the images of a build to save to a local cache,
+// which are the images of all the stages, so that a later build can also
+// take the intermediate stages from the cache, and the final image. The
+// client saves them with GET /images/get, and loads them back with POST
+// /images/load before passing their IDs in CacheFrom.
+func localCacheImages(build *builder.Result) []string {
+	var imageIDs []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			imageIDs = append(imageIDs, id)
+		}
+	}
+	for _, stage := range build.StageImages {
+		add(stage.ImageID)
+	}
+	add(build.ImageID)
+	return imageIDs
+}
@@ -0,0 +1,21 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/builder"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLocalCacheImages(t *testing.T) {
+	build := &builder.Result{
+		ImageID: "sha256:3",
+		StageImages: []builder.StageImage{
+			{Name: "build", ImageID: "sha256:1"},
+			{Name: "skipped"},
+			{ImageID: "sha256:3"},
+		},
+	}
+	assert.Check(t, is.DeepEqual([]string{"sha256:1", "sha256:3"}, localCacheImages(build)))
+}
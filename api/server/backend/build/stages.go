@@ -0,0 +1,30 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder"
+)
+
+// exportedStages returns the images of the named stages, or of all the
+// stages if all is set, to emit for the client to save. A stage without a
+// name is named after its index, which cannot clash with a stage name as
+// stage names start with a letter.
+func exportedStages(stages []builder.StageImage, all bool) []types.BuildStage {
+	var exported []types.BuildStage
+	for i, stage := range stages {
+		name := stage.Name
+		if name == "" {
+			if !all {
+				continue
+			}
+			name = strconv.Itoa(i)
+		}
+		if stage.ImageID == "" {
+			continue
+		}
+		exported = append(exported, types.BuildStage{Name: name, ID: stage.ImageID})
+	}
+	return exported
+}
@@ -0,0 +1,28 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestExportedStages(t *testing.T) {
+	stages := []builder.StageImage{
+		{Name: "deps", ImageID: "sha256:1"},
+		{ImageID: "sha256:2"},
+		{Name: "skipped"},
+		{Name: "final", ImageID: "sha256:3"},
+	}
+	assert.Check(t, is.DeepEqual([]types.BuildStage{
+		{Name: "deps", ID: "sha256:1"},
+		{Name: "final", ID: "sha256:3"},
+	}, exportedStages(stages, false)))
+	assert.Check(t, is.DeepEqual([]types.BuildStage{
+		{Name: "deps", ID: "sha256:1"},
+		{Name: "1", ID: "sha256:2"},
+		{Name: "final", ID: "sha256:3"},
+	}, exportedStages(stages, true)))
+}
@@ -3,6 +3,8 @@ package build // import "github.com/docker/docker/api/server/backend/build"
 import (
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/image"
@@ -14,19 +16,37 @@ type Tagger struct {
 	imageComponent ImageComponent
 	stdout         io.Writer
 	repoAndTags    []reference.Named
+	digestRepos    []reference.Named
+	// stageRepoAndTags maps the lowercase names of build stages to the
+	// tags of their images
+	stageRepoAndTags map[string][]reference.Named
 }
 
 // NewTagger returns a new Tagger for tagging the images of a build.
-// If any of the names are invalid tags an error is returned.
-func NewTagger(backend ImageComponent, stdout io.Writer, names []string) (*Tagger, error) {
+// The image is tagged with each of names, and with its own digest in each
+// of the digestRepos repositories. The images of named stages are tagged
+// with the stageTags, in the form stage=name. If any of the names are invalid
+// tags or any of the digestRepos are not plain repository names an error is
+// returned.
+func NewTagger(backend ImageComponent, stdout io.Writer, names []string, digestRepos []string, stageTags []string) (*Tagger, error) {
 	reposAndTags, err := sanitizeRepoAndTags(names)
 	if err != nil {
 		return nil, err
 	}
+	repos, err := sanitizeDigestRepos(digestRepos)
+	if err != nil {
+		return nil, err
+	}
+	stageReposAndTags, err := sanitizeStageTags(stageTags)
+	if err != nil {
+		return nil, err
+	}
 	return &Tagger{
-		imageComponent: backend,
-		stdout:         stdout,
-		repoAndTags:    reposAndTags,
+		imageComponent:   backend,
+		stdout:           stdout,
+		repoAndTags:      reposAndTags,
+		digestRepos:      repos,
+		stageRepoAndTags: stageReposAndTags,
 	}, nil
 }
 
@@ -38,9 +58,99 @@ func (bt *Tagger) TagImages(imageID image.ID) error {
 		}
 		fmt.Fprintf(bt.stdout, "Successfully tagged %s\n", reference.FamiliarString(rt))
 	}
+	if len(bt.digestRepos) == 0 {
+		return nil
+	}
+	// The digest is not a valid tag as is, so use "sha256-<hex>" instead
+	// of "sha256:<hex>"
+	digestTag := strings.Replace(imageID.String(), ":", "-", 1)
+	for _, repo := range bt.digestRepos {
+		rt, err := reference.WithTag(repo, digestTag)
+		if err != nil {
+			return err
+		}
+		if err := bt.imageComponent.TagImageWithReference(imageID, rt); err != nil {
+			return err
+		}
+		fmt.Fprintf(bt.stdout, "Successfully tagged %s\n", reference.FamiliarString(rt))
+	}
 	return nil
 }
 
+// TagStageImages creates the image tags of the stages for the images of
+// stageImageIDs, which maps the lowercase names of the stages to their images
+func (bt *Tagger) TagStageImages(stageImageIDs map[string]string) error {
+	stages := make([]string, 0, len(bt.stageRepoAndTags))
+	for stage := range bt.stageRepoAndTags {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		imageID, ok := stageImageIDs[stage]
+		if !ok || imageID == "" {
+			return errors.Errorf("cannot tag stage %s: the stage has no image", stage)
+		}
+		for _, rt := range bt.stageRepoAndTags[stage] {
+			if err := bt.imageComponent.TagImageWithReference(image.ID(imageID), rt); err != nil {
+				return err
+			}
+			fmt.Fprintf(bt.stdout, "Successfully tagged %s with the image of stage %s\n", reference.FamiliarString(rt), stage)
+		}
+	}
+	return nil
+}
+
+// sanitizeStageTags parses the raw "tagstage" parameter received from the
+// client, in the form stage=name, to the tags of each stage. The stage names
+// are case-insensitive.
+func sanitizeStageTags(stageTags []string) (map[string][]reference.Named, error) {
+	if len(stageTags) == 0 {
+		return nil, nil
+	}
+	names := make(map[string][]string)
+	for _, stageTag := range stageTags {
+		kv := strings.SplitN(stageTag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("invalid stage tag %q: expected <stage>=<name>", stageTag)
+		}
+		stage := strings.ToLower(kv[0])
+		names[stage] = append(names[stage], kv[1])
+	}
+	stageReposAndTags := make(map[string][]reference.Named, len(names))
+	for stage, stageNames := range names {
+		reposAndTags, err := sanitizeRepoAndTags(stageNames)
+		if err != nil {
+			return nil, err
+		}
+		stageReposAndTags[stage] = reposAndTags
+	}
+	return stageReposAndTags, nil
+}
+
+// sanitizeDigestRepos parses the raw "tagbydigest" parameter received from
+// the client. Each name must be a repository without a tag or digest.
+func sanitizeDigestRepos(names []string) ([]reference.Named, error) {
+	var repos []reference.Named
+	uniqNames := make(map[string]struct{})
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		ref, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return nil, err
+		}
+		if !reference.IsNameOnly(ref) {
+			return nil, errors.Errorf("repository %s for tagging by digest cannot contain a tag or digest", name)
+		}
+		if _, exists := uniqNames[ref.Name()]; !exists {
+			uniqNames[ref.Name()] = struct{}{}
+			repos = append(repos, ref)
+		}
+	}
+	return repos, nil
+}
+
 // sanitizeRepoAndTags parses the raw "t" parameter received from the client
 // to a slice of repoAndTag.
 // It also validates each repoName and tag.
@@ -0,0 +1,50 @@
+package build // import "github.com/docker/docker/api/server/backend/build"
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type fakeTagImageComponent struct {
+	ImageComponent
+	tags map[string]string
+}
+
+func (c *fakeTagImageComponent) TagImageWithReference(imageID image.ID, newTag reference.Named) error {
+	c.tags[reference.FamiliarString(newTag)] = imageID.String()
+	return nil
+}
+
+func TestTagStageImages(t *testing.T) {
+	imageComponent := &fakeTagImageComponent{tags: make(map[string]string)}
+	stdout := &bytes.Buffer{}
+	tagger, err := NewTagger(imageComponent, stdout, []string{"app"}, nil, []string{"Build=myrepo/build", "runtime=myrepo/runtime:1.0", "build=myrepo/build:dev"})
+	assert.NilError(t, err)
+
+	assert.NilError(t, tagger.TagImages("sha256:final"))
+	assert.NilError(t, tagger.TagStageImages(map[string]string{"build": "sha256:build", "runtime": "sha256:runtime"}))
+	assert.Check(t, is.DeepEqual(map[string]string{
+		"app:latest":          "sha256:final",
+		"myrepo/build:latest": "sha256:build",
+		"myrepo/build:dev":    "sha256:build",
+		"myrepo/runtime:1.0":  "sha256:runtime",
+	}, imageComponent.tags))
+	assert.Check(t, is.Contains(stdout.String(), "Successfully tagged myrepo/runtime:1.0 with the image of stage runtime"))
+
+	err = tagger.TagStageImages(map[string]string{"build": "sha256:build"})
+	assert.Check(t, is.ErrorContains(err, "cannot tag stage runtime: the stage has no image"))
+}
+
+func TestSanitizeStageTags(t *testing.T) {
+	for _, stageTag := range []string{"build", "=myrepo/build", "build="} {
+		_, err := sanitizeStageTags([]string{stageTag})
+		assert.Check(t, is.ErrorContains(err, "expected <stage>=<name>"), stageTag)
+	}
+	_, err := sanitizeStageTags([]string{"build=Invalid"})
+	assert.Check(t, is.ErrorContains(err, "invalid reference format"))
+}
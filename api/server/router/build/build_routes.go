@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/api/server/httputils"
 	"github.com/docker/docker/api/types"
@@ -21,13 +22,30 @@ import (
 	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/progress"
 	"github.com/docker/docker/pkg/streamformatter"
+	"github.com/docker/go-connections/nat"
 	units "github.com/docker/go-units"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// buildErrorCode is the code of a build error that is not caused by a RUN
+// instruction returning a non-zero code, so that clients can tell errors of
+// the builder apart from the exit code of the command. Like for docker run,
+// it is above the codes commonly used by commands.
+const buildErrorCode = 125
+
+// withBuildErrorCode sets buildErrorCode as the code of err, unless err
+// already has the exit code of a RUN instruction.
+func withBuildErrorCode(err error) error {
+	if jsonErr, ok := errors.Cause(err).(*jsonmessage.JSONError); ok && jsonErr.Code != 0 {
+		return &jsonmessage.JSONError{Message: err.Error(), Code: jsonErr.Code}
+	}
+	return &jsonmessage.JSONError{Message: err.Error(), Code: buildErrorCode}
+}
+
 type invalidIsolationError string
 
 func (e invalidIsolationError) Error() string {
@@ -43,6 +61,11 @@ func newImageBuildOptions(ctx context.Context, r *http.Request) (*types.ImageBui
 		options.Remove = true
 	} else if r.FormValue("rm") == "" && versions.GreaterThanOrEqualTo(version, "1.12") {
 		options.Remove = true
+	} else if r.FormValue("rm") == "on-failure" && versions.GreaterThanOrEqualTo(version, "1.38") {
+		// the container of a failed step is never removed unless forcerm
+		// is set, so this is rm=1 with the kept container reported
+		options.Remove = true
+		options.KeepOnFailure = true
 	} else {
 		options.Remove = httputils.BoolValue(r, "rm")
 	}
@@ -67,6 +90,55 @@ func newImageBuildOptions(ctx context.Context, r *http.Request) (*types.ImageBui
 	options.ExtraHosts = r.Form["extrahosts"]
 	options.SecurityOpt = r.Form["securityopt"]
 	options.Squash = httputils.BoolValue(r, "squash")
+	if versions.GreaterThanOrEqualTo(version, "1.38") {
+		options.SquashStages = httputils.BoolValue(r, "squashstages")
+		options.ErrorOnDeprecated = httputils.BoolValue(r, "errorondeprecated")
+		options.CacheStats = httputils.BoolValue(r, "cachestats")
+		options.RequireCmd = httputils.BoolValue(r, "requirecmd")
+		options.ListStages = httputils.BoolValue(r, "liststages")
+		options.SkipOnBuild = r.Form["skiponbuild"]
+		options.TagByDigest = r.Form["tagbydigest"]
+		options.MaxParallelism = int(httputils.Int64ValueOrZero(r, "maxparallelism"))
+		options.QuietSteps = httputils.BoolValue(r, "quietsteps")
+		options.NanoCPUs = httputils.Int64ValueOrZero(r, "nanocpus")
+		options.InlineCache = httputils.BoolValue(r, "inlinecache")
+		options.LabelSchema = httputils.BoolValue(r, "labelschema")
+		options.LabelSchemaRevision = r.FormValue("labelschemarevision")
+		options.LabelSchemaSource = r.FormValue("labelschemasource")
+		options.ExplainIgnore = r.FormValue("explainignore")
+		options.StrictBuildArgs = httputils.BoolValue(r, "strictbuildargs")
+		options.LazyContext = httputils.BoolValue(r, "lazycontext")
+		options.CacheTo = httputils.BoolValue(r, "cacheto")
+		options.OutputHistory = httputils.BoolValue(r, "outputhistory")
+		options.StrictCase = httputils.BoolValue(r, "strictcase")
+		options.Created = r.FormValue("created")
+		options.TagStages = r.Form["tagstage"]
+		options.Lint = httputils.BoolValue(r, "lint")
+		options.ArgToEnvPrefix = r.FormValue("argtoenvprefix")
+		options.RedactArgs = r.Form["redactargs"]
+		options.Warnings = r.FormValue("warnings")
+		options.WarnOverwrite = r.Form["warnoverwrite"]
+		options.BaseArgs = httputils.BoolValue(r, "baseargs")
+		options.RequireRunnable = httputils.BoolValue(r, "requirerunnable")
+		options.NoCacheFilter = r.Form["nocachefilter"]
+		options.SBOM = httputils.BoolValue(r, "sbom")
+		options.RunReadonly = httputils.BoolValue(r, "runreadonly")
+		options.MaxSteps = int(httputils.Int64ValueOrZero(r, "maxsteps"))
+		options.ModeNormalize = httputils.BoolValue(r, "modenormalize")
+		options.ExportStages = httputils.BoolValue(r, "exportstages")
+		options.ExportAllStages = httputils.BoolValue(r, "exportallstages")
+		options.PullRetries = int(httputils.Int64ValueOrZero(r, "pullretries"))
+		options.PullRetryDelay = time.Duration(httputils.Int64ValueOrZero(r, "pullretrydelay"))
+		options.MaxFilesPerLayer = int(httputils.Int64ValueOrZero(r, "maxfilesperlayer"))
+		options.DebugOnFailure = httputils.BoolValue(r, "debugonfailure")
+		options.Provenance = httputils.BoolValue(r, "provenance")
+		options.DNS = r.Form["dns"]
+		options.DNSSearch = r.Form["dnssearch"]
+		options.DNSOptions = r.Form["dnsoption"]
+		options.AllowMutableTags = httputils.BoolValue(r, "allowmutabletags")
+		options.WarnMissingDockerignore = httputils.Int64ValueOrZero(r, "warnmissingdockerignore")
+		options.StrictMissingDockerignore = httputils.BoolValue(r, "strictmissingdockerignore")
+	}
 	options.Target = r.FormValue("target")
 	options.RemoteContext = r.FormValue("remote")
 	if versions.GreaterThanOrEqualTo(version, "1.32") {
@@ -92,6 +164,10 @@ func newImageBuildOptions(ctx context.Context, r *http.Request) (*types.ImageBui
 		return nil, errdefs.InvalidParameter(errors.New("The daemon on this platform does not support setting security options on build"))
 	}
 
+	if err := validateResources(options); err != nil {
+		return nil, err
+	}
+
 	var buildUlimits = []*units.Ulimit{}
 	ulimitsJSON := r.FormValue("ulimits")
 	if ulimitsJSON != "" {
@@ -131,6 +207,27 @@ func newImageBuildOptions(ctx context.Context, r *http.Request) (*types.ImageBui
 		options.Labels = labels
 	}
 
+	assertLabelsJSON := r.FormValue("assertlabels")
+	if assertLabelsJSON != "" {
+		var assertLabels = map[string]string{}
+		if err := json.Unmarshal([]byte(assertLabelsJSON), &assertLabels); err != nil {
+			return nil, errors.Wrap(errdefs.InvalidParameter(err), "error reading assert labels")
+		}
+		options.AssertLabels = assertLabels
+	}
+
+	assertPortsJSON := r.FormValue("assertports")
+	if assertPortsJSON != "" {
+		var assertPorts = []string{}
+		if err := json.Unmarshal([]byte(assertPortsJSON), &assertPorts); err != nil {
+			return nil, errors.Wrap(errdefs.InvalidParameter(err), "error reading assert ports")
+		}
+		if _, _, err := nat.ParsePortSpecs(assertPorts); err != nil {
+			return nil, errors.Wrap(errdefs.InvalidParameter(err), "error reading assert ports")
+		}
+		options.AssertPorts = assertPorts
+	}
+
 	cacheFromJSON := r.FormValue("cachefrom")
 	if cacheFromJSON != "" {
 		var cacheFrom = []string{}
@@ -160,6 +257,32 @@ func parseVersion(s string) (types.BuilderVersion, error) {
 	return "", errors.Errorf("invalid version %s", s)
 }
 
+// minBuildMemory is the minimum memory limit of the intermediate containers,
+// the same as for any other container
+const minBuildMemory = 4 * 1024 * 1024
+
+// validateResources checks the resource limits of the intermediate
+// containers, so that invalid values fail before the build starts instead of
+// at the first RUN instruction.
+func validateResources(options *types.ImageBuildOptions) error {
+	if options.Memory != 0 && options.Memory < minBuildMemory {
+		return errdefs.InvalidParameter(errors.New("minimum memory limit allowed is 4MB"))
+	}
+	if options.MemorySwap < -1 {
+		return errdefs.InvalidParameter(errors.Errorf("invalid memory swap limit %d", options.MemorySwap))
+	}
+	if options.MemorySwap > 0 && options.Memory > 0 && options.MemorySwap < options.Memory {
+		return errdefs.InvalidParameter(errors.New("minimum memoryswap limit should be larger than memory limit"))
+	}
+	if options.NanoCPUs < 0 || options.NanoCPUs > int64(runtime.NumCPU())*1e9 {
+		return errdefs.InvalidParameter(errors.Errorf("range of CPUs is from 0.01 to %d.00, as there are only %d CPUs available", runtime.NumCPU(), runtime.NumCPU()))
+	}
+	if options.NanoCPUs > 0 && (options.CPUPeriod > 0 || options.CPUQuota > 0) {
+		return errdefs.InvalidParameter(errors.New("conflicting options: CPUs cannot be set together with CPU period or CPU quota"))
+	}
+	return nil
+}
+
 func (br *buildRouter) postPrune(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	report, err := br.backend.PruneCache(ctx)
 	if err != nil {
@@ -213,6 +336,9 @@ func (br *buildRouter) postBuild(ctx context.Context, w http.ResponseWriter, r *
 		if !output.Flushed() {
 			return err
 		}
+		if versions.GreaterThanOrEqualTo(version, "1.38") {
+			err = withBuildErrorCode(err)
+		}
 		_, err = output.Write(streamformatter.FormatError(err))
 		if err != nil {
 			logrus.Warnf("could not write error response: %v", err)
@@ -230,6 +356,10 @@ func (br *buildRouter) postBuild(ctx context.Context, w http.ResponseWriter, r *
 		return errdefs.InvalidParameter(errors.New("squash is only supported with experimental mode"))
 	}
 
+	if buildOptions.SquashStages && !br.daemon.HasExperimental() {
+		return errdefs.InvalidParameter(errors.New("squash-stages is only supported with experimental mode"))
+	}
+
 	if buildOptions.Version == types.BuilderBuildKit && !br.daemon.HasExperimental() {
 		return errdefs.InvalidParameter(errors.New("buildkit is only supported with experimental mode"))
 	}
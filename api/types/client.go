@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
@@ -154,6 +155,7 @@ type ImageBuildOptions struct {
 	CPUShares      int64
 	CPUQuota       int64
 	CPUPeriod      int64
+	NanoCPUs       int64
 	Memory         int64
 	MemorySwap     int64
 	CgroupParent   string
@@ -173,6 +175,166 @@ type ImageBuildOptions struct {
 	// preserves the original image and creates a new one from the parent with all
 	// the changes applied to a single layer
 	Squash bool
+	// SquashStages squashes the layers added by the final stage, and by any
+	// stages it is built from, into a single layer on top of the first base
+	// image of that chain of stages
+	SquashStages bool
+	// ErrorOnDeprecated fails the build when a deprecated instruction is
+	// used, instead of printing a warning
+	ErrorOnDeprecated bool
+	// CacheStats prints the number of build steps that were taken from the
+	// build cache at the end of the build
+	CacheStats bool
+	// RequireCmd fails the build if the final image is built from scratch
+	// and has neither a CMD nor an ENTRYPOINT
+	RequireCmd bool
+	// RequireRunnable fails the build if the final image has neither a CMD
+	// nor an ENTRYPOINT, whatever its base image
+	RequireRunnable bool
+	// NoCacheFilter disables the build cache for the steps of the named
+	// stages, and for the steps given as step:<number>
+	NoCacheFilter []string
+	// SBOM emits the files added to the image by the COPY and ADD
+	// instructions, as a list of BuildSBOMFile, in the moby.image.sbom aux
+	// message of the build output
+	SBOM bool
+	// RunReadonly runs the commands of RUN with a read-only root filesystem,
+	// so that they can only write to the mounts of their container
+	RunReadonly bool
+	// MaxSteps fails the build before it starts if the Dockerfile has more
+	// steps, 0 meaning that the number of steps is unlimited
+	MaxSteps int
+	// ModeNormalize sets the modes of the files copied by ADD and COPY
+	// without --chmod to 0644, or 0755 for executables and directories
+	ModeNormalize bool
+	// ExportStages emits the image of each named stage of a successful
+	// build, as a list of BuildStage, in the moby.build.stages aux message of
+	// the build output, for the client to save them with ImageSave
+	ExportStages bool
+	// ExportAllStages also emits the images of the stages without a name if
+	// ExportStages is set
+	ExportAllStages bool
+	// PullRetries is the number of times pulling an image for FROM or COPY
+	// --from is retried after a transient error, like a network error or an
+	// error of the registry. Missing images and denied pulls fail at once.
+	PullRetries int
+	// PullRetryDelay is the delay before the first retry of a pull, doubled
+	// at each retry, one second if not set
+	PullRetryDelay time.Duration
+	// MaxFilesPerLayer fails a COPY, ADD or RUN step that adds or modifies
+	// more files and directories in its layer, 0 meaning that the number of
+	// files is unlimited. RUN steps taken from the build cache are not
+	// checked.
+	MaxFilesPerLayer int
+	// DebugOnFailure keeps the container of a RUN step that fails, and
+	// prints its ID and how to start a shell in its filesystem. It cannot be
+	// used with ForceRemove.
+	DebugOnFailure bool
+	// KeepOnFailure removes the intermediate containers like Remove, and
+	// prints the ID of the container of a failed step, which is kept.
+	KeepOnFailure bool
+	// Provenance records how the image was built, as a BuildProvenance, in
+	// the com.docker.build.provenance label of the image
+	Provenance bool
+	// DNS, DNSSearch and DNSOptions set the DNS servers, search domains and
+	// resolver options of the containers of the RUN steps, like the --dns,
+	// --dns-search and --dns-option options of docker run
+	DNS        []string
+	DNSSearch  []string
+	DNSOptions []string
+	// AllowMutableTags suppresses the warning printed when a FROM instruction
+	// refers to an image by a tag, which can be moved to another image,
+	// instead of a digest
+	AllowMutableTags bool
+	// WarnMissingDockerignore prints a warning if the build context is
+	// larger than this number of bytes and has no .dockerignore file. 0, the
+	// default, disables the check.
+	WarnMissingDockerignore int64
+	// StrictMissingDockerignore fails the build instead of printing the
+	// warning of WarnMissingDockerignore
+	StrictMissingDockerignore bool
+	// ListStages prints the build stages of the Dockerfile, their base
+	// images and the stages they depend on, without building
+	ListStages bool
+	// SkipOnBuild lists the groups of labeled ONBUILD triggers of the base
+	// image that are not executed
+	SkipOnBuild []string
+	// TagByDigest lists repositories in which the built image is tagged
+	// with its own digest, for example myrepo/app:sha256-<hex>
+	TagByDigest []string
+	// MaxParallelism is the maximum number of build stages that are built
+	// at the same time. Stages that do not depend on each other are built
+	// concurrently if it is greater than 1.
+	MaxParallelism int
+	// QuietSteps only prints the header of each build step. The output of
+	// a step is only printed if the step fails.
+	QuietSteps bool
+	// InlineCache records the cache key of each build step in a label of
+	// the image, so that it can be used with CacheFrom after it is pushed
+	// and pulled.
+	InlineCache bool
+	// LabelSchema adds the org.opencontainers.image.created, .revision and
+	// .source annotation labels to the image. Labels override them.
+	LabelSchema         bool
+	LabelSchemaRevision string
+	LabelSchemaSource   string
+	// ExplainIgnore prints the .dockerignore pattern, with its line number,
+	// that excludes or re-includes the given path of the build context,
+	// without building
+	ExplainIgnore string
+	// StrictBuildArgs fails the build if one or more build-args are not
+	// consumed, instead of printing a warning
+	StrictBuildArgs bool
+	// AssertLabels fails the build if the labels of the final image,
+	// including the labels inherited from the base image, are not exactly
+	// the given ones
+	AssertLabels map[string]string
+	// AssertPorts fails the build if the ports exposed by the final image,
+	// including the ports exposed by the base image, are not exactly the
+	// given ones, in the format of EXPOSE, such as 80/tcp
+	AssertPorts []string
+	// LazyContext only transfers the files of a client session build
+	// context that the Dockerfile references
+	LazyContext bool
+	// CacheTo emits the IDs of the images of all the stages, in the
+	// moby.cache.images aux message of the build output, for the client to
+	// save them to a local cache with ImageSave. A later build uses the cache
+	// by loading the images with ImageLoad and passing their IDs in CacheFrom.
+	CacheTo bool
+	// OutputHistory emits the history of the image, as a list of
+	// BuildHistoryItem, in the moby.image.history aux message of the
+	// build output
+	OutputHistory bool
+	// StrictCase fails the build if a source of COPY or ADD only matches a
+	// file whose name differs in case, instead of printing a warning
+	StrictCase bool
+	// Created sets the created timestamp of the final image, in RFC 3339
+	// format, instead of the time of the build
+	Created string
+	// TagStages tags the images of named stages, in the form stage=name,
+	// in addition to the final image
+	TagStages []string
+	// Lint prints the known anti-patterns found in the instructions of the
+	// Dockerfile, with their line numbers, without building
+	Lint bool
+	// ArgToEnvPrefix sets the build-args whose name starts with the prefix
+	// as environment variables of the image, without ARG and ENV
+	// instructions
+	ArgToEnvPrefix string
+	// RedactArgs lists patterns of names of build-args and ENV variables
+	// whose values are replaced with *** in the history of the image
+	RedactArgs []string
+	// Warnings sets how the warnings of the build are printed, either inline
+	// with the output of the step that emits them (the default), or deferred
+	// to a single block printed once the build completes
+	Warnings string
+	// WarnOverwrite lists absolute paths under which the files of the image
+	// replaced by COPY and ADD instructions are reported with a warning
+	WarnOverwrite []string
+	// BaseArgs declares, in each stage, the ARGs declared by the history of
+	// its base image, so that build-args can set them without an ARG
+	// instruction
+	BaseArgs bool
 	// CacheFrom specifies images that are used for matching cache. Images
 	// specified here do not need to have a valid parent chain to match cache.
 	CacheFrom   []string
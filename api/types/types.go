@@ -587,6 +587,64 @@ type BuildResult struct {
 	ID string
 }
 
+// BuildHistoryItem describes a layer of the history of the image of a
+// successful build, oldest first, emitted when the OutputHistory build
+// option is set
+type BuildHistoryItem struct {
+	CreatedBy  string
+	Comment    string `json:",omitempty"`
+	Size       int64
+	EmptyLayer bool
+}
+
+// BuildStage is the image of a stage of a successful build, emitted when the
+// ExportStages build option is set
+type BuildStage struct {
+	// Name is the name of the stage, or its index, starting at 0, if the
+	// stage has no name
+	Name string
+	ID   string
+}
+
+// BuildSBOMFile describes a file that a COPY or ADD instruction of a
+// successful build added to the image, emitted when the SBOM build option is
+// set
+type BuildSBOMFile struct {
+	// Path is the path of the file in the image
+	Path string
+	Size int64
+	// Digest is the digest of the content of the file
+	Digest string
+	// Instruction is the COPY or ADD instruction that added the file
+	Instruction string
+	// Layer is the diff ID of the layer the instruction created
+	Layer string
+}
+
+// BuildProvenance describes how the image of a build was made, recorded as
+// JSON in the com.docker.build.provenance label of the image when the
+// Provenance build option is set
+type BuildProvenance struct {
+	// DockerfileDigest is the digest of the content of the Dockerfile
+	DockerfileDigest string
+	// BuildArgs are the build-args passed to the build that it used, with
+	// the values of those matching the RedactArgs patterns replaced by ***
+	BuildArgs map[string]string `json:",omitempty"`
+	// BaseImages are the images the stages are built from, stages built
+	// from another stage or from scratch excepted
+	BaseImages []BuildProvenanceImage `json:",omitempty"`
+	// Created is the time of the build, in RFC 3339 format
+	Created string
+}
+
+// BuildProvenanceImage is a base image of a build
+type BuildProvenanceImage struct {
+	// Name is the reference of the image in the FROM instruction
+	Name string
+	// ID is the ID of the image, the digest of its config
+	ID string
+}
+
 // BuildCache contains information about a build cache record
 type BuildCache struct {
 	ID      string
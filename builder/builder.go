@@ -14,6 +14,7 @@ import (
 	containerpkg "github.com/docker/docker/container"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/containerfs"
 )
 
@@ -70,12 +71,30 @@ type ExecBackend interface {
 	ContainerStart(containerID string, hostConfig *container.HostConfig, checkpoint string, checkpointDir string) error
 	// ContainerWait stops processing until the given container is stopped.
 	ContainerWait(ctx context.Context, name string, condition containerpkg.WaitCondition) (<-chan containerpkg.StateStatus, error)
+	// ContainerChanges returns the changes of the filesystem of a container
+	ContainerChanges(name string) ([]archive.Change, error)
 }
 
 // Result is the output produced by a Builder
 type Result struct {
 	ImageID   string
 	FromImage Image
+	// StageImageIDs maps the lowercase names of the stages of the TagStages
+	// option to their images
+	StageImageIDs map[string]string
+	// SBOM lists the files added to the image by COPY and ADD, if the SBOM
+	// option is set
+	SBOM []types.BuildSBOMFile
+	// StageImages lists the images of the stages, in the order of the
+	// Dockerfile, if the ExportStages or CacheTo option is set
+	StageImages []StageImage
+}
+
+// StageImage is the image a stage of a build produced
+type StageImage struct {
+	// Name is the name of the stage, empty if it has none
+	Name    string
+	ImageID string
 }
 
 // ImageCacheBuilder represents a generator for stateful image cache.
@@ -112,4 +131,7 @@ type RWLayer interface {
 	Release() error
 	Root() containerfs.ContainerFS
 	Commit() (ROLayer, error)
+	// CommitOnto commits the changes in the layer on top of parent instead
+	// of the layer it was created from.
+	CommitOnto(parent ROLayer) (ROLayer, error)
 }
@@ -0,0 +1,56 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/builder"
+	dockerimage "github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// baseImageArgs returns the names of the ARGs declared by the instructions of
+// the Dockerfiles the image was built from, as recorded in its history.
+func baseImageArgs(image builder.Image) []string {
+	img, ok := image.(*dockerimage.Image)
+	if !ok {
+		return nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, h := range img.History {
+		// ARG instructions are committed with a nop comment, such as
+		// "/bin/sh -c #(nop)  ARG NAME=default"
+		i := strings.Index(h.CreatedBy, "#(nop) ")
+		if i < 0 {
+			continue
+		}
+		comment := strings.TrimSpace(h.CreatedBy[i+len("#(nop) "):])
+		if !strings.HasPrefix(comment, "ARG ") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimSpace(comment[len("ARG "):]), "=", 2)[0]
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// declareBaseImageArgs declares the ARGs of the base image of the stage,
+// without their default value, so that build-args can set them without an
+// ARG instruction in the Dockerfile.
+func declareBaseImageArgs(d dispatchRequest, image builder.Image) {
+	names := baseImageArgs(image)
+	if len(names) == 0 {
+		fmt.Fprintf(d.builder.warningOutput(), "[Warning] The base image %s declares no ARG\n", stringid.TruncateID(image.ImageID()))
+		return
+	}
+	for _, name := range names {
+		d.state.buildArgs.AddArg(name, nil)
+		if _, ok := d.builder.options.BuildArgs[name]; ok {
+			fmt.Fprintf(d.builder.Stdout, " ---> Using build-arg %s declared by the base image\n", name)
+		}
+	}
+}
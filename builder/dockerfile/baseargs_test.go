@@ -0,0 +1,42 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"testing"
+
+	dockerimage "github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestBaseImageArgs(t *testing.T) {
+	img := &dockerimage.Image{History: []dockerimage.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:abcdef in / "},
+		{CreatedBy: "/bin/sh -c #(nop)  ARG VERSION=1.0"},
+		{CreatedBy: "/bin/sh -c #(nop)  ARG MODE"},
+		{CreatedBy: "|2 MODE=prod VERSION=1.0 /bin/sh -c echo ARG FOO"},
+		{CreatedBy: `cmd /S /C #(nop)  ARG VERSION=2.0`},
+	}}
+	assert.Check(t, is.DeepEqual([]string{"VERSION", "MODE"}, baseImageArgs(img)))
+	assert.Check(t, is.Len(baseImageArgs(&mockImage{id: "abcdef"}), 0))
+}
+
+func TestDeclareBaseImageArgs(t *testing.T) {
+	version := "2.0"
+	b := newBuilderWithMockBackend()
+	b.options.BuildArgs = map[string]*string{"VERSION": &version}
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(b.options.BuildArgs), newStagesBuildResults())
+
+	img := &dockerimage.Image{History: []dockerimage.History{
+		{CreatedBy: "/bin/sh -c #(nop)  ARG VERSION=1.0"},
+		{CreatedBy: "/bin/sh -c #(nop)  ARG MODE"},
+	}}
+	declareBaseImageArgs(sb, img)
+	assert.Check(t, is.DeepEqual(map[string]string{"VERSION": "2.0"}, sb.state.buildArgs.GetAllAllowed()))
+	assert.Check(t, is.Len(sb.state.buildArgs.UnusedBuildArgs(), 0))
+	stdout := b.Stdout.(*bytes.Buffer)
+	assert.Check(t, is.Contains(stdout.String(), "Using build-arg VERSION declared by the base image"))
+
+	declareBaseImageArgs(sb, &dockerimage.Image{})
+	assert.Check(t, is.Contains(stdout.String(), "declares no ARG"))
+}
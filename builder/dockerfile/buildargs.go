@@ -3,10 +3,20 @@ package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 import (
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/runconfig/opts"
 )
 
+// vcsRefBuildArg is set to the commit of a git build context, unless it is
+// passed explicitly. It is not reported as unused, as most Dockerfiles do not
+// declare it.
+const vcsRefBuildArg = "BUILD_VCS_REF"
+
 // builtinAllowedBuildArgs is list of built-in allowed build args
 // these args are considered transparent and are excluded from the image history.
 // Filtering from history is implemented in dispatchers.go
@@ -69,17 +79,55 @@ func (b *BuildArgs) MergeReferencedArgs(other *BuildArgs) {
 // WarnOnUnusedBuildArgs checks if there are any leftover build-args that were
 // passed but not consumed during build. Print a warning, if there are any.
 func (b *BuildArgs) WarnOnUnusedBuildArgs(out io.Writer) {
+	if leftoverArgs := b.UnusedBuildArgs(); len(leftoverArgs) > 0 {
+		fmt.Fprintf(out, "[Warning] One or more build-args %v were not consumed\n", leftoverArgs)
+	}
+}
+
+// UnusedBuildArgs returns the sorted names of the build-args that were passed
+// but not consumed during build, builtin args excepted.
+func (b *BuildArgs) UnusedBuildArgs() []string {
 	var leftoverArgs []string
 	for arg := range b.argsFromOptions {
 		_, isReferenced := b.referencedArgs[arg]
 		_, isBuiltin := builtinAllowedBuildArgs[arg]
-		if !isBuiltin && !isReferenced {
+		if !isBuiltin && !isReferenced && arg != vcsRefBuildArg {
 			leftoverArgs = append(leftoverArgs, arg)
 		}
 	}
-	if len(leftoverArgs) > 0 {
-		fmt.Fprintf(out, "[Warning] One or more build-args %v were not consumed\n", leftoverArgs)
+	sort.Strings(leftoverArgs)
+	return leftoverArgs
+}
+
+// UsedBuildArgs returns the sorted names of the build-args that were passed
+// and consumed during build
+func (b *BuildArgs) UsedBuildArgs() []string {
+	var usedArgs []string
+	for arg := range b.argsFromOptions {
+		if _, isReferenced := b.referencedArgs[arg]; isReferenced {
+			usedArgs = append(usedArgs, arg)
+		}
 	}
+	sort.Strings(usedArgs)
+	return usedArgs
+}
+
+// setVCSRefBuildArg sets the BUILD_VCS_REF build-arg to the revision of the
+// source, if it was checked out from a version control system and the
+// build-arg is not passed with a value.
+func setVCSRefBuildArg(options *types.ImageBuildOptions, source builder.Source) {
+	vcs, ok := source.(remotecontext.VCSSource)
+	if !ok {
+		return
+	}
+	if v, ok := options.BuildArgs[vcsRefBuildArg]; ok && v != nil {
+		return
+	}
+	if options.BuildArgs == nil {
+		options.BuildArgs = make(map[string]*string)
+	}
+	revision := vcs.VCSRevision()
+	options.BuildArgs[vcsRefBuildArg] = &revision
 }
 
 // ResetAllowed clears the list of args that are allowed to be used by a
@@ -118,6 +166,20 @@ func (b *BuildArgs) GetAllMeta() map[string]string {
 	return b.getAllFromMapping(b.allowedMetaArgs)
 }
 
+// ReferencePrefixedArgs returns the sorted names of the args provided by the
+// user that start with prefix, and marks them as referenced.
+func (b *BuildArgs) ReferencePrefixedArgs(prefix string) []string {
+	var keys []string
+	for key, value := range b.argsFromOptions {
+		if value != nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			b.referencedArgs[key] = struct{}{}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (b *BuildArgs) getAllFromMapping(source map[string]*string) map[string]string {
 	m := make(map[string]string)
 
@@ -5,6 +5,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 )
@@ -85,6 +87,48 @@ func TestWarnOnUnusedBuildArgs(t *testing.T) {
 	assert.Check(t, is.Contains(out, "ThisArgIsNotUsed"))
 }
 
+func TestUnusedBuildArgs(t *testing.T) {
+	buildArgs := NewBuildArgs(map[string]*string{
+		"ThisArgIsUsed":       strPtr("fromopt1"),
+		"ThisArgIsNotUsed":    strPtr("fromopt2"),
+		"AnotherArgIsNotUsed": strPtr("fromopt3"),
+		"HTTP_PROXY":          strPtr("unreferenced builtin"),
+	})
+	buildArgs.AddArg("ThisArgIsUsed", nil)
+
+	assert.Check(t, is.DeepEqual([]string{"AnotherArgIsNotUsed", "ThisArgIsNotUsed"}, buildArgs.UnusedBuildArgs()))
+}
+
+type fakeVCSSource struct {
+	builder.Source
+	revision string
+}
+
+func (s fakeVCSSource) VCSRevision() string {
+	return s.revision
+}
+
+func TestSetVCSRefBuildArg(t *testing.T) {
+	options := &types.ImageBuildOptions{}
+	setVCSRefBuildArg(options, nil)
+	assert.Check(t, is.Len(options.BuildArgs, 0))
+
+	setVCSRefBuildArg(options, fakeVCSSource{revision: "0123abcd"})
+	assert.Check(t, is.DeepEqual(map[string]*string{"BUILD_VCS_REF": strPtr("0123abcd")}, options.BuildArgs))
+
+	// an explicit build-arg is kept, unless it has no value
+	options.BuildArgs["BUILD_VCS_REF"] = strPtr("explicit")
+	setVCSRefBuildArg(options, fakeVCSSource{revision: "0123abcd"})
+	assert.Check(t, is.Equal("explicit", *options.BuildArgs["BUILD_VCS_REF"]))
+	options.BuildArgs["BUILD_VCS_REF"] = nil
+	setVCSRefBuildArg(options, fakeVCSSource{revision: "0123abcd"})
+	assert.Check(t, is.Equal("0123abcd", *options.BuildArgs["BUILD_VCS_REF"]))
+
+	// the revision is not reported as unused
+	buildArgs := NewBuildArgs(options.BuildArgs)
+	assert.Check(t, is.Len(buildArgs.UnusedBuildArgs(), 0))
+}
+
 func TestIsUnreferencedBuiltin(t *testing.T) {
 	buildArgs := NewBuildArgs(map[string]*string{
 		"ThisArgIsUsed":    strPtr("fromopt1"),
@@ -14,18 +14,22 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
 	"github.com/docker/docker/builder/fscache"
 	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/dockerversion"
 	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/pkg/system"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/moby/buildkit/frontend/dockerfile/parser"
-	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"github.com/docker/go-connections/nat"
 	"github.com/moby/buildkit/session"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -85,7 +89,7 @@ func (bm *BuildManager) Build(ctx context.Context, config backend.BuildConfig) (
 		config.Options.Dockerfile = builder.DefaultDockerfileName
 	}
 
-	source, dockerfile, err := remotecontext.Detect(config)
+	source, dockerfile, dockerfileDigest, err := remotecontext.Detect(config)
 	if err != nil {
 		return nil, err
 	}
@@ -96,11 +100,12 @@ func (bm *BuildManager) Build(ctx context.Context, config backend.BuildConfig) (
 			}
 		}
 	}()
+	setVCSRefBuildArg(config.Options, source)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	if src, err := bm.initializeClientSession(ctx, cancel, config.Options); err != nil {
+	if src, err := bm.initializeClientSession(ctx, cancel, config.Options, dockerfile); err != nil {
 		return nil, err
 	} else if src != nil {
 		source = src
@@ -117,10 +122,10 @@ func (bm *BuildManager) Build(ctx context.Context, config backend.BuildConfig) (
 	if err != nil {
 		return nil, err
 	}
-	return b.build(source, dockerfile)
+	return b.build(source, dockerfile, dockerfileDigest)
 }
 
-func (bm *BuildManager) initializeClientSession(ctx context.Context, cancel func(), options *types.ImageBuildOptions) (builder.Source, error) {
+func (bm *BuildManager) initializeClientSession(ctx context.Context, cancel func(), options *types.ImageBuildOptions, dockerfile *parser.Result) (builder.Source, error) {
 	if options.SessionID == "" || bm.sg == nil {
 		return nil, nil
 	}
@@ -143,6 +148,9 @@ func (bm *BuildManager) initializeClientSession(ctx context.Context, cancel func
 		if err != nil {
 			return nil, err
 		}
+		if options.LazyContext {
+			csi.includePatterns = contextIncludePatterns(dockerfile.AST)
+		}
 		src, err := bm.fsCache.SyncFrom(ctx, csi)
 		if err != nil {
 			return nil, err
@@ -182,6 +190,28 @@ type Builder struct {
 	containerManager *containerManager
 	imageProber      ImageProber
 	platform         *specs.Platform
+	cacheHits        int
+	// created is the time the final image is created at, set by the Created
+	// option, or the zero time for the current time
+	created time.Time
+	// stageImageIDs maps the lowercase names of the named stages to their
+	// images
+	stageImageIDs map[string]string
+	// stageImages holds the image of each stage, by index
+	stageImages []string
+	// stageBaseImages holds the base image of each stage, by index
+	stageBaseImages []types.BuildProvenanceImage
+	// usedBuildArgs lists the build-args passed to the build that it used
+	usedBuildArgs []string
+	// stepOutput holds back the output of each step for quiet-steps builds
+	stepOutput *stepOutputRecorder
+	// warnings collects the warnings printed once the build completes, if
+	// they are deferred
+	warnings *deferredWarnings
+	// noCacheFilter selects the steps that do not use the build cache, which
+	// are set in noCacheSteps once the stages are known
+	noCacheFilter *noCacheFilter
+	noCacheSteps  map[interface{}]bool
 }
 
 // newBuilder creates a new Dockerfile builder from an optional dockerfile and a Options.
@@ -191,6 +221,8 @@ func newBuilder(clientCtx context.Context, options builderOptions) (*Builder, er
 		config = new(types.ImageBuildOptions)
 	}
 
+	setInlineCacheFromBuildArgs(config)
+
 	b := &Builder{
 		clientCtx:        clientCtx,
 		options:          config,
@@ -205,6 +237,29 @@ func newBuilder(clientCtx context.Context, options builderOptions) (*Builder, er
 		imageProber:      newImageProber(options.Backend, config.CacheFrom, config.NoCache),
 		containerManager: newContainerManager(options.Backend),
 	}
+	if config.QuietSteps {
+		b.stepOutput = newStepOutputRecorder(b.Stdout, b.Stderr)
+		b.Stdout = b.stepOutput.Stdout()
+		b.Stderr = b.stepOutput.Stderr()
+	}
+
+	created, err := parseCreated(config.Created)
+	if err != nil {
+		return nil, err
+	}
+	b.created = created
+	if err := checkRedactPatterns(config.RedactArgs); err != nil {
+		return nil, err
+	}
+	if err := checkWarnOverwritePaths(config.WarnOverwrite); err != nil {
+		return nil, err
+	}
+	if b.warnings, err = newDeferredWarnings(config.Warnings); err != nil {
+		return nil, err
+	}
+	if b.noCacheFilter, err = parseNoCacheFilter(config.NoCacheFilter); err != nil {
+		return nil, err
+	}
 
 	// same as in Builder.Build in builder/builder-next/builder.go
 	// TODO: remove once config.Platform is of type specs.Platform
@@ -239,9 +294,38 @@ func buildLabelOptions(labels map[string]string, stages []instructions.Stage) {
 
 // Build runs the Dockerfile builder by parsing the Dockerfile and executing
 // the instructions from the file.
-func (b *Builder) build(source builder.Source, dockerfile *parser.Result) (*builder.Result, error) {
+func (b *Builder) build(source builder.Source, dockerfile *parser.Result, dockerfileDigest digest.Digest) (*builder.Result, error) {
 	defer b.imageSources.Unmount()
+	if b.warnings != nil {
+		// printed whether the build succeeds or not, and not held back
+		// with the output of the steps of quiet-steps builds
+		stdout := b.Stdout
+		if b.stepOutput != nil {
+			stdout = b.stepOutput.stdout
+		}
+		defer b.warnings.Flush(stdout)
+	}
 
+	if b.options.ExplainIgnore != "" {
+		return nil, explainIgnore(b.Stdout, source, b.options.ExplainIgnore)
+	}
+	if err := checkMinVersion(dockerfile.MinVersion, dockerversion.Version); err != nil {
+		return nil, err
+	}
+	if b.options.InlineCache && b.options.Squash {
+		return nil, errdefs.InvalidParameter(errors.New("inline cache is not supported with squash"))
+	}
+	if !b.created.IsZero() && (b.options.Squash || b.options.SquashStages) {
+		// the squashed image is created at the time it is squashed
+		return nil, errdefs.InvalidParameter(errors.New("created is not supported with squash"))
+	}
+	if b.options.SBOM && (b.options.Squash || b.options.SquashStages) {
+		// the layers of the files are replaced by the squashed layer
+		return nil, errdefs.InvalidParameter(errors.New("sbom is not supported with squash"))
+	}
+	if err := expandIncludes(dockerfile, source); err != nil {
+		return nil, err
+	}
 	stages, metaArgs, err := instructions.Parse(dockerfile.AST)
 	if err != nil {
 		if instructions.IsUnknownInstruction(err) {
@@ -249,6 +333,24 @@ func (b *Builder) build(source builder.Source, dockerfile *parser.Result) (*buil
 		}
 		return nil, errdefs.InvalidParameter(err)
 	}
+	if err := checkDuplicateStageNames(dockerfile.AST); err != nil {
+		return nil, err
+	}
+	if err := checkMaxSteps(b.options.MaxSteps, stages, metaArgs); err != nil {
+		return nil, err
+	}
+	if b.options.Lint {
+		printLintFindings(b.Stdout, lintDockerfile(dockerfile.AST))
+		return nil, nil
+	}
+	if b.options.ListStages {
+		nodes, err := buildStageGraph(stages, metaArgs, dockerfile.EscapeToken, NewBuildArgs(b.options.BuildArgs))
+		if err != nil {
+			return nil, err
+		}
+		printStageGraph(b.Stdout, nodes)
+		return nil, nil
+	}
 	if b.options.Target != "" {
 		targetIx, found := instructions.HasStage(stages, b.options.Target)
 		if !found {
@@ -257,9 +359,19 @@ func (b *Builder) build(source builder.Source, dockerfile *parser.Result) (*buil
 		}
 		stages = stages[:targetIx+1]
 	}
+	if err := checkTagStages(b.options.TagStages, stages); err != nil {
+		return nil, err
+	}
+	if err := checkRequiredArgs(stages, metaArgs, b.options.BuildArgs); err != nil {
+		return nil, err
+	}
 
 	// Add 'LABEL' command specified by '--label' option to the last stage
-	buildLabelOptions(b.options.Labels, stages)
+	created := b.created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	buildLabelOptions(withLabelSchema(b.options, stages, created), stages)
 
 	dockerfile.PrintWarnings(b.Stderr)
 	dispatchState, err := b.dispatchDockerfileWithCancellation(stages, metaArgs, dockerfile.EscapeToken, source)
@@ -270,7 +382,294 @@ func (b *Builder) build(source builder.Source, dockerfile *parser.Result) (*buil
 		buildsFailed.WithValues(metricsDockerfileEmptyError).Inc()
 		return nil, errors.New("No image was generated. Is your Dockerfile empty?")
 	}
-	return &builder.Result{ImageID: dispatchState.imageID, FromImage: dispatchState.baseImage}, nil
+	if b.options.RequireCmd || b.options.RequireRunnable {
+		if err := checkRequireCmd(dispatchState, b.options.RequireRunnable); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.AssertLabels != nil {
+		if err := checkAssertLabels(dispatchState.runConfig.Labels, b.options.AssertLabels); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.AssertPorts != nil {
+		if err := checkAssertPorts(dispatchState.runConfig.ExposedPorts, b.options.AssertPorts); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.Provenance {
+		if err := b.embedProvenance(dispatchState, b.provenance(dockerfileDigest, created)); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.InlineCache {
+		if err := b.embedInlineCache(dispatchState); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.options.RedactArgs) > 0 {
+		if err := b.redactImageHistory(dispatchState, b.options.RedactArgs); err != nil {
+			return nil, err
+		}
+	}
+	if !b.created.IsZero() {
+		if err := b.setImageCreated(dispatchState, b.created); err != nil {
+			return nil, err
+		}
+	}
+	fromImage := dispatchState.baseImage
+	if b.options.SquashStages {
+		fromImage = dispatchState.rootImage
+	}
+	// the image of the last stage may have been replaced since it was built
+	b.recordStageImage(len(stages)-1, dispatchState)
+	result := &builder.Result{
+		ImageID:       dispatchState.imageID,
+		FromImage:     fromImage,
+		StageImageIDs: tagStageImageIDs(b.options.TagStages, b.stageImageIDs),
+		SBOM:          dispatchState.sbomFiles,
+	}
+	if b.options.ExportStages || b.options.CacheTo {
+		for i, stage := range stages {
+			result.StageImages = append(result.StageImages, builder.StageImage{Name: stage.Name, ImageID: b.stageImages[i]})
+		}
+	}
+	return result, nil
+}
+
+// checkTagStages returns an error if a stage of the TagStages option, in the
+// form stage=name, is not a named stage of the build
+func checkTagStages(tagStages []string, stages []instructions.Stage) error {
+	for _, tagStage := range tagStages {
+		name := strings.SplitN(tagStage, "=", 2)[0]
+		if _, found := instructions.HasStage(stages, name); !found {
+			return errdefs.InvalidParameter(errors.Errorf("cannot tag stage %s: no stage of the build has this name", name))
+		}
+	}
+	return nil
+}
+
+// checkRequiredArgs returns an error naming the ARGs declared with --required
+// that are not set by the build-args, so that the build fails before its
+// first step
+func checkRequiredArgs(stages []instructions.Stage, metaArgs []instructions.ArgCommand, buildArgs map[string]*string) error {
+	var missing []string
+	seen := map[string]bool{}
+	check := func(arg *instructions.ArgCommand) {
+		if !arg.Required || seen[arg.Key] {
+			return
+		}
+		seen[arg.Key] = true
+		if v, ok := buildArgs[arg.Key]; !ok || v == nil {
+			missing = append(missing, arg.Key)
+		}
+	}
+	for i := range metaArgs {
+		check(&metaArgs[i])
+	}
+	for _, stage := range stages {
+		for _, cmd := range stage.Commands {
+			if arg, ok := cmd.(*instructions.ArgCommand); ok {
+				check(arg)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("missing required build-args, set them with --build-arg: %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// countSteps returns the number of steps of a build: its global ARGs, and the
+// FROM and the commands of each stage
+func countSteps(stages []instructions.Stage, metaArgs []instructions.ArgCommand) int {
+	steps := len(metaArgs) + len(stages)
+	for _, stage := range stages {
+		steps += len(stage.Commands)
+	}
+	return steps
+}
+
+// checkMaxSteps returns an error if the Dockerfile has more steps than the
+// MaxSteps option allows, 0 meaning unlimited
+func checkMaxSteps(maxSteps int, stages []instructions.Stage, metaArgs []instructions.ArgCommand) error {
+	if maxSteps < 0 {
+		return errdefs.InvalidParameter(errors.Errorf("invalid max-steps %d: must not be negative", maxSteps))
+	}
+	if steps := countSteps(stages, metaArgs); maxSteps > 0 && steps > maxSteps {
+		return errdefs.InvalidParameter(errors.Errorf("the Dockerfile has %d steps, more than the maximum of %d", steps, maxSteps))
+	}
+	return nil
+}
+
+// recordStageImage records the image of the stage at index, and by name if
+// the stage is named
+func (b *Builder) recordStageImage(index int, state *dispatchState) {
+	if state.baseImage != nil {
+		for len(b.stageBaseImages) <= index {
+			b.stageBaseImages = append(b.stageBaseImages, types.BuildProvenanceImage{})
+		}
+		b.stageBaseImages[index] = types.BuildProvenanceImage{Name: state.baseName, ID: state.baseImage.ImageID()}
+	}
+	if state.imageID == "" {
+		return
+	}
+	for len(b.stageImages) <= index {
+		b.stageImages = append(b.stageImages, "")
+	}
+	b.stageImages[index] = state.imageID
+	if state.stageName == "" {
+		return
+	}
+	if b.stageImageIDs == nil {
+		b.stageImageIDs = make(map[string]string)
+	}
+	b.stageImageIDs[strings.ToLower(state.stageName)] = state.imageID
+}
+
+// tagStageImageIDs returns the images of the stages of the TagStages option
+func tagStageImageIDs(tagStages []string, stageImageIDs map[string]string) map[string]string {
+	if len(tagStages) == 0 {
+		return nil
+	}
+	imageIDs := make(map[string]string, len(tagStages))
+	for _, tagStage := range tagStages {
+		name := strings.ToLower(strings.SplitN(tagStage, "=", 2)[0])
+		imageIDs[name] = stageImageIDs[name]
+	}
+	return imageIDs
+}
+
+// checkRequireCmd returns an error if the image has neither a CMD nor an
+// ENTRYPOINT. Unless anyBase is set, only images built from scratch are
+// checked.
+func checkRequireCmd(state *dispatchState, anyBase bool) error {
+	if len(state.runConfig.Cmd) > 0 || len(state.runConfig.Entrypoint) > 0 {
+		return nil
+	}
+	fromScratch := state.rootImage != nil && state.rootImage.ImageID() == ""
+	switch {
+	case fromScratch:
+		return errdefs.InvalidParameter(errors.New("image built from scratch has neither a CMD nor an ENTRYPOINT"))
+	case anyBase:
+		return errdefs.InvalidParameter(errors.New("image has neither a CMD nor an ENTRYPOINT, it cannot be run without a command"))
+	}
+	return nil
+}
+
+// checkAssertLabels returns an error if the labels of the image are not
+// exactly the expected ones, including the labels inherited from the base
+// image. The inline cache label is added afterwards and is not checked.
+func checkAssertLabels(labels, expected map[string]string) error {
+	var diff []string
+	for _, k := range sortedKeys(expected) {
+		v, ok := labels[k]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("missing %s=%s", k, expected[k]))
+		case v != expected[k]:
+			diff = append(diff, fmt.Sprintf("%s is %q, expected %q", k, v, expected[k]))
+		}
+	}
+	for _, k := range sortedKeys(labels) {
+		if _, ok := expected[k]; !ok {
+			diff = append(diff, fmt.Sprintf("unexpected %s=%s", k, labels[k]))
+		}
+	}
+	if len(diff) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("image labels do not match the asserted labels: %s", strings.Join(diff, ", ")))
+	}
+	return nil
+}
+
+// checkAssertPorts returns an error if the ports exposed by the image are not
+// exactly the expected ones, including the ports exposed by the base image.
+// Like with EXPOSE, a port without a protocol is a tcp port.
+func checkAssertPorts(exposed nat.PortSet, expected []string) error {
+	expectedPorts, _, err := nat.ParsePortSpecs(expected)
+	if err != nil {
+		return errdefs.InvalidParameter(errors.Wrap(err, "invalid asserted port"))
+	}
+	var diff []string
+	for _, p := range sortedPorts(expectedPorts) {
+		if _, ok := exposed[p]; !ok {
+			diff = append(diff, "missing "+string(p))
+		}
+	}
+	for _, p := range sortedPorts(exposed) {
+		if _, ok := expectedPorts[p]; !ok {
+			diff = append(diff, "unexpected "+string(p))
+		}
+	}
+	if len(diff) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("image exposed ports do not match the asserted ports: %s", strings.Join(diff, ", ")))
+	}
+	return nil
+}
+
+// sortedPorts returns the ports of set by port number, then by protocol
+func sortedPorts(set nat.PortSet) []nat.Port {
+	ports := make([]nat.Port, 0, len(set))
+	for p := range set {
+		ports = append(ports, p)
+	}
+	nat.Sort(ports, func(i, j nat.Port) bool {
+		if i.Int() != j.Int() {
+			return i.Int() < j.Int()
+		}
+		return i.Proto() < j.Proto()
+	})
+	return ports
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// explainIgnore prints the pattern of the .dockerignore file of the build
+// context that decides whether file is excluded from the context
+func explainIgnore(out io.Writer, source builder.Source, file string) error {
+	if source == nil {
+		return errdefs.InvalidParameter(errors.New("explain-ignore requires a build context"))
+	}
+	pattern, excluded, err := remotecontext.ExplainIgnore(source, file)
+	if err != nil {
+		return errdefs.InvalidParameter(err)
+	}
+	switch {
+	case pattern == nil:
+		fmt.Fprintf(out, "%s is not matched by any .dockerignore pattern\n", file)
+	case excluded:
+		fmt.Fprintf(out, "%s is excluded by %q at %s:%d\n", file, pattern.Pattern, pattern.File, pattern.Line)
+	default:
+		fmt.Fprintf(out, "%s is re-included by %q at %s:%d\n", file, pattern.Pattern, pattern.File, pattern.Line)
+	}
+	return nil
+}
+
+// checkMinVersion returns an error if the builder version is older than the
+// version required by the min-version parser directive. Development builds,
+// whose version is not a version number, are never considered too old.
+func checkMinVersion(minVersion, builderVersion string) error {
+	if minVersion == "" {
+		return nil
+	}
+	version := builderVersion
+	if ix := strings.IndexAny(version, "-+"); ix >= 0 {
+		version = version[:ix]
+	}
+	if version == "" || strings.Trim(version, "0123456789.") != "" {
+		return nil
+	}
+	if versions.LessThan(version, minVersion) {
+		return errdefs.InvalidParameter(errors.Errorf("the Dockerfile requires builder version %s or newer, but this builder is version %s", minVersion, builderVersion))
+	}
+	return nil
 }
 
 func emitImageID(aux *streamformatter.AuxFormatter, state *dispatchState) error {
@@ -299,14 +698,76 @@ func printCommand(out io.Writer, currentCommandIndex int, totalCommands int, cmd
 	return currentCommandIndex + 1
 }
 
+func printCacheStats(out io.Writer, cacheHits int, totalCommands int, noCache bool) {
+	fmt.Fprintf(out, "Cache: %d/%d steps reused", cacheHits, totalCommands)
+	if noCache {
+		fmt.Fprint(out, ", caching disabled")
+	}
+	fmt.Fprintln(out)
+}
+
+// stepHeaderOutput returns the writer for the header of the next build step.
+// For quiet-steps builds the output of the previous step is dropped.
+func (b *Builder) stepHeaderOutput() io.Writer {
+	if b.stepOutput == nil {
+		return b.Stdout
+	}
+	b.stepOutput.Discard()
+	return b.stepOutput.stdout
+}
+
+// dispatchStage dispatches the FROM instruction and the commands of a single
+// build stage.
+func dispatchStage(d dispatchRequest, stage *instructions.Stage, printStep func(out io.Writer, cmd interface{})) (err error) {
+	b := d.builder
+	if b.stepOutput != nil {
+		defer func() {
+			if err != nil {
+				b.stepOutput.Flush()
+			}
+		}()
+	}
+	printStep(b.stepHeaderOutput(), stage.SourceCode)
+	d.state.noCache = b.noCacheSteps[stage]
+	if err := initializeStage(d, stage); err != nil {
+		return err
+	}
+	d.state.updateRunConfig()
+	fmt.Fprintf(b.Stdout, " ---> %s\n", stringid.TruncateID(d.state.imageID))
+	for _, cmd := range stage.Commands {
+		select {
+		case <-b.clientCtx.Done():
+			logrus.Debug("Builder: build cancelled!")
+			fmt.Fprint(b.Stdout, "Build cancelled\n")
+			buildsFailed.WithValues(metricsBuildCanceled).Inc()
+			return errors.New("Build cancelled")
+		default:
+			// Not cancelled yet, keep going...
+		}
+
+		printStep(b.stepHeaderOutput(), cmd)
+
+		d.state.noCache = b.noCacheSteps[cmd]
+		if err := dispatch(d, cmd); err != nil {
+			return err
+		}
+		d.state.updateRunConfig()
+		fmt.Fprintf(b.Stdout, " ---> %s\n", stringid.TruncateID(d.state.imageID))
+
+	}
+	return emitImageID(b.Aux, d.state)
+}
+
 func (b *Builder) dispatchDockerfileWithCancellation(parseResult []instructions.Stage, metaArgs []instructions.ArgCommand, escapeToken rune, source builder.Source) (*dispatchState, error) {
 	dispatchRequest := dispatchRequest{}
 	buildArgs := NewBuildArgs(b.options.BuildArgs)
-	totalCommands := len(metaArgs) + len(parseResult)
+	totalCommands := countSteps(parseResult, metaArgs)
 	currentCommandIndex := 1
-	for _, stage := range parseResult {
-		totalCommands += len(stage.Commands)
+	noCacheSteps, err := b.noCacheFilter.excludedSteps(parseResult, len(metaArgs)+1)
+	if err != nil {
+		return nil, err
 	}
+	b.noCacheSteps = noCacheSteps
 	shlex := shell.NewLex(escapeToken)
 	for _, meta := range metaArgs {
 		currentCommandIndex = printCommand(b.Stdout, currentCommandIndex, totalCommands, &meta)
@@ -317,50 +778,48 @@ func (b *Builder) dispatchDockerfileWithCancellation(parseResult []instructions.
 		}
 	}
 
-	stagesResults := newStagesBuildResults()
+	printStep := func(out io.Writer, cmd interface{}) {
+		currentCommandIndex = printCommand(out, currentCommandIndex, totalCommands, cmd)
+	}
 
-	for _, stage := range parseResult {
-		if err := stagesResults.checkStageNameAvailable(stage.Name); err != nil {
+	var state *dispatchState
+	if b.options.MaxParallelism > 1 && len(parseResult) > 1 {
+		var err error
+		state, err = b.dispatchStagesInParallel(parseResult, escapeToken, source, buildArgs, printStep)
+		if err != nil {
 			return nil, err
 		}
-		dispatchRequest = newDispatchRequest(b, escapeToken, source, buildArgs, stagesResults)
+	} else {
+		stagesResults := newStagesBuildResults()
 
-		currentCommandIndex = printCommand(b.Stdout, currentCommandIndex, totalCommands, stage.SourceCode)
-		if err := initializeStage(dispatchRequest, &stage); err != nil {
-			return nil, err
-		}
-		dispatchRequest.state.updateRunConfig()
-		fmt.Fprintf(b.Stdout, " ---> %s\n", stringid.TruncateID(dispatchRequest.state.imageID))
-		for _, cmd := range stage.Commands {
-			select {
-			case <-b.clientCtx.Done():
-				logrus.Debug("Builder: build cancelled!")
-				fmt.Fprint(b.Stdout, "Build cancelled\n")
-				buildsFailed.WithValues(metricsBuildCanceled).Inc()
-				return nil, errors.New("Build cancelled")
-			default:
-				// Not cancelled yet, keep going...
+		for i, stage := range parseResult {
+			if err := stagesResults.checkStageNameAvailable(stage.Name); err != nil {
+				return nil, err
 			}
-
-			currentCommandIndex = printCommand(b.Stdout, currentCommandIndex, totalCommands, cmd)
-
-			if err := dispatch(dispatchRequest, cmd); err != nil {
+			dispatchRequest = newDispatchRequest(b, escapeToken, source, buildArgs, stagesResults)
+			if err := dispatchStage(dispatchRequest, &stage, printStep); err != nil {
 				return nil, err
 			}
-			dispatchRequest.state.updateRunConfig()
-			fmt.Fprintf(b.Stdout, " ---> %s\n", stringid.TruncateID(dispatchRequest.state.imageID))
-
-		}
-		if err := emitImageID(b.Aux, dispatchRequest.state); err != nil {
-			return nil, err
+			buildArgs.MergeReferencedArgs(dispatchRequest.state.buildArgs)
+			if err := commitStage(dispatchRequest.state, stagesResults); err != nil {
+				return nil, err
+			}
+			b.recordStageImage(i, dispatchRequest.state)
 		}
-		buildArgs.MergeReferencedArgs(dispatchRequest.state.buildArgs)
-		if err := commitStage(dispatchRequest.state, stagesResults); err != nil {
-			return nil, err
+		state = dispatchRequest.state
+	}
+	if b.options.StrictBuildArgs {
+		if leftoverArgs := buildArgs.UnusedBuildArgs(); len(leftoverArgs) > 0 {
+			return nil, errdefs.InvalidParameter(errors.Errorf("one or more build-args %v were not consumed", leftoverArgs))
 		}
+	} else {
+		buildArgs.WarnOnUnusedBuildArgs(b.warningOutput())
+	}
+	b.usedBuildArgs = buildArgs.UsedBuildArgs()
+	if b.options.CacheStats {
+		printCacheStats(b.Stdout, b.cacheHits, totalCommands, b.options.NoCache)
 	}
-	buildArgs.WarnOnUnusedBuildArgs(b.Stdout)
-	return dispatchRequest.state, nil
+	return state, nil
 }
 
 // BuildFromConfig builds directly from `changes`, treating it as if it were the contents of a Dockerfile
@@ -0,0 +1,294 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/go-connections/nat"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+)
+
+func TestMinVersionDirective(t *testing.T) {
+	result, err := parser.Parse(strings.NewReader("# escape=`\n# min-version=17.09\nFROM busybox\n"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("17.09", result.MinVersion))
+	assert.Check(t, is.Equal('`', result.EscapeToken))
+
+	// like escape, the directive is a comment after the first instruction
+	result, err = parser.Parse(strings.NewReader("FROM busybox\n# min-version=17.09\n"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("", result.MinVersion))
+
+	// a value that is not a version number is ignored
+	result, err = parser.Parse(strings.NewReader("# min-version=latest\nFROM busybox\n"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("", result.MinVersion))
+	assert.Check(t, is.DeepEqual([]string{"[WARNING]: Ignoring invalid min-version 'latest'. Must be a version number like 17.09"}, result.Warnings))
+
+	_, err = parser.Parse(strings.NewReader("# min-version=17.09\n# min-version=18.03\nFROM busybox\n"))
+	assert.Check(t, is.ErrorContains(err, "only one min-version parser directive can be used"))
+}
+
+func TestCheckMinVersion(t *testing.T) {
+	testCases := []struct {
+		minVersion     string
+		builderVersion string
+		expectedErr    string
+	}{
+		{minVersion: "", builderVersion: "17.06.0-ce"},
+		{minVersion: "17.09", builderVersion: "17.09.0-ce"},
+		{minVersion: "17.09", builderVersion: "18.03.1-ce"},
+		{minVersion: "17.09", builderVersion: "library-import"},
+		{minVersion: "17.09", builderVersion: "dev"},
+		{
+			minVersion:     "17.09",
+			builderVersion: "17.06.2-ee-6",
+			expectedErr:    "the Dockerfile requires builder version 17.09 or newer, but this builder is version 17.06.2-ee-6",
+		},
+		{
+			minVersion:     "99.0",
+			builderVersion: "18.06.0-ce",
+			expectedErr:    "requires builder version 99.0 or newer",
+		},
+	}
+	for _, tc := range testCases {
+		err := checkMinVersion(tc.minVersion, tc.builderVersion)
+		if tc.expectedErr == "" {
+			assert.Check(t, err, tc.builderVersion)
+			continue
+		}
+		assert.Check(t, is.ErrorContains(err, tc.expectedErr), tc.builderVersion)
+	}
+}
+
+func TestCheckRequireCmd(t *testing.T) {
+	scratch := &mockImage{}
+	busybox := &mockImage{id: "busybox"}
+	testCases := []struct {
+		rootImage   builder.Image
+		config      container.Config
+		anyBase     bool
+		expectedErr string
+	}{
+		{rootImage: scratch, expectedErr: "image built from scratch has neither a CMD nor an ENTRYPOINT"},
+		{rootImage: scratch, anyBase: true, expectedErr: "image built from scratch has neither a CMD nor an ENTRYPOINT"},
+		{rootImage: scratch, config: container.Config{Cmd: []string{"/app"}}},
+		{rootImage: busybox},
+		{rootImage: busybox, anyBase: true, expectedErr: "image has neither a CMD nor an ENTRYPOINT, it cannot be run without a command"},
+		{rootImage: busybox, anyBase: true, config: container.Config{Entrypoint: []string{"/app"}}},
+	}
+	for i, tc := range testCases {
+		state := &dispatchState{rootImage: tc.rootImage, runConfig: &tc.config}
+		err := checkRequireCmd(state, tc.anyBase)
+		if tc.expectedErr == "" {
+			assert.Check(t, err, i)
+			continue
+		}
+		assert.Check(t, is.ErrorContains(err, tc.expectedErr), i)
+		assert.Check(t, errdefs.IsInvalidParameter(err), i)
+	}
+}
+
+func TestCheckMaxSteps(t *testing.T) {
+	stages, metaArgs, _ := parseStages(t, `ARG BASE=busybox
+FROM ${BASE} AS build
+RUN echo build > /out
+FROM busybox
+COPY --from=build /out /out
+`)
+	assert.Check(t, is.Equal(5, countSteps(stages, metaArgs)))
+	assert.Check(t, checkMaxSteps(0, stages, metaArgs))
+	assert.Check(t, checkMaxSteps(5, stages, metaArgs))
+
+	err := checkMaxSteps(4, stages, metaArgs)
+	assert.Check(t, is.Error(err, "the Dockerfile has 5 steps, more than the maximum of 4"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+	assert.Check(t, is.ErrorContains(checkMaxSteps(-1, stages, metaArgs), "invalid max-steps -1"))
+}
+
+func TestCheckRequiredArgs(t *testing.T) {
+	stages, metaArgs, _ := parseStages(t, `ARG --required BASE
+FROM ${BASE}
+ARG --required DB_PASSWORD
+ARG --required BASE
+ARG OPTIONAL
+`)
+	assert.Check(t, stages[0].Commands[0].(*instructions.ArgCommand).Required)
+	assert.Check(t, !stages[0].Commands[2].(*instructions.ArgCommand).Required)
+
+	err := checkRequiredArgs(stages, metaArgs, map[string]*string{"BASE": strPtr("busybox"), "DB_PASSWORD": nil})
+	assert.Check(t, is.Error(err, "missing required build-args, set them with --build-arg: DB_PASSWORD"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+	err = checkRequiredArgs(stages, metaArgs, nil)
+	assert.Check(t, is.Error(err, "missing required build-args, set them with --build-arg: BASE, DB_PASSWORD"))
+	assert.Check(t, checkRequiredArgs(stages, metaArgs, map[string]*string{"BASE": strPtr("busybox"), "DB_PASSWORD": strPtr("")}))
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nARG --required DB_PASSWORD=secret\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "ARG --required DB_PASSWORD cannot have a default value"))
+}
+
+func TestCheckAssertLabels(t *testing.T) {
+	labels := map[string]string{"maintainer": "me", "version": "1.0"}
+	testCases := []struct {
+		expected    map[string]string
+		expectedErr string
+	}{
+		{expected: map[string]string{"maintainer": "me", "version": "1.0"}},
+		{
+			expected:    map[string]string{},
+			expectedErr: "image labels do not match the asserted labels: unexpected maintainer=me, unexpected version=1.0",
+		},
+		{
+			expected:    map[string]string{"maintainer": "me", "version": "2.0", "vendor": "acme"},
+			expectedErr: "image labels do not match the asserted labels: missing vendor=acme, version is \"1.0\", expected \"2.0\"",
+		},
+	}
+	for _, tc := range testCases {
+		err := checkAssertLabels(labels, tc.expected)
+		if tc.expectedErr == "" {
+			assert.Check(t, err)
+			continue
+		}
+		assert.Check(t, is.Error(err, tc.expectedErr))
+	}
+	assert.Check(t, checkAssertLabels(nil, map[string]string{}))
+}
+
+func TestCheckAssertPorts(t *testing.T) {
+	exposed := nat.PortSet{"80/tcp": {}, "53/udp": {}}
+	testCases := []struct {
+		expected    []string
+		expectedErr string
+	}{
+		{expected: []string{"80", "53/udp"}},
+		{
+			expected:    []string{},
+			expectedErr: "image exposed ports do not match the asserted ports: unexpected 53/udp, unexpected 80/tcp",
+		},
+		{
+			expected:    []string{"80/tcp", "443/tcp"},
+			expectedErr: "image exposed ports do not match the asserted ports: missing 443/tcp, unexpected 53/udp",
+		},
+		{
+			expected:    []string{"9000", "53/tcp", "53/udp", "80", "10000"},
+			expectedErr: "image exposed ports do not match the asserted ports: missing 53/tcp, missing 9000/tcp, missing 10000/tcp",
+		},
+	}
+	for _, tc := range testCases {
+		err := checkAssertPorts(exposed, tc.expected)
+		if tc.expectedErr == "" {
+			assert.Check(t, err)
+			continue
+		}
+		assert.Check(t, is.Error(err, tc.expectedErr))
+	}
+	assert.Check(t, checkAssertPorts(nil, []string{}))
+}
+
+func TestSetInlineCacheFromBuildArgs(t *testing.T) {
+	enabled, disabled := "1", "0"
+	testCases := []struct {
+		buildArgs map[string]*string
+		expected  bool
+	}{
+		{buildArgs: map[string]*string{"FOO": &enabled}},
+		{buildArgs: map[string]*string{inlineCacheBuildArg: &enabled}, expected: true},
+		{buildArgs: map[string]*string{inlineCacheBuildArg: &disabled}},
+		{buildArgs: map[string]*string{inlineCacheBuildArg: nil}},
+	}
+	for _, tc := range testCases {
+		options := &types.ImageBuildOptions{BuildArgs: tc.buildArgs}
+		setInlineCacheFromBuildArgs(options)
+		assert.Check(t, is.Equal(tc.expected, options.InlineCache))
+		_, ok := options.BuildArgs[inlineCacheBuildArg]
+		assert.Check(t, !ok)
+	}
+}
+
+func TestExplainIgnore(t *testing.T) {
+	contextDir := fs.NewDir(t, "builder-explain-ignore",
+		fs.WithFile(".dockerignore", "# build output\nbin\n!bin/keep\n"))
+	defer contextDir.Remove()
+
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(contextDir.Path()))
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		file     string
+		expected string
+	}{
+		{file: "bin/app", expected: "bin/app is excluded by \"bin\" at .dockerignore:2\n"},
+		{file: "bin/keep", expected: "bin/keep is re-included by \"!bin/keep\" at .dockerignore:3\n"},
+		{file: "main.go", expected: "main.go is not matched by any .dockerignore pattern\n"},
+	}
+	for _, tc := range testCases {
+		out := new(bytes.Buffer)
+		assert.NilError(t, explainIgnore(out, source, tc.file))
+		assert.Check(t, is.Equal(tc.expected, out.String()))
+	}
+
+	err = explainIgnore(new(bytes.Buffer), nil, "main.go")
+	assert.Check(t, is.ErrorContains(err, "requires a build context"))
+}
+
+func TestParseCreated(t *testing.T) {
+	created, err := parseCreated("")
+	assert.NilError(t, err)
+	assert.Check(t, created.IsZero())
+
+	created, err = parseCreated("2018-06-01T10:00:00+02:00")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("2018-06-01T08:00:00Z", created.Format(time.RFC3339)))
+
+	_, err = parseCreated("2018-06-01")
+	assert.Check(t, is.ErrorContains(err, `invalid created timestamp "2018-06-01": expected an RFC 3339 timestamp`))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	_, err = newBuilder(context.Background(), builderOptions{
+		Options: &types.ImageBuildOptions{Created: "yesterday"},
+		Backend: &MockBackend{},
+	})
+	assert.Check(t, is.ErrorContains(err, `invalid created timestamp "yesterday"`))
+}
+
+func TestTagStages(t *testing.T) {
+	dockerfile := `FROM busybox AS Build
+LABEL build=1
+FROM busybox AS runtime
+LABEL runtime=2
+FROM busybox
+LABEL last=3
+`
+	stages, metaArgs, escapeToken := parseStages(t, dockerfile)
+	assert.Check(t, checkTagStages([]string{"build=myrepo/build", "RUNTIME=myrepo/runtime"}, stages))
+	err := checkTagStages([]string{"test=myrepo/test"}, stages)
+	assert.Check(t, is.ErrorContains(err, "cannot tag stage test: no stage of the build has this name"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	for _, parallelism := range []int{0, 2} {
+		b := newBuilderWithMockBackend()
+		b.options.MaxParallelism = parallelism
+		_, err := b.dispatchDockerfileWithCancellation(stages, metaArgs, escapeToken, nil)
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(b.stageImageIDs, 2))
+		imageIDs := tagStageImageIDs([]string{"Build=myrepo/build"}, b.stageImageIDs)
+		assert.Check(t, is.Len(imageIDs, 1))
+		assert.Check(t, imageIDs["build"] != "")
+	}
+	assert.Check(t, is.Nil(tagStageImageIDs(nil, map[string]string{"build": "sha256:build"})))
+}
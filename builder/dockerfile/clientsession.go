@@ -2,10 +2,16 @@ package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 
 import (
 	"context"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
 	"github.com/docker/docker/builder/fscache"
 	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/urlutil"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/filesync"
 	"github.com/pkg/errors"
@@ -74,3 +80,65 @@ func (csi *ClientSessionSourceIdentifier) SharedKey() string {
 func (csi *ClientSessionSourceIdentifier) Key() string {
 	return csi.uuid
 }
+
+// contextIncludePatterns returns the paths of the build context that the
+// Dockerfile reads, from the sources of its ADD and COPY instructions and
+// the files of its ENV --from-file and RUN --cache-key-from instructions, so
+// that only those files are transferred from the client. It returns nil, to
+// transfer the whole context, if the paths cannot be known before the build:
+// if a path uses variables, refers to the root of the context, or if the
+// Dockerfile uses INCLUDE.
+//
+// The ADD and COPY instructions of ONBUILD triggers of the base images are
+// not taken into account.
+func contextIncludePatterns(ast *parser.Node) []string {
+	patterns := []string{}
+	for _, node := range ast.Children {
+		var paths []string
+		switch node.Value {
+		case command.Include:
+			return nil
+		case command.Add, command.Copy, command.Env, command.Run:
+			cmd, err := instructions.ParseInstruction(node)
+			if err != nil {
+				// the error is reported when the instruction is dispatched
+				return nil
+			}
+			switch c := cmd.(type) {
+			case *instructions.AddCommand:
+				for _, src := range c.Sources() {
+					if !urlutil.IsURL(src) && !remotecontext.HasURLScheme(src) {
+						paths = append(paths, src)
+					}
+				}
+			case *instructions.CopyCommand:
+				if c.From == "" {
+					paths = append(paths, c.Sources()...)
+				}
+				if c.NewerThan != "" {
+					paths = append(paths, c.NewerThan)
+				}
+			case *instructions.EnvCommand:
+				if c.FromFile {
+					for _, kv := range c.Env {
+						paths = append(paths, kv.Value)
+					}
+				}
+			case *instructions.RunCommand:
+				paths = c.CacheKeyFrom
+			}
+		}
+		for _, p := range paths {
+			if strings.Contains(p, "$") {
+				return nil
+			}
+			// Paths are relative to the root of the context
+			p = path.Clean("/" + strings.Replace(p, "\\", "/", -1))[1:]
+			if p == "" {
+				return nil
+			}
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
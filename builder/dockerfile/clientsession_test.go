@@ -0,0 +1,60 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestContextIncludePatterns(t *testing.T) {
+	testCases := []struct {
+		doc        string
+		dockerfile string
+		expected   []string
+	}{
+		{
+			doc: "sources",
+			dockerfile: `FROM busybox AS build
+COPY file /
+COPY ./src/*.go /tmp/README.md /src/
+ADD http://example.com/file.txt /
+ADD archive.tar /
+COPY --from=build /file /file2
+ENV --from-file VERSION=/version.txt
+ONBUILD COPY onbuild /
+RUN cat /file
+RUN --cache-key-from=package-lock.json npm ci
+`,
+			expected: []string{"file", "src/*.go", "tmp/README.md", "archive.tar", "version.txt", "package-lock.json"},
+		},
+		{
+			doc:        "no sources",
+			dockerfile: "FROM busybox\nRUN true\n",
+			expected:   []string{},
+		},
+		{
+			doc:        "variable",
+			dockerfile: "FROM busybox\nARG SRC=file\nCOPY file $SRC /\n",
+		},
+		{
+			doc:        "whole context",
+			dockerfile: "FROM busybox\nCOPY file /\nCOPY . /app\n",
+		},
+		{
+			doc:        "include",
+			dockerfile: "FROM busybox\nCOPY file /\nINCLUDE snippet.df\n",
+		},
+		{
+			doc:        "invalid instruction",
+			dockerfile: "FROM busybox\nCOPY file\n",
+		},
+	}
+	for _, tc := range testCases {
+		result, err := parser.Parse(strings.NewReader(tc.dockerfile))
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(tc.expected, contextIncludePatterns(result.AST)), tc.doc)
+	}
+}
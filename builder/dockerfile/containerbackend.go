@@ -134,6 +134,14 @@ func (c *containerManager) removeContainer(containerID string, stdout io.Writer)
 	return nil
 }
 
+// PrintKept prints the IDs of the containers managed by this container manager
+// that have not been removed
+func (c *containerManager) PrintKept(stdout io.Writer) {
+	for containerID := range c.tmpContainers {
+		fmt.Fprintf(stdout, "Keeping intermediate container %s of the failed step\n", stringid.TruncateID(containerID))
+	}
+}
+
 // RemoveAll containers managed by this container manager
 func (c *containerManager) RemoveAll(stdout io.Writer) {
 	for containerID := range c.tmpContainers {
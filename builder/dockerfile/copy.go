@@ -9,15 +9,21 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/progress"
@@ -30,6 +36,12 @@ import (
 
 const unnamedFilename = "__unnamed__"
 
+// basenamePlaceholder is replaced, in the destination of a COPY or ADD, by
+// the name of each source file
+const basenamePlaceholder = "{basename}"
+
+var destPlaceholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
 type pathCache interface {
 	Load(key interface{}) (value interface{}, ok bool)
 	Store(key, value interface{})
@@ -42,6 +54,9 @@ type copyInfo struct {
 	path         string
 	hash         string
 	noDecompress bool
+	// skipped are the files of a source directory, relative to it, that are
+	// not copied because they are not newer than the COPY --newer-than file
+	skipped []string
 }
 
 func (c copyInfo) fullPath() (string, error) {
@@ -63,7 +78,21 @@ type copyInstruction struct {
 	infos                   []copyInfo
 	dest                    string
 	chownStr                string
+	chmodStr                string
+	chownFrom               string
 	allowLocalDecompression bool
+	keepNewer               bool
+	intoNamed               bool
+	link                    bool
+	preserveSymlinks        bool
+	preserveDirMode         bool
+	excludes                []string
+	newerThan               string
+	// original is the instruction as written in the Dockerfile
+	original string
+	// destTemplate is set if dest contains placeholders expanded for each
+	// source, see destFor
+	destTemplate bool
 }
 
 // copier reads a raw COPY or ADD command, fetches remote sources using a downloader,
@@ -74,6 +103,20 @@ type copier struct {
 	pathCache   pathCache
 	download    sourceDownloader
 	platform    *specs.Platform
+	// urlSchemes is set for ADD, whose sources may also be URLs using the
+	// schemes registered with remotecontext.RegisterURLFetcher. A source with
+	// an unregistered scheme is rejected instead of read from the context.
+	urlSchemes bool
+	// excludes matches the paths that are not copied, relative to a source
+	// directory or against the name of a source file
+	excludes *fileutils.PatternMatcher
+	// newerThan is set by COPY --newer-than, only the source files modified
+	// after it are copied
+	newerThan time.Time
+	// warnings receives the warnings about sources that only match a file
+	// with a different case, which are errors if strictCase is set
+	warnings   io.Writer
+	strictCase bool
 	// for cleanup. TODO: having copier.cleanup() is error prone and hard to
 	// follow. Code calling performCopy should manage the lifecycle of its params.
 	// Copier should take override source as input, not imageMount.
@@ -88,6 +131,8 @@ func copierFromDispatchRequest(req dispatchRequest, download sourceDownloader, i
 		download:    download,
 		imageSource: imageSource,
 		platform:    req.builder.platform,
+		warnings:    req.builder.warningOutput(),
+		strictCase:  req.builder.options.StrictCase,
 	}
 }
 
@@ -104,17 +149,115 @@ func (o *copier) createCopyInstruction(args []string, cmdName string) (copyInstr
 	}
 	inst.dest = fromSlash(args[last], pathOS)
 	separator := string(separator(pathOS))
+	var err error
+	if inst.destTemplate, err = isDestTemplate(inst.dest, cmdName); err != nil {
+		return inst, err
+	}
 	infos, err := o.getCopyInfosForSourcePaths(args[0:last], inst.dest)
 	if err != nil {
 		return inst, errors.Wrapf(err, "%s failed", cmdName)
 	}
-	if len(infos) > 1 && !strings.HasSuffix(inst.dest, separator) {
+	if len(infos) > 1 && !inst.destTemplate && !strings.HasSuffix(inst.dest, separator) {
 		return inst, errors.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
 	}
+	if inst.destTemplate {
+		for _, info := range infos {
+			if base := info.root.Base(info.path); base == "." || base == info.root.Dir(base) {
+				return inst, errdefs.InvalidParameter(errors.Errorf("%s: cannot expand %s for source %s, which has no name", cmdName, basenamePlaceholder, info.path))
+			}
+		}
+	}
 	inst.infos = infos
 	return inst, nil
 }
 
+// isDestTemplate returns whether the destination of a COPY or ADD contains
+// placeholders, and an error if one of them is not supported. The only
+// supported placeholder is {basename}.
+func isDestTemplate(dest, cmdName string) (bool, error) {
+	placeholders := destPlaceholderRegexp.FindAllString(dest, -1)
+	for _, p := range placeholders {
+		if p != basenamePlaceholder {
+			return false, errdefs.InvalidParameter(errors.Errorf("%s: unsupported placeholder %s in destination %s, only %s is supported", cmdName, p, dest, basenamePlaceholder))
+		}
+	}
+	return len(placeholders) > 0, nil
+}
+
+// destFor returns the destination of the copy of info. It is dest, with the
+// placeholders expanded if it is a template. As dest is part of the cache key
+// of the copy, along with the hashes of the sources, which include their
+// names, the cache key covers both the template and the matched files.
+func (inst copyInstruction) destFor(info copyInfo) string {
+	if !inst.destTemplate {
+		return inst.dest
+	}
+	return strings.Replace(inst.dest, basenamePlaceholder, info.root.Base(info.path), -1)
+}
+
+// excludesFor returns the exclude patterns of the copy of info, which are the
+// patterns of the instruction and the files skipped in the source directory.
+func (inst copyInstruction) excludesFor(info copyInfo) []string {
+	if len(info.skipped) == 0 {
+		return inst.excludes
+	}
+	excludes := append([]string(nil), inst.excludes...)
+	for _, p := range info.skipped {
+		excludes = append(excludes, literalPattern(p))
+	}
+	return excludes
+}
+
+// literalPattern returns an exclude pattern that only matches the path p. The
+// characters that have a meaning in patterns are escaped, except on Windows
+// where patterns cannot be escaped.
+func literalPattern(p string) string {
+	if runtime.GOOS == "windows" {
+		return p
+	}
+	var pattern strings.Builder
+	for _, r := range p {
+		if r < utf8.RuneSelf && r != '/' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			pattern.WriteByte('\\')
+		}
+		pattern.WriteRune(r)
+	}
+	return pattern.String()
+}
+
+// renameSourcesAndDest converts the arguments of COPY --rename, a source
+// directory, a new name and a destination directory, to the arguments of a
+// copy of the source directory to the renamed directory. The new directory
+// always ends with a separator, so that the copy does not depend on whether
+// the destination ends with one.
+func renameSourcesAndDest(args []string) ([]string, error) {
+	src, name, parent := args[0], args[1], args[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return nil, errdefs.InvalidParameter(errors.Errorf("COPY --rename: invalid name %q, it must be a single path element", name))
+	}
+	return []string{src, strings.TrimRight(parent, "/\\") + "/" + name + "/"}, nil
+}
+
+// checkRenameSource returns an error if the sources of COPY --rename are not
+// a single directory
+func checkRenameSource(infos []copyInfo) error {
+	if len(infos) != 1 {
+		return errdefs.InvalidParameter(errors.New("COPY --rename requires a single source directory"))
+	}
+	fullPath, err := infos[0].fullPath()
+	if err != nil {
+		return err
+	}
+	fi, err := infos[0].root.Stat(fullPath)
+	if err != nil {
+		return errors.Wrap(err, "COPY --rename")
+	}
+	if !fi.IsDir() {
+		return errdefs.InvalidParameter(errors.Errorf("COPY --rename requires a source directory, %s is not a directory", infos[0].path))
+	}
+	return nil
+}
+
 // getCopyInfosForSourcePaths iterates over the source files and calculate the info
 // needed to copy (e.g. hash value if cached)
 // The dest is used in case source is URL (and ends with "/")
@@ -128,14 +271,15 @@ func (o *copier) getCopyInfosForSourcePaths(sources []string, dest string) ([]co
 		infos = append(infos, subinfos...)
 	}
 
-	if len(infos) == 0 {
+	// with --newer-than, no source file may be newer and nothing is copied
+	if len(infos) == 0 && o.newerThan.IsZero() {
 		return nil, errors.New("no source files were specified")
 	}
 	return infos, nil
 }
 
 func (o *copier) getCopyInfoForSourcePath(orig, dest string) ([]copyInfo, error) {
-	if !urlutil.IsURL(orig) {
+	if !urlutil.IsURL(orig) && !(o.urlSchemes && remotecontext.HasURLScheme(orig)) {
 		return o.calcCopyInfo(orig, true)
 	}
 
@@ -196,7 +340,8 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 	}
 
 	if o.source == nil {
-		return nil, errors.Errorf("missing build context")
+		// the Dockerfile was sent alone, from stdin or from a URL
+		return nil, errdefs.InvalidParameter(errors.Errorf("no build context to copy %s from, the Dockerfile was sent without a context", origPath))
 	}
 
 	root := o.source.Root()
@@ -216,7 +361,7 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 		return o.copyWithWildcards(origPath)
 	}
 
-	if imageSource != nil && imageSource.ImageID() != "" {
+	if imageSource != nil && imageSource.ImageID() != "" && !o.filtersSources() {
 		// return a cached copy if one exists
 		if h, ok := o.pathCache.Load(imageSource.ImageID() + origPath); ok {
 			return newCopyInfos(newCopyInfoFromSource(o.source, origPath, h.(string))), nil
@@ -225,23 +370,56 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 
 	// Deal with the single file case
 	copyInfo, err := copyInfoForFile(o.source, origPath)
+	if allowWildcards {
+		// the path was written in the Dockerfile, not found by a walk
+		err = o.checkSourceCase(origPath, err)
+	}
 	switch {
 	case err != nil:
 		return nil, err
 	case copyInfo.hash != "":
+		if o.excludes != nil {
+			if excluded, _ := o.excludes.Matches(root.Base(origPath)); excluded {
+				return nil, nil
+			}
+		}
+		if !o.newerThan.IsZero() {
+			fi, err := remotecontext.StatAt(o.source, origPath)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.ModTime().After(o.newerThan) {
+				return nil, nil
+			}
+		}
 		o.storeInPathCache(imageSource, origPath, copyInfo.hash)
 		return newCopyInfos(copyInfo), err
 	}
 
 	// TODO: remove, handle dirs in Hash()
-	subfiles, err := walkSource(o.source, origPath)
+	subfiles, err := walkSource(o.source, origPath, o.excludes, o.newerThan)
 	if err != nil {
 		return nil, err
 	}
+	copyInfo = newCopyInfoFromSource(o.source, origPath, hashStringSlice("dir", subfiles))
+	if !o.newerThan.IsZero() {
+		var newer int
+		copyInfo.skipped, newer, err = olderFiles(o.source, origPath, o.excludes, o.newerThan)
+		if err != nil {
+			return nil, err
+		}
+		if newer == 0 {
+			return nil, nil
+		}
+	}
+	o.storeInPathCache(imageSource, origPath, copyInfo.hash)
+	return newCopyInfos(copyInfo), nil
+}
 
-	hash := hashStringSlice("dir", subfiles)
-	o.storeInPathCache(imageSource, origPath, hash)
-	return newCopyInfos(newCopyInfoFromSource(o.source, origPath, hash)), nil
+// filtersSources returns whether only some of the files of the sources are
+// copied, in which case the hashes of the sources are not cached by path.
+func (o *copier) filtersSources() bool {
+	return o.excludes != nil || !o.newerThan.IsZero()
 }
 
 func containsWildcards(name, platform string) bool {
@@ -258,15 +436,22 @@ func containsWildcards(name, platform string) bool {
 }
 
 func (o *copier) storeInPathCache(im *imageMount, path string, hash string) {
-	if im != nil {
+	if im != nil && !o.filtersSources() {
 		o.pathCache.Store(im.ImageID()+path, hash)
 	}
 }
 
 func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
 	root := o.source.Root()
+	walkRoot, err := wildcardWalkRoot(root, origPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := root.Lstat(walkRoot); os.IsNotExist(err) {
+		return nil, nil
+	}
 	var copyInfos []copyInfo
-	if err := root.Walk(root.Path(), func(path string, info os.FileInfo, err error) error {
+	if err := root.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -288,6 +473,14 @@ func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
 		if err != nil {
 			return err
 		}
+		if o.imageSource != nil {
+			// files matched in another image are identified by the image
+			// and their path as well, so the cache is not reused when a
+			// different set of files matches
+			for i := range subInfos {
+				subInfos[i].hash = hashStringSlice("from", []string{o.imageSource.ImageID(), rel, subInfos[i].hash})
+			}
+		}
 		copyInfos = append(copyInfos, subInfos...)
 		return nil
 	}); err != nil {
@@ -296,6 +489,31 @@ func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
 	return copyInfos, nil
 }
 
+// wildcardWalkRoot returns the directory to walk to find the matches of
+// pattern, which is the longest leading part of pattern without wildcards.
+// The symlinks and .. elements of that part are resolved within root.
+func wildcardWalkRoot(root containerfs.ContainerFS, pattern string) (string, error) {
+	prefix := string(root.Separator())
+	dir, _ := root.Split(pattern)
+	for _, elem := range strings.Split(dir, string(root.Separator())) {
+		if elem == "" {
+			continue
+		}
+		if containsWildcards(elem, root.OS()) || strings.Contains(elem, "\\") {
+			break
+		}
+		prefix = root.Join(prefix, elem)
+	}
+	walkRoot, err := root.ResolveScopedPath(prefix, false)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := remotecontext.Rel(root, walkRoot); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(root.Separator())) {
+		return "", errors.Errorf("pattern %s is outside of the build context", pattern)
+	}
+	return walkRoot, nil
+}
+
 func copyInfoForFile(source builder.Source, path string) (copyInfo, error) {
 	fi, err := remotecontext.StatAt(source, path)
 	if err != nil {
@@ -312,8 +530,70 @@ func copyInfoForFile(source builder.Source, path string) (copyInfo, error) {
 	return newCopyInfoFromSource(source, path, "file:"+hash), nil
 }
 
+// checkSourceCase reports a source path that only matches a file of the
+// source whose name differs in case, which depends on whether the filesystem
+// of the source is case-insensitive. When the file is not found, statErr is
+// completed with the name of the file. When it is found, a warning is printed,
+// or an error is returned if strictCase is set.
+func (o *copier) checkSourceCase(origPath string, statErr error) error {
+	if statErr != nil && !os.IsNotExist(errors.Cause(statErr)) {
+		return statErr
+	}
+	actual := sourcePathCase(o.source, origPath)
+	switch {
+	case actual == "" || actual == origPath:
+		return statErr
+	case statErr != nil:
+		return errors.Errorf("%v (%s only differs in case)", statErr, actual)
+	case o.strictCase:
+		return errdefs.InvalidParameter(errors.Errorf("%s only matches %s, whose name differs in case", origPath, actual))
+	}
+	fmt.Fprintf(o.warnings, "[Warning] %s only matches %s, whose name differs in case, and would not be found on a case-sensitive filesystem\n", origPath, actual)
+	return nil
+}
+
+// sourcePathCase returns path with the names of the files of the source it
+// matches when case is ignored, or "" if it does not match any file.
+func sourcePathCase(source builder.Source, path string) string {
+	root := source.Root()
+	var names []string
+	for _, name := range strings.Split(path, string(root.Separator())) {
+		if name == "" || name == "." {
+			continue
+		}
+		dirPath, err := remotecontext.FullPath(source, root.Join(names...))
+		if err != nil {
+			return ""
+		}
+		dir, err := root.Open(dirPath)
+		if err != nil {
+			return ""
+		}
+		fis, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil {
+			return ""
+		}
+		match := ""
+		for _, fi := range fis {
+			if fi.Name() == name {
+				match = name
+				break
+			}
+			if match == "" && strings.EqualFold(fi.Name(), name) {
+				match = fi.Name()
+			}
+		}
+		if match == "" {
+			return ""
+		}
+		names = append(names, match)
+	}
+	return root.Join(names...)
+}
+
 // TODO: dedupe with copyWithWildcards()
-func walkSource(source builder.Source, origPath string) ([]string, error) {
+func walkSource(source builder.Source, origPath string, excludes *fileutils.PatternMatcher, newerThan time.Time) ([]string, error) {
 	fp, err := remotecontext.FullPath(source, origPath)
 	if err != nil {
 		return nil, err
@@ -331,6 +611,21 @@ func walkSource(source builder.Source, origPath string) ([]string, error) {
 		if rel == "." {
 			return nil
 		}
+		if excludes != nil {
+			relDir, err := source.Root().Rel(fp, path)
+			if err != nil {
+				return err
+			}
+			if excluded, _ := excludes.Matches(relDir); excluded && relDir != "." {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if !newerThan.IsZero() && !info.IsDir() && !info.ModTime().After(newerThan) {
+			return nil
+		}
 		hash, err := source.Hash(rel)
 		if err != nil {
 			return nil
@@ -347,6 +642,49 @@ func walkSource(source builder.Source, origPath string) ([]string, error) {
 	return subfiles, nil
 }
 
+// olderFiles returns the paths, relative to the source directory origPath, of
+// the files that are not modified after t and the number of files that are.
+// Directories are not compared, they are copied if they contain a newer file.
+func olderFiles(source builder.Source, origPath string, excludes *fileutils.PatternMatcher, t time.Time) ([]string, int, error) {
+	fp, err := remotecontext.FullPath(source, origPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		older []string
+		newer int
+	)
+	err = source.Root().Walk(fp, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := source.Root().Rel(fp, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if excludes != nil {
+			if excluded, _ := excludes.Matches(rel); excluded {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		switch {
+		case info.IsDir():
+		case info.ModTime().After(t):
+			newer++
+		default:
+			older = append(older, rel)
+		}
+		return nil
+	})
+	return older, newer, err
+}
+
 type sourceDownloader func(string) (builder.Source, string, error)
 
 func newRemoteSourceDownloader(output, stdout io.Writer) sourceDownloader {
@@ -386,7 +724,7 @@ func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote b
 		return
 	}
 
-	resp, err := remotecontext.GetWithStatusError(srcURL)
+	resp, err := remotecontext.FetchURL(srcURL)
 	if err != nil {
 		return
 	}
@@ -451,8 +789,21 @@ func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote b
 
 type copyFileOptions struct {
 	decompress bool
+	keepNewer  bool
+	intoNamed  bool
+	normalize  bool
+	symlinks   bool
+	dirMode    bool
+	excludes   []string
 	chownPair  idtools.IDPair
+	// parentPair owns, and parentMode is the mode of, the missing parent
+	// directories of the destination created by the copy
+	parentPair idtools.IDPair
+	parentMode os.FileMode
 	archiver   Archiver
+	// opaque replaces an existing destination directory with the copied
+	// directory, instead of merging them, when the layer is applied
+	opaque bool
 }
 
 type copyEndpoint struct {
@@ -476,15 +827,43 @@ func performCopyForInfo(dest copyInfo, source copyInfo, options copyFileOptions)
 	srcEndpoint := &copyEndpoint{driver: source.root, path: srcPath}
 	destEndpoint := &copyEndpoint{driver: dest.root, path: destPath}
 
+	if options.symlinks {
+		target, isLink, err := symlinkTarget(source)
+		if err != nil {
+			return err
+		}
+		if isLink {
+			destExistsAsDir, err := isExistingDirectory(destEndpoint)
+			if err != nil {
+				return err
+			}
+			if endsInSlash(dest.root, dest.path) || destExistsAsDir {
+				destEndpoint.path = dest.root.Join(destPath, source.root.Base(source.path))
+			}
+			return copySymlink(target, destEndpoint, options)
+		}
+	}
+
 	src, err := source.root.Stat(srcPath)
 	if err != nil {
 		return errors.Wrapf(err, "source path not found")
 	}
 	if src.IsDir() {
-		return copyDirectory(archiver, srcEndpoint, destEndpoint, options.chownPair)
+		if err := copyDirectory(archiver, srcEndpoint, destEndpoint, options); err != nil {
+			return err
+		}
+		if options.opaque && destPath != dest.root.Path() {
+			return writeOpaqueWhiteout(destEndpoint)
+		}
+		return nil
 	}
 	if options.decompress && isArchivePath(source.root, srcPath) && !source.noDecompress {
-		return archiver.UntarPath(srcPath, destPath)
+		if options.intoNamed {
+			if destEndpoint, err = namedArchiveDest(destEndpoint, source.root.Base(source.path)); err != nil {
+				return err
+			}
+		}
+		return untarPath(archiver, srcEndpoint, destEndpoint, options)
 	}
 
 	destExistsAsDir, err := isExistingDirectory(destEndpoint)
@@ -499,7 +878,109 @@ func performCopyForInfo(dest copyInfo, source copyInfo, options copyFileOptions)
 		destPath = dest.root.Join(destPath, source.root.Base(source.path))
 		destEndpoint = &copyEndpoint{driver: dest.root, path: destPath}
 	}
-	return copyFile(archiver, srcEndpoint, destEndpoint, options.chownPair)
+	return copyFile(archiver, srcEndpoint, destEndpoint, options)
+}
+
+// writeOpaqueWhiteout marks the directory at dest as opaque, so the contents of
+// the same directory in the parent layers are hidden when the layer is applied.
+func writeOpaqueWhiteout(dest *copyEndpoint) error {
+	f, err := dest.driver.OpenFile(dest.driver.Join(dest.path, archive.WhiteoutOpaqueDir), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace the destination directory")
+	}
+	return f.Close()
+}
+
+// untarPath extracts the archive at source into dest.
+func untarPath(archiver Archiver, source, dest *copyEndpoint, options copyFileOptions) error {
+	if err := createParentDirs(dest.driver, dest.path, options); err != nil {
+		return err
+	}
+	tarArchive, err := source.driver.Open(source.path)
+	if err != nil {
+		return err
+	}
+	defer tarArchive.Close()
+	idMappings := archiver.IDMappings()
+	tarOptions := &archive.TarOptions{
+		UIDMaps:   idMappings.UIDs(),
+		GIDMaps:   idMappings.GIDs(),
+		KeepNewer: options.keepNewer,
+	}
+	return untarFunc(dest.driver)(tarArchive, dest.path, tarOptions)
+}
+
+// symlinkTarget returns the target of source if source is a symlink. Only
+// relative targets that stay inside the root of the source are accepted.
+func symlinkTarget(source copyInfo) (string, bool, error) {
+	root := source.root
+	parent, err := root.ResolveScopedPath(root.Dir(source.path), true)
+	if err != nil {
+		return "", false, err
+	}
+	linkPath := root.Join(parent, root.Base(source.path))
+	fi, err := root.Lstat(linkPath)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "source path not found")
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", false, nil
+	}
+	target, err := root.Readlink(linkPath)
+	if err != nil {
+		return "", false, err
+	}
+	if root.IsAbs(target) {
+		return "", false, errors.Errorf("cannot preserve symlink %s: target %s is an absolute path", source.path, target)
+	}
+	rel, err := root.Rel(root.Path(), root.Join(parent, target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(root.Separator())) {
+		return "", false, errors.Errorf("cannot preserve symlink %s: target %s is outside of the build context", source.path, target)
+	}
+	return target, true, nil
+}
+
+func copySymlink(target string, dest *copyEndpoint, options copyFileOptions) error {
+	if err := createParentDirs(dest.driver, dest.driver.Dir(dest.path), options); err != nil {
+		return err
+	}
+	if err := dest.driver.Remove(dest.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to replace %s", dest.path)
+	}
+	if err := dest.driver.Symlink(target, dest.path); err != nil {
+		return errors.Wrapf(err, "failed to create symlink")
+	}
+	return dest.driver.Lchown(dest.path, int64(options.chownPair.UID), int64(options.chownPair.GID))
+}
+
+// namedArchiveDest returns the directory of dest that the archive named name is
+// extracted into with ADD --into-named, which is named after the archive
+// without its extension. The directory may already exist, but not as another
+// kind of file.
+func namedArchiveDest(dest *copyEndpoint, name string) (*copyEndpoint, error) {
+	dirName := archiveDirName(name)
+	if dirName == "" || dirName == "." || dirName == ".." {
+		return nil, errdefs.InvalidParameter(errors.Errorf("ADD --into-named: cannot name a directory after the archive %s", name))
+	}
+	named := &copyEndpoint{driver: dest.driver, path: dest.driver.Join(dest.path, dirName)}
+	fi, err := named.driver.Lstat(named.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return named, nil
+		}
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errdefs.InvalidParameter(errors.Errorf("ADD --into-named: cannot extract %s, %s exists in the destination and is not a directory", name, dirName))
+	}
+	return named, nil
+}
+
+// archiveDirName returns the name of the archive without its extension, and
+// without the .tar extension of a compressed tarball such as release.tar.gz.
+func archiveDirName(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.TrimSuffix(name, ".tar")
 }
 
 func isArchivePath(driver containerfs.ContainerFS, path string) bool {
@@ -517,37 +998,190 @@ func isArchivePath(driver containerfs.ContainerFS, path string) bool {
 	return err == nil
 }
 
-func copyDirectory(archiver Archiver, source, dest *copyEndpoint, chownPair idtools.IDPair) error {
+func copyDirectory(archiver Archiver, source, dest *copyEndpoint, options copyFileOptions) error {
 	destExists, err := isExistingDirectory(dest)
 	if err != nil {
 		return errors.Wrapf(err, "failed to query destination path")
 	}
+	if !destExists {
+		if err := createParentDirs(dest.driver, dest.driver.Dir(dest.path), options); err != nil {
+			return err
+		}
+	}
 
-	if err := archiver.CopyWithTar(source.path, dest.path); err != nil {
+	if len(options.excludes) == 0 {
+		if err := archiver.CopyWithTar(source.path, dest.path); err != nil {
+			return errors.Wrapf(err, "failed to copy directory")
+		}
+		// TODO: @gupta-ak. Investigate how LCOW permission mappings will work.
+		if err := fixPermissions(source.path, dest.path, options.chownPair, !destExists, nil); err != nil {
+			return err
+		}
+		if err := normalizeModes(source.path, dest.path, options, destExists, nil); err != nil {
+			return err
+		}
+		return preserveDirMode(source.path, dest.path, options, destExists)
+	}
+
+	pm, err := fileutils.NewPatternMatcher(options.excludes)
+	if err != nil {
+		return err
+	}
+	if err := copyDirectoryExcluding(archiver, source, dest, options.excludes); err != nil {
 		return errors.Wrapf(err, "failed to copy directory")
 	}
+	if err := fixPermissions(source.path, dest.path, options.chownPair, !destExists, pm); err != nil {
+		return err
+	}
+	if err := normalizeModes(source.path, dest.path, options, destExists, pm); err != nil {
+		return err
+	}
+	return preserveDirMode(source.path, dest.path, options, destExists)
+}
+
+// preserveDirMode sets the mode of the directory dest to the mode of the source
+// directory if options.dirMode is set, unless dest existed before the copy.
+// The copy creates dest with the mode 0755, and mode normalization does too.
+func preserveDirMode(source, dest string, options copyFileOptions, destExists bool) error {
+	if !options.dirMode || destExists {
+		return nil
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dest, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// copyDirectoryExcluding copies the content of the source directory to dest,
+// leaving out the paths that match excludes.
+func copyDirectoryExcluding(archiver Archiver, source, dest *copyEndpoint, excludes []string) error {
+	tarArchive, err := tarFunc(source.driver)(source.path, &archive.TarOptions{
+		Compression:     archive.Uncompressed,
+		ExcludePatterns: excludes,
+	})
+	if err != nil {
+		return err
+	}
+	defer tarArchive.Close()
+	idMappings := archiver.IDMappings()
+	return untarFunc(dest.driver)(tarArchive, dest.path, &archive.TarOptions{
+		UIDMaps: idMappings.UIDs(),
+		GIDMaps: idMappings.GIDs(),
+	})
+}
+
+func copyFile(archiver Archiver, source, dest *copyEndpoint, options copyFileOptions) error {
+	if err := createParentDirs(dest.driver, dest.driver.Dir(dest.path), options); err != nil {
+		return err
+	}
+	if err := archiver.CopyFileWithTar(source.path, dest.path); err != nil {
+		return errors.Wrapf(err, "failed to copy file")
+	}
 	// TODO: @gupta-ak. Investigate how LCOW permission mappings will work.
-	return fixPermissions(source.path, dest.path, chownPair, !destExists)
+	if err := fixPermissions(source.path, dest.path, options.chownPair, false, nil); err != nil {
+		return err
+	}
+	return normalizeModes(source.path, dest.path, options, false, nil)
 }
 
-func copyFile(archiver Archiver, source, dest *copyEndpoint, chownPair idtools.IDPair) error {
-	if runtime.GOOS == "windows" && dest.driver.OS() == "linux" {
+// normalizeModes sets the modes of the files copied from source to dest to
+// 0644, or 0755 if they are executable, and the modes of the copied
+// directories to 0755, if options.normalize is set, so that they do not depend
+// on the umask of the checkout of the build context. Symlinks are left as they
+// are, and so is dest if it is an existing directory (skipRoot).
+func normalizeModes(source, dest string, options copyFileOptions, skipRoot bool, excludes *fileutils.PatternMatcher) error {
+	if !options.normalize {
+		return nil
+	}
+	return filepath.Walk(source, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skipRoot && fullpath == source {
+			return nil
+		}
+		rel, err := filepath.Rel(source, fullpath)
+		if err != nil {
+			return err
+		}
+		// excluded paths were not copied
+		if excludes != nil && rel != "." {
+			if excluded, _ := excludes.Matches(rel); excluded {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		target := filepath.Join(dest, rel)
+		fi, err := os.Lstat(target)
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chmod(target, normalizedMode(fi.Mode()))
+	})
+}
+
+// normalizedMode returns the normalized permissions for a file of mode
+func normalizedMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() || mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// createParentDirs creates parent and its missing parent directories, owned by
+// options.parentPair. If options.parentMode is set the created directories
+// get that mode, otherwise 0755. Directories that already exist are left as
+// they are.
+func createParentDirs(driver containerfs.Driver, parent string, options copyFileOptions) error {
+	if runtime.GOOS == "windows" && driver.OS() == "linux" {
 		// LCOW
-		if err := dest.driver.MkdirAll(dest.driver.Dir(dest.path), 0755); err != nil {
+		if err := driver.MkdirAll(parent, 0755); err != nil {
 			return errors.Wrapf(err, "failed to create new directory")
 		}
-	} else {
-		if err := idtools.MkdirAllAndChownNew(filepath.Dir(dest.path), 0755, chownPair); err != nil {
-			// Normal containers
-			return errors.Wrapf(err, "failed to create new directory")
+		return nil
+	}
+
+	var missing []string
+	for dir := parent; ; dir = filepath.Dir(dir) {
+		if _, err := driver.Stat(dir); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if err := idtools.MkdirAllAndChownNew(parent, 0755, options.parentPair); err != nil {
+		// Normal containers
+		return errors.Wrapf(err, "failed to create new directory")
+	}
+	if options.parentMode == 0 {
+		return nil
+	}
+	for _, dir := range missing {
+		if err := os.Chmod(dir, options.parentMode); err != nil {
+			return errors.Wrapf(err, "failed to set mode of %s", dir)
 		}
 	}
+	return nil
+}
 
-	if err := archiver.CopyFileWithTar(source.path, dest.path); err != nil {
-		return errors.Wrapf(err, "failed to copy file")
+// parseChmodFlag parses the octal mode of the --chmod flag of ADD and COPY
+func parseChmodFlag(chmod, platform string) (os.FileMode, error) {
+	if chmod == "" {
+		return 0, nil
 	}
-	// TODO: @gupta-ak. Investigate how LCOW permission mappings will work.
-	return fixPermissions(source.path, dest.path, chownPair, false)
+	if platform == "windows" {
+		return 0, errdefs.NotImplemented(errors.New("--chmod is not supported for Windows images"))
+	}
+	mode, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errdefs.InvalidParameter(errors.Errorf("invalid --chmod value %s: must be an octal mode between 0 and 0777", chmod))
+	}
+	return os.FileMode(mode), nil
 }
 
 func endsInSlash(driver containerfs.Driver, path string) bool {
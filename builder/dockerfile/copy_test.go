@@ -1,13 +1,27 @@
 package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 	"gotest.tools/fs"
+	"gotest.tools/skip"
 )
 
 func TestIsExistingDirectory(t *testing.T) {
@@ -146,3 +160,340 @@ func TestGetFilenameForDownload(t *testing.T) {
 		assert.Check(t, is.Equal(testcase.expected, filename))
 	}
 }
+
+func TestPerformCopyPreservesSymlinks(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "symlinks are not supported on Windows")
+	src := fs.NewDir(t, "copy-symlink-src",
+		fs.WithDir("dir", fs.WithFile("target", "contents")))
+	defer src.Remove()
+	dest := fs.NewDir(t, "copy-symlink-dest")
+	defer dest.Remove()
+
+	assert.NilError(t, os.Symlink("target", filepath.Join(src.Path(), "dir", "link")))
+	assert.NilError(t, os.Symlink("../../outside", filepath.Join(src.Path(), "dir", "escaping")))
+	assert.NilError(t, os.Symlink("/etc/passwd", filepath.Join(src.Path(), "dir", "absolute")))
+
+	srcRoot := containerfs.NewLocalContainerFS(src.Path())
+	destInfo := copyInfo{root: containerfs.NewLocalContainerFS(dest.Path()), path: "/out/"}
+	opts := copyFileOptions{
+		symlinks:   true,
+		chownPair:  idtools.IDPair{UID: os.Getuid(), GID: os.Getgid()},
+		parentPair: idtools.IDPair{UID: os.Getuid(), GID: os.Getgid()},
+	}
+
+	err := performCopyForInfo(destInfo, copyInfo{root: srcRoot, path: "dir/link"}, opts)
+	assert.NilError(t, err)
+	target, err := os.Readlink(filepath.Join(dest.Path(), "out", "link"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("target", target))
+
+	err = performCopyForInfo(destInfo, copyInfo{root: srcRoot, path: "dir/escaping"}, opts)
+	assert.Check(t, is.ErrorContains(err, "target ../../outside is outside of the build context"))
+
+	err = performCopyForInfo(destInfo, copyInfo{root: srcRoot, path: "dir/absolute"}, opts)
+	assert.Check(t, is.ErrorContains(err, "target /etc/passwd is an absolute path"))
+}
+
+func TestNamedArchiveDest(t *testing.T) {
+	dest := fs.NewDir(t, "into-named-dest",
+		fs.WithDir("existing"),
+		fs.WithFile("file", "contents"))
+	defer dest.Remove()
+	root := containerfs.NewLocalContainerFS(dest.Path())
+
+	testCases := []struct {
+		name        string
+		expected    string
+		expectedErr string
+	}{
+		{name: "release.tar", expected: "release"},
+		{name: "release.tar.gz", expected: "release"},
+		{name: "release-1.0.tgz", expected: "release-1.0"},
+		{name: "existing.tar", expected: "existing"},
+		{name: "file.tar", expectedErr: "ADD --into-named: cannot extract file.tar, file exists in the destination and is not a directory"},
+		{name: ".tar", expectedErr: "ADD --into-named: cannot name a directory after the archive .tar"},
+	}
+	for _, tc := range testCases {
+		named, err := namedArchiveDest(&copyEndpoint{driver: root, path: dest.Path()}, tc.name)
+		if tc.expectedErr != "" {
+			assert.Check(t, is.Error(err, tc.expectedErr), tc.name)
+			assert.Check(t, errdefs.IsInvalidParameter(err), tc.name)
+			continue
+		}
+		assert.Check(t, err, tc.name)
+		assert.Check(t, is.Equal(filepath.Join(dest.Path(), tc.expected), named.path), tc.name)
+	}
+}
+
+func TestWildcardWalkRoot(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "paths are unix specific")
+	dir := fs.NewDir(t, "wildcard-walk-root", fs.WithDir("out", fs.WithDir("lib")))
+	defer dir.Remove()
+	assert.NilError(t, os.Symlink("../..", filepath.Join(dir.Path(), "escaping")))
+	assert.NilError(t, os.Symlink("/out", filepath.Join(dir.Path(), "absolute")))
+	root := containerfs.NewLocalContainerFS(dir.Path())
+
+	var testcases = []struct {
+		pattern  string
+		expected string
+	}{
+		{pattern: "*.so", expected: ""},
+		{pattern: "out/*.so", expected: "out"},
+		{pattern: "out/lib/*.so", expected: "out/lib"},
+		{pattern: "out/lib*/a.so", expected: "out"},
+		{pattern: "out/l\\*b/*.so", expected: "out"},
+		// the walk never leaves the root
+		{pattern: "../*.so", expected: ""},
+		{pattern: "out/../../../*.so", expected: ""},
+		{pattern: "escaping/*.so", expected: ""},
+		{pattern: "escaping/out/*.so", expected: "out"},
+		{pattern: "absolute/lib/*.so", expected: "out/lib"},
+	}
+	for _, testcase := range testcases {
+		walkRoot, err := wildcardWalkRoot(root, testcase.pattern)
+		assert.Check(t, err, testcase.pattern)
+		assert.Check(t, is.Equal(filepath.Join(dir.Path(), testcase.expected), walkRoot), testcase.pattern)
+	}
+}
+
+func TestDownloadSourceWithRegisteredScheme(t *testing.T) {
+	err := remotecontext.RegisterURLFetcher("test-download", func(u *url.URL) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          ioutil.NopCloser(strings.NewReader("contents")),
+			ContentLength: -1,
+		}, nil
+	})
+	assert.NilError(t, err)
+
+	remote, filename, err := downloadSource(ioutil.Discard, ioutil.Discard, "test-download://bucket/dir/file.txt")
+	assert.NilError(t, err)
+	defer os.RemoveAll(remote.Root().Path())
+	assert.Check(t, is.Equal("file.txt", filename))
+
+	content, err := ioutil.ReadFile(filepath.Join(remote.Root().Path(), filename))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("contents", string(content)))
+}
+
+func TestCopySourceWithRegisteredScheme(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the test uses unix paths")
+	err := remotecontext.RegisterURLFetcher("test-copy", func(u *url.URL) (*http.Response, error) {
+		return nil, errors.New("not implemented")
+	})
+	assert.NilError(t, err)
+	src := fs.NewDir(t, "copy-registered-scheme", fs.WithDir("test-copy:", fs.WithFile("file", "contents")))
+	defer src.Remove()
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(src.Path()))
+	assert.NilError(t, err)
+
+	// only ADD downloads the sources that use a URL scheme
+	o := &copier{source: source, download: errOnSourceDownload, warnings: ioutil.Discard}
+	infos, err := o.getCopyInfosForSourcePaths([]string{"test-copy://file"}, "/dest/")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(infos, 1))
+
+	o.urlSchemes = true
+	_, err = o.getCopyInfosForSourcePaths([]string{"test-copy://file"}, "/dest/")
+	assert.Check(t, is.Error(err, "source can't be a URL for COPY"))
+}
+
+func TestWalkSourceExcludes(t *testing.T) {
+	src := fs.NewDir(t, "walk-source-excludes",
+		fs.WithDir("src",
+			fs.WithFile("main.go", "package main"),
+			fs.WithFile("README.md", "readme"),
+			fs.WithDir("node_modules", fs.WithFile("module.js", "js")),
+			fs.WithDir("docs", fs.WithFile("index.md", "docs"))))
+	defer src.Remove()
+
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(src.Path()))
+	assert.NilError(t, err)
+
+	all, err := walkSource(source, "src", nil, time.Time{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(all, 7))
+
+	excludes, err := fileutils.NewPatternMatcher([]string{"**/*.md", "node_modules"})
+	assert.NilError(t, err)
+	filtered, err := walkSource(source, "src", excludes, time.Time{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(filtered, 3))
+
+	// the remaining paths are the src and docs directories and main.go
+	mainHash, err := source.Hash(filepath.Join("src", "main.go"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(filtered, mainHash))
+}
+
+func TestCopierNewerThan(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "exclude patterns cannot be escaped on Windows")
+	ref := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	before, after := fs.WithTimestamps(ref, ref.Add(-time.Hour)), fs.WithTimestamps(ref, ref.Add(time.Hour))
+	src := fs.NewDir(t, "copier-newer-than",
+		fs.WithFile("old.txt", "old", before),
+		fs.WithFile("new.txt", "new", after),
+		fs.WithDir("src",
+			fs.WithFile("old [1].txt", "old", before),
+			fs.WithFile("new.txt", "new", after)),
+		fs.WithDir("stale", fs.WithFile("old.txt", "old", before)))
+	defer src.Remove()
+
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(src.Path()))
+	assert.NilError(t, err)
+	o := copier{source: source, newerThan: ref}
+
+	infos, err := o.getCopyInfosForSourcePaths([]string{"old.txt", "new.txt", "src", "stale"}, "/dest/")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(infos, 2))
+	assert.Check(t, is.Equal("new.txt", infos[0].path))
+	assert.Check(t, is.Equal("src", infos[1].path))
+	assert.Check(t, is.DeepEqual([]string{"old [1].txt"}, infos[1].skipped))
+
+	// the skipped files are excluded from the copy of the directory
+	inst := copyInstruction{excludes: []string{"*.md"}}
+	excludes, err := fileutils.NewPatternMatcher(inst.excludesFor(infos[1]))
+	assert.NilError(t, err)
+	for p, expected := range map[string]bool{"old [1].txt": true, "old 1.txt": false, "new.txt": false, "README.md": true} {
+		excluded, err := excludes.Matches(p)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(expected, excluded), p)
+	}
+
+	// nothing is newer, which is not an error
+	infos, err = o.getCopyInfosForSourcePaths([]string{"old.txt", "stale"}, "/dest/")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(infos, 0))
+}
+
+func TestParseChmodFlag(t *testing.T) {
+	mode, err := parseChmodFlag("", "linux")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0), mode))
+
+	mode, err = parseChmodFlag("0750", "linux")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0750), mode))
+
+	_, err = parseChmodFlag("1777", "linux")
+	assert.Check(t, is.ErrorContains(err, "invalid --chmod value 1777"))
+	_, err = parseChmodFlag("rwx", "linux")
+	assert.Check(t, is.ErrorContains(err, "invalid --chmod value rwx"))
+	_, err = parseChmodFlag("0750", "windows")
+	assert.Check(t, is.ErrorContains(err, "not supported for Windows images"))
+}
+
+func TestRenameSourcesAndDest(t *testing.T) {
+	var testcases = []struct {
+		args        []string
+		expected    []string
+		expectedErr string
+	}{
+		{args: []string{"src", "app", "/opt/"}, expected: []string{"src", "/opt/app/"}},
+		{args: []string{"src", "app", "/opt"}, expected: []string{"src", "/opt/app/"}},
+		{args: []string{"src", "app", "/"}, expected: []string{"src", "/app/"}},
+		{args: []string{"src", "app", "."}, expected: []string{"src", "./app/"}},
+		{args: []string{"src", "app", `C:\opt\`}, expected: []string{"src", `C:\opt/app/`}},
+		{args: []string{"src", "a/b", "/opt/"}, expectedErr: `invalid name "a/b"`},
+		{args: []string{"src", "..", "/opt/"}, expectedErr: `invalid name ".."`},
+	}
+	for _, testcase := range testcases {
+		actual, err := renameSourcesAndDest(testcase.args)
+		if testcase.expectedErr != "" {
+			assert.Check(t, is.ErrorContains(err, testcase.expectedErr), testcase.args)
+			continue
+		}
+		assert.Check(t, err)
+		assert.Check(t, is.DeepEqual(testcase.expected, actual))
+	}
+}
+
+func TestCheckRenameSource(t *testing.T) {
+	src := fs.NewDir(t, "copy-rename-src",
+		fs.WithDir("dir", fs.WithFile("file", "contents")))
+	defer src.Remove()
+	root := containerfs.NewLocalContainerFS(src.Path())
+
+	assert.Check(t, checkRenameSource([]copyInfo{{root: root, path: "dir"}}))
+	err := checkRenameSource([]copyInfo{{root: root, path: "dir/file"}})
+	assert.Check(t, is.ErrorContains(err, "dir/file is not a directory"))
+	err = checkRenameSource([]copyInfo{{root: root, path: "dir"}, {root: root, path: "dir/file"}})
+	assert.Check(t, is.ErrorContains(err, "requires a single source directory"))
+}
+
+func TestCheckSourceCase(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the test relies on a case-sensitive filesystem")
+	src := fs.NewDir(t, "copy-source-case",
+		fs.WithDir("Dir", fs.WithFile("foo.txt", "contents")),
+		fs.WithFile("bar.txt", "contents"),
+		fs.WithFile("BAR.txt", "contents"))
+	defer src.Remove()
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(src.Path()))
+	assert.NilError(t, err)
+
+	assert.Check(t, is.Equal("Dir/foo.txt", sourcePathCase(source, "dir/Foo.txt")))
+	assert.Check(t, is.Equal("Dir/foo.txt", sourcePathCase(source, "./Dir/foo.txt")))
+	assert.Check(t, is.Equal("bar.txt", sourcePathCase(source, "bar.txt")))
+	assert.Check(t, is.Equal("", sourcePathCase(source, "dir/missing.txt")))
+
+	stdout := &bytes.Buffer{}
+	o := &copier{source: source, warnings: stdout}
+	_, statErr := remotecontext.StatAt(source, "dir/Foo.txt")
+	err = o.checkSourceCase("dir/Foo.txt", statErr)
+	assert.Check(t, is.ErrorContains(err, "no such file or directory (Dir/foo.txt only differs in case)"))
+	_, statErr = remotecontext.StatAt(source, "missing.txt")
+	assert.Check(t, is.Equal(statErr, o.checkSourceCase("missing.txt", statErr)))
+
+	// a case-insensitive filesystem finds the file
+	assert.Check(t, o.checkSourceCase("dir/Foo.txt", nil))
+	assert.Check(t, is.Contains(stdout.String(), "[Warning] dir/Foo.txt only matches Dir/foo.txt, whose name differs in case"))
+	o.strictCase = true
+	err = o.checkSourceCase("dir/Foo.txt", nil)
+	assert.Check(t, is.ErrorContains(err, "dir/Foo.txt only matches Dir/foo.txt, whose name differs in case"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestCreateCopyInstructionDestTemplate(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the test uses unix paths")
+	src := fs.NewDir(t, "copy-dest-template",
+		fs.WithFile("a.conf", "a"),
+		fs.WithFile("b.conf", "b"),
+		fs.WithFile("c.txt", "c"))
+	defer src.Remove()
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(src.Path()))
+	assert.NilError(t, err)
+	o := &copier{source: source, download: errOnSourceDownload}
+
+	inst, err := o.createCopyInstruction([]string{"*.conf", "/etc/app/{basename}.bak"}, "COPY")
+	assert.NilError(t, err)
+	assert.Check(t, inst.destTemplate)
+	var dests []string
+	for _, info := range inst.infos {
+		dests = append(dests, inst.destFor(info))
+	}
+	assert.Check(t, is.DeepEqual([]string{"/etc/app/a.conf.bak", "/etc/app/b.conf.bak"}, dests))
+
+	inst, err = o.createCopyInstruction([]string{"c.txt", "/etc/app/{basename}"}, "COPY")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("/etc/app/c.txt", inst.destFor(inst.infos[0])))
+
+	inst, err = o.createCopyInstruction([]string{"c.txt", "/etc/app/"}, "COPY")
+	assert.NilError(t, err)
+	assert.Check(t, !inst.destTemplate)
+	assert.Check(t, is.Equal("/etc/app/", inst.destFor(inst.infos[0])))
+
+	_, err = o.createCopyInstruction([]string{"*.conf", "/etc/app/{name}.bak"}, "COPY")
+	assert.Check(t, is.ErrorContains(err, "COPY: unsupported placeholder {name} in destination /etc/app/{name}.bak, only {basename} is supported"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	_, err = o.createCopyInstruction([]string{".", "/etc/{basename}"}, "COPY")
+	assert.Check(t, is.ErrorContains(err, "cannot expand {basename} for source ."))
+}
+
+func TestCalcCopyInfoWithoutContext(t *testing.T) {
+	o := &copier{}
+	_, err := o.calcCopyInfo("foo", true)
+	assert.Check(t, is.ErrorContains(err, "no build context to copy foo from, the Dockerfile was sent without a context"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
@@ -7,10 +7,11 @@ import (
 	"path/filepath"
 
 	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/idtools"
 )
 
-func fixPermissions(source, destination string, rootIDs idtools.IDPair, overrideSkip bool) error {
+func fixPermissions(source, destination string, rootIDs idtools.IDPair, overrideSkip bool, excludes *fileutils.PatternMatcher) error {
 	var (
 		skipChownRoot bool
 		err           error
@@ -37,6 +38,15 @@ func fixPermissions(source, destination string, rootIDs idtools.IDPair, override
 		if err != nil {
 			return err
 		}
+		// Excluded paths were not copied
+		if excludes != nil && cleaned != "." {
+			if excluded, _ := excludes.Matches(cleaned); excluded {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 
 		fullpath = filepath.Join(destination, cleaned)
 		return os.Lchown(fullpath, rootIDs.UID, rootIDs.GID)
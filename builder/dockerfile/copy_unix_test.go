@@ -0,0 +1,148 @@
+// +build !windows
+
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/idtools"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+	"gotest.tools/skip"
+)
+
+func TestCreateParentDirs(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	dest := fs.NewDir(t, "create-parent-dirs", fs.WithDir("existing", fs.WithMode(0755)))
+	defer dest.Remove()
+
+	options := copyFileOptions{
+		parentPair: idtools.IDPair{UID: 1000, GID: 1001},
+		parentMode: 0750,
+	}
+	parent := filepath.Join(dest.Path(), "existing", "new", "deep")
+	assert.NilError(t, createParentDirs(containerfs.NewLocalDriver(), parent, options))
+
+	for _, tc := range []struct {
+		path string
+		uid  uint32
+		gid  uint32
+		mode os.FileMode
+	}{
+		{path: "existing", uid: 0, gid: 0, mode: 0755},
+		{path: "existing/new", uid: 1000, gid: 1001, mode: 0750},
+		{path: "existing/new/deep", uid: 1000, gid: 1001, mode: 0750},
+	} {
+		fi, err := os.Stat(filepath.Join(dest.Path(), tc.path))
+		assert.NilError(t, err)
+		stat := fi.Sys().(*syscall.Stat_t)
+		assert.Check(t, is.Equal(tc.uid, stat.Uid), tc.path)
+		assert.Check(t, is.Equal(tc.gid, stat.Gid), tc.path)
+		assert.Check(t, is.Equal(tc.mode, fi.Mode().Perm()), tc.path)
+	}
+}
+
+func TestNormalizeModes(t *testing.T) {
+	tree := func(name string) *fs.Dir {
+		return fs.NewDir(t, name, fs.WithMode(0700),
+			fs.WithFile("config", "", fs.WithMode(0600)),
+			fs.WithFile("run.sh", "", fs.WithMode(0700)),
+			fs.WithFile("excluded", "", fs.WithMode(0600)),
+			fs.WithDir("lib", fs.WithMode(0750), fs.WithFile("lib.so", "", fs.WithMode(0664))),
+			fs.WithSymlink("link", "config"))
+	}
+	source := tree("normalize-src")
+	defer source.Remove()
+	dest := tree("normalize-dest")
+	defer dest.Remove()
+
+	excludes, err := fileutils.NewPatternMatcher([]string{"excluded"})
+	assert.NilError(t, err)
+	// nothing changes unless the modes are normalized
+	assert.NilError(t, normalizeModes(source.Path(), dest.Path(), copyFileOptions{}, true, excludes))
+	fi, err := os.Stat(filepath.Join(dest.Path(), "config"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0600), fi.Mode().Perm()))
+
+	assert.NilError(t, normalizeModes(source.Path(), dest.Path(), copyFileOptions{normalize: true}, true, excludes))
+	for p, mode := range map[string]os.FileMode{
+		// the existing destination directory is not changed
+		".":          0700,
+		"config":     0644,
+		"run.sh":     0755,
+		"excluded":   0600,
+		"lib":        0755,
+		"lib/lib.so": 0644,
+	} {
+		fi, err := os.Lstat(filepath.Join(dest.Path(), p))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(mode, fi.Mode().Perm()), p)
+	}
+	fi, err = os.Lstat(filepath.Join(dest.Path(), "link"))
+	assert.NilError(t, err)
+	assert.Check(t, fi.Mode()&os.ModeSymlink != 0)
+}
+
+func TestPreserveDirMode(t *testing.T) {
+	source := fs.NewDir(t, "dir-mode-src", fs.WithMode(0700|os.ModeSetgid))
+	defer source.Remove()
+	dest := fs.NewDir(t, "dir-mode-dest", fs.WithDir("created", fs.WithMode(0755)), fs.WithDir("existing", fs.WithMode(0755)))
+	defer dest.Remove()
+
+	created := filepath.Join(dest.Path(), "created")
+	// nothing changes unless the mode is preserved
+	assert.NilError(t, preserveDirMode(source.Path(), created, copyFileOptions{}, false))
+	fi, err := os.Stat(created)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0755), fi.Mode().Perm()))
+
+	assert.NilError(t, preserveDirMode(source.Path(), created, copyFileOptions{dirMode: true}, false))
+	fi, err = os.Stat(created)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0700), fi.Mode().Perm()))
+	assert.Check(t, fi.Mode()&os.ModeSetgid != 0)
+
+	// an existing destination directory is not changed
+	existing := filepath.Join(dest.Path(), "existing")
+	assert.NilError(t, preserveDirMode(source.Path(), existing, copyFileOptions{dirMode: true}, true))
+	fi, err = os.Stat(existing)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(os.FileMode(0755), fi.Mode().Perm()))
+}
+
+func TestCopyDirectoryOpaque(t *testing.T) {
+	src := fs.NewDir(t, "copy-opaque-src", fs.WithDir("dir", fs.WithFile("new", "")))
+	defer src.Remove()
+	dest := fs.NewDir(t, "copy-opaque-dest", fs.WithDir("dest", fs.WithFile("old", "")))
+	defer dest.Remove()
+
+	srcRoot := containerfs.NewLocalContainerFS(src.Path())
+	destRoot := containerfs.NewLocalContainerFS(dest.Path())
+	options := copyFileOptions{
+		archiver:   archive.NewDefaultArchiver(),
+		chownPair:  idtools.IDPair{UID: os.Getuid(), GID: os.Getgid()},
+		parentPair: idtools.IDPair{UID: os.Getuid(), GID: os.Getgid()},
+		opaque:     true,
+	}
+
+	// the existing destination directory is hidden when the layer is applied
+	err := performCopyForInfo(copyInfo{root: destRoot, path: "/dest/"}, copyInfo{root: srcRoot, path: "dir"}, options)
+	assert.NilError(t, err)
+	_, err = os.Lstat(filepath.Join(dest.Path(), "dest", archive.WhiteoutOpaqueDir))
+	assert.Check(t, err)
+	_, err = os.Lstat(filepath.Join(dest.Path(), "dest", "new"))
+	assert.Check(t, err)
+
+	// the root directory is never replaced
+	err = performCopyForInfo(copyInfo{root: destRoot, path: "/"}, copyInfo{root: srcRoot, path: "dir"}, options)
+	assert.NilError(t, err)
+	_, err = os.Lstat(filepath.Join(dest.Path(), archive.WhiteoutOpaqueDir))
+	assert.Check(t, os.IsNotExist(err))
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/idtools"
 )
 
@@ -13,7 +14,7 @@ var pathBlacklist = map[string]bool{
 	"c:\\windows": true,
 }
 
-func fixPermissions(source, destination string, rootIDs idtools.IDPair, overrideSkip bool) error {
+func fixPermissions(source, destination string, rootIDs idtools.IDPair, overrideSkip bool, excludes *fileutils.PatternMatcher) error {
 	// chown is not supported on Windows
 	return nil
 }
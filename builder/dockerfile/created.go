@@ -0,0 +1,53 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/pkg/errors"
+)
+
+// parseCreated parses the Created option, an RFC 3339 timestamp. The zero
+// time is returned if the option is not set.
+func parseCreated(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	created, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errdefs.InvalidParameter(errors.Errorf("invalid created timestamp %q: expected an RFC 3339 timestamp such as 2006-01-02T15:04:05Z", value))
+	}
+	return created.UTC(), nil
+}
+
+// setImageCreated replaces the final image with an image created at the
+// given time. The history entry of the last step gets the same time, as the
+// image and its last history entry are created together.
+func (b *Builder) setImageCreated(state *dispatchState, created time.Time) error {
+	im, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return err
+	}
+	img, ok := im.Image().(*image.Image)
+	if !ok {
+		return errors.Errorf("unexpected image type")
+	}
+
+	newImage := *img
+	newImage.Created = created
+	if len(img.History) > 0 {
+		newImage.History = append([]image.History{}, img.History...)
+		newImage.History[len(newImage.History)-1].Created = created
+	}
+	dt, err := newImage.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode image config")
+	}
+	exportedImage, err := b.docker.CreateImage(dt, img.Parent.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to set the created timestamp")
+	}
+	state.imageID = exportedImage.ImageID()
+	return nil
+}
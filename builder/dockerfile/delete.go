@@ -0,0 +1,70 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"os"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"github.com/pkg/errors"
+)
+
+// performDelete removes the absolute paths from a new layer of the image of
+// the stage, without starting a container
+func (b *Builder) performDelete(state *dispatchState, paths []string, strict bool) error {
+	comment := "DELETE "
+	if strict {
+		comment += "--strict "
+	}
+	comment += strings.Join(paths, " ")
+	runConfigWithCommentCmd := copyRunConfig(state.runConfig, withCmdComment(comment, state.operatingSystem))
+	hit, err := b.probeCache(state, runConfigWithCommentCmd)
+	if err != nil || hit {
+		return err
+	}
+
+	imageMount, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get destination image %q", state.imageID)
+	}
+	rwLayer, err := imageMount.NewRWLayer()
+	if err != nil {
+		return err
+	}
+	defer rwLayer.Release()
+
+	if err := deletePaths(rwLayer.Root(), paths, strict); err != nil {
+		return err
+	}
+	newLayer, err := rwLayer.Commit()
+	if err != nil {
+		return err
+	}
+	return b.exportImage(state, newLayer, imageMount.Image(), runConfigWithCommentCmd)
+}
+
+// deletePaths removes the paths from root. The symlinks of their parent
+// directories are resolved in root, while a path that is a symlink is removed
+// itself. With strict, a path that does not exist is an error.
+func deletePaths(root containerfs.ContainerFS, paths []string, strict bool) error {
+	for _, p := range paths {
+		parent, err := root.ResolveScopedPath(root.Dir(p), true)
+		if err != nil {
+			return err
+		}
+		target := root.Join(parent, root.Base(p))
+		if _, err := root.Lstat(target); err != nil {
+			if os.IsNotExist(err) {
+				if strict {
+					return errdefs.InvalidParameter(errors.Errorf("DELETE: %s does not exist", p))
+				}
+				continue
+			}
+			return err
+		}
+		if err := root.RemoveAll(target); err != nil {
+			return errors.Wrapf(err, "failed to delete %s", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// +build !windows
+
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+)
+
+func TestParseDelete(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\nDELETE /tmp/a b\nDELETE --strict [\"/c d\"]\n")
+	cmd := stages[0].Commands[0].(*instructions.DeleteCommand)
+	assert.Check(t, is.DeepEqual([]string{"/tmp/a", "b"}, cmd.Paths))
+	assert.Check(t, !cmd.Strict)
+	cmd = stages[0].Commands[1].(*instructions.DeleteCommand)
+	assert.Check(t, is.DeepEqual([]string{"/c d"}, cmd.Paths))
+	assert.Check(t, cmd.Strict)
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nDELETE\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "DELETE requires at least one argument"))
+}
+
+func TestDispatchDeleteRoot(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.imageID = "abcdef"
+	sb.state.runConfig.WorkingDir = "/app"
+	err := dispatch(sb, &instructions.DeleteCommand{Paths: []string{".."}})
+	assert.Check(t, is.Error(err, "DELETE cannot remove the root directory"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestDeletePaths(t *testing.T) {
+	dir := fs.NewDir(t, "delete-paths",
+		fs.WithFile("file", ""),
+		fs.WithDir("dir", fs.WithFile("a", "")),
+		fs.WithDir("target", fs.WithFile("b", ""), fs.WithFile("c", "")))
+	defer dir.Remove()
+	// the targets of the symlinks are absolute paths of the image
+	for _, link := range []string{"link", "dirlink"} {
+		assert.NilError(t, os.Symlink("/target", filepath.Join(dir.Path(), link)))
+	}
+	root := containerfs.NewLocalContainerFS(dir.Path())
+
+	// the parent directory symlink is followed, the symlink itself is removed
+	err := deletePaths(root, []string{"/file", "/dir", "/link", "/dirlink/b", "/missing"}, false)
+	assert.NilError(t, err)
+	for _, p := range []string{"file", "dir", "link", "target/b"} {
+		_, err := os.Lstat(filepath.Join(dir.Path(), p))
+		assert.Check(t, os.IsNotExist(err), p)
+	}
+	_, err = os.Lstat(filepath.Join(dir.Path(), "target", "c"))
+	assert.Check(t, err)
+
+	err = deletePaths(root, []string{"/target/c", "/missing"}, true)
+	assert.Check(t, is.Error(err, "DELETE: /missing does not exist"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
@@ -10,24 +10,36 @@ package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/continuity/driver"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
+	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/signal"
+	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/go-connections/nat"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/moby/buildkit/frontend/dockerfile/parser"
-	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	units "github.com/docker/go-units"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
@@ -36,44 +48,175 @@ import (
 //
 // Sets the environment variable foo to bar, also makes interpolation
 // in the dockerfile available from the next statement on via ${foo}.
+// Keys are compared case-insensitively on Windows, so a warning is printed
+// when a key replaces one that only differs in case.
+//
+// ENV --unset foo removes foo from the environment, including when it is
+// inherited from the base image.
+//
+// ENV --from-file foo=path sets foo to the content of the file at path in
+// the build context, without leading and trailing whitespace.
+//
+// ENV --inherit foo sets foo to its value in the environment of the base
+// image, making the use of an inherited variable explicit.
 //
 func dispatchEnv(d dispatchRequest, c *instructions.EnvCommand) error {
-	runConfig := d.state.runConfig
+	if len(c.Unset) > 0 {
+		return dispatchEnvUnset(d, c)
+	}
+	if len(c.Inherit) > 0 {
+		return dispatchEnvInherit(d, c)
+	}
+	env := c.Env
+	if c.FromFile {
+		var err error
+		if env, err = envFromFiles(d.source, c.Env); err != nil {
+			return err
+		}
+	}
 	commitMessage := bytes.NewBufferString("ENV")
-	for _, e := range c.Env {
-		name := e.Key
+	for _, e := range env {
 		newVar := e.String()
-
 		commitMessage.WriteString(" " + newVar)
-		gotOne := false
-		for i, envVar := range runConfig.Env {
-			envParts := strings.SplitN(envVar, "=", 2)
-			compareFrom := envParts[0]
-			if shell.EqualEnvKeys(compareFrom, name) {
-				runConfig.Env[i] = newVar
-				gotOne = true
-				break
+		setEnv(d, e.Key, newVar)
+	}
+	return d.builder.commit(d.state, commitMessage.String())
+}
+
+// setEnv sets the variable name of the environment of the stage to newVar, in
+// the form name=value, replacing the variable if it is already set
+func setEnv(d dispatchRequest, name, newVar string) {
+	runConfig := d.state.runConfig
+	for i, envVar := range runConfig.Env {
+		envParts := strings.SplitN(envVar, "=", 2)
+		compareFrom := envParts[0]
+		if shell.EqualEnvKeys(compareFrom, name) {
+			if compareFrom != name {
+				fmt.Fprintf(d.builder.warningOutput(), "[Warning] ENV keys %s and %s only differ in case and refer to the same variable, using %s\n", compareFrom, name, newVar)
 			}
+			runConfig.Env[i] = newVar
+			return
 		}
-		if !gotOne {
-			runConfig.Env = append(runConfig.Env, newVar)
+	}
+	runConfig.Env = append(runConfig.Env, newVar)
+}
+
+// dispatchEnvInherit sets variables to their value in the environment of the
+// base image, even if they were changed since the FROM instruction. Variables
+// that the base image does not set are ignored, unless --strict is used. As
+// the values come from the base image, which is part of the cache key of the
+// step, only the names are recorded in the history.
+func dispatchEnvInherit(d dispatchRequest, c *instructions.EnvCommand) error {
+	var baseEnv []string
+	if d.state.baseImage != nil && d.state.baseImage.RunConfig() != nil {
+		baseEnv = d.state.baseImage.RunConfig().Env
+	}
+	for _, name := range c.Inherit {
+		found := false
+		for _, envVar := range baseEnv {
+			kv := strings.SplitN(envVar, "=", 2)
+			if !shell.EqualEnvKeys(kv[0], name) {
+				continue
+			}
+			var value string
+			if len(kv) == 2 {
+				value = kv[1]
+			}
+			setEnv(d, name, name+"="+value)
+			found = true
+			break
+		}
+		if !found && c.Strict {
+			return errdefs.InvalidParameter(errors.Errorf("ENV --inherit: %s is not set in the base image", name))
 		}
 	}
-	return d.builder.commit(d.state, commitMessage.String())
+	return d.builder.commit(d.state, "ENV --inherit "+strings.Join(c.Inherit, " "))
+}
+
+// envFromFiles returns the variables of ENV --from-file, with the content of
+// the files they refer to as values. As the values are part of the image
+// config, changing the content of a file invalidates the build cache.
+func envFromFiles(source builder.Source, env instructions.KeyValuePairs) (instructions.KeyValuePairs, error) {
+	if source == nil {
+		return nil, errdefs.InvalidParameter(errors.New("ENV --from-file requires a build context"))
+	}
+	resolved := make(instructions.KeyValuePairs, 0, len(env))
+	for _, e := range env {
+		fi, err := remotecontext.StatAt(source, e.Value)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil, errdefs.InvalidParameter(errors.Errorf("ENV --from-file: %s: no such file in the build context", e.Value))
+			}
+			return nil, errors.Wrapf(err, "ENV --from-file: %s", e.Value)
+		}
+		if fi.IsDir() {
+			return nil, errdefs.InvalidParameter(errors.Errorf("ENV --from-file: %s is a directory", e.Value))
+		}
+		fullPath, err := remotecontext.FullPath(source, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		dt, err := driver.ReadFile(source.Root(), fullPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ENV --from-file: %s", e.Value)
+		}
+		resolved = append(resolved, instructions.KeyValuePair{Key: e.Key, Value: strings.TrimSpace(string(dt))})
+	}
+	return resolved, nil
+}
+
+// dispatchEnvUnset removes variables from the environment. Unlike setting a
+// variable to an empty value, the variable is not in the environment of the
+// image anymore. Variables that are not set are ignored, unless --strict is
+// used.
+func dispatchEnvUnset(d dispatchRequest, c *instructions.EnvCommand) error {
+	runConfig := d.state.runConfig
+	for _, name := range c.Unset {
+		var env []string
+		found := false
+		for _, envVar := range runConfig.Env {
+			if shell.EqualEnvKeys(strings.SplitN(envVar, "=", 2)[0], name) {
+				found = true
+				continue
+			}
+			env = append(env, envVar)
+		}
+		if !found && c.Strict {
+			return errdefs.InvalidParameter(errors.Errorf("ENV --unset: %s is not set", name))
+		}
+		runConfig.Env = env
+	}
+	return d.builder.commit(d.state, "ENV --unset "+strings.Join(c.Unset, " "))
 }
 
 // MAINTAINER some text <maybe@an.email.address>
 //
 // Sets the maintainer metadata.
 func dispatchMaintainer(d dispatchRequest, c *instructions.MaintainerCommand) error {
+	if err := checkDeprecated(d, "MAINTAINER", "LABEL maintainer="); err != nil {
+		return err
+	}
 
 	d.state.maintainer = c.Maintainer
 	return d.builder.commit(d.state, "MAINTAINER "+c.Maintainer)
 }
 
+// checkDeprecated reports the use of a deprecated instruction. It prints a
+// warning, or fails the build if ErrorOnDeprecated was requested.
+func checkDeprecated(d dispatchRequest, name, replacement string) error {
+	if d.builder.options.ErrorOnDeprecated {
+		return errdefs.InvalidParameter(errors.Errorf("%s instruction is deprecated, use %s instead", name, replacement))
+	}
+	fmt.Fprintf(d.builder.warningOutput(), "[Warning] %s instruction is deprecated, use %s instead\n", name, replacement)
+	return nil
+}
+
 // LABEL some json data describing the image
 //
-// Sets the Label variable foo to bar,
+// Sets the Label variable foo to bar. Like with ENV, the keys and values are
+// expanded with the environment and the build-args declared by ARG. The
+// labels of the --label option are set by LABEL instructions added to the
+// last stage, which take precedence and are not expanded.
 //
 func dispatchLabel(d dispatchRequest, c *instructions.LabelCommand) error {
 	if d.state.runConfig.Labels == nil {
@@ -91,10 +234,15 @@ func dispatchLabel(d dispatchRequest, c *instructions.LabelCommand) error {
 //
 // Add the file 'foo' to '/path'. Tarball and Remote URL (http, https) handling
 // exist here. If you do not wish to have this automatic handling, use COPY.
+// With --keep-newer the existing files that were modified after the files of
+// a tarball are kept instead of being replaced. With --into-named a tarball is
+// extracted into a directory of the destination named after the tarball
+// without its extension, such as /opt/release for release.tar.gz and /opt/.
 //
 func dispatchAdd(d dispatchRequest, c *instructions.AddCommand) error {
 	downloader := newRemoteSourceDownloader(d.builder.Output, d.builder.Stdout)
 	copier := copierFromDispatchRequest(d, downloader, nil)
+	copier.urlSchemes = true
 	defer copier.Cleanup()
 
 	copyInstruction, err := copier.createCopyInstruction(c.SourcesAndDest, "ADD")
@@ -102,16 +250,43 @@ func dispatchAdd(d dispatchRequest, c *instructions.AddCommand) error {
 		return err
 	}
 	copyInstruction.chownStr = c.Chown
+	copyInstruction.chmodStr = c.Chmod
 	copyInstruction.allowLocalDecompression = true
+	copyInstruction.keepNewer = c.KeepNewer
+	copyInstruction.intoNamed = c.IntoNamed
+	copyInstruction.original = c.String()
 
 	return d.builder.performCopy(d, copyInstruction)
 }
 
 // COPY foo /path
 //
-// Same as 'ADD' but without the tar and remote url handling.
+// Same as 'ADD' but without the tar and remote url handling. With --link the
+// files are copied into a new layer that does not depend on the parent image,
+// and a source directory replaces the contents of an existing destination
+// directory instead of being merged with them. With --preserve-symlinks a
+// source that is a symlink is copied as a symlink instead of copying the file
+// it points to. Paths matching an --exclude
+// pattern, using the .dockerignore syntax relative to a source directory or
+// against the name of a source file, are not copied. Missing parent
+// directories of the destination are owned by the current user, and get the
+// mode given with --chmod. Symlinks in the destination are followed within the
+// image, also with --link, and a missing symlink target is created. With
+// --newer-than only the source files modified after the given file of the
+// build context are copied, and nothing is copied if none of them is. With
+// --preserve-dir-mode a destination directory created by the copy of a source
+// directory gets the mode of the source directory instead of 0755, while an
+// existing destination directory is left as it is. With --chown-from the
+// copied files are owned by the owner of the given path of the image, which
+// must exist.
 //
 func dispatchCopy(d dispatchRequest, c *instructions.CopyCommand) error {
+	if c.PreserveDirMode && d.state.operatingSystem == "windows" {
+		return errdefs.NotImplemented(errors.New("COPY --preserve-dir-mode is not supported for Windows images"))
+	}
+	if c.ChownFrom != "" && d.state.operatingSystem == "windows" {
+		return errdefs.NotImplemented(errors.New("COPY --chown-from is not supported for Windows images"))
+	}
 	var im *imageMount
 	var err error
 	if c.From != "" {
@@ -122,15 +297,94 @@ func dispatchCopy(d dispatchRequest, c *instructions.CopyCommand) error {
 	}
 	copier := copierFromDispatchRequest(d, errOnSourceDownload, im)
 	defer copier.Cleanup()
-	copyInstruction, err := copier.createCopyInstruction(c.SourcesAndDest, "COPY")
+	if len(c.Excludes) > 0 {
+		copier.excludes, err = fileutils.NewPatternMatcher(c.Excludes)
+		if err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid exclude pattern"))
+		}
+	}
+	if c.NewerThan != "" {
+		if copier.newerThan, err = newerThanTime(d.source, c.NewerThan); err != nil {
+			return err
+		}
+	}
+	sourcesAndDest := c.SourcesAndDest
+	if c.Rename {
+		if sourcesAndDest, err = renameSourcesAndDest(c.SourcesAndDest); err != nil {
+			return err
+		}
+	}
+	copyInstruction, err := copier.createCopyInstruction(sourcesAndDest, "COPY")
 	if err != nil {
 		return err
 	}
+	if c.Rename {
+		if err := checkRenameSource(copyInstruction.infos); err != nil {
+			return err
+		}
+	}
 	copyInstruction.chownStr = c.Chown
+	copyInstruction.chmodStr = c.Chmod
+	copyInstruction.link = c.Link
+	copyInstruction.preserveSymlinks = c.PreserveSymlinks
+	copyInstruction.excludes = c.Excludes
+	copyInstruction.newerThan = c.NewerThan
+	copyInstruction.preserveDirMode = c.PreserveDirMode
+	if c.ChownFrom != "" {
+		if copyInstruction.chownFrom, err = normalizeDest(d.state.runConfig.WorkingDir, c.ChownFrom, d.state.operatingSystem); err != nil {
+			return err
+		}
+	}
+	copyInstruction.original = c.String()
 
 	return d.builder.performCopy(d, copyInstruction)
 }
 
+// DELETE /path ...
+//
+// Remove files and directories from the image. Unlike RUN rm, no container is
+// started: the paths are removed from a new layer of the image, which records
+// them as deleted. Relative paths are relative to the working directory, and
+// the paths that do not exist are ignored, unless --strict is set.
+//
+func dispatchDelete(d dispatchRequest, c *instructions.DeleteCommand) error {
+	if d.state.operatingSystem == "windows" {
+		return errdefs.NotImplemented(errors.New("DELETE is not supported for Windows images"))
+	}
+	if !d.state.hasFromImage() {
+		return errors.New("Please provide a source image with `from` prior to delete")
+	}
+	paths := make([]string, 0, len(c.Paths))
+	for _, p := range c.Paths {
+		dest, err := normalizeDest(d.state.runConfig.WorkingDir, p, d.state.operatingSystem)
+		if err != nil {
+			return err
+		}
+		dest = path.Clean(dest)
+		if dest == "/" {
+			return errdefs.InvalidParameter(errors.New("DELETE cannot remove the root directory"))
+		}
+		paths = append(paths, dest)
+	}
+	return d.builder.performDelete(d.state, paths, c.Strict)
+}
+
+// newerThanTime returns the modification time of the file of COPY
+// --newer-than, which is always looked up in the build context.
+func newerThanTime(source builder.Source, p string) (time.Time, error) {
+	if source == nil {
+		return time.Time{}, errdefs.InvalidParameter(errors.New("COPY --newer-than requires a build context"))
+	}
+	fi, err := remotecontext.StatAt(source, p)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return time.Time{}, errdefs.InvalidParameter(errors.Errorf("COPY --newer-than: %s: no such file in the build context", p))
+		}
+		return time.Time{}, errors.Wrapf(err, "COPY --newer-than: %s", p)
+	}
+	return fi.ModTime(), nil
+}
+
 func (d *dispatchRequest) getImageMount(imageRefOrID string) (*imageMount, error) {
 	if imageRefOrID == "" {
 		// TODO: this could return the source in the default case as well?
@@ -171,7 +425,7 @@ func initializeStage(d dispatchRequest, cmd *instructions.Stage) error {
 		platform = &p
 	}
 
-	image, err := d.getFromImage(d.shlex, cmd.BaseName, platform)
+	image, name, err := d.getFromImage(d.shlex, cmd.BaseName, platform)
 	if err != nil {
 		return err
 	}
@@ -179,15 +433,48 @@ func initializeStage(d dispatchRequest, cmd *instructions.Stage) error {
 	if err := state.beginStage(cmd.Name, image); err != nil {
 		return err
 	}
+	state.baseName = name
+	state.rootImage = d.stages.getRootImage(image)
+	// the stage inherits the files of the stage it is built from
+	state.sbomFiles = append([]types.BuildSBOMFile(nil), d.stages.sbomFiles[image.ImageID()]...)
+	if d.builder.options.BaseArgs && image.ImageID() != "" {
+		declareBaseImageArgs(d, image)
+	}
+	if prefix := d.builder.options.ArgToEnvPrefix; prefix != "" {
+		if err := dispatchPrefixedArgsEnv(d, prefix); err != nil {
+			return err
+		}
+	}
+	groups := popOnbuildGroups(state.runConfig)
 	if len(state.runConfig.OnBuild) > 0 {
 		triggers := state.runConfig.OnBuild
 		state.runConfig.OnBuild = nil
-		return dispatchTriggeredOnBuild(d, triggers)
+		return dispatchTriggeredOnBuild(d, triggers, groups)
 	}
 	return nil
 }
 
-func dispatchTriggeredOnBuild(d dispatchRequest, triggers []string) error {
+// dispatchPrefixedArgsEnv sets the build-args whose name starts with prefix
+// as ENV variables of the stage, like an ENV instruction following FROM, so
+// that they are persisted in the image without an ARG and an ENV instruction
+// for each of them. Later ENV instructions override them.
+func dispatchPrefixedArgsEnv(d dispatchRequest, prefix string) error {
+	keys := d.state.buildArgs.ReferencePrefixedArgs(prefix)
+	if len(keys) == 0 {
+		return nil
+	}
+	env := make(instructions.KeyValuePairs, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, instructions.KeyValuePair{Key: key, Value: *d.builder.options.BuildArgs[key]})
+	}
+	return dispatchEnv(d, &instructions.EnvCommand{Env: env})
+}
+
+func dispatchTriggeredOnBuild(d dispatchRequest, triggers []string, groups map[int]string) error {
+	triggers = filterSkippedTriggers(d.builder.Stdout, triggers, groups, d.builder.options.SkipOnBuild)
+	if len(triggers) == 0 {
+		return nil
+	}
 	fmt.Fprintf(d.builder.Stdout, "# Executing %d build trigger", len(triggers))
 	if len(triggers) > 1 {
 		fmt.Fprint(d.builder.Stdout, "s")
@@ -217,6 +504,53 @@ func dispatchTriggeredOnBuild(d dispatchRequest, triggers []string) error {
 	return nil
 }
 
+// filterSkippedTriggers removes the triggers whose group, keyed by the index
+// of the trigger, is one of the skipped groups. Triggers without a group
+// always run.
+func filterSkippedTriggers(out io.Writer, triggers []string, groups map[int]string, skip []string) []string {
+	var result []string
+	for i, trigger := range triggers {
+		if group := groups[i]; group != "" && containsString(skip, group) {
+			fmt.Fprintf(out, "# Skipping build trigger of group %s\n", group)
+			continue
+		}
+		result = append(result, trigger)
+	}
+	return result
+}
+
+// onbuildGroupLabelPrefix is followed by the index of an ONBUILD trigger to
+// form the label holding the group of the trigger. The group is kept out of
+// the trigger so that OnBuild only holds Dockerfile instructions, which other
+// builders can run.
+const onbuildGroupLabelPrefix = "com.docker.build.onbuild-group."
+
+// popOnbuildGroups returns the groups of the ONBUILD triggers of runConfig,
+// keyed by the index of the trigger, and removes their labels, as the
+// triggers are not inherited by the image being built.
+func popOnbuildGroups(runConfig *container.Config) map[int]string {
+	groups := make(map[int]string)
+	for key, group := range runConfig.Labels {
+		if !strings.HasPrefix(key, onbuildGroupLabelPrefix) {
+			continue
+		}
+		delete(runConfig.Labels, key)
+		if i, err := strconv.Atoi(strings.TrimPrefix(key, onbuildGroupLabelPrefix)); err == nil {
+			groups[i] = group
+		}
+	}
+	return groups
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *dispatchRequest) getExpandedString(shlex *shell.Lex, str string) (string, error) {
 	substitutionArgs := []string{}
 	for key, value := range d.state.buildArgs.GetAllMeta() {
@@ -274,23 +608,65 @@ func (d *dispatchRequest) getImageOrStage(name string, platform *specs.Platform)
 	}
 	return imageMount.Image(), nil
 }
-func (d *dispatchRequest) getFromImage(shlex *shell.Lex, basename string, platform *specs.Platform) (builder.Image, error) {
+// getFromImage returns the base image of a stage, and its name with the
+// variables expanded
+func (d *dispatchRequest) getFromImage(shlex *shell.Lex, basename string, platform *specs.Platform) (builder.Image, string, error) {
 	name, err := d.getExpandedString(shlex, basename)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	// Empty string is interpreted to FROM scratch by images.GetImageAndReleasableLayer,
 	// so validate expanded result is not empty.
 	if name == "" {
-		return nil, errors.Errorf("base name (%s) should not be blank", basename)
+		return nil, "", errors.Errorf("base name (%s) should not be blank", basename)
+	}
+	if name != basename {
+		// the reference was built from build args, so report what it
+		// expanded to if it is not valid
+		if _, err := reference.ParseAnyReference(name); err != nil {
+			return nil, "", errdefs.InvalidParameter(errors.Errorf("invalid reference format for base name %s (expanded from %s)", name, basename))
+		}
 	}
 
-	return d.getImageOrStage(name, platform)
+	if _, ok := d.stages.getByName(name); !ok && !d.builder.options.AllowMutableTags && isMutableReference(name) {
+		fmt.Fprintf(d.builder.warningOutput(), "[Warning] FROM %s uses mutable tag; consider pinning by digest\n", name)
+	}
+
+	image, err := d.getImageOrStage(name, platform)
+	return image, name, err
+}
+
+// isMutableReference returns whether the image reference name is a tag, or
+// a name without a tag, which means latest, instead of a digest. Image IDs and
+// scratch are not mutable.
+func isMutableReference(name string) bool {
+	if name == api.NoBaseImageSpecifier {
+		return false
+	}
+	ref, err := reference.ParseAnyReference(name)
+	if err != nil {
+		return false
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return false
+	}
+	_, pinned := named.(reference.Canonical)
+	return !pinned
 }
 
 func dispatchOnbuild(d dispatchRequest, c *instructions.OnbuildCommand) error {
-	d.state.runConfig.OnBuild = append(d.state.runConfig.OnBuild, c.Expression)
-	return d.builder.commit(d.state, "ONBUILD "+c.Expression)
+	runConfig := d.state.runConfig
+	commitStr := "ONBUILD " + c.Expression
+	if c.Group != "" {
+		if runConfig.Labels == nil {
+			runConfig.Labels = make(map[string]string)
+		}
+		runConfig.Labels[onbuildGroupLabelPrefix+strconv.Itoa(len(runConfig.OnBuild))] = c.Group
+		commitStr = fmt.Sprintf("ONBUILD [group=%s] %s", c.Group, c.Expression)
+	}
+	runConfig.OnBuild = append(runConfig.OnBuild, c.Expression)
+	return d.builder.commit(d.state, commitStr)
 }
 
 // WORKDIR /tmp
@@ -299,6 +675,9 @@ func dispatchOnbuild(d dispatchRequest, c *instructions.OnbuildCommand) error {
 //
 func dispatchWorkdir(d dispatchRequest, c *instructions.WorkdirCommand) error {
 	runConfig := d.state.runConfig
+	if err := checkWorkdirTraversal(d.state.operatingSystem, runConfig.WorkingDir, c.Path); err != nil {
+		return err
+	}
 	var err error
 	runConfig.WorkingDir, err = normalizeWorkdir(d.state.operatingSystem, runConfig.WorkingDir, c.Path)
 	if err != nil {
@@ -330,6 +709,41 @@ func dispatchWorkdir(d dispatchRequest, c *instructions.WorkdirCommand) error {
 	return d.builder.commitContainer(d.state, containerID, runConfigWithCommentCmd)
 }
 
+// checkWorkdirTraversal returns an error if the requested working directory
+// uses ".." to escape the root directory, which normalization would
+// otherwise silently clamp to the root.
+func checkWorkdirTraversal(platform string, current string, requested string) error {
+	isWindows := platform == "windows" || (platform == "" && runtime.GOOS == "windows")
+	isSeparator := func(r rune) bool {
+		return r == '/' || (r == '\\' && (isWindows || runtime.GOOS == "windows"))
+	}
+	stripVolume := func(p string) string {
+		if isWindows && len(p) >= 2 && p[1] == ':' {
+			return p[2:]
+		}
+		return p
+	}
+
+	p := stripVolume(requested)
+	if p == "" || !isSeparator(rune(p[0])) {
+		p = stripVolume(current) + "/" + p
+	}
+	depth := 0
+	for _, elem := range strings.FieldsFunc(p, isSeparator) {
+		switch elem {
+		case ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return errdefs.InvalidParameter(errors.Errorf("WORKDIR %s escapes the root directory", requested))
+			}
+		default:
+			depth++
+		}
+	}
+	return nil
+}
+
 func resolveCmdLine(cmd instructions.ShellDependantCmdLine, runConfig *container.Config, os string) []string {
 	result := cmd.CmdLine
 	if cmd.PrependShell && result != nil {
@@ -348,11 +762,51 @@ func resolveCmdLine(cmd instructions.ShellDependantCmdLine, runConfig *container
 // RUN echo hi          # cmd /S /C echo hi   (Windows)
 // RUN [ "echo", "hi" ] # echo hi
 //
+// Variables in the exec form are only expanded when --expand is set, in which
+// case a literal dollar sign can be kept by escaping it.
+//
+// RUN --network=none runs the command without network access, whatever the
+// network mode of the build.
+//
+// RUN --cache-key-from=path makes the content of a file of the build context
+// part of the cache key of the command, so that the command runs again when
+// the file changes.
+//
+// RUN --if=condition skips the command if the condition expands to an empty
+// string or a false boolean. The expanded condition is part of the cache key.
+//
+// With the DebugOnFailure option the container of a command that fails is
+// kept, and its ID is printed with how to start a shell in its filesystem.
+//
 func dispatchRun(d dispatchRequest, c *instructions.RunCommand) error {
 	if !system.IsOSSupported(d.state.operatingSystem) {
 		return system.ErrNotSupportedOperatingSystem
 	}
+	var condition string
+	if c.If != "" {
+		value, run, err := runCondition(d, c.If)
+		if err != nil {
+			return err
+		}
+		if !run {
+			fmt.Fprintf(d.builder.Stdout, " ---> Skipping, the condition %s is false\n", c.If)
+			return nil
+		}
+		condition = value
+	}
+	networkMode, err := runNetworkMode(c.Network)
+	if err != nil {
+		return err
+	}
 	stateRunConfig := d.state.runConfig
+	user, err := runUser(d, c.User)
+	if err != nil {
+		return err
+	}
+	cacheKey, err := runCacheKey(d.source, c.CacheKeyFrom)
+	if err != nil {
+		return err
+	}
 	cmdFromArgs := resolveCmdLine(c.ShellDependantCmdLine, stateRunConfig, d.state.operatingSystem)
 	buildArgs := d.state.buildArgs.FilterAllowed(stateRunConfig.Env)
 
@@ -363,13 +817,21 @@ func dispatchRun(d dispatchRequest, c *instructions.RunCommand) error {
 
 	runConfigForCacheProbe := copyRunConfig(stateRunConfig,
 		withCmd(saveCmd),
-		withEntrypointOverride(saveCmd, nil))
-	if hit, err := d.builder.probeCache(d.state, runConfigForCacheProbe); err != nil || hit {
-		return err
+		withUser(user),
+		withEntrypointOverride(saveCmd, nil),
+		withCacheKeyFrom(cacheKey),
+		withRunCondition(condition))
+	// RUN --no-cache always executes the command. The resulting image is new,
+	// so the following steps will not match the cache either.
+	if !c.NoCache {
+		if hit, err := d.builder.probeCache(d.state, runConfigForCacheProbe); err != nil || hit {
+			return err
+		}
 	}
 
 	runConfig := copyRunConfig(stateRunConfig,
 		withCmd(cmdFromArgs),
+		withUser(user),
 		withEnv(append(stateRunConfig.Env, buildArgs...)),
 		withEntrypointOverride(saveCmd, strslice.StrSlice{""}),
 		withoutHealthcheck())
@@ -377,12 +839,15 @@ func dispatchRun(d dispatchRequest, c *instructions.RunCommand) error {
 	// set config as already being escaped, this prevents double escaping on windows
 	runConfig.ArgsEscaped = true
 
-	cID, err := d.builder.create(runConfig)
+	cID, err := d.builder.create(runConfig, networkMode)
 	if err != nil {
 		return err
 	}
 
-	if err := d.builder.containerManager.Run(d.builder.clientCtx, cID, d.builder.Stdout, d.builder.Stderr); err != nil {
+	if err := runWithRetries(d, cID, c.Retries, c.RetryDelay); err != nil {
+		if d.builder.options.DebugOnFailure {
+			printDebugContainer(d.builder.Stdout, cID)
+		}
 		if err, ok := err.(*statusCodeError); ok {
 			// TODO: change error type, because jsonmessage.JSONError assumes HTTP
 			msg := fmt.Sprintf(
@@ -391,6 +856,10 @@ func dispatchRun(d dispatchRequest, c *instructions.RunCommand) error {
 			if err.Error() != "" {
 				msg = fmt.Sprintf("%s: %s", msg, err.Error())
 			}
+			if err.StatusCode() == 137 && d.builder.options.Memory > 0 {
+				// the OOM killer sends SIGKILL
+				msg = fmt.Sprintf("%s (killed, possibly out of memory: the memory limit of the build is %s)", msg, units.BytesSize(float64(d.builder.options.Memory)))
+			}
 			return &jsonmessage.JSONError{
 				Message: msg,
 				Code:    err.StatusCode(),
@@ -398,10 +867,129 @@ func dispatchRun(d dispatchRequest, c *instructions.RunCommand) error {
 		}
 		return err
 	}
+	if err := d.builder.checkRunLayerFiles(cID, c.String()); err != nil {
+		return err
+	}
 
 	return d.builder.commitContainer(d.state, cID, runConfigForCacheProbe)
 }
 
+// printDebugContainer prints the ID of the container of a failed RUN step,
+// which is kept as ForceRemove cannot be set with DebugOnFailure, and how to
+// start a shell in its filesystem. The container has exited, so it is
+// committed to an image first.
+func printDebugContainer(out io.Writer, containerID string) {
+	image := "debug-" + stringid.TruncateID(containerID)
+	fmt.Fprintf(out, " ---> Keeping the container %s of the failed step for debugging\n", containerID)
+	fmt.Fprintf(out, " ---> Start a shell in it with: docker commit %s %s && docker run -it --rm --entrypoint sh %s\n", containerID, image, image)
+}
+
+// runCondition expands the variables of the condition of RUN --if and
+// returns the expanded condition, and whether the command must run, which is
+// unless the condition is empty or a false boolean such as 0 or false.
+func runCondition(d dispatchRequest, condition string) (string, bool, error) {
+	runConfigEnv := d.state.runConfig.Env
+	envs := append(runConfigEnv, d.state.buildArgs.FilterAllowed(runConfigEnv)...)
+	value, err := d.shlex.ProcessWord(condition, envs)
+	if err != nil {
+		return "", false, errdefs.InvalidParameter(errors.Wrap(err, "invalid RUN --if condition"))
+	}
+	if value == "" {
+		return value, false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	return value, err != nil || b, nil
+}
+
+// runUser returns the user to run a RUN --user command as, with its variables
+// expanded, or the user of the image if there is no override. The user is
+// resolved against the /etc/passwd of the image when the container starts,
+// like the user set by USER. As the container config of the command, which
+// is part of its cache key, holds the user, changing it does not match the
+// cache.
+func runUser(d dispatchRequest, user string) (string, error) {
+	if user == "" {
+		return d.state.runConfig.User, nil
+	}
+	runConfigEnv := d.state.runConfig.Env
+	envs := append(runConfigEnv, d.state.buildArgs.FilterAllowed(runConfigEnv)...)
+	value, err := d.shlex.ProcessWord(user, envs)
+	if err != nil {
+		return "", errdefs.InvalidParameter(errors.Wrap(err, "invalid RUN --user"))
+	}
+	if value == "" {
+		return "", errdefs.InvalidParameter(errors.Errorf("RUN --user=%s expands to an empty user", user))
+	}
+	return value, nil
+}
+
+// runCacheKey returns the digests of the content of the files of RUN
+// --cache-key-from, as space separated path=digest pairs, or an empty string
+// if there are none.
+func runCacheKey(source builder.Source, paths []string) (string, error) {
+	if len(paths) == 0 {
+		return "", nil
+	}
+	if source == nil {
+		return "", errdefs.InvalidParameter(errors.New("RUN --cache-key-from requires a build context"))
+	}
+	keys := make([]string, 0, len(paths))
+	for _, p := range paths {
+		fi, err := remotecontext.StatAt(source, p)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return "", errdefs.InvalidParameter(errors.Errorf("RUN --cache-key-from: %s: no such file in the build context", p))
+			}
+			return "", errors.Wrapf(err, "RUN --cache-key-from: %s", p)
+		}
+		if fi.IsDir() {
+			return "", errdefs.InvalidParameter(errors.Errorf("RUN --cache-key-from: %s is a directory", p))
+		}
+		fullPath, err := remotecontext.FullPath(source, p)
+		if err != nil {
+			return "", err
+		}
+		dgst, err := fileDigest(source.Root(), fullPath)
+		if err != nil {
+			return "", errors.Wrapf(err, "RUN --cache-key-from: %s", p)
+		}
+		keys = append(keys, p+"="+dgst.String())
+	}
+	return strings.Join(keys, " "), nil
+}
+
+// runNetworkMode returns the network mode to run a RUN --network command with,
+// or an empty string to use the network mode of the build. A command can only
+// be isolated from the network: like for the whole build, giving it access to
+// the network of the host is up to the user starting the build.
+func runNetworkMode(network string) (string, error) {
+	switch network {
+	case "", "default":
+		return "", nil
+	case "none":
+		return network, nil
+	}
+	return "", errdefs.InvalidParameter(errors.Errorf("invalid RUN --network=%s: only default and none are supported", network))
+}
+
+// runWithRetries runs the container, and starts it again each time it exits
+// with a non-zero code until retries is exhausted. The filesystem of the
+// container is kept between attempts.
+func runWithRetries(d dispatchRequest, cID string, retries int, delay time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		err := d.builder.containerManager.Run(d.builder.clientCtx, cID, d.builder.Stdout, d.builder.Stderr)
+		if _, ok := err.(*statusCodeError); !ok || attempt > retries {
+			return err
+		}
+		fmt.Fprintf(d.builder.Stdout, " ---> Command failed, retrying in %s (%d/%d)\n", delay, attempt, retries)
+		select {
+		case <-time.After(delay):
+		case <-d.builder.clientCtx.Done():
+			return errCancelled
+		}
+	}
+}
+
 // Derive the command to use for probeCache() and to commit in this container.
 // Note that we only do this if there are any build-time env vars.  Also, we
 // use the special argument "|#" at the start of the args array. This will
@@ -433,6 +1021,9 @@ func prependEnvOnCmd(buildArgs *BuildArgs, buildArgVars []string, cmd strslice.S
 // Argument handling is the same as RUN.
 //
 func dispatchCmd(d dispatchRequest, c *instructions.CmdCommand) error {
+	if err := checkEmptyExecutable("CMD", c.ShellDependantCmdLine); err != nil {
+		return err
+	}
 	runConfig := d.state.runConfig
 	cmd := resolveCmdLine(c.ShellDependantCmdLine, runConfig, d.state.operatingSystem)
 	runConfig.Cmd = cmd
@@ -450,6 +1041,19 @@ func dispatchCmd(d dispatchRequest, c *instructions.CmdCommand) error {
 	return nil
 }
 
+// checkEmptyExecutable returns an error if the JSON form of a command has an
+// empty string as its executable, which would otherwise only fail when a
+// container is started from the image.
+func checkEmptyExecutable(name string, cmd instructions.ShellDependantCmdLine) error {
+	if cmd.PrependShell || len(cmd.CmdLine) == 0 {
+		return nil
+	}
+	if cmd.CmdLine[0] == "" {
+		return errdefs.InvalidParameter(errors.Errorf("%s executable can not be an empty string", name))
+	}
+	return nil
+}
+
 // HEALTHCHECK foo
 //
 // Set the default healthcheck command to run in the container (which may be empty).
@@ -476,6 +1080,9 @@ func dispatchHealthcheck(d dispatchRequest, c *instructions.HealthCheckCommand)
 // is initialized at newBuilder time instead of through argument parsing.
 //
 func dispatchEntrypoint(d dispatchRequest, c *instructions.EntrypointCommand) error {
+	if err := checkEmptyExecutable("ENTRYPOINT", c.ShellDependantCmdLine); err != nil {
+		return err
+	}
 	runConfig := d.state.runConfig
 	cmd := resolveCmdLine(c.ShellDependantCmdLine, runConfig, d.state.operatingSystem)
 	runConfig.Entrypoint = cmd
@@ -489,7 +1096,8 @@ func dispatchEntrypoint(d dispatchRequest, c *instructions.EntrypointCommand) er
 // EXPOSE 6667/tcp 7000/tcp
 //
 // Expose ports for links and port mappings. This all ends up in
-// req.runConfig.ExposedPorts for runconfig.
+// req.runConfig.ExposedPorts for runconfig. Ports must be between 1 and 65535,
+// and the protocol tcp, udp or sctp.
 //
 func dispatchExpose(d dispatchRequest, c *instructions.ExposeCommand, envs []string) error {
 	// custom multi word expansion
@@ -505,6 +1113,11 @@ func dispatchExpose(d dispatchRequest, c *instructions.ExposeCommand, envs []str
 	}
 	c.Ports = ports
 
+	for _, p := range ports {
+		if err := validateExposedPort(p); err != nil {
+			return err
+		}
+	}
 	ps, _, err := nat.ParsePortSpecs(ports)
 	if err != nil {
 		return err
@@ -520,12 +1133,48 @@ func dispatchExpose(d dispatchRequest, c *instructions.ExposeCommand, envs []str
 	return d.builder.commit(d.state, "EXPOSE "+strings.Join(c.Ports, " "))
 }
 
+// validateExposedPort checks the container port, or range of ports, and the
+// protocol of a port of EXPOSE, after expansion. Errors are reported before
+// nat.ParsePortSpecs, which does not reject port 0 and whose errors do not
+// tell which part of the port is invalid.
+func validateExposedPort(rawPort string) error {
+	// the container port is the last part of [ip:]hostPort:containerPort
+	proto, port := nat.SplitProtoPort(rawPort[strings.LastIndex(rawPort, ":")+1:])
+	if port == "" {
+		return errdefs.InvalidParameter(errors.Errorf("EXPOSE %s: no port specified", rawPort))
+	}
+	for _, n := range strings.SplitN(port, "-", 2) {
+		v, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return errdefs.InvalidParameter(errors.Errorf("EXPOSE %s: invalid port %q", rawPort, n))
+		}
+		if v < 1 || v > 65535 {
+			return errdefs.InvalidParameter(errors.Errorf("EXPOSE %s: port %d is out of the valid range 1-65535", rawPort, v))
+		}
+	}
+	switch strings.ToLower(proto) {
+	case "tcp", "udp", "sctp":
+		return nil
+	}
+	return errdefs.InvalidParameter(errors.Errorf("EXPOSE %s: invalid protocol %q, expected tcp, udp or sctp", rawPort, proto))
+}
+
 // USER foo
 //
 // Set the user to 'foo' for future commands and when running the
-// ENTRYPOINT/CMD at container run time.
+// ENTRYPOINT/CMD at container run time. With --strict the names of the user
+// and of the group of the user:group form must be found in the /etc/passwd
+// and /etc/group files of the image, while numeric ids are always accepted.
 //
 func dispatchUser(d dispatchRequest, c *instructions.UserCommand) error {
+	if c.Strict {
+		if d.state.operatingSystem == "windows" {
+			return errdefs.NotImplemented(errors.New("USER --strict is not supported for Windows images"))
+		}
+		if err := d.builder.checkUserResolves(d.state, c.User); err != nil {
+			return err
+		}
+	}
 	d.state.runConfig.User = c.User
 	return d.builder.commit(d.state, fmt.Sprintf("USER %v", c.User))
 }
@@ -565,6 +1214,8 @@ func dispatchStopSignal(d dispatchRequest, c *instructions.StopSignalCommand) er
 // Adds the variable foo to the trusted list of variables that can be passed
 // to builder using the --build-arg flag for expansion/substitution or passing to 'run'.
 // Dockerfile author may optionally set a default value of this variable.
+// ARG --required name declares a variable without a default value that must
+// be passed with --build-arg, which is checked before the build starts.
 func dispatchArg(d dispatchRequest, c *instructions.ArgCommand) error {
 
 	commitStr := "ARG " + c.Key
@@ -578,8 +1229,14 @@ func dispatchArg(d dispatchRequest, c *instructions.ArgCommand) error {
 
 // SHELL powershell -command
 //
-// Set the non-default shell to use.
+// Set the non-default shell to use. SHELL --os=<os> is ignored unless the
+// stage is built for that operating system, so that a Dockerfile can set
+// the shell of each platform it supports.
 func dispatchShell(d dispatchRequest, c *instructions.ShellCommand) error {
+	if c.OS != "" && c.OS != d.state.operatingSystem {
+		fmt.Fprintf(d.builder.Stdout, " ---> Skipping, the shell is for %s\n", c.OS)
+		return nil
+	}
 	d.state.runConfig.Shell = c.Shell
 	return d.builder.commit(d.state, fmt.Sprintf("SHELL %v", d.state.runConfig.Shell))
 }
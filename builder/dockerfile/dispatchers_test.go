@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/docker/docker/api/types"
@@ -11,13 +12,21 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/image/cache"
+	"github.com/docker/docker/pkg/containerfs"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/go-connections/nat"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	digest "github.com/opencontainers/go-digest"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+	"gotest.tools/skip"
 )
 
 func newBuilderWithMockBackend() *Builder {
@@ -77,6 +86,127 @@ func TestEnvValueWithExistingRunConfigEnv(t *testing.T) {
 	assert.Check(t, is.DeepEqual(expected, sb.state.runConfig.Env))
 }
 
+func TestEnvCaseCollision(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	envCommand := &instructions.EnvCommand{
+		Env: instructions.KeyValuePairs{
+			instructions.KeyValuePair{Key: "FOO", Value: "bar"},
+			instructions.KeyValuePair{Key: "foo", Value: "baz"},
+		},
+	}
+	err := dispatch(sb, envCommand)
+	assert.NilError(t, err)
+
+	out := b.Stdout.(*bytes.Buffer).String()
+	if runtime.GOOS == "windows" {
+		assert.Check(t, is.DeepEqual([]string{"foo=baz"}, sb.state.runConfig.Env))
+		assert.Check(t, is.Contains(out, "[Warning] ENV keys FOO and foo only differ in case and refer to the same variable, using foo=baz"))
+	} else {
+		assert.Check(t, is.DeepEqual([]string{"FOO=bar", "foo=baz"}, sb.state.runConfig.Env))
+		assert.Check(t, !strings.Contains(out, "[Warning]"))
+	}
+}
+
+func TestEnvUnset(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\nENV --unset FOO BAZ\n")
+	envCommand := stages[0].Commands[0].(*instructions.EnvCommand)
+	assert.Check(t, is.DeepEqual([]string{"FOO", "BAZ"}, envCommand.Unset))
+	assert.Check(t, !envCommand.Strict)
+
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.runConfig.Env = []string{"FOO=bar", "PATH=/bin", "FOOBAR=1", "EMPTY="}
+	assert.NilError(t, dispatch(sb, envCommand))
+	assert.Check(t, is.DeepEqual([]string{"PATH=/bin", "FOOBAR=1", "EMPTY="}, sb.state.runConfig.Env))
+
+	stages, _, _ = parseStages(t, "FROM busybox\nENV --unset --strict EMPTY FOO\n")
+	envCommand = stages[0].Commands[0].(*instructions.EnvCommand)
+	assert.Check(t, envCommand.Strict)
+	err := dispatch(sb, envCommand)
+	assert.Check(t, is.Error(err, "ENV --unset: FOO is not set"))
+}
+
+func TestEnvUnsetParseErrors(t *testing.T) {
+	testCases := []struct {
+		dockerfile  string
+		expectedErr string
+	}{
+		{dockerfile: "ENV --unset\n", expectedErr: "ENV --unset requires at least one argument"},
+		{dockerfile: "ENV --unset FOO=bar\n", expectedErr: `ENV --unset takes variable names, got "FOO=bar"`},
+		{dockerfile: "ENV --strict FOO=bar\n", expectedErr: "ENV --strict can only be used with --unset or --inherit"},
+		{dockerfile: "ENV --unset --from-file FOO\n", expectedErr: "ENV --unset and --from-file cannot be used together"},
+		{dockerfile: "ENV --from-file FOO=\n", expectedErr: "ENV --from-file requires a file path for FOO"},
+		{dockerfile: "ENV --inherit\n", expectedErr: "ENV --inherit requires at least one argument"},
+		{dockerfile: "ENV --inherit FOO=bar\n", expectedErr: `ENV --inherit takes variable names, got "FOO=bar"`},
+		{dockerfile: "ENV --inherit --unset FOO\n", expectedErr: "ENV --inherit cannot be used with --unset or --from-file"},
+	}
+	for _, tc := range testCases {
+		result, err := parser.Parse(strings.NewReader("FROM busybox\n" + tc.dockerfile))
+		assert.NilError(t, err)
+		_, _, err = instructions.Parse(result.AST)
+		assert.Check(t, is.ErrorContains(err, tc.expectedErr), tc.dockerfile)
+	}
+}
+
+func TestEnvInherit(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\nENV --inherit FOO MISSING\n")
+	envCommand := stages[0].Commands[0].(*instructions.EnvCommand)
+	assert.Check(t, is.DeepEqual([]string{"FOO", "MISSING"}, envCommand.Inherit))
+	assert.Check(t, !envCommand.Strict)
+
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.baseImage = &mockImage{config: &container.Config{Env: []string{"PATH=/bin", "FOO=bar"}}}
+	sb.state.runConfig.Env = []string{"PATH=/bin", "FOO=changed", "MISSING=set"}
+	assert.NilError(t, dispatch(sb, envCommand))
+	// a variable that is not set in the base image is left as is
+	assert.Check(t, is.DeepEqual([]string{"PATH=/bin", "FOO=bar", "MISSING=set"}, sb.state.runConfig.Env))
+
+	stages, _, _ = parseStages(t, "FROM busybox\nENV --inherit --strict FOO MISSING\n")
+	envCommand = stages[0].Commands[0].(*instructions.EnvCommand)
+	assert.Check(t, envCommand.Strict)
+	err := dispatch(sb, envCommand)
+	assert.Check(t, is.Error(err, "ENV --inherit: MISSING is not set in the base image"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestEnvFromFile(t *testing.T) {
+	contextDir := fs.NewDir(t, "builder-env-from-file",
+		fs.WithFile("VERSION.txt", " 1.2.3\n"),
+		fs.WithDir("dir"))
+	defer contextDir.Remove()
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(contextDir.Path()))
+	assert.NilError(t, err)
+
+	stages, _, _ := parseStages(t, "FROM busybox\nENV --from-file VERSION=VERSION.txt\n")
+	envCommand := stages[0].Commands[0].(*instructions.EnvCommand)
+	assert.Check(t, envCommand.FromFile)
+
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', source, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	assert.NilError(t, dispatch(sb, envCommand))
+	assert.Check(t, is.DeepEqual([]string{"VERSION=1.2.3"}, sb.state.runConfig.Env))
+	assert.Check(t, is.Equal("VERSION.txt", envCommand.Env[0].Value))
+
+	testCases := []struct {
+		path        string
+		expectedErr string
+	}{
+		{path: "MISSING.txt", expectedErr: "ENV --from-file: MISSING.txt: no such file in the build context"},
+		{path: "dir", expectedErr: "ENV --from-file: dir is a directory"},
+	}
+	for _, tc := range testCases {
+		cmd := &instructions.EnvCommand{
+			Env:      instructions.KeyValuePairs{{Key: "VERSION", Value: tc.path}},
+			FromFile: true,
+		}
+		err := dispatch(sb, cmd)
+		assert.Check(t, is.Error(err, tc.expectedErr))
+		assert.Check(t, errdefs.IsInvalidParameter(err))
+	}
+}
+
 func TestMaintainer(t *testing.T) {
 	maintainerEntry := "Some Maintainer <maintainer@example.com>"
 	b := newBuilderWithMockBackend()
@@ -87,6 +217,20 @@ func TestMaintainer(t *testing.T) {
 	assert.Check(t, is.Equal(maintainerEntry, sb.state.maintainer))
 }
 
+func TestMaintainerDeprecated(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	cmd := &instructions.MaintainerCommand{Maintainer: "Some Maintainer"}
+
+	assert.NilError(t, dispatch(sb, cmd))
+	assert.Check(t, is.Contains(b.Stdout.(*bytes.Buffer).String(), "[Warning] MAINTAINER instruction is deprecated"))
+
+	b.options.ErrorOnDeprecated = true
+	err := dispatch(sb, cmd)
+	assert.Check(t, is.ErrorContains(err, "MAINTAINER instruction is deprecated, use LABEL maintainer= instead"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
 func TestLabel(t *testing.T) {
 	labelName := "label"
 	labelValue := "value"
@@ -105,6 +249,63 @@ func TestLabel(t *testing.T) {
 	assert.Check(t, is.Equal(sb.state.runConfig.Labels[labelName], labelValue))
 }
 
+func TestLabelBuildArgs(t *testing.T) {
+	stages, _, _ := parseStages(t, `FROM busybox
+ARG VER
+ARG NAME=app
+LABEL version=${VER} name=$NAME
+ENV VERSION=${VER}
+`)
+	// labels of the --label option are added to the last stage, and are not
+	// expanded
+	buildLabelOptions(map[string]string{"name": "${NAME}-flag"}, stages)
+
+	ver := "1.2"
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(map[string]*string{"VER": &ver}), newStagesBuildResults())
+	for _, cmd := range stages[0].Commands {
+		assert.NilError(t, dispatch(sb, cmd))
+	}
+	assert.Check(t, is.DeepEqual(map[string]string{"version": "1.2", "name": "${NAME}-flag"}, sb.state.runConfig.Labels))
+	assert.Check(t, is.DeepEqual([]string{"VERSION=1.2"}, sb.state.runConfig.Env))
+}
+
+func TestLabelEnvHeredoc(t *testing.T) {
+	stages, _, _ := parseStages(t, `FROM busybox
+ENV NAME=app
+LABEL description=<<EOF
+The "$NAME" image,
+  with a second line \ and a backslash
+EOF
+ENV GREETING=<<'END'
+hello $NAME
+END
+LABEL version=1
+`)
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	for _, cmd := range stages[0].Commands {
+		assert.NilError(t, dispatch(sb, cmd))
+	}
+	assert.Check(t, is.DeepEqual(map[string]string{
+		"description": "The \"app\" image,\n  with a second line \\ and a backslash",
+		"version":     "1",
+	}, sb.state.runConfig.Labels))
+	assert.Check(t, is.DeepEqual([]string{"NAME=app", "GREETING=hello $NAME"}, sb.state.runConfig.Env))
+
+	testCases := []struct {
+		dockerfile  string
+		expectedErr string
+	}{
+		{dockerfile: "LABEL description=<<EOF\nline\n", expectedErr: "heredoc on line 2 is not terminated by EOF"},
+		{dockerfile: "LABEL description=<<\"EOF\nline\nEOF\n", expectedErr: "invalid heredoc delimiter on line 2: unbalanced quotes"},
+	}
+	for _, tc := range testCases {
+		_, err := parser.Parse(strings.NewReader("FROM busybox\n" + tc.dockerfile))
+		assert.Check(t, is.Error(err, tc.expectedErr))
+	}
+}
+
 func TestFromScratch(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -125,6 +326,17 @@ func TestFromScratch(t *testing.T) {
 	assert.Check(t, is.DeepEqual([]string{expected}, sb.state.runConfig.Env))
 }
 
+func TestFromInvalidPlatform(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	cmd := &instructions.Stage{
+		BaseName: "busybox",
+		Platform: "not/a/valid/platform",
+	}
+	err := initializeStage(sb, cmd)
+	assert.Check(t, is.ErrorContains(err, "failed to parse platform not/a/valid/platform"))
+}
+
 func TestFromWithArg(t *testing.T) {
 	tag, expected := ":sometag", "expectedthisid"
 
@@ -173,6 +385,85 @@ func TestFromWithArgButBuildArgsNotGiven(t *testing.T) {
 	assert.Error(t, err, "base name (${THETAG}) should not be blank")
 }
 
+func TestFromWithArgInvalidReference(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	tag := "Invalid Tag"
+	args := NewBuildArgs(map[string]*string{"THETAG": &tag})
+
+	metaArg := instructions.ArgCommand{KeyValuePairOptional: instructions.KeyValuePairOptional{
+		Key: "THETAG",
+	}}
+	cmd := &instructions.Stage{
+		BaseName: "alpine:${THETAG}",
+	}
+	err := processMetaArg(metaArg, shell.NewLex('\\'), args)
+	assert.NilError(t, err)
+
+	sb := newDispatchRequest(b, '\\', nil, args, newStagesBuildResults())
+	err = initializeStage(sb, cmd)
+	assert.Check(t, is.Error(err, "invalid reference format for base name alpine:Invalid Tag (expanded from alpine:${THETAG})"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestFromMutableTag(t *testing.T) {
+	digested := "busybox@sha256:" + strings.Repeat("a", 64)
+	testCases := []struct {
+		baseName         string
+		allowMutableTags bool
+		expectedWarning  bool
+	}{
+		{baseName: "busybox", expectedWarning: true},
+		{baseName: "busybox:latest", expectedWarning: true},
+		{baseName: "example.com/busybox:1.0", expectedWarning: true},
+		{baseName: "busybox:latest", allowMutableTags: true},
+		{baseName: digested},
+		{baseName: "busybox:1.0@sha256:" + strings.Repeat("a", 64)},
+		{baseName: strings.Repeat("b", 64)},
+		{baseName: "sha256:" + strings.Repeat("b", 64)},
+		{baseName: "scratch"},
+		{baseName: "build"},
+	}
+	for _, tc := range testCases {
+		b := newBuilderWithMockBackend()
+		b.options.AllowMutableTags = tc.allowMutableTags
+		b.docker.(*MockBackend).getImageFunc = func(name string) (builder.Image, builder.ROLayer, error) {
+			return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+		}
+		stages := newStagesBuildResults()
+		assert.NilError(t, stages.commitStage("build", &container.Config{Image: "abcdef"}))
+		sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), stages)
+		err := initializeStage(sb, &instructions.Stage{BaseName: tc.baseName})
+		if tc.baseName == "scratch" && runtime.GOOS == "windows" {
+			continue
+		}
+		assert.NilError(t, err)
+
+		out := b.Stdout.(*bytes.Buffer).String()
+		warning := "[Warning] FROM " + tc.baseName + " uses mutable tag; consider pinning by digest\n"
+		if tc.expectedWarning {
+			assert.Check(t, is.Contains(out, warning), tc.baseName)
+		} else {
+			assert.Check(t, !strings.Contains(out, "mutable tag"), tc.baseName)
+		}
+	}
+}
+
+func TestFromBuildLabels(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).getImageFunc = func(name string) (builder.Image, builder.ROLayer, error) {
+		labels := map[string]string{
+			cache.InlineCacheLabel: `["sha256:aaaa"]`,
+			provenanceLabel:        `{"dockerfileDigest":"sha256:bbbb"}`,
+			"maintainer":           "me",
+		}
+		return &mockImage{id: "abcdef", config: &container.Config{Labels: labels}}, nil, nil
+	}
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	err := initializeStage(sb, &instructions.Stage{BaseName: "busybox"})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(map[string]string{"maintainer": "me"}, sb.state.runConfig.Labels))
+}
+
 func TestFromWithUndefinedArg(t *testing.T) {
 	tag, expected := "sometag", "expectedthisid"
 
@@ -194,6 +485,28 @@ func TestFromWithUndefinedArg(t *testing.T) {
 	assert.Check(t, is.Equal(expected, sb.state.imageID))
 }
 
+func TestFromWithArgToEnvPrefix(t *testing.T) {
+	mode, other, base := "prod", "other", "override"
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).getImageFunc = func(name string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "baseid", config: &container.Config{Env: []string{"APP_MODE=" + base, "PATH=/bin"}}}, nil, nil
+	}
+	b.options.ArgToEnvPrefix = "APP_"
+	b.options.BuildArgs = map[string]*string{"APP_MODE": &mode, "APP_UNSET": nil, "OTHER": &other}
+	args := NewBuildArgs(b.options.BuildArgs)
+	sb := newDispatchRequest(b, '\\', nil, args, newStagesBuildResults())
+
+	err := initializeStage(sb, &instructions.Stage{BaseName: "busybox"})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"APP_MODE=prod", "PATH=/bin"}, sb.state.runConfig.Env))
+	assert.Check(t, is.DeepEqual([]string{"APP_UNSET", "OTHER"}, sb.state.buildArgs.UnusedBuildArgs()))
+
+	// ENV instructions override the build-args
+	err = dispatch(sb, &instructions.EnvCommand{Env: instructions.KeyValuePairs{{Key: "APP_MODE", Value: "dev"}}})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"APP_MODE=dev", "PATH=/bin"}, sb.state.runConfig.Env))
+}
+
 func TestFromMultiStageWithNamedStage(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	firstFrom := &instructions.Stage{BaseName: "someimg", Name: "base"}
@@ -222,6 +535,50 @@ func TestOnbuild(t *testing.T) {
 	assert.Check(t, is.Equal("ADD . /app/src", sb.state.runConfig.OnBuild[0]))
 }
 
+func TestOnbuildGroup(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	cmd := &instructions.OnbuildCommand{
+		Expression: "RUN make test",
+		Group:      "dev",
+	}
+	err := dispatch(sb, &instructions.OnbuildCommand{Expression: "RUN make"})
+	assert.NilError(t, err)
+	err = dispatch(sb, cmd)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"RUN make", "RUN make test"}, sb.state.runConfig.OnBuild))
+	assert.Check(t, is.DeepEqual(map[string]string{onbuildGroupLabelPrefix + "1": "dev"}, sb.state.runConfig.Labels))
+
+	groups := popOnbuildGroups(sb.state.runConfig)
+	assert.Check(t, is.DeepEqual(map[int]string{1: "dev"}, groups))
+	assert.Check(t, is.Len(sb.state.runConfig.Labels, 0))
+}
+
+func TestFilterSkippedTriggers(t *testing.T) {
+	triggers := []string{
+		"RUN echo always",
+		"RUN echo dev",
+		"RUN echo test",
+	}
+	groups := map[int]string{1: "dev", 2: "test"}
+	out := &bytes.Buffer{}
+	result := filterSkippedTriggers(out, triggers, groups, []string{"dev"})
+	assert.Check(t, is.DeepEqual([]string{"RUN echo always", "RUN echo test"}, result))
+	assert.Check(t, is.Equal("# Skipping build trigger of group dev\n", out.String()))
+}
+
+func TestAddUnsupportedURLScheme(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	cmd := &instructions.AddCommand{
+		SourcesAndDest: instructions.SourcesAndDest{"unsupported://bucket/file", "/dest/"},
+	}
+
+	err := dispatch(sb, cmd)
+	assert.Check(t, is.Error(err, "ADD failed: unsupported URL scheme unsupported"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
 func TestWorkdir(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -239,6 +596,56 @@ func TestWorkdir(t *testing.T) {
 	assert.Check(t, is.Equal(workingDir, sb.state.runConfig.WorkingDir))
 }
 
+func TestWorkdirEscapesRoot(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "Unix paths")
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.baseImage = &mockImage{}
+
+	err := dispatch(sb, &instructions.WorkdirCommand{Path: "/a/../../escape"})
+	assert.Check(t, is.Error(err, "WORKDIR /a/../../escape escapes the root directory"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	sb.state.runConfig.WorkingDir = "/test1/test2"
+	err = dispatch(sb, &instructions.WorkdirCommand{Path: ".."})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("/test1", sb.state.runConfig.WorkingDir))
+
+	err = dispatch(sb, &instructions.WorkdirCommand{Path: "../.."})
+	assert.Check(t, is.ErrorContains(err, "escapes the root directory"))
+}
+
+func TestPatternSubstitution(t *testing.T) {
+	envs := []string{"FOO=archive.tar", "PATHNAME=/usr/local/lib/file.tar.gz"}
+	testCases := []struct {
+		word     string
+		expected string
+	}{
+		{word: "/dest/${FOO%.tar}/", expected: "/dest/archive/"},
+		{word: "${PATHNAME#*/}", expected: "usr/local/lib/file.tar.gz"},
+		{word: "${PATHNAME##*/}", expected: "file.tar.gz"},
+		{word: "${PATHNAME%.*}", expected: "/usr/local/lib/file.tar"},
+		{word: "${PATHNAME%%.*}", expected: "/usr/local/lib/file"},
+		{word: "${PATHNAME/lib/share}", expected: "/usr/local/share/file.tar.gz"},
+		{word: "${PATHNAME//\\//_}", expected: "_usr_local_lib_file.tar.gz"},
+		{word: "${PATHNAME/l[io]?/X}", expected: "/usr/Xal/lib/file.tar.gz"},
+		{word: "${FOO/.tar}", expected: "archive"},
+		{word: "${FOO%.zip}", expected: "archive.tar"},
+		{word: "${UNSET#foo}", expected: ""},
+	}
+	shlex := shell.NewLex('\\')
+	for _, tc := range testCases {
+		result, err := shlex.ProcessWord(tc.word, envs)
+		assert.NilError(t, err, tc.word)
+		assert.Check(t, is.Equal(tc.expected, result), tc.word)
+	}
+
+	_, err := shlex.ProcessWord("${FOO/#archive/x}", envs)
+	assert.Check(t, is.ErrorContains(err, "unsupported anchored pattern"))
+	_, err = shlex.ProcessWord("${FOO%.tar", envs)
+	assert.Check(t, is.ErrorContains(err, "missing '}'"))
+}
+
 func TestCmd(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -265,6 +672,22 @@ func TestCmd(t *testing.T) {
 	assert.Check(t, sb.state.cmdSet)
 }
 
+func TestCmdEmptyExecutable(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.baseImage = &mockImage{}
+
+	cmd := &instructions.CmdCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      strslice.StrSlice{"", "x"},
+			PrependShell: false,
+		},
+	}
+	err := dispatch(sb, cmd)
+	assert.Check(t, is.Error(err, "CMD executable can not be an empty string"))
+	assert.Check(t, is.Nil(sb.state.runConfig.Cmd))
+}
+
 func TestHealthcheckNone(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -322,6 +745,189 @@ func TestEntrypoint(t *testing.T) {
 	assert.Check(t, is.DeepEqual(expectedEntrypoint, sb.state.runConfig.Entrypoint))
 }
 
+func TestEntrypointEmptyExecutable(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+	sb.state.baseImage = &mockImage{}
+
+	cmd := &instructions.EntrypointCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      strslice.StrSlice{"", "x"},
+			PrependShell: false,
+		},
+	}
+	err := dispatch(sb, cmd)
+	assert.Check(t, is.Error(err, "ENTRYPOINT executable can not be an empty string"))
+	assert.Check(t, is.Nil(sb.state.runConfig.Entrypoint))
+
+	// the shell form is not affected as the executable is the shell
+	cmd.ShellDependantCmdLine = instructions.ShellDependantCmdLine{
+		CmdLine:      strslice.StrSlice{""},
+		PrependShell: true,
+	}
+	assert.NilError(t, dispatch(sb, cmd))
+}
+
+func TestRunIf(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	args := NewBuildArgs(make(map[string]*string))
+	args.argsFromOptions["DEBUG"] = strPtr("1")
+	args.argsFromOptions["TRACE"] = strPtr("false")
+	sb := newDispatchRequest(b, '`', nil, args, newStagesBuildResults())
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+	}
+	var created []string
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		created = append(created, config.Config.Cmd[len(config.Config.Cmd)-1])
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+	sb.state.buildArgs.AddArg("DEBUG", nil)
+	sb.state.buildArgs.AddArg("TRACE", nil)
+	sb.state.runConfig.Env = []string{"EMPTY=", "ZERO=0"}
+
+	for _, condition := range []string{"${DEBUG}", "$TRACE", "${UNSET}", "$EMPTY", "$ZERO", "yes"} {
+		run := &instructions.RunCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+				CmdLine:      strslice.StrSlice{"echo " + condition},
+				PrependShell: true,
+			},
+			NoCache: true,
+			If:      condition,
+		}
+		assert.NilError(t, dispatch(sb, run), condition)
+	}
+	assert.Check(t, is.DeepEqual([]string{"echo ${DEBUG}", "echo yes"}, created))
+	assert.Check(t, is.Contains(b.Stdout.(*bytes.Buffer).String(), "Skipping, the condition $TRACE is false"))
+
+	// the expanded condition is part of the cache key of the command
+	runConfig := copyRunConfig(&container.Config{}, withRunCondition("1"))
+	assert.Check(t, is.DeepEqual(map[string]string{runConditionLabel: "1"}, runConfig.Labels))
+	assert.Check(t, is.Len(copyRunConfig(&container.Config{}, withRunCondition("")).Labels, 0))
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nRUN --if= true\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "RUN --if requires a condition"))
+}
+
+func TestRunUser(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	args := NewBuildArgs(make(map[string]*string))
+	args.argsFromOptions["APP_UID"] = strPtr("1001")
+	sb := newDispatchRequest(b, '`', nil, args, newStagesBuildResults())
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{User: "root"}}, nil, nil
+	}
+	var users []string
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		users = append(users, config.Config.User)
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+	sb.state.buildArgs.AddArg("APP_UID", nil)
+
+	for _, user := range []string{"dockerio", "${APP_UID}", ""} {
+		run := &instructions.RunCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+				CmdLine:      strslice.StrSlice{"id"},
+				PrependShell: true,
+			},
+			NoCache: true,
+			User:    user,
+		}
+		assert.NilError(t, dispatch(sb, run), user)
+	}
+	assert.Check(t, is.DeepEqual([]string{"dockerio", "1001", "root"}, users))
+	assert.Check(t, is.Equal("root", sb.state.runConfig.User))
+
+	_, err := runUser(sb, "$UNSET")
+	assert.Check(t, is.ErrorContains(err, "RUN --user=$UNSET expands to an empty user"))
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nRUN --user= id\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "RUN --user requires a user"))
+}
+
+func TestRunCacheKey(t *testing.T) {
+	contextDir := fs.NewDir(t, "builder-run-cache-key",
+		fs.WithFile("package-lock.json", "{}"),
+		fs.WithDir("dir"))
+	defer contextDir.Remove()
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(contextDir.Path()))
+	assert.NilError(t, err)
+
+	stages, _, _ := parseStages(t, "FROM busybox\nRUN --cache-key-from=package-lock.json npm ci\n")
+	run := stages[0].Commands[0].(*instructions.RunCommand)
+	assert.Check(t, is.DeepEqual([]string{"package-lock.json"}, run.CacheKeyFrom))
+
+	key, err := runCacheKey(source, run.CacheKeyFrom)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("package-lock.json="+digest.FromString("{}").String(), key))
+	runConfig := copyRunConfig(&container.Config{}, withCacheKeyFrom(key))
+	assert.Check(t, is.DeepEqual(map[string]string{cacheKeyFromLabel: key}, runConfig.Labels))
+
+	key, err = runCacheKey(source, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(copyRunConfig(&container.Config{}, withCacheKeyFrom(key)).Labels, 0))
+
+	testCases := []struct {
+		path        string
+		expectedErr string
+	}{
+		{path: "MISSING.json", expectedErr: "RUN --cache-key-from: MISSING.json: no such file in the build context"},
+		{path: "dir", expectedErr: "RUN --cache-key-from: dir is a directory"},
+	}
+	for _, tc := range testCases {
+		_, err := runCacheKey(source, []string{tc.path})
+		assert.Check(t, is.Error(err, tc.expectedErr))
+		assert.Check(t, errdefs.IsInvalidParameter(err))
+	}
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nRUN --cache-key-from= npm ci\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "RUN --cache-key-from requires a file"))
+}
+
+func TestCmdEntrypointExpand(t *testing.T) {
+	stages, _, _ := parseStages(t, `FROM busybox
+ENTRYPOINT --expand ["${APP_BIN}", "\\$HOME", "--dir=$DIR"]
+CMD --expand ["$APP_BIN"]
+CMD ["$APP_BIN"]
+`)
+	args := NewBuildArgs(make(map[string]*string))
+	args.argsFromOptions["APP_BIN"] = strPtr("/bin/echo")
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '\\', nil, args, newStagesBuildResults())
+	sb.state.baseImage = &mockImage{}
+	sb.state.buildArgs.AddArg("APP_BIN", nil)
+	sb.state.runConfig.Env = []string{"DIR=/srv"}
+
+	assert.NilError(t, dispatch(sb, stages[0].Commands[0]))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"/bin/echo", "$HOME", "--dir=/srv"}, sb.state.runConfig.Entrypoint))
+	assert.NilError(t, dispatch(sb, stages[0].Commands[1]))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"/bin/echo"}, sb.state.runConfig.Cmd))
+	// the JSON form is literal by default
+	assert.NilError(t, dispatch(sb, stages[0].Commands[2]))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"$APP_BIN"}, sb.state.runConfig.Cmd))
+
+	for _, dockerfile := range []string{"CMD --expand $APP_BIN\n", "ENTRYPOINT --expand $APP_BIN\n"} {
+		result, err := parser.Parse(strings.NewReader("FROM busybox\n" + dockerfile))
+		assert.NilError(t, err)
+		_, _, err = instructions.Parse(result.AST)
+		assert.Check(t, is.ErrorContains(err, "--expand requires the JSON form"), dockerfile)
+	}
+}
+
 func TestExpose(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -341,6 +947,39 @@ func TestExpose(t *testing.T) {
 	assert.Check(t, is.Contains(sb.state.runConfig.ExposedPorts, portsMapping[0].Port))
 }
 
+func TestExposeValidatesPorts(t *testing.T) {
+	testCases := []struct {
+		port          string
+		expected      nat.Port
+		expectedError string
+	}{
+		{port: "1", expected: "1/tcp"},
+		{port: "65535/udp", expected: "65535/udp"},
+		{port: "80/sctp", expected: "80/sctp"},
+		{port: "80/TCP", expected: "80/tcp"},
+		{port: "$PORT", expected: "8080/tcp"},
+		{port: "0", expectedError: "EXPOSE 0: port 0 is out of the valid range 1-65535"},
+		{port: "70000", expectedError: "EXPOSE 70000: port 70000 is out of the valid range 1-65535"},
+		{port: "8000-70000/udp", expectedError: "EXPOSE 8000-70000/udp: port 70000 is out of the valid range 1-65535"},
+		{port: "http", expectedError: `EXPOSE http: invalid port "http"`},
+		{port: "/sctp", expectedError: "EXPOSE /sctp: no port specified"},
+		{port: "80/icmp", expectedError: `EXPOSE 80/icmp: invalid protocol "icmp", expected tcp, udp or sctp`},
+	}
+	for _, tc := range testCases {
+		b := newBuilderWithMockBackend()
+		sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+		sb.state.runConfig.Env = []string{"PORT=8080"}
+		err := dispatch(sb, &instructions.ExposeCommand{Ports: []string{tc.port}})
+		if tc.expectedError != "" {
+			assert.Check(t, is.Error(err, tc.expectedError), tc.port)
+			assert.Check(t, errdefs.IsInvalidParameter(err), tc.port)
+			continue
+		}
+		assert.NilError(t, err, tc.port)
+		assert.Check(t, is.DeepEqual(nat.PortSet{tc.expected: {}}, sb.state.runConfig.ExposedPorts), tc.port)
+	}
+}
+
 func TestUser(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -353,6 +992,15 @@ func TestUser(t *testing.T) {
 	assert.Check(t, is.Equal("test", sb.state.runConfig.User))
 }
 
+func TestParseUserStrict(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\nUSER app:app\nUSER --strict app:app\n")
+	cmd := stages[0].Commands[0].(*instructions.UserCommand)
+	assert.Check(t, !cmd.Strict)
+	cmd = stages[0].Commands[1].(*instructions.UserCommand)
+	assert.Check(t, cmd.Strict)
+	assert.Check(t, is.Equal("app:app", cmd.User))
+}
+
 func TestVolume(t *testing.T) {
 	b := newBuilderWithMockBackend()
 	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
@@ -550,3 +1198,206 @@ func TestRunIgnoresHealthcheck(t *testing.T) {
 	assert.NilError(t, dispatch(sb, run))
 	assert.Check(t, is.DeepEqual(expectedTest, sb.state.runConfig.Healthcheck.Test))
 }
+
+func TestRunExpandsExecFormArgs(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	args := NewBuildArgs(make(map[string]*string))
+	sb := newDispatchRequest(b, '\\', nil, args, newStagesBuildResults())
+	b.disableCommit = false
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.makeImageCacheFunc = func(_ []string) builder.ImageCache {
+		return &mockImageCache{}
+	}
+	b.imageProber = newImageProber(mockBackend, nil, false)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+	}
+	var created strslice.StrSlice
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		created = config.Config.Cmd
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+	sb.state.buildArgs.AddArg("FOO", strPtr("bar"))
+
+	run := &instructions.RunCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      strslice.StrSlice{"echo", "$FOO", "\\$FOO"},
+			PrependShell: false,
+		},
+	}
+	assert.NilError(t, dispatch(sb, run))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"echo", "$FOO", "\\$FOO"}, created))
+
+	run = &instructions.RunCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      strslice.StrSlice{"echo", "$FOO", "\\$FOO"},
+			PrependShell: false,
+		},
+		ExpandArgs: true,
+	}
+	assert.NilError(t, dispatch(sb, run))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"echo", "bar", "$FOO"}, created))
+}
+
+func TestRunNoCache(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	args := NewBuildArgs(make(map[string]*string))
+	sb := newDispatchRequest(b, '`', nil, args, newStagesBuildResults())
+	b.disableCommit = false
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.makeImageCacheFunc = func(_ []string) builder.ImageCache {
+		return &mockImageCache{
+			getCacheFunc: func(parentID string, cfg *container.Config) (string, error) {
+				return "cachedid", nil
+			},
+		}
+	}
+	b.imageProber = newImageProber(mockBackend, nil, false)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+	}
+	var created int
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		created++
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	mockBackend.commitFunc = func(cfg backend.CommitConfig) (image.ID, error) {
+		return "newid", nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+
+	run := &instructions.RunCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      strslice.StrSlice{"apt-get update"},
+			PrependShell: true,
+		},
+	}
+	assert.NilError(t, dispatch(sb, run))
+	assert.Check(t, is.Equal("cachedid", sb.state.imageID))
+	assert.Check(t, is.Equal(0, created))
+
+	run.NoCache = true
+	assert.NilError(t, dispatch(sb, run))
+	assert.Check(t, is.Equal("newid", sb.state.imageID))
+	assert.Check(t, is.Equal(1, created))
+}
+
+func TestRunNetwork(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.options.NetworkMode = "bridge"
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+	}
+	var networkMode container.NetworkMode
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		networkMode = config.HostConfig.NetworkMode
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+
+	testCases := []struct {
+		network     string
+		expected    container.NetworkMode
+		expectedErr string
+	}{
+		{network: "", expected: "bridge"},
+		{network: "default", expected: "bridge"},
+		{network: "none", expected: "none"},
+		{network: "host", expectedErr: "invalid RUN --network=host: only default and none are supported"},
+	}
+	for _, tc := range testCases {
+		networkMode = ""
+		run := &instructions.RunCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+				CmdLine:      strslice.StrSlice{"apt-get update"},
+				PrependShell: true,
+			},
+			NoCache: true,
+			Network: tc.network,
+		}
+		err := dispatch(sb, run)
+		if tc.expectedErr != "" {
+			assert.Check(t, is.Error(err, tc.expectedErr))
+			assert.Check(t, errdefs.IsInvalidParameter(err))
+			assert.Check(t, is.Equal(container.NetworkMode(""), networkMode))
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(tc.expected, networkMode), tc.network)
+	}
+}
+
+func TestRunReadonly(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.getImageFunc = func(_ string) (builder.Image, builder.ROLayer, error) {
+		return &mockImage{id: "abcdef", config: &container.Config{}}, nil, nil
+	}
+	var readonly []bool
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		readonly = append(readonly, config.HostConfig.ReadonlyRootfs)
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	from := &instructions.Stage{BaseName: "abcdef"}
+	assert.NilError(t, initializeStage(sb, from))
+
+	for _, runReadonly := range []bool{false, true} {
+		b.options.RunReadonly = runReadonly
+		run := &instructions.RunCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+				CmdLine:      strslice.StrSlice{"touch /file"},
+				PrependShell: true,
+			},
+			NoCache: true,
+		}
+		assert.NilError(t, dispatch(sb, run))
+	}
+	assert.Check(t, is.DeepEqual([]bool{false, true}, readonly))
+}
+
+func TestShellOS(t *testing.T) {
+	stages, _, _ := parseStages(t, `FROM busybox
+SHELL --os=windows ["powershell", "-command"]
+SHELL --os=Linux ["/bin/bash", "-c"]
+SHELL ["/bin/sh", "-c"]
+`)
+	var shells []*instructions.ShellCommand
+	for _, cmd := range stages[0].Commands {
+		shells = append(shells, cmd.(*instructions.ShellCommand))
+	}
+	assert.Check(t, is.Equal("windows", shells[0].OS))
+	assert.Check(t, is.Equal("linux", shells[1].OS))
+	assert.Check(t, is.Equal("", shells[2].OS))
+
+	for _, osName := range []string{"linux", "windows"} {
+		b := newBuilderWithMockBackend()
+		sb := newDispatchRequest(b, '`', nil, NewBuildArgs(make(map[string]*string)), newStagesBuildResults())
+		sb.state.operatingSystem = osName
+		for _, shell := range shells[:2] {
+			assert.NilError(t, dispatch(sb, shell))
+		}
+		if osName == "linux" {
+			assert.Check(t, is.DeepEqual(strslice.StrSlice{"/bin/bash", "-c"}, sb.state.runConfig.Shell))
+			assert.Check(t, is.Contains(b.Stdout.(*bytes.Buffer).String(), "Skipping, the shell is for windows"))
+		} else {
+			assert.Check(t, is.DeepEqual(strslice.StrSlice{"powershell", "-command"}, sb.state.runConfig.Shell))
+			assert.Check(t, is.Contains(b.Stdout.(*bytes.Buffer).String(), "Skipping, the shell is for linux"))
+		}
+	}
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nSHELL --os= [\"sh\"]\n"))
+	assert.NilError(t, err)
+	_, _, err = instructions.Parse(result.AST)
+	assert.Check(t, is.ErrorContains(err, "SHELL --os requires an operating system"))
+}
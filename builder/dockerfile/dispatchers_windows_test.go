@@ -44,3 +44,26 @@ func TestNormalizeWorkdir(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckWorkdirTraversal(t *testing.T) {
+	tests := []struct {
+		platform, current, requested string
+		escapes                      bool
+	}{
+		{"windows", `C:oo`, `..`, false},
+		{"windows", `C:oo`, `..\..`, true},
+		{"windows", ``, `C:\..\..\escape`, true},
+		{"windows", ``, `c:/a/../b`, false},
+		{"linux", `/foo`, `..`, false},
+		{"linux", ``, `/a/../../escape`, true},
+	}
+	for _, i := range tests {
+		err := checkWorkdirTraversal(i.platform, i.current, i.requested)
+		if i.escapes && err == nil {
+			t.Fatalf("TestCheckWorkdirTraversal Expected an error for '%s' '%s'", i.current, i.requested)
+		}
+		if !i.escapes && err != nil {
+			t.Fatalf("TestCheckWorkdirTraversal Expected no error for '%s' '%s', got %s", i.current, i.requested, err)
+		}
+	}
+}
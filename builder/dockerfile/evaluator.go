@@ -25,13 +25,16 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/shell"
 	"github.com/docker/docker/errdefs"
+	dockerimage "github.com/docker/docker/image"
+	"github.com/docker/docker/image/cache"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/runconfig/opts"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/moby/buildkit/frontend/dockerfile/shell"
 	"github.com/pkg/errors"
 )
 
@@ -63,6 +66,10 @@ func dispatch(d dispatchRequest, cmd instructions.Command) (err error) {
 			d.builder.containerManager.RemoveAll(d.builder.Stdout)
 			return
 		}
+		// with DebugOnFailure the kept container is already reported by RUN
+		if d.builder.options.KeepOnFailure && !d.builder.options.DebugOnFailure {
+			d.builder.containerManager.PrintKept(d.builder.Stdout)
+		}
 	}()
 	switch c := cmd.(type) {
 	case *instructions.EnvCommand:
@@ -75,6 +82,8 @@ func dispatch(d dispatchRequest, cmd instructions.Command) (err error) {
 		return dispatchAdd(d, c)
 	case *instructions.CopyCommand:
 		return dispatchCopy(d, c)
+	case *instructions.DeleteCommand:
+		return dispatchDelete(d, c)
 	case *instructions.OnbuildCommand:
 		return dispatchOnbuild(d, c)
 	case *instructions.WorkdirCommand:
@@ -110,9 +119,22 @@ type dispatchState struct {
 	cmdSet          bool
 	imageID         string
 	baseImage       builder.Image
+	rootImage       builder.Image
 	stageName       string
 	buildArgs       *BuildArgs
 	operatingSystem string
+	// baseName is the reference of the base image in the FROM instruction,
+	// with its variables expanded
+	baseName string
+	// cacheKeys holds the cache key of each entry of the history of the
+	// image, to embed them with the inline cache
+	cacheKeys []string
+	// noCache is set while dispatching a step that does not use the build
+	// cache, as selected by the no-cache filter
+	noCache bool
+	// sbomFiles lists the files added by the COPY and ADD instructions of
+	// the stage and of the stages it is built from, if the SBOM option is set
+	sbomFiles []types.BuildSBOMFile
 }
 
 func newDispatchState(baseArgs *BuildArgs) *dispatchState {
@@ -124,12 +146,29 @@ func newDispatchState(baseArgs *BuildArgs) *dispatchState {
 type stagesBuildResults struct {
 	flat    []*container.Config
 	indexed map[string]*container.Config
+	// rootImages maps the image of each stage to the first base image of
+	// the chain of stages it was built from
+	rootImages map[string]builder.Image
+	// sbomFiles maps the image of each stage to the files its COPY and ADD
+	// instructions, and the ones of the stages it was built from, added
+	sbomFiles map[string][]types.BuildSBOMFile
 }
 
 func newStagesBuildResults() *stagesBuildResults {
 	return &stagesBuildResults{
-		indexed: make(map[string]*container.Config),
+		indexed:    make(map[string]*container.Config),
+		rootImages: make(map[string]builder.Image),
+		sbomFiles:  make(map[string][]types.BuildSBOMFile),
+	}
+}
+
+// getRootImage returns the first base image of the chain of stages image
+// was built from, or image itself if it is not the result of a stage.
+func (r *stagesBuildResults) getRootImage(image builder.Image) builder.Image {
+	if root, ok := r.rootImages[image.ImageID()]; ok {
+		return root
 	}
+	return image
 }
 
 func (r *stagesBuildResults) getByName(name string) (*container.Config, bool) {
@@ -182,7 +221,14 @@ func (r *stagesBuildResults) commitStage(name string, config *container.Config)
 }
 
 func commitStage(state *dispatchState, stages *stagesBuildResults) error {
-	return stages.commitStage(state.stageName, state.runConfig)
+	if err := stages.commitStage(state.stageName, state.runConfig); err != nil {
+		return err
+	}
+	if state.imageID != "" {
+		stages.rootImages[state.imageID] = state.rootImage
+		stages.sbomFiles[state.imageID] = state.sbomFiles
+	}
+	return nil
 }
 
 type dispatchRequest struct {
@@ -230,12 +276,29 @@ func (s *dispatchState) beginStage(stageName string, image builder.Image) error
 		s.runConfig = &container.Config{}
 	}
 	s.baseImage = image
+	s.cacheKeys = nil
+	if img, ok := image.(*dockerimage.Image); ok {
+		// keys are not known for the base image unless it has an inline cache
+		s.cacheKeys = cache.InlineCacheKeys(img)
+		if s.cacheKeys == nil {
+			s.cacheKeys = make([]string, len(img.History))
+		}
+	}
+	// the inline cache and the provenance only describe the base image
+	delete(s.runConfig.Labels, cache.InlineCacheLabel)
+	delete(s.runConfig.Labels, provenanceLabel)
 	s.setDefaultPath()
 	s.runConfig.OpenStdin = false
 	s.runConfig.StdinOnce = false
 	return nil
 }
 
+// recordCacheKey records the cache key of a step that adds an entry to the
+// history of the image, whether it was found in the cache or not
+func (s *dispatchState) recordCacheKey(runConfig *container.Config) {
+	s.cacheKeys = append(s.cacheKeys, cache.CacheKey(runConfig))
+}
+
 // Add the default PATH to runConfig.ENV if one exists for the operating system and there
 // is no PATH set. Note that Windows containers on Windows won't have one as it's set by HCS
 func (s *dispatchState) setDefaultPath() {
@@ -2,11 +2,17 @@ package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/errdefs"
 	dockerimage "github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/locker"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -17,9 +23,13 @@ type getAndMountFunc func(string, bool, *specs.Platform) (builder.Image, builder
 // imageSources mounts images and provides a cache for mounted images. It tracks
 // all images so they can be unmounted at the end of the build.
 type imageSources struct {
+	mu        sync.Mutex
 	byImageID map[string]*imageMount
 	mounts    []*imageMount
 	getImage  getAndMountFunc
+	// getting locks the images that are looked up by the stages built
+	// concurrently, so that an image is only mounted once
+	getting locker.Locker
 }
 
 func newImageSources(ctx context.Context, options builderOptions) *imageSources {
@@ -32,12 +42,18 @@ func newImageSources(ctx context.Context, options builderOptions) *imageSources
 				pullOption = backend.PullOptionPreferLocal
 			}
 		}
-		return options.Backend.GetImageAndReleasableLayer(ctx, idOrRef, backend.GetImageAndLayerOptions{
-			PullOption: pullOption,
-			AuthConfig: options.Options.AuthConfigs,
-			Output:     options.ProgressWriter.Output,
-			Platform:   platform,
-		})
+		get := func() (builder.Image, builder.ROLayer, error) {
+			return options.Backend.GetImageAndReleasableLayer(ctx, idOrRef, backend.GetImageAndLayerOptions{
+				PullOption: pullOption,
+				AuthConfig: options.Options.AuthConfigs,
+				Output:     options.ProgressWriter.Output,
+				Platform:   platform,
+			})
+		}
+		if localOnly {
+			return get()
+		}
+		return getWithPullRetries(ctx, get, options.Options.PullRetries, options.Options.PullRetryDelay, options.ProgressWriter.StdoutFormatter)
 	}
 
 	return &imageSources{
@@ -46,8 +62,49 @@ func newImageSources(ctx context.Context, options builderOptions) *imageSources
 	}
 }
 
+// getWithPullRetries calls get, which may pull an image, and calls it again up
+// to retries times while it fails with a transient error. The first retry is
+// after delay, or one second, and the delay is doubled at each retry.
+func getWithPullRetries(ctx context.Context, get func() (builder.Image, builder.ROLayer, error), retries int, delay time.Duration, out io.Writer) (builder.Image, builder.ROLayer, error) {
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 0; ; i++ {
+		image, layer, err := get()
+		if err == nil || i >= retries || !isTransientPullError(err) {
+			return image, layer, err
+		}
+		fmt.Fprintf(out, "Pull failed, retrying in %s (%d/%d): %v\n", delay, i+1, retries, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, err
+		}
+		delay *= 2
+	}
+}
+
+// isTransientPullError returns whether getting an image may succeed if it is
+// retried. Errors that are not classified, like network errors, and errors of
+// the registry are transient, but missing images and denied pulls are not.
+func isTransientPullError(err error) bool {
+	switch {
+	case errdefs.IsNotFound(err), errdefs.IsUnauthorized(err), errdefs.IsForbidden(err),
+		errdefs.IsInvalidParameter(err), errdefs.IsNotImplemented(err), errdefs.IsCancelled(err):
+		return false
+	}
+	cause := errors.Cause(err)
+	return cause != context.Canceled && cause != context.DeadlineExceeded
+}
+
 func (m *imageSources) Get(idOrRef string, localOnly bool, platform *specs.Platform) (*imageMount, error) {
-	if im, ok := m.byImageID[idOrRef]; ok {
+	m.getting.Lock(idOrRef)
+	defer m.getting.Unlock(idOrRef)
+
+	m.mu.Lock()
+	im, ok := m.byImageID[idOrRef]
+	m.mu.Unlock()
+	if ok {
 		return im, nil
 	}
 
@@ -55,12 +112,14 @@ func (m *imageSources) Get(idOrRef string, localOnly bool, platform *specs.Platf
 	if err != nil {
 		return nil, err
 	}
-	im := newImageMount(image, layer)
+	im = newImageMount(image, layer)
 	m.Add(im)
 	return im, nil
 }
 
 func (m *imageSources) Unmount() (retErr error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, im := range m.mounts {
 		if err := im.unmount(); err != nil {
 			logrus.Error(err)
@@ -71,6 +130,8 @@ func (m *imageSources) Unmount() (retErr error) {
 }
 
 func (m *imageSources) Add(im *imageMount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	switch im.image {
 	case nil:
 		// set the OS for scratch images
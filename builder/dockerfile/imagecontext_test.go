@@ -0,0 +1,93 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/errdefs"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestGetWithPullRetries(t *testing.T) {
+	// flakyGet fails with err the first failures times it is called
+	flakyGet := func(failures int, err error) (func() (builder.Image, builder.ROLayer, error), *int) {
+		calls := 0
+		return func() (builder.Image, builder.ROLayer, error) {
+			calls++
+			if calls <= failures {
+				return nil, nil, err
+			}
+			return &mockImage{id: "busybox"}, &mockLayer{}, nil
+		}, &calls
+	}
+	unavailable := errdefs.System(errors.New("received unexpected HTTP status: 503 Service Unavailable"))
+
+	get, calls := flakyGet(2, unavailable)
+	out := &bytes.Buffer{}
+	image, _, err := getWithPullRetries(context.Background(), get, 3, time.Millisecond, out)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("busybox", image.ImageID()))
+	assert.Check(t, is.Equal(3, *calls))
+	assert.Check(t, is.Contains(out.String(), "Pull failed, retrying in 1ms (1/3): received unexpected HTTP status: 503"))
+	assert.Check(t, is.Contains(out.String(), "retrying in 2ms (2/3)"))
+
+	// the retries are exhausted
+	get, calls = flakyGet(2, unavailable)
+	_, _, err = getWithPullRetries(context.Background(), get, 1, time.Millisecond, &bytes.Buffer{})
+	assert.Check(t, is.Error(err, unavailable.Error()))
+	assert.Check(t, is.Equal(2, *calls))
+
+	// a missing image fails at once
+	get, calls = flakyGet(2, errdefs.NotFound(errors.New("manifest for busybox:nope not found")))
+	_, _, err = getWithPullRetries(context.Background(), get, 3, time.Millisecond, &bytes.Buffer{})
+	assert.Check(t, errdefs.IsNotFound(err))
+	assert.Check(t, is.Equal(1, *calls))
+
+	// the build is cancelled while waiting for a retry
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	get, calls = flakyGet(2, unavailable)
+	_, _, err = getWithPullRetries(ctx, get, 3, time.Hour, &bytes.Buffer{})
+	assert.Check(t, is.Error(err, unavailable.Error()))
+	assert.Check(t, is.Equal(1, *calls))
+}
+
+func TestImageSourcesGetConcurrently(t *testing.T) {
+	var calls int32
+	m := &imageSources{
+		byImageID: make(map[string]*imageMount),
+		getImage: func(idOrRef string, _ bool, _ *specs.Platform) (builder.Image, builder.ROLayer, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(10 * time.Millisecond)
+			return &mockImage{id: idOrRef}, &mockLayer{}, nil
+		},
+	}
+
+	// the stages built concurrently share the mount of their base image
+	mounts := make([]*imageMount, 4)
+	var wg sync.WaitGroup
+	for i := range mounts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			im, err := m.Get("abcdef", true, nil)
+			assert.Check(t, err)
+			mounts[i] = im
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Check(t, is.Equal(int32(1), atomic.LoadInt32(&calls)))
+	assert.Check(t, is.Len(m.mounts, 1))
+	for _, im := range mounts {
+		assert.Check(t, im == mounts[0])
+	}
+}
@@ -0,0 +1,112 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// expandIncludes replaces the INCLUDE instructions of the Dockerfile with the
+// instructions of the Dockerfile fragments they refer to, read from the build
+// context. Fragments cannot contain FROM instructions, and may include other
+// fragments as long as there is no cycle.
+//
+// Errors in a fragment are reported with its path and line. The included
+// instructions are then attributed to the line of the INCLUDE instruction of
+// the Dockerfile. As the fragments are inlined, their content is part of the
+// cache key of the included instructions.
+func expandIncludes(dockerfile *parser.Result, source builder.Source) error {
+	children, err := expandIncludeNodes(dockerfile.AST.Children, dockerfile.EscapeToken, source, nil)
+	if err != nil {
+		return err
+	}
+	dockerfile.AST.Children = children
+	return nil
+}
+
+func expandIncludeNodes(nodes []*parser.Node, escapeToken rune, source builder.Source, includeStack []string) ([]*parser.Node, error) {
+	expanded := make([]*parser.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Value != command.Include {
+			expanded = append(expanded, node)
+			continue
+		}
+		included, err := readInclude(node, escapeToken, source, includeStack)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range included {
+			n.StartLine = node.StartLine
+		}
+		expanded = append(expanded, included...)
+	}
+	return expanded, nil
+}
+
+func readInclude(node *parser.Node, escapeToken rune, source builder.Source, includeStack []string) ([]*parser.Node, error) {
+	if node.Next == nil || node.Next.Next != nil {
+		return nil, errdefs.InvalidParameter(errors.New("INCLUDE requires exactly one argument"))
+	}
+	if source == nil {
+		return nil, errdefs.InvalidParameter(errors.New("INCLUDE requires a build context"))
+	}
+	includePath := node.Next.Value
+	// Paths are relative to the root of the context
+	cleanPath := path.Clean("/" + strings.Replace(includePath, "\\", "/", -1))[1:]
+	for _, p := range includeStack {
+		if p == cleanPath {
+			cycle := append(append([]string{}, includeStack...), cleanPath)
+			return nil, errdefs.InvalidParameter(errors.Errorf("INCLUDE: circular include of %s (%s)", cleanPath, strings.Join(cycle, " -> ")))
+		}
+	}
+
+	fi, err := remotecontext.StatAt(source, includePath)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errdefs.InvalidParameter(errors.Errorf("INCLUDE %s: no such file in the build context", includePath))
+		}
+		return nil, errors.Wrapf(err, "INCLUDE %s", includePath)
+	}
+	if fi.IsDir() {
+		return nil, errdefs.InvalidParameter(errors.Errorf("INCLUDE %s: is a directory", includePath))
+	}
+	fullPath, err := remotecontext.FullPath(source, includePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := source.Root().Open(fullPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "INCLUDE %s", includePath)
+	}
+	defer f.Close()
+	result, err := parser.Parse(f)
+	if err != nil {
+		return nil, errdefs.InvalidParameter(errors.Wrapf(err, "INCLUDE %s", includePath))
+	}
+	if result.EscapeToken != escapeToken {
+		return nil, errdefs.InvalidParameter(errors.Errorf("INCLUDE %s: the escape directive of an included file must match the one of the Dockerfile", includePath))
+	}
+
+	for _, n := range result.AST.Children {
+		switch n.Value {
+		case command.From:
+			return nil, errdefs.InvalidParameter(errors.Errorf("%s line %d: FROM cannot be used in an included file", cleanPath, n.StartLine))
+		case command.Include:
+			// checked when it is expanded
+		default:
+			if _, err := instructions.ParseInstruction(n); err != nil {
+				return nil, errdefs.InvalidParameter(errors.Errorf("%s line %d: %v", cleanPath, n.StartLine, err))
+			}
+		}
+	}
+	stack := append(append([]string{}, includeStack...), cleanPath)
+	return expandIncludeNodes(result.AST.Children, escapeToken, source, stack)
+}
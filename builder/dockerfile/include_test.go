@@ -0,0 +1,89 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+)
+
+func newIncludeSource(t *testing.T, ops ...fs.PathOp) (builder.Source, func()) {
+	contextDir := fs.NewDir(t, "builder-include", ops...)
+	source, err := remotecontext.NewLazySource(containerfs.NewLocalContainerFS(contextDir.Path()))
+	assert.NilError(t, err)
+	return source, contextDir.Remove
+}
+
+func TestExpandIncludes(t *testing.T) {
+	source, cleanup := newIncludeSource(t,
+		fs.WithDir("snippets",
+			fs.WithFile("setup.df", "# setup\nRUN echo setup\nINCLUDE snippets/env.df\n"),
+			fs.WithFile("env.df", "ENV FOO=bar\n")))
+	defer cleanup()
+
+	dockerfile := `FROM busybox
+RUN echo before
+
+INCLUDE /snippets/setup.df
+CMD ["sh"]
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	assert.NilError(t, err)
+	assert.NilError(t, expandIncludes(result, source))
+
+	var values []string
+	var lines []int
+	for _, n := range result.AST.Children {
+		values = append(values, n.Original)
+		lines = append(lines, n.StartLine)
+	}
+	assert.Check(t, is.DeepEqual([]string{"FROM busybox", "RUN echo before", "RUN echo setup", "ENV FOO=bar", `CMD ["sh"]`}, values))
+	assert.Check(t, is.DeepEqual([]int{1, 2, 4, 4, 5}, lines))
+
+	stages, _, err := instructions.Parse(result.AST)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(stages[0].Commands, 4))
+}
+
+func TestExpandIncludesErrors(t *testing.T) {
+	source, cleanup := newIncludeSource(t,
+		fs.WithFile("a.df", "RUN echo a\nINCLUDE b.df\n"),
+		fs.WithFile("b.df", "INCLUDE ./a.df\n"),
+		fs.WithFile("from.df", "RUN echo from\nFROM busybox\n"),
+		fs.WithFile("invalid.df", "RUN echo invalid\n\nCOPY --chown\n"),
+		fs.WithDir("dir"))
+	defer cleanup()
+
+	testCases := []struct {
+		include     string
+		expectedErr string
+	}{
+		{include: "", expectedErr: "INCLUDE requires exactly one argument"},
+		{include: "a.df b.df", expectedErr: "INCLUDE requires exactly one argument"},
+		{include: "a.df", expectedErr: "INCLUDE: circular include of a.df (a.df -> b.df -> a.df)"},
+		{include: "missing.df", expectedErr: "INCLUDE missing.df: no such file in the build context"},
+		{include: "dir", expectedErr: "INCLUDE dir: is a directory"},
+		{include: "from.df", expectedErr: "from.df line 2: FROM cannot be used in an included file"},
+		{include: "invalid.df", expectedErr: "invalid.df line 3: COPY requires at least two arguments"},
+	}
+	for _, tc := range testCases {
+		result, err := parser.Parse(strings.NewReader("FROM busybox\nINCLUDE " + tc.include + "\n"))
+		assert.NilError(t, err)
+		err = expandIncludes(result, source)
+		assert.Check(t, is.ErrorContains(err, tc.expectedErr), tc.include)
+		assert.Check(t, errdefs.IsInvalidParameter(err), tc.include)
+	}
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nINCLUDE ../outside.df\n"))
+	assert.NilError(t, err)
+	err = expandIncludes(result, source)
+	assert.Check(t, is.ErrorContains(err, "Forbidden path outside the build context"))
+}
@@ -0,0 +1,44 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"encoding/json"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/image/cache"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// inlineCacheBuildArg enables the inline cache like the InlineCache option,
+// for compatibility with BuildKit
+const inlineCacheBuildArg = "BUILDKIT_INLINE_CACHE"
+
+// setInlineCacheFromBuildArgs enables the inline cache if the
+// BUILDKIT_INLINE_CACHE build arg is set to 1. The build arg is removed, so it
+// does not end up in the environment of RUN instructions.
+func setInlineCacheFromBuildArgs(options *types.ImageBuildOptions) {
+	value, ok := options.BuildArgs[inlineCacheBuildArg]
+	if !ok {
+		return
+	}
+	if value != nil && *value == "1" {
+		options.InlineCache = true
+	}
+	delete(options.BuildArgs, inlineCacheBuildArg)
+}
+
+// embedInlineCache records the cache keys of the steps of the final stage in
+// the cache.InlineCacheLabel of the image, so that --cache-from matches the
+// steps on their full config after the image is pushed and pulled.
+func (b *Builder) embedInlineCache(state *dispatchState) error {
+	err := b.labelImage(state, cache.InlineCacheLabel, func(img *image.Image) (string, error) {
+		if len(state.cacheKeys) != len(img.History) {
+			logrus.Debugf("[BUILDER] not embedding inline cache: %d cache keys for %d history entries", len(state.cacheKeys), len(img.History))
+			return "", nil
+		}
+		keys, err := json.Marshal(state.cacheKeys)
+		return string(keys), err
+	})
+	return errors.Wrap(err, "failed to embed inline cache")
+}
@@ -0,0 +1,836 @@
+package instructions // import "github.com/docker/docker/builder/dockerfile/instructions"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+type parseRequest struct {
+	command    string
+	args       []string
+	attributes map[string]bool
+	flags      *BFlags
+	original   string
+}
+
+var parseRunPreHooks []func(*RunCommand, parseRequest) error
+var parseRunPostHooks []func(*RunCommand, parseRequest) error
+
+func nodeArgs(node *parser.Node) []string {
+	result := []string{}
+	for ; node.Next != nil; node = node.Next {
+		arg := node.Next
+		if len(arg.Children) == 0 {
+			result = append(result, arg.Value)
+		} else if len(arg.Children) == 1 {
+			//sub command
+			result = append(result, arg.Children[0].Value)
+			result = append(result, nodeArgs(arg.Children[0])...)
+		}
+	}
+	return result
+}
+
+func newParseRequestFromNode(node *parser.Node) parseRequest {
+	return parseRequest{
+		command:    node.Value,
+		args:       nodeArgs(node),
+		attributes: node.Attributes,
+		original:   node.Original,
+		flags:      NewBFlagsWithArgs(node.Flags),
+	}
+}
+
+// ParseInstruction converts an AST to a typed instruction (either a command or a build stage beginning when encountering a `FROM` statement)
+func ParseInstruction(node *parser.Node) (interface{}, error) {
+	req := newParseRequestFromNode(node)
+	switch node.Value {
+	case command.Env:
+		return parseEnv(req)
+	case command.Maintainer:
+		return parseMaintainer(req)
+	case command.Label:
+		return parseLabel(req)
+	case command.Add:
+		return parseAdd(req)
+	case command.Copy:
+		return parseCopy(req)
+	case command.Delete:
+		return parseDelete(req)
+	case command.From:
+		return parseFrom(req)
+	case command.Onbuild:
+		return parseOnBuild(req)
+	case command.Workdir:
+		return parseWorkdir(req)
+	case command.Run:
+		return parseRun(req)
+	case command.Cmd:
+		return parseCmd(req)
+	case command.Healthcheck:
+		return parseHealthcheck(req)
+	case command.Entrypoint:
+		return parseEntrypoint(req)
+	case command.Expose:
+		return parseExpose(req)
+	case command.User:
+		return parseUser(req)
+	case command.Volume:
+		return parseVolume(req)
+	case command.StopSignal:
+		return parseStopSignal(req)
+	case command.Arg:
+		return parseArg(req)
+	case command.Shell:
+		return parseShell(req)
+	}
+
+	return nil, &UnknownInstruction{Instruction: node.Value, Line: node.StartLine}
+}
+
+// ParseCommand converts an AST to a typed Command
+func ParseCommand(node *parser.Node) (Command, error) {
+	s, err := ParseInstruction(node)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := s.(Command); ok {
+		return c, nil
+	}
+	return nil, errors.Errorf("%T is not a command type", s)
+}
+
+// UnknownInstruction represents an error occurring when a command is unresolvable
+type UnknownInstruction struct {
+	Line        int
+	Instruction string
+}
+
+func (e *UnknownInstruction) Error() string {
+	return fmt.Sprintf("unknown instruction: %s", strings.ToUpper(e.Instruction))
+}
+
+// IsUnknownInstruction checks if the error is an UnknownInstruction or a parseError containing an UnknownInstruction
+func IsUnknownInstruction(err error) bool {
+	_, ok := err.(*UnknownInstruction)
+	if !ok {
+		var pe *parseError
+		if pe, ok = err.(*parseError); ok {
+			_, ok = pe.inner.(*UnknownInstruction)
+		}
+	}
+	return ok
+}
+
+type parseError struct {
+	inner error
+	node  *parser.Node
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("Dockerfile parse error line %d: %v", e.node.StartLine, e.inner.Error())
+}
+
+// Parse a Dockerfile into a collection of buildable stages.
+// metaArgs is a collection of ARG instructions that occur before the first FROM.
+func Parse(ast *parser.Node) (stages []Stage, metaArgs []ArgCommand, err error) {
+	for _, n := range ast.Children {
+		cmd, err := ParseInstruction(n)
+		if err != nil {
+			return nil, nil, &parseError{inner: err, node: n}
+		}
+		if len(stages) == 0 {
+			// meta arg case
+			if a, isArg := cmd.(*ArgCommand); isArg {
+				metaArgs = append(metaArgs, *a)
+				continue
+			}
+		}
+		switch c := cmd.(type) {
+		case *Stage:
+			stages = append(stages, *c)
+		case Command:
+			stage, err := CurrentStage(stages)
+			if err != nil {
+				return nil, nil, err
+			}
+			stage.AddCommand(c)
+		default:
+			return nil, nil, errors.Errorf("%T is not a command type", cmd)
+		}
+
+	}
+	return stages, metaArgs, nil
+}
+
+func parseKvps(args []string, cmdName string) (KeyValuePairs, error) {
+	if len(args) == 0 {
+		return nil, errAtLeastOneArgument(cmdName)
+	}
+	if len(args)%2 != 0 {
+		// should never get here, but just in case
+		return nil, errTooManyArguments(cmdName)
+	}
+	var res KeyValuePairs
+	for j := 0; j < len(args); j += 2 {
+		if len(args[j]) == 0 {
+			return nil, errBlankCommandNames(cmdName)
+		}
+		name := args[j]
+		value := args[j+1]
+		res = append(res, KeyValuePair{Key: name, Value: value})
+	}
+	return res, nil
+}
+
+func parseEnv(req parseRequest) (*EnvCommand, error) {
+	flUnset := req.flags.AddBool("unset", false)
+	flStrict := req.flags.AddBool("strict", false)
+	flFromFile := req.flags.AddBool("from-file", false)
+	flInherit := req.flags.AddBool("inherit", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	if flUnset.IsTrue() && flFromFile.IsTrue() {
+		return nil, errors.New("ENV --unset and --from-file cannot be used together")
+	}
+	if flInherit.IsTrue() && (flUnset.IsTrue() || flFromFile.IsTrue()) {
+		return nil, errors.New("ENV --inherit cannot be used with --unset or --from-file")
+	}
+	if flUnset.IsTrue() || flInherit.IsTrue() {
+		flag := "--unset"
+		if flInherit.IsTrue() {
+			flag = "--inherit"
+		}
+		if len(req.args) == 0 {
+			return nil, errAtLeastOneArgument("ENV " + flag)
+		}
+		for _, name := range req.args {
+			if name == "" || strings.Contains(name, "=") {
+				return nil, errors.Errorf("ENV %s takes variable names, got %q", flag, name)
+			}
+		}
+		cmd := &EnvCommand{
+			Strict:          flStrict.IsTrue(),
+			withNameAndCode: newWithNameAndCode(req),
+		}
+		if flInherit.IsTrue() {
+			cmd.Inherit = req.args
+		} else {
+			cmd.Unset = req.args
+		}
+		return cmd, nil
+	}
+	if flStrict.IsTrue() {
+		return nil, errors.New("ENV --strict can only be used with --unset or --inherit")
+	}
+	envs, err := parseKvps(req.args, "ENV")
+	if err != nil {
+		return nil, err
+	}
+	if flFromFile.IsTrue() {
+		for _, env := range envs {
+			if env.Value == "" {
+				return nil, errors.Errorf("ENV --from-file requires a file path for %s", env.Key)
+			}
+		}
+	}
+	return &EnvCommand{
+		Env:             envs,
+		FromFile:        flFromFile.IsTrue(),
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+}
+
+func parseMaintainer(req parseRequest) (*MaintainerCommand, error) {
+	if len(req.args) != 1 {
+		return nil, errExactlyOneArgument("MAINTAINER")
+	}
+
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	return &MaintainerCommand{
+		Maintainer:      req.args[0],
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+}
+
+func parseLabel(req parseRequest) (*LabelCommand, error) {
+
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	labels, err := parseKvps(req.args, "LABEL")
+	if err != nil {
+		return nil, err
+	}
+
+	return &LabelCommand{
+		Labels:          labels,
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+}
+
+func parseAdd(req parseRequest) (*AddCommand, error) {
+	if len(req.args) < 2 {
+		return nil, errNoDestinationArgument("ADD")
+	}
+	flChown := req.flags.AddString("chown", "")
+	flChmod := req.flags.AddString("chmod", "")
+	flKeepNewer := req.flags.AddBool("keep-newer", false)
+	flIntoNamed := req.flags.AddBool("into-named", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	return &AddCommand{
+		SourcesAndDest:  SourcesAndDest(req.args),
+		withNameAndCode: newWithNameAndCode(req),
+		Chown:           flChown.Value,
+		Chmod:           flChmod.Value,
+		KeepNewer:       flKeepNewer.IsTrue(),
+		IntoNamed:       flIntoNamed.IsTrue(),
+	}, nil
+}
+
+func parseCopy(req parseRequest) (*CopyCommand, error) {
+	if len(req.args) < 2 {
+		return nil, errNoDestinationArgument("COPY")
+	}
+	flChown := req.flags.AddString("chown", "")
+	flChmod := req.flags.AddString("chmod", "")
+	flFrom := req.flags.AddString("from", "")
+	flLink := req.flags.AddBool("link", false)
+	flPreserveSymlinks := req.flags.AddBool("preserve-symlinks", false)
+	flExcludes := req.flags.AddStrings("exclude")
+	flRename := req.flags.AddBool("rename", false)
+	flNewerThan := req.flags.AddString("newer-than", "")
+	flPreserveDirMode := req.flags.AddBool("preserve-dir-mode", false)
+	flChownFrom := req.flags.AddString("chown-from", "")
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	if flRename.IsTrue() && len(req.args) != 3 {
+		return nil, errors.New("COPY --rename requires exactly three arguments: a source directory, a new name and a destination directory")
+	}
+	if flChownFrom.Value != "" && flChown.Value != "" {
+		return nil, errors.New("COPY --chown and --chown-from cannot be used together")
+	}
+	return &CopyCommand{
+		SourcesAndDest:   SourcesAndDest(req.args),
+		From:             flFrom.Value,
+		withNameAndCode:  newWithNameAndCode(req),
+		Chown:            flChown.Value,
+		Chmod:            flChmod.Value,
+		Link:             flLink.IsTrue(),
+		PreserveSymlinks: flPreserveSymlinks.IsTrue(),
+		Excludes:         flExcludes.StringValues,
+		NewerThan:        flNewerThan.Value,
+		Rename:           flRename.IsTrue(),
+		PreserveDirMode:  flPreserveDirMode.IsTrue(),
+		ChownFrom:        flChownFrom.Value,
+	}, nil
+}
+
+func parseFrom(req parseRequest) (*Stage, error) {
+	stageName, err := parseBuildStageName(req.args)
+	if err != nil {
+		return nil, err
+	}
+
+	flPlatform := req.flags.AddString("platform", "")
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	code := strings.TrimSpace(req.original)
+	return &Stage{
+		BaseName:   req.args[0],
+		Name:       stageName,
+		SourceCode: code,
+		Commands:   []Command{},
+		Platform:   flPlatform.Value,
+	}, nil
+
+}
+
+func parseBuildStageName(args []string) (string, error) {
+	stageName := ""
+	switch {
+	case len(args) == 3 && strings.EqualFold(args[1], "as"):
+		stageName = strings.ToLower(args[2])
+		if ok, _ := regexp.MatchString("^[a-z][a-z0-9-_\\.]*$", stageName); !ok {
+			return "", errors.Errorf("invalid name for build stage: %q, name can't start with a number or contain symbols", stageName)
+		}
+	case len(args) != 1:
+		return "", errors.New("FROM requires either one or three arguments")
+	}
+
+	return stageName, nil
+}
+
+func parseOnBuild(req parseRequest) (*OnbuildCommand, error) {
+	if len(req.args) == 0 {
+		return nil, errAtLeastOneArgument("ONBUILD")
+	}
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	expression := regexp.MustCompile(`(?i)^\s*ONBUILD\s*`).ReplaceAllString(req.original, "")
+	expression = strings.TrimSpace(expression)
+	var group string
+	if strings.HasPrefix(expression, "[group=") {
+		match := onbuildGroupRegexp.FindStringSubmatch(expression)
+		if match == nil {
+			return nil, fmt.Errorf("invalid ONBUILD group label in %q", expression)
+		}
+		group, expression = match[1], strings.TrimSpace(expression[len(match[0]):])
+	}
+	if expression == "" {
+		return nil, errAtLeastOneArgument("ONBUILD")
+	}
+
+	triggerInstruction := strings.ToUpper(strings.Fields(expression)[0])
+	switch triggerInstruction {
+	case "ONBUILD":
+		return nil, errors.New("Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed")
+	case "MAINTAINER", "FROM":
+		return nil, fmt.Errorf("%s isn't allowed as an ONBUILD trigger", triggerInstruction)
+	}
+
+	return &OnbuildCommand{
+		Expression:      expression,
+		Group:           group,
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+
+}
+
+var onbuildGroupRegexp = regexp.MustCompile(`^\[group=([a-zA-Z0-9][a-zA-Z0-9_.-]*)\]\s*`)
+
+func parseWorkdir(req parseRequest) (*WorkdirCommand, error) {
+	if len(req.args) != 1 {
+		return nil, errExactlyOneArgument("WORKDIR")
+	}
+
+	err := req.flags.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return &WorkdirCommand{
+		Path:            req.args[0],
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+
+}
+
+func parseShellDependentCommand(req parseRequest, emptyAsNil bool) ShellDependantCmdLine {
+	args := handleJSONArgs(req.args, req.attributes)
+	cmd := strslice.StrSlice(args)
+	if emptyAsNil && len(cmd) == 0 {
+		cmd = nil
+	}
+	return ShellDependantCmdLine{
+		CmdLine:      cmd,
+		PrependShell: !req.attributes["json"],
+	}
+}
+
+func parseRun(req parseRequest) (*RunCommand, error) {
+	cmd := &RunCommand{}
+
+	for _, fn := range parseRunPreHooks {
+		if err := fn(cmd, req); err != nil {
+			return nil, err
+		}
+	}
+
+	flExpand := req.flags.AddBool("expand", false)
+	flNoCache := req.flags.AddBool("no-cache", false)
+	flRetry := req.flags.AddString("retry", "")
+	flRetryDelay := req.flags.AddString("retry-delay", "")
+	flNetwork := req.flags.AddString("network", "")
+	flIf := req.flags.AddString("if", "")
+	flUser := req.flags.AddString("user", "")
+	flCacheKeyFrom := req.flags.AddStrings("cache-key-from")
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	for _, p := range flCacheKeyFrom.StringValues {
+		if p == "" {
+			return nil, errors.New("RUN --cache-key-from requires a file")
+		}
+	}
+	if flIf.IsUsed() && flIf.Value == "" {
+		return nil, errors.New("RUN --if requires a condition")
+	}
+	if flUser.IsUsed() && flUser.Value == "" {
+		return nil, errors.New("RUN --user requires a user")
+	}
+
+	cmd.ShellDependantCmdLine = parseShellDependentCommand(req, false)
+	cmd.withNameAndCode = newWithNameAndCode(req)
+	cmd.ExpandArgs = flExpand.IsTrue()
+	cmd.NoCache = flNoCache.IsTrue()
+	cmd.Network = flNetwork.Value
+	cmd.If = flIf.Value
+	cmd.User = flUser.Value
+	cmd.CacheKeyFrom = flCacheKeyFrom.StringValues
+
+	if flRetry.Value != "" {
+		retries, err := strconv.ParseInt(flRetry.Value, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for --retry")
+		}
+		if retries < 0 {
+			return nil, fmt.Errorf("--retry must not be negative (not %d)", retries)
+		}
+		cmd.Retries = int(retries)
+	}
+	if flRetryDelay.Value != "" {
+		delay, err := time.ParseDuration(flRetryDelay.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for --retry-delay")
+		}
+		if delay < 0 {
+			return nil, fmt.Errorf("--retry-delay must not be negative (not %s)", delay)
+		}
+		cmd.RetryDelay = delay
+	}
+
+	for _, fn := range parseRunPostHooks {
+		if err := fn(cmd, req); err != nil {
+			return nil, err
+		}
+	}
+
+	return cmd, nil
+}
+
+func parseCmd(req parseRequest) (*CmdCommand, error) {
+	flExpand := req.flags.AddBool("expand", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	cmdLine := parseShellDependentCommand(req, false)
+	if flExpand.IsTrue() && cmdLine.PrependShell {
+		return nil, errors.New("CMD --expand requires the JSON form")
+	}
+	return &CmdCommand{
+		ShellDependantCmdLine: cmdLine,
+		withNameAndCode:       newWithNameAndCode(req),
+		ExpandArgs:            flExpand.IsTrue(),
+	}, nil
+
+}
+
+func parseEntrypoint(req parseRequest) (*EntrypointCommand, error) {
+	flExpand := req.flags.AddBool("expand", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	cmdLine := parseShellDependentCommand(req, true)
+	if flExpand.IsTrue() && cmdLine.PrependShell {
+		return nil, errors.New("ENTRYPOINT --expand requires the JSON form")
+	}
+
+	cmd := &EntrypointCommand{
+		ShellDependantCmdLine: cmdLine,
+		withNameAndCode:       newWithNameAndCode(req),
+		ExpandArgs:            flExpand.IsTrue(),
+	}
+
+	return cmd, nil
+}
+
+// parseOptInterval(flag) is the duration of flag.Value, or 0 if
+// empty. An error is reported if the value is given and less than minimum duration.
+func parseOptInterval(f *Flag) (time.Duration, error) {
+	s := f.Value
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < container.MinimumDuration {
+		return 0, fmt.Errorf("Interval %#v cannot be less than %s", f.name, container.MinimumDuration)
+	}
+	return d, nil
+}
+func parseHealthcheck(req parseRequest) (*HealthCheckCommand, error) {
+	if len(req.args) == 0 {
+		return nil, errAtLeastOneArgument("HEALTHCHECK")
+	}
+	cmd := &HealthCheckCommand{
+		withNameAndCode: newWithNameAndCode(req),
+	}
+
+	typ := strings.ToUpper(req.args[0])
+	args := req.args[1:]
+	if typ == "NONE" {
+		if len(args) != 0 {
+			return nil, errors.New("HEALTHCHECK NONE takes no arguments")
+		}
+		test := strslice.StrSlice{typ}
+		cmd.Health = &container.HealthConfig{
+			Test: test,
+		}
+	} else {
+
+		healthcheck := container.HealthConfig{}
+
+		flInterval := req.flags.AddString("interval", "")
+		flTimeout := req.flags.AddString("timeout", "")
+		flStartPeriod := req.flags.AddString("start-period", "")
+		flRetries := req.flags.AddString("retries", "")
+
+		if err := req.flags.Parse(); err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case "CMD":
+			cmdSlice := handleJSONArgs(args, req.attributes)
+			if len(cmdSlice) == 0 {
+				return nil, errors.New("Missing command after HEALTHCHECK CMD")
+			}
+
+			if !req.attributes["json"] {
+				typ = "CMD-SHELL"
+			}
+
+			healthcheck.Test = strslice.StrSlice(append([]string{typ}, cmdSlice...))
+		default:
+			return nil, fmt.Errorf("Unknown type %#v in HEALTHCHECK (try CMD)", typ)
+		}
+
+		interval, err := parseOptInterval(flInterval)
+		if err != nil {
+			return nil, err
+		}
+		healthcheck.Interval = interval
+
+		timeout, err := parseOptInterval(flTimeout)
+		if err != nil {
+			return nil, err
+		}
+		healthcheck.Timeout = timeout
+
+		startPeriod, err := parseOptInterval(flStartPeriod)
+		if err != nil {
+			return nil, err
+		}
+		healthcheck.StartPeriod = startPeriod
+
+		if flRetries.Value != "" {
+			retries, err := strconv.ParseInt(flRetries.Value, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			if retries < 1 {
+				return nil, fmt.Errorf("--retries must be at least 1 (not %d)", retries)
+			}
+			healthcheck.Retries = int(retries)
+		} else {
+			healthcheck.Retries = 0
+		}
+
+		cmd.Health = &healthcheck
+	}
+	return cmd, nil
+}
+
+func parseExpose(req parseRequest) (*ExposeCommand, error) {
+	portsTab := req.args
+
+	if len(req.args) == 0 {
+		return nil, errAtLeastOneArgument("EXPOSE")
+	}
+
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(portsTab)
+	return &ExposeCommand{
+		Ports:           portsTab,
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+}
+
+func parseUser(req parseRequest) (*UserCommand, error) {
+	if len(req.args) != 1 {
+		return nil, errExactlyOneArgument("USER")
+	}
+
+	flStrict := req.flags.AddBool("strict", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	return &UserCommand{
+		User:            req.args[0],
+		Strict:          flStrict.IsTrue(),
+		withNameAndCode: newWithNameAndCode(req),
+	}, nil
+}
+
+func parseVolume(req parseRequest) (*VolumeCommand, error) {
+	if len(req.args) == 0 {
+		return nil, errAtLeastOneArgument("VOLUME")
+	}
+
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	cmd := &VolumeCommand{
+		withNameAndCode: newWithNameAndCode(req),
+	}
+
+	for _, v := range req.args {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return nil, errors.New("VOLUME specified can not be an empty string")
+		}
+		cmd.Volumes = append(cmd.Volumes, v)
+	}
+	return cmd, nil
+
+}
+
+func parseDelete(req parseRequest) (*DeleteCommand, error) {
+	if len(req.args) == 0 {
+		return nil, errAtLeastOneArgument("DELETE")
+	}
+	flStrict := req.flags.AddBool("strict", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	cmd := &DeleteCommand{
+		Strict:          flStrict.IsTrue(),
+		withNameAndCode: newWithNameAndCode(req),
+	}
+	for _, p := range req.args {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			return nil, errors.New("DELETE specified can not be an empty string")
+		}
+		cmd.Paths = append(cmd.Paths, p)
+	}
+	return cmd, nil
+}
+
+func parseStopSignal(req parseRequest) (*StopSignalCommand, error) {
+	if len(req.args) != 1 {
+		return nil, errExactlyOneArgument("STOPSIGNAL")
+	}
+	sig := req.args[0]
+
+	cmd := &StopSignalCommand{
+		Signal:          sig,
+		withNameAndCode: newWithNameAndCode(req),
+	}
+	return cmd, nil
+
+}
+
+func parseArg(req parseRequest) (*ArgCommand, error) {
+	flRequired := req.flags.AddBool("required", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	if len(req.args) != 1 {
+		return nil, errExactlyOneArgument("ARG")
+	}
+
+	kvpo := KeyValuePairOptional{}
+
+	arg := req.args[0]
+	// 'arg' can just be a name or name-value pair. Note that this is different
+	// from 'env' that handles the split of name and value at the parser level.
+	// The reason for doing it differently for 'arg' is that we support just
+	// defining an arg and not assign it a value (while 'env' always expects a
+	// name-value pair). If possible, it will be good to harmonize the two.
+	if strings.Contains(arg, "=") {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts[0]) == 0 {
+			return nil, errBlankCommandNames("ARG")
+		}
+
+		kvpo.Key = parts[0]
+		kvpo.Value = &parts[1]
+	} else {
+		kvpo.Key = arg
+	}
+	if flRequired.IsTrue() && kvpo.Value != nil {
+		return nil, errors.Errorf("ARG --required %s cannot have a default value", kvpo.Key)
+	}
+
+	return &ArgCommand{
+		KeyValuePairOptional: kvpo,
+		withNameAndCode:      newWithNameAndCode(req),
+		Required:             flRequired.IsTrue(),
+	}, nil
+}
+
+func parseShell(req parseRequest) (*ShellCommand, error) {
+	flOS := req.flags.AddString("os", "")
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+	if flOS.IsUsed() && flOS.Value == "" {
+		return nil, errors.New("SHELL --os requires an operating system")
+	}
+	shellSlice := handleJSONArgs(req.args, req.attributes)
+	switch {
+	case len(shellSlice) == 0:
+		// SHELL []
+		return nil, errAtLeastOneArgument("SHELL")
+	case req.attributes["json"]:
+		// SHELL ["powershell", "-command"]
+
+		return &ShellCommand{
+			Shell:           strslice.StrSlice(shellSlice),
+			OS:              strings.ToLower(flOS.Value),
+			withNameAndCode: newWithNameAndCode(req),
+		}, nil
+	default:
+		// SHELL powershell -command - not JSON
+		return nil, errNotJSON("SHELL", req.original)
+	}
+}
+
+func errAtLeastOneArgument(command string) error {
+	return errors.Errorf("%s requires at least one argument", command)
+}
+
+func errExactlyOneArgument(command string) error {
+	return errors.Errorf("%s requires exactly one argument", command)
+}
+
+func errNoDestinationArgument(command string) error {
+	return errors.Errorf("%s requires at least two arguments, but only one was provided. Destination could not be determined.", command)
+}
+
+func errBlankCommandNames(command string) error {
+	return errors.Errorf("%s names can not be blank", command)
+}
+
+func errTooManyArguments(command string) error {
+	return errors.Errorf("Bad input to %s, too many arguments", command)
+}
@@ -13,11 +13,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/chrootarchive"
@@ -108,15 +110,14 @@ func (b *Builder) commitContainer(dispatchState *dispatchState, id string, conta
 
 	imageID, err := b.docker.CommitBuildStep(commitCfg)
 	dispatchState.imageID = string(imageID)
-	return err
-}
-
-func (b *Builder) exportImage(state *dispatchState, layer builder.RWLayer, parent builder.Image, runConfig *container.Config) error {
-	newLayer, err := layer.Commit()
 	if err != nil {
 		return err
 	}
+	dispatchState.recordCacheKey(containerConfig)
+	return nil
+}
 
+func (b *Builder) exportImage(state *dispatchState, newLayer builder.ROLayer, parent builder.Image, runConfig *container.Config) error {
 	// add an image mount without an image so the layer is properly unmounted
 	// if there is an error before we can add the full mount with image
 	b.imageSources.Add(newImageMount(nil, newLayer))
@@ -147,17 +148,95 @@ func (b *Builder) exportImage(state *dispatchState, layer builder.RWLayer, paren
 
 	state.imageID = exportedImage.ImageID()
 	b.imageSources.Add(newImageMount(exportedImage, newLayer))
+	state.recordCacheKey(runConfig)
+	return nil
+}
+
+// labelImage replaces the image built by state with a copy of it that has the
+// label key set to the value returned by value for the image. The image is
+// kept as it is if value returns an empty string.
+func (b *Builder) labelImage(state *dispatchState, key string, value func(img *image.Image) (string, error)) error {
+	im, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return err
+	}
+	img, ok := im.Image().(*image.Image)
+	if !ok {
+		return errors.Errorf("unexpected image type")
+	}
+	v, err := value(img)
+	if err != nil || v == "" {
+		return err
+	}
+
+	config := copyRunConfig(img.Config)
+	labels := make(map[string]string, len(config.Labels)+1)
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[key] = v
+	config.Labels = labels
+
+	newImage := *img
+	newImage.Config = config
+	dt, err := newImage.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode image config")
+	}
+	exportedImage, err := b.docker.CreateImage(dt, img.Parent.String())
+	if err != nil {
+		return err
+	}
+	state.imageID = exportedImage.ImageID()
 	return nil
 }
 
 func (b *Builder) performCopy(req dispatchRequest, inst copyInstruction) error {
 	state := req.state
+	if err := b.checkCopyLayerFiles(inst); err != nil {
+		return err
+	}
 	srcHash := getSourceHashFromInfos(inst.infos)
 
 	var chownComment string
 	if inst.chownStr != "" {
 		chownComment = fmt.Sprintf("--chown=%s", inst.chownStr)
 	}
+	if inst.chmodStr != "" {
+		chownComment = fmt.Sprintf("--chmod=%s ", inst.chmodStr) + chownComment
+	}
+	if inst.chownFrom != "" {
+		chownComment = fmt.Sprintf("--chown-from=%s ", inst.chownFrom) + chownComment
+	}
+	if inst.preserveSymlinks {
+		chownComment = "--preserve-symlinks " + chownComment
+	}
+	if inst.link {
+		chownComment = "--link " + chownComment
+	}
+	if inst.keepNewer {
+		chownComment = "--keep-newer " + chownComment
+	}
+	if inst.preserveDirMode {
+		chownComment = "--preserve-dir-mode " + chownComment
+	}
+	if inst.intoNamed {
+		chownComment = "--into-named " + chownComment
+	}
+	// the modes given with --chmod are not normalized
+	normalizeModes := b.options.ModeNormalize && inst.chmodStr == ""
+	if normalizeModes {
+		if state.operatingSystem == "windows" {
+			return errdefs.NotImplemented(errors.New("mode-normalize is not supported for Windows images"))
+		}
+		chownComment = "--mode-normalize " + chownComment
+	}
+	if inst.newerThan != "" {
+		chownComment = fmt.Sprintf("--newer-than=%s ", inst.newerThan) + chownComment
+	}
+	for i := len(inst.excludes) - 1; i >= 0; i-- {
+		chownComment = fmt.Sprintf("--exclude=%s ", inst.excludes[i]) + chownComment
+	}
 	commentStr := fmt.Sprintf("%s %s%s in %s ", inst.cmdName, chownComment, srcHash, inst.dest)
 
 	// TODO: should this have been using origPaths instead of srcHash in the comment?
@@ -165,54 +244,185 @@ func (b *Builder) performCopy(req dispatchRequest, inst copyInstruction) error {
 		state.runConfig,
 		withCmdCommentString(commentStr, state.operatingSystem))
 	hit, err := b.probeCache(state, runConfigWithCommentCmd)
-	if err != nil || hit {
+	if err != nil {
 		return err
 	}
+	if hit {
+		return b.recordSBOMFiles(state, inst)
+	}
 
 	imageMount, err := b.imageSources.Get(state.imageID, true, req.builder.platform)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get destination image %q", state.imageID)
 	}
 
-	rwLayer, err := imageMount.NewRWLayer()
+	layerMount := imageMount
+	if inst.link {
+		// A linked copy is performed on an empty layer so that the resulting
+		// diff only depends on the copied content and not on the parent image.
+		layerMount, err = b.imageSources.Get("", true, req.builder.platform)
+		if err != nil {
+			return errors.Wrap(err, "failed to get empty layer for linked copy")
+		}
+	}
+
+	rwLayer, err := layerMount.NewRWLayer()
 	if err != nil {
 		return err
 	}
 	defer rwLayer.Release()
 
-	destInfo, err := createDestInfo(state.runConfig.WorkingDir, inst, rwLayer, state.operatingSystem)
-	if err != nil {
-		return err
+	destInfos := make([]copyInfo, len(inst.infos))
+	for i, info := range inst.infos {
+		if destInfos[i], err = createDestInfo(state.runConfig.WorkingDir, inst, inst.destFor(info), rwLayer, state.operatingSystem); err != nil {
+			return err
+		}
+	}
+
+	// users and groups are looked up, and the symlinks in the destination
+	// are resolved, in the image being built, which for a linked copy is not
+	// the layer the files are copied to
+	imageRoot := rwLayer.Root()
+	if inst.link {
+		imageLayer, err := imageMount.NewRWLayer()
+		if err != nil {
+			return err
+		}
+		defer imageLayer.Release()
+		imageRoot = imageLayer.Root()
+		for i := range destInfos {
+			if destInfos[i].path, err = resolveDestInRoot(imageLayer.Root(), destInfos[i].path); err != nil {
+				return err
+			}
+		}
 	}
 
+	ctrRootPath := imageRoot.Path()
+
 	chownPair := b.idMappings.RootPair()
 	// if a chown was requested, perform the steps to get the uid, gid
 	// translated (if necessary because of user namespaces), and replace
 	// the root pair with the chown pair for copy operations
 	if inst.chownStr != "" {
-		chownPair, err = parseChownFlag(inst.chownStr, destInfo.root.Path(), b.idMappings)
+		chownPair, err = parseChownFlag(inst.chownStr, ctrRootPath, b.idMappings)
 		if err != nil {
 			return errors.Wrapf(err, "unable to convert uid/gid chown string to host mapping")
 		}
 	}
+	if inst.chownFrom != "" {
+		if chownPair, err = chownFromPair(imageRoot, inst.chownFrom); err != nil {
+			return err
+		}
+	}
+	// the missing parent directories of the destination are owned by the
+	// current user, so that it can write to them in later steps
+	parentPair := chownPair
+	if inst.chownStr == "" && inst.chownFrom == "" && state.runConfig.User != "" {
+		parentPair, err = parseUserPair(state.runConfig.User, ctrRootPath, b.idMappings)
+		if err != nil {
+			return errors.Wrapf(err, "unable to convert user %s to host mapping", state.runConfig.User)
+		}
+	}
+	parentMode, err := parseChmodFlag(inst.chmodStr, state.operatingSystem)
+	if err != nil {
+		return err
+	}
 
-	for _, info := range inst.infos {
+	for i, info := range inst.infos {
 		opts := copyFileOptions{
 			decompress: inst.allowLocalDecompression,
-			archiver:   b.getArchiver(info.root, destInfo.root),
+			keepNewer:  inst.keepNewer,
+			intoNamed:  inst.intoNamed,
+			normalize:  normalizeModes,
+			symlinks:   inst.preserveSymlinks,
+			dirMode:    inst.preserveDirMode,
+			opaque:     inst.link && state.operatingSystem != "windows",
+			excludes:   inst.excludesFor(info),
+			archiver:   b.getArchiver(info.root, destInfos[i].root),
 			chownPair:  chownPair,
+			parentPair: parentPair,
+			parentMode: parentMode,
+		}
+		if len(b.options.WarnOverwrite) > 0 {
+			overwritten, err := overwrittenPaths(imageRoot, destInfos[i], info, opts, b.options.WarnOverwrite)
+			if err != nil {
+				return errors.Wrap(err, "failed to check the overwritten files")
+			}
+			for _, p := range overwritten {
+				fmt.Fprintf(b.warningOutput(), "[Warning] %s overwrites %s\n", inst.cmdName, p)
+			}
 		}
-		if err := performCopyForInfo(destInfo, info, opts); err != nil {
+		if err := performCopyForInfo(destInfos[i], info, opts); err != nil {
 			return errors.Wrapf(err, "failed to copy files")
 		}
 	}
-	return b.exportImage(state, rwLayer, imageMount.Image(), runConfigWithCommentCmd)
+
+	var newLayer builder.ROLayer
+	if inst.link {
+		for _, destInfo := range destInfos {
+			if err := resetDestParentTimes(destInfo); err != nil {
+				return err
+			}
+		}
+		newLayer, err = rwLayer.CommitOnto(imageMount.layer)
+	} else {
+		newLayer, err = rwLayer.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	if err := b.exportImage(state, newLayer, imageMount.Image(), runConfigWithCommentCmd); err != nil {
+		return err
+	}
+	return b.recordSBOMFiles(state, inst)
 }
 
-func createDestInfo(workingDir string, inst copyInstruction, rwLayer builder.RWLayer, platform string) (copyInfo, error) {
+// checkUserResolves returns an error if the name of the user or of the group
+// of a USER instruction is not found in the image of the stage
+func (b *Builder) checkUserResolves(state *dispatchState, user string) error {
+	imageMount, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get image %q", state.imageID)
+	}
+	rwLayer, err := imageMount.NewRWLayer()
+	if err != nil {
+		return err
+	}
+	defer rwLayer.Release()
+	return checkUserGroup(user, rwLayer.Root().Path())
+}
+
+// resetDestParentTimes sets the modification time of the directories leading
+// to the destination of a linked copy to the Unix epoch. These directories are
+// created by the copy itself, so their timestamps would otherwise make
+// identical copies produce different layers.
+func resetDestParentTimes(dest copyInfo) error {
+	destPath, err := dest.fullPath()
+	if err != nil {
+		return err
+	}
+	epoch := time.Unix(0, 0)
+	for p := destPath; p != dest.root.Path() && p != dest.root.Dir(p); p = dest.root.Dir(p) {
+		fi, err := dest.root.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		case !fi.IsDir():
+			continue
+		}
+		if err := system.Chtimes(p, epoch, epoch); err != nil {
+			return errors.Wrapf(err, "failed to reset times of %s", p)
+		}
+	}
+	return nil
+}
+
+func createDestInfo(workingDir string, inst copyInstruction, dest string, rwLayer builder.RWLayer, platform string) (copyInfo, error) {
 	// Twiddle the destination when it's a relative path - meaning, make it
 	// relative to the WORKINGDIR
-	dest, err := normalizeDest(workingDir, inst.dest, platform)
+	dest, err := normalizeDest(workingDir, dest, platform)
 	if err != nil {
 		return copyInfo{}, errors.Wrapf(err, "invalid %s", inst.cmdName)
 	}
@@ -220,6 +430,26 @@ func createDestInfo(workingDir string, inst copyInstruction, rwLayer builder.RWL
 	return copyInfo{root: rwLayer.Root(), path: dest}, nil
 }
 
+// resolveDestInRoot resolves the symlinks in dest, which may point to paths
+// that do not exist yet, without leaving root. The result is a path relative to
+// root, so it can be used on another layer than the one it was resolved in.
+func resolveDestInRoot(root containerfs.ContainerFS, dest string) (string, error) {
+	resolved, err := root.ResolveScopedPath(dest, true)
+	if err != nil {
+		return "", err
+	}
+	rel, err := root.Rel(root.Path(), resolved)
+	if err != nil {
+		return "", err
+	}
+	sep := string(root.Separator())
+	resolvedDest := root.Join(sep, rel)
+	if endsInSlash(root, dest) && !endsInSlash(root, resolvedDest) {
+		resolvedDest += sep
+	}
+	return resolvedDest, nil
+}
+
 // normalizeDest normalises the destination of a COPY/ADD command in a
 // platform semantically consistent way.
 func normalizeDest(workingDir, requested string, platform string) (string, error) {
@@ -322,6 +552,12 @@ func withCmdCommentString(comment string, platform string) runConfigModifier {
 	}
 }
 
+func withUser(user string) runConfigModifier {
+	return func(runConfig *container.Config) {
+		runConfig.User = user
+	}
+}
+
 func withEnv(env []string) runConfigModifier {
 	return func(runConfig *container.Config) {
 		runConfig.Env = env
@@ -343,6 +579,45 @@ func withEntrypointOverride(cmd []string, entrypoint []string) runConfigModifier
 	}
 }
 
+// cacheKeyFromLabel holds the digests of the files of RUN --cache-key-from
+const cacheKeyFromLabel = "com.docker.build.cache-key-from"
+
+// withCacheKeyFrom sets the digests of the files of RUN --cache-key-from as a
+// label of the config the cache is probed with, which is only recorded as the
+// container config of the image, so that changing a file does not match the
+// cache. The label is left unset if key is empty.
+func withCacheKeyFrom(key string) runConfigModifier {
+	return func(runConfig *container.Config) {
+		if key == "" {
+			return
+		}
+		// the labels were copied by copyRunConfig
+		if runConfig.Labels == nil {
+			runConfig.Labels = make(map[string]string)
+		}
+		runConfig.Labels[cacheKeyFromLabel] = key
+	}
+}
+
+const runConditionLabel = "com.docker.build.run-if"
+
+// withRunCondition sets the expanded condition of RUN --if as a label of the
+// config the cache is probed with, so that a command is not taken from the
+// cache of the same command run with another condition. The label is left
+// unset if condition is empty.
+func withRunCondition(condition string) runConfigModifier {
+	return func(runConfig *container.Config) {
+		if condition == "" {
+			return
+		}
+		// the labels were copied by copyRunConfig
+		if runConfig.Labels == nil {
+			runConfig.Labels = make(map[string]string)
+		}
+		runConfig.Labels[runConditionLabel] = condition
+	}
+}
+
 // withoutHealthcheck disables healthcheck.
 //
 // The dockerfile RUN instruction expect to run without healthcheck
@@ -407,13 +682,18 @@ func getShell(c *container.Config, os string) []string {
 }
 
 func (b *Builder) probeCache(dispatchState *dispatchState, runConfig *container.Config) (bool, error) {
+	if dispatchState.noCache {
+		return false, nil
+	}
 	cachedID, err := b.imageProber.Probe(dispatchState.imageID, runConfig)
 	if cachedID == "" || err != nil {
 		return false, err
 	}
 	fmt.Fprint(b.Stdout, " ---> Using cache\n")
+	b.cacheHits++
 
 	dispatchState.imageID = cachedID
+	dispatchState.recordCacheKey(runConfig)
 	return true, nil
 }
 
@@ -423,21 +703,26 @@ func (b *Builder) probeAndCreate(dispatchState *dispatchState, runConfig *contai
 	if hit, err := b.probeCache(dispatchState, runConfig); err != nil || hit {
 		return "", err
 	}
-	return b.create(runConfig)
+	return b.create(runConfig, "")
 }
 
-func (b *Builder) create(runConfig *container.Config) (string, error) {
+// create creates a container for runConfig. The network mode of the build is
+// used unless networkMode is set.
+func (b *Builder) create(runConfig *container.Config, networkMode string) (string, error) {
 	logrus.Debugf("[BUILDER] Command to be executed: %v", runConfig.Cmd)
 
 	isWCOW := runtime.GOOS == "windows" && b.platform != nil && b.platform.OS == "windows"
 	hostConfig := hostConfigFromOptions(b.options, isWCOW)
+	if networkMode != "" {
+		hostConfig.NetworkMode = container.NetworkMode(networkMode)
+	}
 	container, err := b.containerManager.Create(runConfig, hostConfig)
 	if err != nil {
 		return "", err
 	}
 	// TODO: could this be moved into containerManager.Create() ?
 	for _, warning := range container.Warnings {
-		fmt.Fprintf(b.Stdout, " ---> [Warning] %s\n", warning)
+		fmt.Fprintf(b.warningOutput(), " ---> [Warning] %s\n", warning)
 	}
 	fmt.Fprintf(b.Stdout, " ---> Running in %s\n", stringid.TruncateID(container.ID))
 	return container.ID, nil
@@ -449,6 +734,7 @@ func hostConfigFromOptions(options *types.ImageBuildOptions, isWCOW bool) *conta
 		CPUShares:    options.CPUShares,
 		CPUPeriod:    options.CPUPeriod,
 		CPUQuota:     options.CPUQuota,
+		NanoCPUs:     options.NanoCPUs,
 		CpusetCpus:   options.CPUSetCPUs,
 		CpusetMems:   options.CPUSetMems,
 		Memory:       options.Memory,
@@ -465,6 +751,12 @@ func hostConfigFromOptions(options *types.ImageBuildOptions, isWCOW bool) *conta
 		// Set a log config to override any default value set on the daemon
 		LogConfig:  defaultLogConfig,
 		ExtraHosts: options.ExtraHosts,
+		DNS:        options.DNS,
+		DNSSearch:  options.DNSSearch,
+		DNSOptions: options.DNSOptions,
+		// only the containers of RUN are started, the other ones are
+		// committed without running
+		ReadonlyRootfs: options.RunReadonly,
 	}
 
 	// For WCOW, the default of 20GB hard-coded in the platform
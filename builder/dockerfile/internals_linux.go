@@ -1,10 +1,14 @@
 package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 
 import (
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/symlink"
 	lcUser "github.com/opencontainers/runc/libcontainer/user"
@@ -24,13 +28,9 @@ func parseChownFlag(chown, ctrRootPath string, idMappings *idtools.IDMappings) (
 		userStr, grpStr = parts[0], parts[1]
 	}
 
-	passwdPath, err := symlink.FollowSymlinkInScope(filepath.Join(ctrRootPath, "etc", "passwd"), ctrRootPath)
+	passwdPath, groupPath, err := userDatabasePaths(ctrRootPath)
 	if err != nil {
-		return idtools.IDPair{}, errors.Wrapf(err, "can't resolve /etc/passwd path in container rootfs")
-	}
-	groupPath, err := symlink.FollowSymlinkInScope(filepath.Join(ctrRootPath, "etc", "group"), ctrRootPath)
-	if err != nil {
-		return idtools.IDPair{}, errors.Wrapf(err, "can't resolve /etc/group path in container rootfs")
+		return idtools.IDPair{}, err
 	}
 	uid, err := lookupUser(userStr, passwdPath)
 	if err != nil {
@@ -49,6 +49,103 @@ func parseChownFlag(chown, ctrRootPath string, idMappings *idtools.IDMappings) (
 	return chownPair, nil
 }
 
+// chownFromPair returns the uid and gid of the owner of the path p of the
+// image, whose symlinks are resolved in root. They are already host ids, so
+// they are not converted for user namespaces.
+func chownFromPair(root containerfs.ContainerFS, p string) (idtools.IDPair, error) {
+	resolved, err := root.ResolveScopedPath(p, true)
+	if err != nil {
+		return idtools.IDPair{}, err
+	}
+	fi, err := root.Stat(resolved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idtools.IDPair{}, errdefs.InvalidParameter(errors.Errorf("COPY --chown-from: %s does not exist in the image", p))
+		}
+		return idtools.IDPair{}, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return idtools.IDPair{}, errors.Errorf("COPY --chown-from: cannot get the owner of %s", p)
+	}
+	return idtools.IDPair{UID: int(st.Uid), GID: int(st.Gid)}, nil
+}
+
+// parseUserPair returns the host uid and gid of a USER value, using the
+// primary group of the user if no group is specified
+func parseUserPair(user, ctrRootPath string, idMappings *idtools.IDMappings) (idtools.IDPair, error) {
+	passwdPath, groupPath, err := userDatabasePaths(ctrRootPath)
+	if err != nil {
+		return idtools.IDPair{}, err
+	}
+	execUser, err := lcUser.GetExecUserPath(user, &lcUser.ExecUser{}, passwdPath, groupPath)
+	if err != nil {
+		return idtools.IDPair{}, errors.Wrapf(err, "can't find uid/gid for user %s", user)
+	}
+
+	// convert as necessary because of user namespaces
+	userPair, err := idMappings.ToHost(idtools.IDPair{UID: execUser.Uid, GID: execUser.Gid})
+	if err != nil {
+		return idtools.IDPair{}, errors.Wrapf(err, "unable to convert uid/gid to host mapping")
+	}
+	return userPair, nil
+}
+
+// checkUserGroup returns an error naming the user and the group of the
+// user[:group] value that are not found in the /etc/passwd and /etc/group
+// files of the root filesystem ctrRootPath, such as a group that is still to
+// be created for an existing user. Numeric ids are always found.
+func checkUserGroup(user, ctrRootPath string) error {
+	passwdPath, groupPath, err := userDatabasePaths(ctrRootPath)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(user, ":", 2)
+	var missing []string
+	if _, err := lookupUser(parts[0], passwdPath); err != nil {
+		if !isUserNotFound(err) {
+			return errors.Wrapf(err, "USER --strict: failed to look up user %s", parts[0])
+		}
+		missing = append(missing, "user "+parts[0]+" not found in /etc/passwd")
+	}
+	if len(parts) == 2 {
+		if _, err := lookupGroup(parts[1], groupPath); err != nil {
+			if !isUserNotFound(err) {
+				return errors.Wrapf(err, "USER --strict: failed to look up group %s", parts[1])
+			}
+			missing = append(missing, "group "+parts[1]+" not found in /etc/group")
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return errdefs.InvalidParameter(errors.Errorf("USER --strict: %s of the image, create it in a RUN instruction before USER", missing[0]))
+	default:
+		return errdefs.InvalidParameter(errors.Errorf("USER --strict: %s of the image, create them in a RUN instruction before USER", strings.Join(missing, " and ")))
+	}
+}
+
+// isUserNotFound returns whether err of lookupUser or lookupGroup means that
+// the name is not in the file, or that the file does not exist, rather than
+// that the file could not be read
+func isUserNotFound(err error) bool {
+	_, isPathErr := err.(*os.PathError)
+	return !isPathErr || os.IsNotExist(err)
+}
+
+func userDatabasePaths(ctrRootPath string) (string, string, error) {
+	passwdPath, err := symlink.FollowSymlinkInScope(filepath.Join(ctrRootPath, "etc", "passwd"), ctrRootPath)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "can't resolve /etc/passwd path in container rootfs")
+	}
+	groupPath, err := symlink.FollowSymlinkInScope(filepath.Join(ctrRootPath, "etc", "group"), ctrRootPath)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "can't resolve /etc/group path in container rootfs")
+	}
+	return passwdPath, groupPath, nil
+}
+
 func lookupUser(userStr, filepath string) (int, error) {
 	// if the string is actually a uid integer, parse to int and return
 	// as we don't need to translate with the help of files
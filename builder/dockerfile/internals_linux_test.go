@@ -5,9 +5,13 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
 	"github.com/docker/docker/pkg/idtools"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+	"gotest.tools/skip"
 )
 
 func TestChownFlagParsing(t *testing.T) {
@@ -136,3 +140,64 @@ othergrp:x:6666:
 		})
 	}
 }
+
+func TestChownFromPair(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	dir := fs.NewDir(t, "chown-from",
+		fs.WithDir("var", fs.WithDir("lib", fs.WithDir("app"))))
+	defer dir.Remove()
+	appDir := filepath.Join(dir.Path(), "var", "lib", "app")
+	assert.NilError(t, os.Chown(appDir, 1001, 1002))
+	// the target of the symlink is an absolute path of the image
+	assert.NilError(t, os.Symlink("/var/lib/app", filepath.Join(dir.Path(), "app")))
+	root := containerfs.NewLocalContainerFS(dir.Path())
+
+	for _, p := range []string{"/var/lib/app", "/app"} {
+		pair, err := chownFromPair(root, p)
+		assert.Check(t, err)
+		assert.Check(t, is.DeepEqual(idtools.IDPair{UID: 1001, GID: 1002}, pair), p)
+	}
+
+	_, err := chownFromPair(root, "/missing")
+	assert.Check(t, is.Error(err, "COPY --chown-from: /missing does not exist in the image"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestCheckUserGroup(t *testing.T) {
+	dir := fs.NewDir(t, "check-user-group",
+		fs.WithDir("etc",
+			fs.WithFile("passwd", "root:x:0:0::/root:/bin/sh\napp:x:1001:1002::/app:/bin/sh\n"),
+			fs.WithFile("group", "root:x:0:\napp:x:1002:\n")))
+	defer dir.Remove()
+
+	testCases := []struct {
+		user        string
+		expectedErr string
+	}{
+		{user: "app"},
+		{user: "app:app"},
+		{user: "app:root"},
+		{user: "1042:1043"},
+		{user: "bob", expectedErr: "USER --strict: user bob not found in /etc/passwd of the image, create it in a RUN instruction before USER"},
+		// the user exists, but its group still has to be created
+		{user: "app:devs", expectedErr: "USER --strict: group devs not found in /etc/group of the image, create it in a RUN instruction before USER"},
+		{user: "bob:devs", expectedErr: "USER --strict: user bob not found in /etc/passwd and group devs not found in /etc/group of the image, create them in a RUN instruction before USER"},
+	}
+	for _, tc := range testCases {
+		err := checkUserGroup(tc.user, dir.Path())
+		if tc.expectedErr == "" {
+			assert.Check(t, err, tc.user)
+			continue
+		}
+		assert.Check(t, is.Error(err, tc.expectedErr), tc.user)
+		assert.Check(t, errdefs.IsInvalidParameter(err), tc.user)
+	}
+
+	// an image without a group file has no group
+	noGroup := fs.NewDir(t, "check-user-group-no-group",
+		fs.WithDir("etc", fs.WithFile("passwd", "app:x:1001:1002::/app:/bin/sh\n")))
+	defer noGroup.Remove()
+	assert.Check(t, checkUserGroup("app", noGroup.Path()))
+	err := checkUserGroup("app:app", noGroup.Path())
+	assert.Check(t, is.Error(err, "USER --strict: group app not found in /etc/group of the image, create it in a RUN instruction before USER"))
+}
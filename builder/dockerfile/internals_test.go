@@ -3,6 +3,7 @@ package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
@@ -12,9 +13,11 @@ import (
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/containerfs"
 	"github.com/docker/go-connections/nat"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
 	"gotest.tools/skip"
 )
 
@@ -79,7 +82,7 @@ func readAndCheckDockerfile(t *testing.T, testName, contextDir, dockerfilePath,
 		Options: &types.ImageBuildOptions{Dockerfile: dockerfilePath},
 		Source:  tarStream,
 	}
-	_, _, err = remotecontext.Detect(config)
+	_, _, _, err = remotecontext.Detect(config)
 	assert.Check(t, is.Error(err, expectedError))
 }
 
@@ -171,3 +174,30 @@ func TestDeepCopyRunConfig(t *testing.T) {
 	copy.Shell[0] = "sh"
 	assert.Check(t, is.DeepEqual(fullMutableRunConfig(), runConfig))
 }
+
+func TestResolveDestInRoot(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "symlinks are not supported on Windows")
+	root := fs.NewDir(t, "resolve-dest", fs.WithDir("target"))
+	defer root.Remove()
+	assert.NilError(t, os.Symlink("/target", filepath.Join(root.Path(), "link")))
+	assert.NilError(t, os.Symlink("/missing", filepath.Join(root.Path(), "dangling")))
+	assert.NilError(t, os.Symlink("../../../etc", filepath.Join(root.Path(), "escaping")))
+
+	testCases := []struct {
+		dest     string
+		expected string
+	}{
+		{dest: "/", expected: "/"},
+		{dest: "/plain/dir/", expected: "/plain/dir/"},
+		{dest: "/link/", expected: "/target/"},
+		{dest: "/link/file", expected: "/target/file"},
+		{dest: "/dangling/", expected: "/missing/"},
+		{dest: "/escaping/passwd", expected: "/etc/passwd"},
+	}
+	containerRoot := containerfs.NewLocalContainerFS(root.Path())
+	for _, tc := range testCases {
+		resolved, err := resolveDestInRoot(containerRoot, tc.dest)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(tc.expected, resolved), tc.dest)
+	}
+}
@@ -1,7 +1,24 @@
 package dockerfile // import "github.com/docker/docker/builder/dockerfile"
 
-import "github.com/docker/docker/pkg/idtools"
+import (
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+)
 
 func parseChownFlag(chown, ctrRootPath string, idMappings *idtools.IDMappings) (idtools.IDPair, error) {
 	return idMappings.RootPair(), nil
 }
+
+func chownFromPair(root containerfs.ContainerFS, p string) (idtools.IDPair, error) {
+	return idtools.IDPair{}, errdefs.NotImplemented(errors.New("COPY --chown-from is not supported for Windows images"))
+}
+
+func checkUserGroup(user, ctrRootPath string) error {
+	return errdefs.NotImplemented(errors.New("USER --strict is not supported for Windows images"))
+}
+
+func parseUserPair(user, ctrRootPath string, idMappings *idtools.IDMappings) (idtools.IDPair, error) {
+	return idMappings.RootPair(), nil
+}
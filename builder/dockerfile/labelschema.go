@@ -0,0 +1,54 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/pkg/urlutil"
+)
+
+// Annotation labels from the OCI image spec that are added by the
+// LabelSchema option
+const (
+	labelSchemaCreated  = "org.opencontainers.image.created"
+	labelSchemaRevision = "org.opencontainers.image.revision"
+	labelSchemaSource   = "org.opencontainers.image.source"
+)
+
+// withLabelSchema returns the labels of the --label options together with the
+// OCI annotation labels of the LabelSchema option. The source defaults to the
+// remote context if it is a URL. Labels set with --label, or with a LABEL
+// instruction of the last stage, are not overridden.
+func withLabelSchema(options *types.ImageBuildOptions, stages []instructions.Stage, created time.Time) map[string]string {
+	if !options.LabelSchema || len(stages) == 0 {
+		return options.Labels
+	}
+	source := options.LabelSchemaSource
+	if source == "" && (urlutil.IsGitURL(options.RemoteContext) || urlutil.IsURL(options.RemoteContext)) {
+		source = options.RemoteContext
+	}
+	schema := map[string]string{
+		labelSchemaCreated:  created.UTC().Format(time.RFC3339),
+		labelSchemaRevision: options.LabelSchemaRevision,
+		labelSchemaSource:   source,
+	}
+
+	for _, cmd := range stages[len(stages)-1].Commands {
+		if c, ok := cmd.(*instructions.LabelCommand); ok {
+			for _, kvp := range c.Labels {
+				delete(schema, kvp.Key)
+			}
+		}
+	}
+	labels := make(map[string]string, len(options.Labels)+len(schema))
+	for key, value := range schema {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	for key, value := range options.Labels {
+		labels[key] = value
+	}
+	return labels
+}
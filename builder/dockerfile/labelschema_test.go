@@ -0,0 +1,49 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestWithLabelSchema(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\nLABEL org.opencontainers.image.revision=from-dockerfile\n")
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	options := &types.ImageBuildOptions{
+		Labels: map[string]string{"foo": "bar"},
+	}
+	assert.Check(t, is.DeepEqual(options.Labels, withLabelSchema(options, stages, created)))
+
+	options = &types.ImageBuildOptions{
+		Labels:              map[string]string{"foo": "bar", "org.opencontainers.image.source": "explicit"},
+		LabelSchema:         true,
+		LabelSchemaRevision: "abc123",
+		LabelSchemaSource:   "https://example.com/repo.git",
+	}
+	expected := map[string]string{
+		"foo":                              "bar",
+		"org.opencontainers.image.created": "2018-06-01T10:00:00Z",
+		"org.opencontainers.image.source":  "explicit",
+	}
+	assert.Check(t, is.DeepEqual(expected, withLabelSchema(options, stages, created)))
+}
+
+func TestWithLabelSchemaSourceFromRemoteContext(t *testing.T) {
+	stages, _, _ := parseStages(t, "FROM busybox\n")
+	options := &types.ImageBuildOptions{
+		LabelSchema:   true,
+		RemoteContext: "https://github.com/docker/docker.git#master",
+	}
+	labels := withLabelSchema(options, stages, time.Now())
+	assert.Check(t, is.Equal(options.RemoteContext, labels[labelSchemaSource]))
+	_, ok := labels[labelSchemaRevision]
+	assert.Check(t, !ok)
+
+	options.RemoteContext = "client-session"
+	_, ok = withLabelSchema(options, stages, time.Now())[labelSchemaSource]
+	assert.Check(t, !ok)
+}
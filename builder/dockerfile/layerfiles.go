@@ -0,0 +1,142 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// checkLayerFiles returns an error if the step adds or modifies more files
+// than the MaxFilesPerLayer option allows, 0 meaning unlimited
+func (b *Builder) checkLayerFiles(instruction string, files int) error {
+	if max := b.options.MaxFilesPerLayer; max > 0 && files > max {
+		return errdefs.InvalidParameter(errors.Errorf("%s adds or modifies %d files, more than the maximum of %d files per layer", instruction, files, max))
+	}
+	return nil
+}
+
+// checkCopyLayerFiles counts the files and directories that the COPY or ADD
+// instruction copies from its sources, including the entries of the tarballs
+// it extracts. They are counted before the copy, so that a step taken from
+// the cache is checked too.
+func (b *Builder) checkCopyLayerFiles(inst copyInstruction) error {
+	if b.options.MaxFilesPerLayer <= 0 {
+		return nil
+	}
+	var files int
+	for _, info := range inst.infos {
+		n, err := countCopiedFiles(info, copyFileOptions{
+			decompress: inst.allowLocalDecompression,
+			symlinks:   inst.preserveSymlinks,
+			excludes:   inst.excludesFor(info),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to count the copied files")
+		}
+		files += n
+	}
+	return b.checkLayerFiles(inst.original, files)
+}
+
+// checkRunLayerFiles counts the files and directories that the container of
+// a RUN instruction added or modified, before it is committed
+func (b *Builder) checkRunLayerFiles(containerID, instruction string) error {
+	if b.options.MaxFilesPerLayer <= 0 {
+		return nil
+	}
+	changes, err := b.docker.ContainerChanges(containerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to count the changed files")
+	}
+	var files int
+	for _, c := range changes {
+		if c.Kind != archive.ChangeDelete {
+			files++
+		}
+	}
+	return b.checkLayerFiles(instruction, files)
+}
+
+// countCopiedFiles returns the number of files and directories copied from
+// source: the entries of a directory, which is not copied itself, those of an
+// extracted tarball, or the source file
+func countCopiedFiles(source copyInfo, options copyFileOptions) (int, error) {
+	srcPath, err := source.fullPath()
+	if err != nil {
+		return 0, err
+	}
+	stat := source.root.Stat
+	if options.symlinks {
+		stat = source.root.Lstat
+	}
+	fi, err := stat(srcPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "source path not found")
+	}
+
+	switch {
+	case fi.IsDir():
+		var excludes *fileutils.PatternMatcher
+		if len(options.excludes) > 0 {
+			if excludes, err = fileutils.NewPatternMatcher(options.excludes); err != nil {
+				return 0, err
+			}
+		}
+		var files int
+		err = source.root.Walk(srcPath, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := source.root.Rel(srcPath, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			if excludes != nil {
+				if excluded, _ := excludes.Matches(rel); excluded {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			files++
+			return nil
+		})
+		return files, err
+	case options.decompress && isArchivePath(source.root, srcPath) && !source.noDecompress:
+		return countArchiveEntries(source, srcPath)
+	default:
+		return 1, nil
+	}
+}
+
+// countArchiveEntries returns the number of entries of the tarball at p
+func countArchiveEntries(source copyInfo, p string) (int, error) {
+	f, err := source.root.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rdr, err := archive.DecompressStream(f)
+	if err != nil {
+		return 0, err
+	}
+	defer rdr.Close()
+	r := tar.NewReader(rdr)
+	var entries int
+	for {
+		if _, err := r.Next(); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return 0, err
+		}
+		entries++
+	}
+}
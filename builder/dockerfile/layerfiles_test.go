@@ -0,0 +1,72 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/containerfs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+)
+
+func TestCountCopiedFiles(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	for _, name := range []string{"dir/", "dir/a", "dir/b"} {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name == "dir/" {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		assert.NilError(t, w.WriteHeader(hdr))
+	}
+	assert.NilError(t, w.Close())
+
+	src := fs.NewDir(t, "count-copied-files",
+		fs.WithDir("dir",
+			fs.WithFile("a", ""),
+			fs.WithFile("b.log", ""),
+			fs.WithDir("sub", fs.WithFile("c", ""))),
+		fs.WithFile("archive.tar", buf.String()))
+	defer src.Remove()
+	root := containerfs.NewLocalContainerFS(src.Path())
+
+	testCases := []struct {
+		path     string
+		options  copyFileOptions
+		expected int
+	}{
+		{path: "dir", expected: 4},
+		{path: "dir", options: copyFileOptions{excludes: []string{"*.log"}}, expected: 3},
+		{path: "dir", options: copyFileOptions{excludes: []string{"sub"}}, expected: 2},
+		{path: "archive.tar", expected: 1},
+		{path: "archive.tar", options: copyFileOptions{decompress: true}, expected: 3},
+	}
+	for _, tc := range testCases {
+		files, err := countCopiedFiles(copyInfo{root: root, path: tc.path}, tc.options)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(tc.expected, files), tc.path)
+	}
+}
+
+func TestCheckRunLayerFiles(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).changesFunc = func(containerID string) ([]archive.Change, error) {
+		return []archive.Change{
+			{Path: "/app", Kind: archive.ChangeAdd},
+			{Path: "/app/a", Kind: archive.ChangeAdd},
+			{Path: "/etc", Kind: archive.ChangeModify},
+			{Path: "/tmp/b", Kind: archive.ChangeDelete},
+		}, nil
+	}
+	assert.Check(t, b.checkRunLayerFiles("id", "RUN make"))
+
+	b.options.MaxFilesPerLayer = 3
+	assert.Check(t, b.checkRunLayerFiles("id", "RUN make"))
+
+	b.options.MaxFilesPerLayer = 2
+	err := b.checkRunLayerFiles("id", "RUN make")
+	assert.Check(t, is.Error(err, "RUN make adds or modifies 3 files, more than the maximum of 2 files per layer"))
+}
@@ -0,0 +1,98 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/parser"
+)
+
+// lintFinding is an anti-pattern found by the --lint analysis
+type lintFinding struct {
+	line    int
+	message string
+}
+
+// lintDockerfile analyzes the RUN instructions of the Dockerfile for known
+// anti-patterns, without building anything:
+//
+// - apt-get update in a RUN instruction that does not run apt-get install,
+//   as the cached update is reused by the installs of later builds
+// - apt-get install without --no-install-recommends, which installs
+//   packages that are not needed
+func lintDockerfile(ast *parser.Node) []lintFinding {
+	var findings []lintFinding
+	for _, node := range ast.Children {
+		if node.Value != command.Run {
+			continue
+		}
+		var update, install bool
+		for _, args := range aptGetCommands(runCommandLine(node)) {
+			switch args[0] {
+			case "update":
+				update = true
+			case "install":
+				install = true
+				if !containsString(args, "--no-install-recommends") {
+					findings = append(findings, lintFinding{line: node.StartLine, message: "apt-get install without --no-install-recommends installs packages that are not needed"})
+				}
+			}
+		}
+		if update && !install {
+			findings = append(findings, lintFinding{line: node.StartLine, message: "apt-get update without apt-get install in the same RUN instruction, later builds reuse the cached update"})
+		}
+	}
+	return findings
+}
+
+// runCommandLine returns the command line of a RUN instruction, in the shell
+// or the JSON form
+func runCommandLine(node *parser.Node) string {
+	var args []string
+	for n := node.Next; n != nil; n = n.Next {
+		args = append(args, n.Value)
+	}
+	return strings.Join(args, " ")
+}
+
+// aptGetCommands returns the arguments of the apt-get commands of a command
+// line, with the apt-get subcommand first, followed by the other arguments.
+func aptGetCommands(commandLine string) [][]string {
+	var commands [][]string
+	isSeparator := func(r rune) bool {
+		return r == ';' || r == '&' || r == '|' || r == '\n'
+	}
+	for _, cmd := range strings.FieldsFunc(commandLine, isSeparator) {
+		fields := strings.Fields(cmd)
+		// skip the environment variables and sudo of the command
+		for len(fields) > 0 && (strings.Contains(fields[0], "=") || fields[0] == "sudo") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || fields[0] != "apt-get" {
+			continue
+		}
+		var subcommand string
+		var args []string
+		for _, field := range fields[1:] {
+			if subcommand == "" && !strings.HasPrefix(field, "-") {
+				subcommand = field
+				continue
+			}
+			args = append(args, field)
+		}
+		if subcommand != "" {
+			commands = append(commands, append([]string{subcommand}, args...))
+		}
+	}
+	return commands
+}
+
+// printLintFindings prints the findings of the --lint analysis
+func printLintFindings(out io.Writer, findings []lintFinding) {
+	for _, f := range findings {
+		fmt.Fprintf(out, "[Lint] line %d: %s\n", f.line, f.message)
+	}
+	fmt.Fprintf(out, "%d lint finding(s)\n", len(findings))
+}
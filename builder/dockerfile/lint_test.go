@@ -0,0 +1,44 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLintDockerfile(t *testing.T) {
+	dockerfile := `FROM debian
+RUN apt-get update
+RUN apt-get install -y --no-install-recommends curl
+RUN apt-get update && \
+	DEBIAN_FRONTEND=noninteractive apt-get -y install git
+RUN ["apt-get", "-q", "update"]
+RUN echo apt-get update; apt-get install --no-install-recommends -y make
+RUN apt-get update && apt-get install -y --no-install-recommends gcc && rm -rf /var/lib/apt/lists/*
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	assert.NilError(t, err)
+
+	findings := lintDockerfile(result.AST)
+	var lines []int
+	var messages []string
+	for _, f := range findings {
+		lines = append(lines, f.line)
+		messages = append(messages, f.message)
+	}
+	assert.Check(t, is.DeepEqual([]int{2, 4, 6}, lines))
+	assert.Check(t, is.DeepEqual([]string{
+		"apt-get update without apt-get install in the same RUN instruction, later builds reuse the cached update",
+		"apt-get install without --no-install-recommends installs packages that are not needed",
+		"apt-get update without apt-get install in the same RUN instruction, later builds reuse the cached update",
+	}, messages))
+
+	out := &bytes.Buffer{}
+	printLintFindings(out, findings)
+	assert.Check(t, is.Contains(out.String(), "[Lint] line 2: apt-get update without apt-get install"))
+	assert.Check(t, is.Contains(out.String(), "3 lint finding(s)"))
+}
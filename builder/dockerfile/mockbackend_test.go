@@ -13,6 +13,7 @@ import (
 	containerpkg "github.com/docker/docker/container"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/containerfs"
 )
 
@@ -22,6 +23,7 @@ type MockBackend struct {
 	commitFunc          func(backend.CommitConfig) (image.ID, error)
 	getImageFunc        func(string) (builder.Image, builder.ROLayer, error)
 	makeImageCacheFunc  func(cacheFrom []string) builder.ImageCache
+	changesFunc         func(containerID string) ([]archive.Change, error)
 }
 
 func (m *MockBackend) ContainerAttachRaw(cID string, stdin io.ReadCloser, stdout, stderr io.Writer, stream bool, attached chan struct{}) error {
@@ -58,6 +60,13 @@ func (m *MockBackend) ContainerWait(ctx context.Context, containerID string, con
 	return nil, nil
 }
 
+func (m *MockBackend) ContainerChanges(containerID string) ([]archive.Change, error) {
+	if m.changesFunc != nil {
+		return m.changesFunc(containerID)
+	}
+	return nil, nil
+}
+
 func (m *MockBackend) ContainerCreateWorkdir(containerID string) error {
 	return nil
 }
@@ -143,6 +152,10 @@ func (l *mockRWLayer) Commit() (builder.ROLayer, error) {
 	return nil, nil
 }
 
+func (l *mockRWLayer) CommitOnto(parent builder.ROLayer) (builder.ROLayer, error) {
+	return nil, nil
+}
+
 func (l *mockRWLayer) Root() containerfs.ContainerFS {
 	return nil
 }
@@ -0,0 +1,86 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// noCacheFilter selects the steps of a build that do not use the build
+// cache, either all the steps of a named stage, or a single step by the number
+// it is printed with in a sequential build.
+type noCacheFilter struct {
+	stages []string
+	steps  []int
+}
+
+// parseNoCacheFilter parses the values of the NoCacheFilter option, which are
+// stage names or step:<number>.
+func parseNoCacheFilter(values []string) (*noCacheFilter, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	f := &noCacheFilter{}
+	for _, value := range values {
+		if !strings.HasPrefix(value, "step:") {
+			if value == "" {
+				return nil, errdefs.InvalidParameter(errors.New("invalid no-cache-filter \"\": expected a stage name or step:<number>"))
+			}
+			f.stages = append(f.stages, value)
+			continue
+		}
+		step, err := strconv.Atoi(strings.TrimPrefix(value, "step:"))
+		if err != nil || step < 1 {
+			return nil, errdefs.InvalidParameter(errors.Errorf("invalid no-cache-filter %q: expected a stage name or step:<number>", value))
+		}
+		f.steps = append(f.steps, step)
+	}
+	return f, nil
+}
+
+// excludedSteps returns the FROM instructions, as their stage, and the
+// commands of the stages that are selected by the filter. The steps of the
+// stages are numbered from firstStep, in the order of the Dockerfile.
+func (f *noCacheFilter) excludedSteps(stages []instructions.Stage, firstStep int) (map[interface{}]bool, error) {
+	if f == nil {
+		return nil, nil
+	}
+	for _, name := range f.stages {
+		if _, found := instructions.HasStage(stages, name); !found {
+			return nil, errdefs.InvalidParameter(errors.Errorf("invalid no-cache-filter %s: no stage of the build has this name", name))
+		}
+	}
+	steps := make(map[int]bool, len(f.steps))
+	for _, step := range f.steps {
+		steps[step] = true
+	}
+
+	excluded := make(map[interface{}]bool)
+	step := firstStep
+	for i := range stages {
+		stage := &stages[i]
+		allSteps := false
+		for _, name := range f.stages {
+			allSteps = allSteps || strings.EqualFold(name, stage.Name)
+		}
+		if allSteps || steps[step] {
+			excluded[stage] = true
+		}
+		step++
+		for _, cmd := range stage.Commands {
+			if allSteps || steps[step] {
+				excluded[cmd] = true
+			}
+			step++
+		}
+	}
+	for _, s := range f.steps {
+		if s >= step {
+			return nil, errdefs.InvalidParameter(errors.Errorf("invalid no-cache-filter step:%d: the build has %d steps", s, step-1))
+		}
+	}
+	return excluded, nil
+}
@@ -0,0 +1,91 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestParseNoCacheFilter(t *testing.T) {
+	f, err := parseNoCacheFilter(nil)
+	assert.Check(t, err)
+	assert.Check(t, f == nil)
+
+	f, err = parseNoCacheFilter([]string{"builder", "step:3"})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"builder"}, f.stages))
+	assert.Check(t, is.DeepEqual([]int{3}, f.steps))
+
+	for _, value := range []string{"", "step:", "step:0", "step:x"} {
+		_, err = parseNoCacheFilter([]string{value})
+		assert.Check(t, is.ErrorContains(err, "expected a stage name or step:<number>"), value)
+		assert.Check(t, errdefs.IsInvalidParameter(err), value)
+	}
+}
+
+func TestNoCacheFilterExcludedSteps(t *testing.T) {
+	stages, metaArgs, _ := parseStages(t, `ARG BASE=busybox
+FROM ${BASE} AS Builder
+RUN echo build
+FROM busybox
+COPY --from=builder /out /out
+RUN echo final
+`)
+	firstStep := len(metaArgs) + 1
+
+	f, err := parseNoCacheFilter([]string{"builder", "step:6"})
+	assert.NilError(t, err)
+	excluded, err := f.excludedSteps(stages, firstStep)
+	assert.NilError(t, err)
+	assert.Check(t, excluded[&stages[0]])
+	assert.Check(t, excluded[stages[0].Commands[0]])
+	assert.Check(t, !excluded[&stages[1]])
+	assert.Check(t, !excluded[stages[1].Commands[0]])
+	assert.Check(t, excluded[stages[1].Commands[1]])
+	assert.Check(t, is.Len(excluded, 3))
+
+	f, err = parseNoCacheFilter([]string{"test"})
+	assert.NilError(t, err)
+	_, err = f.excludedSteps(stages, firstStep)
+	assert.Check(t, is.ErrorContains(err, "invalid no-cache-filter test: no stage of the build has this name"))
+
+	f, err = parseNoCacheFilter([]string{"step:7"})
+	assert.NilError(t, err)
+	_, err = f.excludedSteps(stages, firstStep)
+	assert.Check(t, is.ErrorContains(err, "invalid no-cache-filter step:7: the build has 6 steps"))
+
+	excluded, err = (*noCacheFilter)(nil).excludedSteps(stages, firstStep)
+	assert.Check(t, err)
+	assert.Check(t, is.Len(excluded, 0))
+}
+
+func TestProbeCacheNoCache(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.imageProber = &fakeImageProber{cachedID: "cached"}
+	state := &dispatchState{imageID: "parent"}
+
+	state.noCache = true
+	hit, err := b.probeCache(state, &container.Config{})
+	assert.NilError(t, err)
+	assert.Check(t, !hit)
+	assert.Check(t, is.Equal("parent", state.imageID))
+
+	state.noCache = false
+	hit, err = b.probeCache(state, &container.Config{})
+	assert.NilError(t, err)
+	assert.Check(t, hit)
+	assert.Check(t, is.Equal("cached", state.imageID))
+}
+
+type fakeImageProber struct {
+	cachedID string
+}
+
+func (p *fakeImageProber) Reset() {}
+
+func (p *fakeImageProber) Probe(parentID string, runConfig *container.Config) (string, error) {
+	return p.cachedID, nil
+}
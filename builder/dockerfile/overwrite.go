@@ -0,0 +1,142 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/containerfs"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// checkWarnOverwritePaths returns an error if a path of the WarnOverwrite
+// option is not an absolute path
+func checkWarnOverwritePaths(paths []string) error {
+	for _, p := range paths {
+		if !path.IsAbs(p) {
+			return errdefs.InvalidParameter(errors.Errorf("invalid warn-overwrite path %q: must be an absolute path", p))
+		}
+	}
+	return nil
+}
+
+// isUnderPrefix returns whether p, a clean absolute path, is one of the
+// prefixes or is inside one of them
+func isUnderPrefix(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = path.Clean(prefix)
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// copiedFile is a file of a source of COPY or ADD, and the path it is copied
+// to in the image
+type copiedFile struct {
+	target string
+	source string
+	info   os.FileInfo
+}
+
+// copiedFiles returns the files that the copy of source to dest adds to root,
+// excluding the directories, which are merged instead of replaced. The files
+// extracted from the archives of ADD are not returned, as they are only known
+// once the archive is read.
+func copiedFiles(root containerfs.ContainerFS, dest copyInfo, source copyInfo, options copyFileOptions) ([]copiedFile, error) {
+	srcPath, err := source.fullPath()
+	if err != nil {
+		return nil, err
+	}
+	// the target of a symlink is copied, unless symlinks are preserved
+	stat := source.root.Stat
+	if options.symlinks {
+		stat = source.root.Lstat
+	}
+	fi, err := stat(srcPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "source path not found")
+	}
+
+	var files []copiedFile
+	switch {
+	case fi.IsDir():
+		var excludes *fileutils.PatternMatcher
+		if len(options.excludes) > 0 {
+			if excludes, err = fileutils.NewPatternMatcher(options.excludes); err != nil {
+				return nil, err
+			}
+		}
+		err = source.root.Walk(srcPath, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := source.root.Rel(srcPath, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			if excludes != nil {
+				if excluded, _ := excludes.Matches(rel); excluded {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			if !info.IsDir() {
+				target := path.Join(filepath.ToSlash(dest.path), filepath.ToSlash(rel))
+				files = append(files, copiedFile{target: path.Clean("/" + target), source: p, info: info})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	case options.decompress && isArchivePath(source.root, srcPath) && !source.noDecompress:
+		return nil, nil
+	default:
+		target := filepath.ToSlash(dest.path)
+		destPath, err := root.ResolveScopedPath(dest.path, true)
+		if err != nil {
+			return nil, err
+		}
+		isDir, err := isExistingDirectory(&copyEndpoint{driver: root, path: destPath})
+		if err != nil {
+			return nil, err
+		}
+		if endsInSlash(dest.root, dest.path) || isDir {
+			target = path.Join(target, source.root.Base(source.path))
+		}
+		files = append(files, copiedFile{target: path.Clean("/" + target), source: srcPath, info: fi})
+	}
+	return files, nil
+}
+
+// overwrittenPaths returns the paths of the existing files of root, under one
+// of the prefixes, that the copy of source to dest replaces.
+func overwrittenPaths(root containerfs.ContainerFS, dest copyInfo, source copyInfo, options copyFileOptions, prefixes []string) ([]string, error) {
+	files, err := copiedFiles(root, dest, source, options)
+	if err != nil {
+		return nil, err
+	}
+	var overwritten []string
+	for _, f := range files {
+		if !isUnderPrefix(f.target, prefixes) {
+			continue
+		}
+		p, err := root.ResolveScopedPath(f.target, true)
+		if err != nil {
+			return nil, err
+		}
+		// missing paths, including the ones whose parent is a file, are
+		// not overwritten
+		if fi, err := root.Lstat(p); err == nil && !fi.IsDir() {
+			overwritten = append(overwritten, f.target)
+		}
+	}
+	return overwritten, nil
+}
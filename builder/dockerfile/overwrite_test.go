@@ -0,0 +1,103 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/pkg/containerfs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
+	"gotest.tools/skip"
+)
+
+func TestCheckWarnOverwritePaths(t *testing.T) {
+	assert.Check(t, checkWarnOverwritePaths([]string{"/etc", "/bin/"}))
+	assert.Check(t, is.ErrorContains(checkWarnOverwritePaths([]string{"/etc", "bin"}), `invalid warn-overwrite path "bin"`))
+}
+
+func TestIsUnderPrefix(t *testing.T) {
+	prefixes := []string{"/etc/", "/bin"}
+	assert.Check(t, isUnderPrefix("/etc", prefixes))
+	assert.Check(t, isUnderPrefix("/etc/passwd", prefixes))
+	assert.Check(t, isUnderPrefix("/bin/sh", prefixes))
+	assert.Check(t, !isUnderPrefix("/binaries/sh", prefixes))
+	assert.Check(t, !isUnderPrefix("/tmp/etc/passwd", prefixes))
+	assert.Check(t, isUnderPrefix("/tmp", []string{"/"}))
+}
+
+func TestOverwrittenPaths(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the test uses unix paths")
+	image := fs.NewDir(t, "overwrite-image",
+		fs.WithDir("etc",
+			fs.WithFile("passwd", "root"),
+			fs.WithDir("conf.d")),
+		fs.WithDir("bin", fs.WithFile("sh", "sh")),
+		fs.WithDir("tmp", fs.WithFile("x", "x")))
+	defer image.Remove()
+	src := fs.NewDir(t, "overwrite-src",
+		fs.WithDir("etc",
+			fs.WithFile("passwd", "user"),
+			fs.WithFile("new", "new"),
+			fs.WithDir("conf.d", fs.WithFile("app.conf", "conf"))),
+		fs.WithDir("bin", fs.WithFile("sh", "sh")),
+		fs.WithDir("tmp", fs.WithFile("x", "x")))
+	defer src.Remove()
+	root := containerfs.NewLocalContainerFS(image.Path())
+	srcRoot := containerfs.NewLocalContainerFS(src.Path())
+	dest := func(p string) copyInfo {
+		return copyInfo{root: root, path: p}
+	}
+
+	overwritten, err := overwrittenPaths(root, dest("/"), copyInfo{root: srcRoot, path: "."}, copyFileOptions{}, []string{"/etc"})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"/etc/passwd"}, overwritten))
+
+	overwritten, err = overwrittenPaths(root, dest("/"), copyInfo{root: srcRoot, path: "."}, copyFileOptions{excludes: []string{"etc/passwd"}}, []string{"/etc", "/bin"})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"/bin/sh"}, overwritten))
+
+	for _, d := range []string{"/etc/", "/etc", "/etc/passwd"} {
+		overwritten, err = overwrittenPaths(root, dest(d), copyInfo{root: srcRoot, path: "etc/passwd"}, copyFileOptions{}, []string{"/etc"})
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual([]string{"/etc/passwd"}, overwritten), d)
+	}
+
+	overwritten, err = overwrittenPaths(root, dest("/etc/new"), copyInfo{root: srcRoot, path: "etc/passwd"}, copyFileOptions{}, []string{"/etc"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(overwritten, 0))
+}
+
+func TestCopiedFiles(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the test uses unix paths")
+	image := fs.NewDir(t, "copied-image", fs.WithDir("app"))
+	defer image.Remove()
+	src := fs.NewDir(t, "copied-src",
+		fs.WithFile("main.go", "package main"),
+		fs.WithDir("lib",
+			fs.WithFile("a.go", "package lib"),
+			fs.WithDir("testdata", fs.WithFile("data", "data"))))
+	defer src.Remove()
+	root := containerfs.NewLocalContainerFS(image.Path())
+	srcRoot := containerfs.NewLocalContainerFS(src.Path())
+	targets := func(files []copiedFile) []string {
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, f.target)
+		}
+		return paths
+	}
+
+	files, err := copiedFiles(root, copyInfo{root: root, path: "/app"}, copyInfo{root: srcRoot, path: "main.go"}, copyFileOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"/app/main.go"}, targets(files)))
+	assert.Check(t, is.Equal(int64(len("package main")), files[0].info.Size()))
+
+	files, err = copiedFiles(root, copyInfo{root: root, path: "/app/main"}, copyInfo{root: srcRoot, path: "main.go"}, copyFileOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"/app/main"}, targets(files)))
+
+	files, err = copiedFiles(root, copyInfo{root: root, path: "/app/lib"}, copyInfo{root: srcRoot, path: "lib"}, copyFileOptions{excludes: []string{"testdata"}})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"/app/lib/a.go"}, targets(files)))
+}
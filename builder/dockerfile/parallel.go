@@ -0,0 +1,275 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
+	"github.com/pkg/errors"
+)
+
+// dispatchStagesInParallel dispatches the build stages concurrently. A stage
+// starts as soon as the stages it is based on or copies from, also with the
+// ONBUILD triggers it runs, are built, with at most MaxParallelism stages
+// running at the same time. Each line of output is prefixed with the name or
+// index of the stage it belongs to. When a stage fails the other stages are
+// cancelled.
+func (b *Builder) dispatchStagesInParallel(stages []instructions.Stage, escapeToken rune, source builder.Source, buildArgs *BuildArgs, printStep func(out io.Writer, cmd interface{})) (*dispatchState, error) {
+	checkNames := newStagesBuildResults()
+	for _, stage := range stages {
+		if err := checkNames.commitStage(stage.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	nodes, err := buildStageGraph(stages, nil, escapeToken, buildArgs.Clone())
+	if err != nil {
+		return nil, err
+	}
+	if err := b.addTriggerDeps(nodes, stages, escapeToken, buildArgs); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(b.clientCtx)
+	defer cancel()
+
+	var (
+		// mu protects states and firstErr, and serializes the step numbers
+		mu       sync.Mutex
+		outputMu sync.Mutex
+		states   = make([]*dispatchState, len(stages))
+		firstErr error
+		builders = make([]*Builder, len(stages))
+		done     = make([]chan struct{}, len(stages))
+		slots    = make(chan struct{}, b.options.MaxParallelism)
+	)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	stdoutBase, stderrBase := b.Stdout, b.Stderr
+	if b.stepOutput != nil {
+		stdoutBase, stderrBase = b.stepOutput.stdout, b.stepOutput.stderr
+	}
+	syncPrintStep := func(out io.Writer, cmd interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		printStep(out, cmd)
+	}
+
+	for i := range stages {
+		go func(i int) {
+			defer close(done[i])
+			for _, dep := range nodes[i].deps {
+				// Like in a sequential build, references to stages defined
+				// later in the Dockerfile are references to images
+				if dep >= i {
+					continue
+				}
+				select {
+				case <-done[dep]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+
+			prefix := "[" + nodes[i].label(i) + "] "
+			stdout := &prefixWriter{mu: &outputMu, out: stdoutBase, prefix: prefix}
+			stderr := &prefixWriter{mu: &outputMu, out: stderrBase, prefix: prefix}
+			sb := b.forStage(ctx, stdout, stderr)
+			builders[i] = sb
+
+			mu.Lock()
+			results := stagesResultsView(states[:i])
+			mu.Unlock()
+
+			d := newDispatchRequest(sb, escapeToken, source, buildArgs, results)
+			err := dispatchStage(d, &stages[i], syncPrintStep)
+			stdout.Flush()
+			stderr.Flush()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			states[i] = d.state
+		}(i)
+	}
+	for _, ch := range done {
+		<-ch
+	}
+
+	for _, sb := range builders {
+		if sb != nil {
+			b.cacheHits += sb.cacheHits
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	for i, state := range states {
+		if state == nil {
+			return nil, errors.New("Build cancelled")
+		}
+		buildArgs.MergeReferencedArgs(state.buildArgs)
+		b.recordStageImage(i, state)
+	}
+	return states[len(states)-1], nil
+}
+
+// addTriggerDeps adds the stages that the ONBUILD triggers run by a stage copy
+// from to the dependencies of the stage. The triggers are the ONBUILD
+// instructions of the stage it is based on, or the ones of its base image,
+// which is looked up before the stages are scheduled.
+func (b *Builder) addTriggerDeps(nodes []stageNode, stages []instructions.Stage, escapeToken rune, buildArgs *BuildArgs) error {
+	shlex := shell.NewLex(escapeToken)
+	substitutionArgs := convertMapToEnvList(buildArgs.GetAllMeta())
+	for i, stage := range stages {
+		var triggers []string
+		if ix, found := instructions.HasStage(stages[:i], nodes[i].baseName); found {
+			for _, cmd := range stages[ix].Commands {
+				if c, ok := cmd.(*instructions.OnbuildCommand); ok {
+					triggers = append(triggers, c.Expression)
+				}
+			}
+		} else if nodes[i].baseName != api.NoBaseImageSpecifier {
+			platform := b.platform
+			if stage.Platform != "" {
+				v, err := shlex.ProcessWord(stage.Platform, substitutionArgs)
+				if err != nil {
+					return errors.Wrapf(err, "failed to process arguments for platform %s", stage.Platform)
+				}
+				p, err := platforms.Parse(v)
+				if err != nil {
+					return errors.Wrapf(err, "failed to parse platform %s", v)
+				}
+				platform = &p
+			}
+			im, err := b.imageSources.Get(nodes[i].baseName, false, platform)
+			if err != nil {
+				return err
+			}
+			if im.Image() != nil && im.Image().RunConfig() != nil {
+				triggers = im.Image().RunConfig().OnBuild
+			}
+		}
+		for _, trigger := range triggers {
+			if from := triggerCopyFrom(trigger); from != "" {
+				if ix, found := findStage(stages[:i], from); found {
+					nodes[i].addDep(ix)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// triggerCopyFrom returns the stage or image an ONBUILD trigger copies from,
+// if it is a COPY --from instruction. Invalid triggers are reported when they
+// are dispatched.
+func triggerCopyFrom(trigger string) string {
+	ast, err := parser.Parse(strings.NewReader(trigger))
+	if err != nil || len(ast.AST.Children) != 1 {
+		return ""
+	}
+	cmd, err := instructions.ParseCommand(ast.AST.Children[0])
+	if err != nil {
+		return ""
+	}
+	if c, ok := cmd.(*instructions.CopyCommand); ok {
+		return c.From
+	}
+	return ""
+}
+
+// forStage returns a copy of the builder to dispatch a single stage with,
+// that has its own output, cache prober and intermediate containers.
+func (b *Builder) forStage(ctx context.Context, stdout, stderr io.Writer) *Builder {
+	sb := *b
+	sb.clientCtx = ctx
+	sb.Stdout = stdout
+	sb.Stderr = stderr
+	sb.imageProber = newImageProber(b.docker, b.options.CacheFrom, b.options.NoCache)
+	sb.containerManager = newContainerManager(b.docker)
+	sb.cacheHits = 0
+	if b.stepOutput != nil {
+		sb.stepOutput = newStepOutputRecorder(stdout, stderr)
+		sb.Stdout = sb.stepOutput.Stdout()
+		sb.Stderr = sb.stepOutput.Stderr()
+	}
+	return &sb
+}
+
+// stagesResultsView returns the results of the stages built so far, keeping
+// the index of each stage. Stages that are not built yet have no result.
+func stagesResultsView(states []*dispatchState) *stagesBuildResults {
+	results := newStagesBuildResults()
+	for _, state := range states {
+		if state == nil {
+			results.flat = append(results.flat, nil)
+			continue
+		}
+		// Stage names were checked to be unique before dispatching
+		commitStage(state, results)
+	}
+	return results
+}
+
+// prefixWriter writes complete lines to out, prefixed with prefix. Writes of
+// all the prefixWriters sharing mu are serialized, so the lines of the
+// different writers are not mixed up.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		ix := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if ix < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf.Next(ix + 1)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush writes the remaining output that does not end with a newline.
+func (w *prefixWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	line := append(w.buf.Bytes(), '\n')
+	w.buf.Reset()
+	return w.writeLine(line)
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}
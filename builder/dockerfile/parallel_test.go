@@ -0,0 +1,105 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/builder"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var mu sync.Mutex
+	out := &bytes.Buffer{}
+	build := &prefixWriter{mu: &mu, out: out, prefix: "[build] "}
+	test := &prefixWriter{mu: &mu, out: out, prefix: "[test] "}
+
+	build.Write([]byte("Step 1/4 : FROM busybox AS build\n ---> "))
+	test.Write([]byte("Step 2/4 : FROM busybox AS test\n"))
+	build.Write([]byte("abcdef\nno newline"))
+	build.Flush()
+	test.Flush()
+
+	expected := `[build] Step 1/4 : FROM busybox AS build
+[test] Step 2/4 : FROM busybox AS test
+[build]  ---> abcdef
+[build] no newline
+`
+	assert.Check(t, is.Equal(expected, out.String()))
+}
+
+func TestStagesResultsView(t *testing.T) {
+	build := newDispatchState(NewBuildArgs(nil))
+	build.stageName = "build"
+	build.runConfig = &container.Config{Image: "build-image"}
+
+	results := stagesResultsView([]*dispatchState{build, nil})
+	c, err := results.get("build")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("build-image", c.Image))
+	c, err = results.get("0")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("build-image", c.Image))
+
+	// The stage being built keeps its index
+	_, err = results.get("2")
+	assert.Check(t, is.Error(err, "refers to current build stage"))
+}
+
+func TestDispatchStagesInParallel(t *testing.T) {
+	dockerfile := `FROM busybox AS first
+LABEL first=1
+FROM busybox AS second
+LABEL second=2
+FROM first
+LABEL last=3
+`
+	stages, metaArgs, escapeToken := parseStages(t, dockerfile)
+	b := newBuilderWithMockBackend()
+	b.options.MaxParallelism = 2
+
+	state, err := b.dispatchDockerfileWithCancellation(stages, metaArgs, escapeToken, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(map[string]string{"last": "3"}, state.runConfig.Labels))
+
+	out := b.Stdout.(*bytes.Buffer).String()
+	assert.Check(t, is.Contains(out, "[second] Step "))
+	// The last stage is based on the first one and only starts once it is
+	// built
+	firstDone := strings.Index(out, " : LABEL first=1\n")
+	lastStart := strings.Index(out, " : FROM first\n")
+	assert.Assert(t, firstDone >= 0 && lastStart >= 0, out)
+	assert.Check(t, firstDone < lastStart, out)
+}
+
+func TestAddTriggerDeps(t *testing.T) {
+	dockerfile := `FROM busybox AS assets
+FROM busybox AS docs
+FROM busybox AS onbuild
+ONBUILD COPY --from=assets /assets /assets
+FROM onbuild
+FROM onbuild-image
+FROM busybox
+`
+	stages, metaArgs, escapeToken := parseStages(t, dockerfile)
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).getImageFunc = func(name string) (builder.Image, builder.ROLayer, error) {
+		var triggers []string
+		if name == "onbuild-image" {
+			triggers = []string{"COPY --from=docs /docs /docs", "RUN true"}
+		}
+		return &mockImage{id: name, config: &container.Config{OnBuild: triggers}}, &mockLayer{}, nil
+	}
+
+	nodes, err := buildStageGraph(stages, metaArgs, escapeToken, NewBuildArgs(nil))
+	assert.NilError(t, err)
+	err = b.addTriggerDeps(nodes, stages, escapeToken, NewBuildArgs(nil))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]int{2, 0}, nodes[3].deps))
+	assert.Check(t, is.DeepEqual([]int{1}, nodes[4].deps))
+	assert.Check(t, is.Len(nodes[5].deps, 0))
+}
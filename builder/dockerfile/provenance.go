@@ -0,0 +1,63 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// provenanceLabel is the label of the image that holds its provenance, with
+// the Provenance option. It is not inherited by the images built from it.
+const provenanceLabel = "com.docker.build.provenance"
+
+// provenance returns the provenance of the build of a Dockerfile with the
+// given digest. The base images of the stages built from another stage, whose
+// image is one of the stage images, are left out, and so are the stages built
+// from scratch.
+func (b *Builder) provenance(dockerfileDigest digest.Digest, created time.Time) types.BuildProvenance {
+	p := types.BuildProvenance{
+		DockerfileDigest: dockerfileDigest.String(),
+		Created:          created.UTC().Format(time.RFC3339Nano),
+	}
+	for _, name := range b.usedBuildArgs {
+		if p.BuildArgs == nil {
+			p.BuildArgs = make(map[string]string)
+		}
+		var value string
+		if v := b.options.BuildArgs[name]; v != nil {
+			value = *v
+		}
+		if isRedacted(name, b.options.RedactArgs) {
+			value = redactedValue
+		}
+		p.BuildArgs[name] = value
+	}
+
+	stageImages := make(map[string]bool, len(b.stageImages))
+	for _, id := range b.stageImages {
+		stageImages[id] = true
+	}
+	seen := make(map[types.BuildProvenanceImage]bool)
+	for _, base := range b.stageBaseImages {
+		if base.ID == "" || stageImages[base.ID] || seen[base] {
+			continue
+		}
+		seen[base] = true
+		p.BaseImages = append(p.BaseImages, base)
+	}
+	return p
+}
+
+// embedProvenance replaces the final image with an image that has the
+// provenance of the build in its provenanceLabel label
+func (b *Builder) embedProvenance(state *dispatchState, provenance types.BuildProvenance) error {
+	err := b.labelImage(state, provenanceLabel, func(*image.Image) (string, error) {
+		dt, err := json.Marshal(provenance)
+		return string(dt), err
+	})
+	return errors.Wrap(err, "failed to embed the provenance")
+}
@@ -0,0 +1,35 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	digest "github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestProvenance(t *testing.T) {
+	version, token := "1.2", "secret"
+	b := newBuilderWithMockBackend()
+	b.options.BuildArgs = map[string]*string{"VERSION": &version, "API_TOKEN": &token, "UNUSED": &version, "FROM_ENV": nil}
+	b.options.RedactArgs = []string{"*_TOKEN"}
+	b.usedBuildArgs = []string{"API_TOKEN", "FROM_ENV", "VERSION"}
+	b.stageImages = []string{"sha256:builder", "sha256:final"}
+	b.stageBaseImages = []types.BuildProvenanceImage{
+		{Name: "golang", ID: "sha256:golang"},
+		{Name: "builder", ID: "sha256:builder"},
+		{Name: "scratch"},
+		{Name: "golang", ID: "sha256:golang"},
+	}
+
+	dgst := digest.FromString("FROM golang\n")
+	created := time.Date(2018, time.January, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	assert.Check(t, is.DeepEqual(types.BuildProvenance{
+		DockerfileDigest: dgst.String(),
+		BuildArgs:        map[string]string{"VERSION": "1.2", "API_TOKEN": "***", "FROM_ENV": ""},
+		BaseImages:       []types.BuildProvenanceImage{{Name: "golang", ID: "sha256:golang"}},
+		Created:          "2018-01-01T11:00:00Z",
+	}, b.provenance(dgst, created)))
+}
@@ -0,0 +1,70 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"io"
+	"sync"
+)
+
+// stepOutputRecorder holds back the output of the current build step for
+// quiet-steps builds. The output is only written if the step fails.
+type stepOutputRecorder struct {
+	stdout io.Writer
+	stderr io.Writer
+
+	mu     sync.Mutex
+	chunks []recordedChunk
+}
+
+type recordedChunk struct {
+	out  io.Writer
+	data []byte
+}
+
+func newStepOutputRecorder(stdout, stderr io.Writer) *stepOutputRecorder {
+	return &stepOutputRecorder{stdout: stdout, stderr: stderr}
+}
+
+// Stdout returns a writer that records output for stdout
+func (r *stepOutputRecorder) Stdout() io.Writer {
+	return &recordingWriter{recorder: r, out: r.stdout}
+}
+
+// Stderr returns a writer that records output for stderr
+func (r *stepOutputRecorder) Stderr() io.Writer {
+	return &recordingWriter{recorder: r, out: r.stderr}
+}
+
+// Discard drops the recorded output
+func (r *stepOutputRecorder) Discard() {
+	r.mu.Lock()
+	r.chunks = nil
+	r.mu.Unlock()
+}
+
+// Flush writes the recorded output, in the order it was recorded, to the
+// stdout and stderr it was meant for
+func (r *stepOutputRecorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, chunk := range r.chunks {
+		if _, err := chunk.out.Write(chunk.data); err != nil {
+			return err
+		}
+	}
+	r.chunks = nil
+	return nil
+}
+
+type recordingWriter struct {
+	recorder *stepOutputRecorder
+	out      io.Writer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.recorder.mu.Lock()
+	w.recorder.chunks = append(w.recorder.chunks, recordedChunk{out: w.out, data: data})
+	w.recorder.mu.Unlock()
+	return len(p), nil
+}
@@ -0,0 +1,40 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestStepOutputRecorder(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	recorder := newStepOutputRecorder(stdout, stderr)
+
+	recorder.Stdout().Write([]byte("first step\n"))
+	recorder.Discard()
+	recorder.Stdout().Write([]byte("second step\n"))
+	recorder.Stderr().Write([]byte("second step error\n"))
+	assert.Check(t, is.Equal("", stdout.String()))
+
+	assert.NilError(t, recorder.Flush())
+	assert.Check(t, is.Equal("second step\n", stdout.String()))
+	assert.Check(t, is.Equal("second step error\n", stderr.String()))
+}
+
+func TestDispatchQuietSteps(t *testing.T) {
+	stages, metaArgs, escapeToken := parseStages(t, "FROM busybox\nLABEL a=b\nENV c=d\n")
+	b := newBuilderWithMockBackend()
+	stdout := b.Stdout.(*bytes.Buffer)
+	b.stepOutput = newStepOutputRecorder(stdout, stdout)
+	b.Stdout = b.stepOutput.Stdout()
+
+	_, err := b.dispatchDockerfileWithCancellation(stages, metaArgs, escapeToken, nil)
+	assert.NilError(t, err)
+	expected := `Step 1/3 : FROM busybox
+Step 2/3 : LABEL a=b
+Step 3/3 : ENV c=d
+`
+	assert.Check(t, is.Equal(expected, stdout.String()))
+}
@@ -0,0 +1,124 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/pkg/errors"
+)
+
+// redactedValue replaces the values of the redacted variables
+const redactedValue = "***"
+
+// assignmentRegexp matches the variable assignments of a history entry, as
+// recorded for the build-args of RUN and for ENV
+var assignmentRegexp = regexp.MustCompile(`(^|\s)([A-Za-z_][A-Za-z0-9_]*)=(\S*)`)
+
+// checkRedactPatterns returns an error if a pattern of the RedactArgs option
+// is not a valid pattern
+func checkRedactPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errdefs.InvalidParameter(errors.Errorf("invalid redact-args pattern %q", pattern))
+		}
+	}
+	return nil
+}
+
+func isRedacted(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCreatedBy replaces the values of the variables matching the patterns
+// in a history entry. The known values, which may contain spaces, are
+// replaced first, then the values of the other assignments up to the next
+// space.
+func redactCreatedBy(createdBy string, patterns []string, knownValues map[string]string) string {
+	names := make([]string, 0, len(knownValues))
+	for name := range knownValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := knownValues[name]; value != "" && isRedacted(name, patterns) {
+			re := regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(name+"="+value) + `(\s|$)`)
+			createdBy = re.ReplaceAllString(createdBy, "${1}"+name+"="+redactedValue+"${2}")
+		}
+	}
+	return assignmentRegexp.ReplaceAllStringFunc(createdBy, func(assignment string) string {
+		m := assignmentRegexp.FindStringSubmatch(assignment)
+		if !isRedacted(m[2], patterns) {
+			return assignment
+		}
+		return m[1] + m[2] + "=" + redactedValue
+	})
+}
+
+// redactImageHistory replaces the final image with an image whose history
+// does not show the values of the build-args and ENV variables matching the
+// RedactArgs patterns. The config of the image, and so the environment of its
+// containers, is unchanged. The command of the container config, from which
+// the history of the last step is recorded, is redacted as well.
+func (b *Builder) redactImageHistory(state *dispatchState, patterns []string) error {
+	im, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return err
+	}
+	img, ok := im.Image().(*image.Image)
+	if !ok {
+		return errors.Errorf("unexpected image type")
+	}
+
+	knownValues := make(map[string]string)
+	for name, value := range b.options.BuildArgs {
+		if value != nil {
+			knownValues[name] = *value
+		}
+	}
+	if img.Config != nil {
+		for _, env := range img.Config.Env {
+			kv := strings.SplitN(env, "=", 2)
+			if len(kv) == 2 {
+				knownValues[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	newImage := *img
+	newImage.History = make([]image.History, len(img.History))
+	for i, h := range img.History {
+		h.CreatedBy = redactCreatedBy(h.CreatedBy, patterns, knownValues)
+		newImage.History[i] = h
+	}
+	if len(img.ContainerConfig.Cmd) > 0 {
+		cmd := make([]string, len(img.ContainerConfig.Cmd))
+		for i, arg := range img.ContainerConfig.Cmd {
+			if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && isRedacted(kv[0], patterns) {
+				arg = kv[0] + "=" + redactedValue
+			} else {
+				arg = redactCreatedBy(arg, patterns, knownValues)
+			}
+			cmd[i] = arg
+		}
+		newImage.ContainerConfig.Cmd = cmd
+	}
+	dt, err := newImage.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode image config")
+	}
+	exportedImage, err := b.docker.CreateImage(dt, img.Parent.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to redact the image history")
+	}
+	state.imageID = exportedImage.ImageID()
+	return nil
+}
@@ -0,0 +1,44 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRedactCreatedBy(t *testing.T) {
+	patterns := []string{"*_TOKEN", "PASSWORD"}
+	knownValues := map[string]string{
+		"API_TOKEN": "my token",
+		"PASSWORD":  "secret",
+		"VERSION":   "1.0",
+	}
+	testCases := []struct {
+		createdBy string
+		expected  string
+	}{
+		{
+			createdBy: "|3 API_TOKEN=my token PASSWORD=secret VERSION=1.0 /bin/sh -c make",
+			expected:  "|3 API_TOKEN=*** PASSWORD=*** VERSION=1.0 /bin/sh -c make",
+		},
+		{
+			createdBy: "/bin/sh -c #(nop)  ENV GIT_TOKEN=abcd PASSWORD=old",
+			expected:  "/bin/sh -c #(nop)  ENV GIT_TOKEN=*** PASSWORD=***",
+		},
+		{
+			createdBy: "/bin/sh -c echo $API_TOKEN",
+			expected:  "/bin/sh -c echo $API_TOKEN",
+		},
+		{
+			createdBy: "/bin/sh -c #(nop)  ENV MY_PASSWORD=secret",
+			expected:  "/bin/sh -c #(nop)  ENV MY_PASSWORD=secret",
+		},
+	}
+	for _, tc := range testCases {
+		assert.Check(t, is.Equal(tc.expected, redactCreatedBy(tc.createdBy, patterns, knownValues)))
+	}
+
+	assert.Check(t, checkRedactPatterns(patterns))
+	assert.Check(t, is.ErrorContains(checkRedactPatterns([]string{"[TOKEN"}), `invalid redact-args pattern "[TOKEN"`))
+}
@@ -0,0 +1,78 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/containerfs"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// recordSBOMFiles adds the regular files that the COPY or ADD instruction,
+// whose image was just built or taken from the cache, added to the image to
+// the files of the stage, if the SBOM option is set. The destination of the
+// files is resolved in the resulting image, so that a cache hit lists the
+// same files as a copy.
+func (b *Builder) recordSBOMFiles(state *dispatchState, inst copyInstruction) error {
+	if !b.options.SBOM {
+		return nil
+	}
+	imageMount, err := b.imageSources.Get(state.imageID, true, b.platform)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get image %q", state.imageID)
+	}
+	img, ok := imageMount.Image().(*image.Image)
+	if !ok || img.RootFS == nil || len(img.RootFS.DiffIDs) == 0 {
+		return errors.Errorf("unexpected image type")
+	}
+	layer := img.RootFS.DiffIDs[len(img.RootFS.DiffIDs)-1].String()
+
+	rwLayer, err := imageMount.NewRWLayer()
+	if err != nil {
+		return err
+	}
+	defer rwLayer.Release()
+
+	for _, info := range inst.infos {
+		options := copyFileOptions{
+			decompress: inst.allowLocalDecompression,
+			symlinks:   inst.preserveSymlinks,
+			excludes:   inst.excludesFor(info),
+		}
+		dest, err := createDestInfo(state.runConfig.WorkingDir, inst, inst.destFor(info), rwLayer, state.operatingSystem)
+		if err != nil {
+			return err
+		}
+		files, err := copiedFiles(rwLayer.Root(), dest, info, options)
+		if err != nil {
+			return errors.Wrap(err, "failed to list the copied files")
+		}
+		for _, f := range files {
+			if !f.info.Mode().IsRegular() {
+				continue
+			}
+			dgst, err := fileDigest(info.root, f.source)
+			if err != nil {
+				return err
+			}
+			state.sbomFiles = append(state.sbomFiles, types.BuildSBOMFile{
+				Path:        f.target,
+				Size:        f.info.Size(),
+				Digest:      dgst.String(),
+				Instruction: inst.original,
+				Layer:       layer,
+			})
+		}
+	}
+	return nil
+}
+
+// fileDigest returns the digest of the content of the file p of root
+func fileDigest(root containerfs.ContainerFS, p string) (digest.Digest, error) {
+	f, err := root.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.FromReader(f)
+}
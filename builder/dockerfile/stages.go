@@ -0,0 +1,179 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// stageNode describes a build stage for the --list-stages analysis
+type stageNode struct {
+	name     string
+	baseName string
+	// deps holds the indexes of the stages this stage is based on or
+	// copies from, in the order they are referenced
+	deps []int
+}
+
+func (n stageNode) label(index int) string {
+	if n.name != "" {
+		return n.name
+	}
+	return strconv.Itoa(index)
+}
+
+// checkDuplicateStageNames returns an error if two stages of the Dockerfile
+// have the same name, which would make FROM and COPY --from ambiguous.
+func checkDuplicateStageNames(ast *parser.Node) error {
+	lines := map[string]int{}
+	for _, node := range ast.Children {
+		if node.Value != command.From {
+			continue
+		}
+		cmd, err := instructions.ParseInstruction(node)
+		if err != nil {
+			return errdefs.InvalidParameter(err)
+		}
+		name := cmd.(*instructions.Stage).Name
+		if name == "" {
+			continue
+		}
+		if line, ok := lines[name]; ok {
+			return errdefs.InvalidParameter(errors.Errorf("duplicate stage name %s: the stages of lines %d and %d have the same name", name, line, node.StartLine))
+		}
+		lines[name] = node.StartLine
+	}
+	return nil
+}
+
+// buildStageGraph resolves the base image of every stage and the stages it
+// depends on through FROM and COPY --from, without dispatching anything.
+func buildStageGraph(stages []instructions.Stage, metaArgs []instructions.ArgCommand, escapeToken rune, buildArgs *BuildArgs) ([]stageNode, error) {
+	shlex := shell.NewLex(escapeToken)
+	for _, meta := range metaArgs {
+		if err := processMetaArg(meta, shlex, buildArgs); err != nil {
+			return nil, err
+		}
+	}
+	substitutionArgs := convertMapToEnvList(buildArgs.GetAllMeta())
+
+	nodes := make([]stageNode, len(stages))
+	for i, stage := range stages {
+		baseName, err := shlex.ProcessWord(stage.BaseName, substitutionArgs)
+		if err != nil {
+			return nil, err
+		}
+		node := stageNode{name: stage.Name, baseName: baseName}
+		if ix, found := instructions.HasStage(stages[:i], baseName); found {
+			node.addDep(ix)
+		}
+		for _, cmd := range stage.Commands {
+			c, ok := cmd.(*instructions.CopyCommand)
+			if !ok || c.From == "" {
+				continue
+			}
+			if ix, found := findStage(stages, c.From); found {
+				node.addDep(ix)
+			}
+		}
+		nodes[i] = node
+	}
+	if err := checkStageCycles(nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (n *stageNode) addDep(ix int) {
+	for _, dep := range n.deps {
+		if dep == ix {
+			return
+		}
+	}
+	n.deps = append(n.deps, ix)
+}
+
+// findStage looks up a stage by name or by index. Unlike the build itself,
+// stages defined later in the Dockerfile are matched as well, so references
+// to them can be reported as cycles.
+func findStage(stages []instructions.Stage, nameOrIndex string) (int, bool) {
+	if ix, found := instructions.HasStage(stages, nameOrIndex); found {
+		return ix, true
+	}
+	ix, err := strconv.Atoi(nameOrIndex)
+	if err != nil || ix < 0 || ix >= len(stages) {
+		return -1, false
+	}
+	return ix, true
+}
+
+func checkStageCycles(nodes []stageNode) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(nodes))
+	var path []int
+
+	var visit func(ix int) error
+	visit = func(ix int) error {
+		switch state[ix] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				cycle = append([]string{nodes[path[i]].label(path[i])}, cycle...)
+				if path[i] == ix {
+					break
+				}
+			}
+			cycle = append(cycle, nodes[ix].label(ix))
+			return errdefs.InvalidParameter(errors.Errorf("circular --from reference: %s", strings.Join(cycle, " -> ")))
+		}
+		state[ix] = visiting
+		path = append(path, ix)
+		for _, dep := range nodes[ix].deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[ix] = visited
+		return nil
+	}
+
+	for ix := range nodes {
+		if err := visit(ix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printStageGraph(out io.Writer, nodes []stageNode) {
+	for i, node := range nodes {
+		fmt.Fprintf(out, "Stage %d", i)
+		if node.name != "" {
+			fmt.Fprintf(out, " (%s)", node.name)
+		}
+		fmt.Fprintf(out, ": FROM %s", node.baseName)
+		if len(node.deps) > 0 {
+			deps := make([]string, 0, len(node.deps))
+			for _, dep := range node.deps {
+				deps = append(deps, nodes[dep].label(dep))
+			}
+			fmt.Fprintf(out, ", depends on %s", strings.Join(deps, ", "))
+		}
+		fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,76 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func parseStages(t *testing.T, dockerfile string) ([]instructions.Stage, []instructions.ArgCommand, rune) {
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	assert.NilError(t, err)
+	stages, metaArgs, err := instructions.Parse(result.AST)
+	assert.NilError(t, err)
+	return stages, metaArgs, result.EscapeToken
+}
+
+func TestListStages(t *testing.T) {
+	dockerfile := `ARG BASE=busybox
+FROM ${BASE} AS build
+RUN echo build > /out
+FROM build AS test
+COPY --from=build /out /in
+FROM busybox
+COPY --from=build /out /out
+COPY --from=1 /in /in
+COPY --from=alpine /etc/alpine-release /
+`
+	stages, metaArgs, escapeToken := parseStages(t, dockerfile)
+	nodes, err := buildStageGraph(stages, metaArgs, escapeToken, NewBuildArgs(nil))
+	assert.NilError(t, err)
+
+	out := &bytes.Buffer{}
+	printStageGraph(out, nodes)
+	expected := `Stage 0 (build): FROM busybox
+Stage 1 (test): FROM build, depends on build
+Stage 2: FROM busybox, depends on build, test
+`
+	assert.Check(t, is.Equal(expected, out.String()))
+}
+
+func TestListStagesCircularFrom(t *testing.T) {
+	dockerfile := `FROM busybox AS one
+COPY --from=three /a /a
+FROM busybox AS two
+COPY --from=one /a /a
+FROM busybox AS three
+COPY --from=two /a /a
+`
+	stages, metaArgs, escapeToken := parseStages(t, dockerfile)
+	_, err := buildStageGraph(stages, metaArgs, escapeToken, NewBuildArgs(nil))
+	assert.Check(t, is.Error(err, "circular --from reference: one -> three -> two -> one"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestCheckDuplicateStageNames(t *testing.T) {
+	result, err := parser.Parse(strings.NewReader(`FROM busybox AS build
+RUN echo build
+FROM busybox
+FROM alpine AS BUILD
+COPY --from=1 /etc /etc
+`))
+	assert.NilError(t, err)
+	err = checkDuplicateStageNames(result.AST)
+	assert.Check(t, is.Error(err, "duplicate stage name build: the stages of lines 1 and 4 have the same name"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	result, err = parser.Parse(strings.NewReader("FROM busybox AS build\nFROM busybox\nFROM build AS test\nFROM busybox\n"))
+	assert.NilError(t, err)
+	assert.Check(t, checkDuplicateStageNames(result.AST))
+}
@@ -0,0 +1,66 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// warningsInline prints the warnings with the output of the step that
+	// emits them
+	warningsInline = "inline"
+	// warningsDeferred prints the warnings as a single block once the build
+	// completes
+	warningsDeferred = "deferred"
+)
+
+// deferredWarnings collects the warnings of a build, unchanged, to print them
+// after the output of all the steps. It is shared by the builders of the
+// stages of a parallel build.
+type deferredWarnings struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// newDeferredWarnings returns the collector of the warnings of a build for
+// the warnings mode, or nil if the warnings are printed inline.
+func newDeferredWarnings(mode string) (*deferredWarnings, error) {
+	switch mode {
+	case "", warningsInline:
+		return nil, nil
+	case warningsDeferred:
+		return &deferredWarnings{}, nil
+	}
+	return nil, errdefs.InvalidParameter(errors.Errorf("invalid warnings mode %q: expected %s or %s", mode, warningsInline, warningsDeferred))
+}
+
+func (w *deferredWarnings) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// Flush prints the collected warnings to out, if there are any
+func (w *deferredWarnings) Flush(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() == 0 {
+		return
+	}
+	fmt.Fprintln(out, "Warnings:")
+	w.buf.WriteTo(out)
+}
+
+// warningOutput returns the writer for the warnings of the build, which is
+// stdout unless the warnings are deferred
+func (b *Builder) warningOutput() io.Writer {
+	if b.warnings == nil {
+		return b.Stdout
+	}
+	return b.warnings
+}
@@ -0,0 +1,52 @@
+package dockerfile // import "github.com/docker/docker/builder/dockerfile"
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestNewDeferredWarnings(t *testing.T) {
+	for _, mode := range []string{"", "inline"} {
+		w, err := newDeferredWarnings(mode)
+		assert.Check(t, err)
+		assert.Check(t, w == nil, mode)
+	}
+	w, err := newDeferredWarnings("deferred")
+	assert.Check(t, err)
+	assert.Check(t, w != nil)
+
+	_, err = newDeferredWarnings("later")
+	assert.Check(t, is.ErrorContains(err, `invalid warnings mode "later": expected inline or deferred`))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestDeferredWarnings(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.warnings = &deferredWarnings{}
+	stdout := b.Stdout.(*bytes.Buffer)
+	buildArgs := NewBuildArgs(map[string]*string{"FOO": strPtr("bar")})
+	sb := newDispatchRequest(b, '\\', nil, buildArgs, newStagesBuildResults())
+
+	assert.NilError(t, dispatch(sb, &instructions.MaintainerCommand{Maintainer: "Some Maintainer"}))
+	stdout.WriteString("Step output\n")
+	buildArgs.WarnOnUnusedBuildArgs(b.warningOutput())
+	assert.Check(t, is.Equal("Step output\n", stdout.String()))
+
+	b.warnings.Flush(stdout)
+	expected := `Step output
+Warnings:
+[Warning] MAINTAINER instruction is deprecated, use LABEL maintainer= instead
+[Warning] One or more build-args [FOO] were not consumed
+`
+	assert.Check(t, is.Equal(expected, stdout.String()))
+
+	// nothing is printed without warnings
+	stdout.Reset()
+	(&deferredWarnings{}).Flush(stdout)
+	assert.Check(t, is.Equal("", stdout.String()))
+}
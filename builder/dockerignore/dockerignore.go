@@ -9,16 +9,64 @@ import (
 	"strings"
 )
 
+// includeDirective is the prefix of a line that merges the patterns of
+// another ignore file in place.
+const includeDirective = "#include "
+
+// OpenFunc opens an ignore file referenced by an include directive. The path
+// is relative to the root of the build context.
+type OpenFunc func(path string) (io.ReadCloser, error)
+
+// Pattern is a pattern of an ignore file, along with where it was read from
+type Pattern struct {
+	Pattern string
+	// File is the path of the ignore file, relative to the root of the
+	// build context
+	File string
+	// Line is the line number of the pattern in File
+	Line int
+}
+
 // ReadAll reads a .dockerignore file and returns the list of file patterns
 // to ignore. Note this will trim whitespace from each line as well
 // as use GO's "clean" func to get the shortest/cleanest path for each.
 func ReadAll(reader io.Reader) ([]string, error) {
+	patterns, err := readAll(reader, nil, []string{".dockerignore"})
+	return patternStrings(patterns), err
+}
+
+// ReadAllWithIncludes is like ReadAll, but also expands "#include path" lines
+// by reading the patterns of the referenced file, opened with open, in
+// place of the directive. Includes may be nested but not circular.
+func ReadAllWithIncludes(reader io.Reader, open OpenFunc) ([]string, error) {
+	patterns, err := ReadPatternsWithIncludes(reader, open)
+	return patternStrings(patterns), err
+}
+
+// ReadPatternsWithIncludes is like ReadAllWithIncludes, but returns the file
+// and line each pattern was read from as well.
+func ReadPatternsWithIncludes(reader io.Reader, open OpenFunc) ([]Pattern, error) {
+	return readAll(reader, open, []string{".dockerignore"})
+}
+
+func patternStrings(patterns []Pattern) []string {
+	if patterns == nil {
+		return nil
+	}
+	excludes := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		excludes = append(excludes, p.Pattern)
+	}
+	return excludes
+}
+
+func readAll(reader io.Reader, open OpenFunc, includeStack []string) ([]Pattern, error) {
 	if reader == nil {
 		return nil, nil
 	}
 
 	scanner := bufio.NewScanner(reader)
-	var excludes []string
+	var excludes []Pattern
 	currentLine := 0
 
 	utf8bom := []byte{0xEF, 0xBB, 0xBF}
@@ -30,6 +78,14 @@ func ReadAll(reader io.Reader) ([]string, error) {
 		}
 		pattern := string(scannedBytes)
 		currentLine++
+		if open != nil && strings.HasPrefix(pattern, includeDirective) {
+			included, err := readInclude(strings.TrimSpace(pattern[len(includeDirective):]), open, includeStack)
+			if err != nil {
+				return nil, err
+			}
+			excludes = append(excludes, included...)
+			continue
+		}
 		// Lines starting with # (comments) are ignored before processing
 		if strings.HasPrefix(pattern, "#") {
 			continue
@@ -55,10 +111,32 @@ func ReadAll(reader io.Reader) ([]string, error) {
 			pattern = "!" + pattern
 		}
 
-		excludes = append(excludes, pattern)
+		excludes = append(excludes, Pattern{
+			Pattern: pattern,
+			File:    includeStack[len(includeStack)-1],
+			Line:    currentLine,
+		})
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("Error reading .dockerignore: %v", err)
 	}
 	return excludes, nil
 }
+
+func readInclude(path string, open OpenFunc, includeStack []string) ([]Pattern, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Error reading %s: missing path for include", includeStack[len(includeStack)-1])
+	}
+	path = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+	for _, p := range includeStack {
+		if p == path {
+			return nil, fmt.Errorf("Error reading .dockerignore: circular include of %s (%s)", path, strings.Join(append(includeStack, path), " -> "))
+		}
+	}
+	f, err := open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: failed to include %s: %v", includeStack[len(includeStack)-1], path, err)
+	}
+	defer f.Close()
+	return readAll(f, open, append(includeStack, path))
+}
@@ -2,9 +2,12 @@ package dockerignore // import "github.com/docker/docker/builder/dockerignore"
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -67,3 +70,78 @@ func TestReadAll(t *testing.T) {
 		t.Fatalf("Sixth element is not !, but %s", di[6])
 	}
 }
+
+func openFrom(files map[string]string) OpenFunc {
+	return func(path string) (io.ReadCloser, error) {
+		content, ok := files[path]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+}
+
+func TestReadAllWithIncludes(t *testing.T) {
+	files := map[string]string{
+		"common/base.ignore":  "*.log\n#include common/extra.ignore\n!keep.log\n",
+		"common/extra.ignore": "tmp\n",
+	}
+	content := "node_modules\n#include /common/base.ignore\n# a comment\nbuild\n"
+
+	di, err := ReadAllWithIncludes(strings.NewReader(content), openFrom(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"node_modules", "*.log", "tmp", "!keep.log", "build"}
+	if !reflect.DeepEqual(di, expected) {
+		t.Fatalf("Expected %v, got %v", expected, di)
+	}
+
+	// without includes enabled the directive is a comment
+	di, err = ReadAll(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"node_modules", "build"}
+	if !reflect.DeepEqual(di, expected) {
+		t.Fatalf("Expected %v, got %v", expected, di)
+	}
+}
+
+func TestReadAllWithIncludesCircular(t *testing.T) {
+	files := map[string]string{
+		"a.ignore": "#include b.ignore\n",
+		"b.ignore": "#include a.ignore\n",
+	}
+	_, err := ReadAllWithIncludes(strings.NewReader("#include a.ignore\n"), openFrom(files))
+	if err == nil || !strings.Contains(err.Error(), "circular include of a.ignore") {
+		t.Fatalf("Expected circular include error, got %v", err)
+	}
+}
+
+func TestReadAllWithIncludesMissing(t *testing.T) {
+	_, err := ReadAllWithIncludes(strings.NewReader("#include missing.ignore\n"), openFrom(nil))
+	if err == nil || !strings.Contains(err.Error(), "failed to include missing.ignore") {
+		t.Fatalf("Expected missing include error, got %v", err)
+	}
+}
+
+func TestReadPatternsWithIncludes(t *testing.T) {
+	files := map[string]string{
+		"common/base.ignore": "# logs\n*.log\n",
+	}
+	content := "node_modules\n\n#include common/base.ignore\n!keep.log\n"
+
+	patterns, err := ReadPatternsWithIncludes(strings.NewReader(content), openFrom(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Pattern{
+		{Pattern: "node_modules", File: ".dockerignore", Line: 1},
+		{Pattern: "*.log", File: "common/base.ignore", Line: 2},
+		{Pattern: "!keep.log", File: ".dockerignore", Line: 4},
+	}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("Expected %v, got %v", expected, patterns)
+	}
+}
@@ -2,18 +2,24 @@ package remotecontext // import "github.com/docker/docker/builder/remotecontext"
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/containerd/continuity/driver"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/parser"
 	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/urlutil"
-	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	units "github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -21,97 +27,212 @@ import (
 // ClientSessionRemote is identifier for client-session context transport
 const ClientSessionRemote = "client-session"
 
-// Detect returns a context and dockerfile from remote location or local
-// archive.
-func Detect(config backend.BuildConfig) (remote builder.Source, dockerfile *parser.Result, err error) {
+// Detect returns a context and dockerfile, with the digest of the content of
+// the dockerfile, from remote location or local archive.
+func Detect(config backend.BuildConfig) (remote builder.Source, dockerfile *parser.Result, dockerfileDigest digest.Digest, err error) {
 	remoteURL := config.Options.RemoteContext
 	dockerfilePath := config.Options.Dockerfile
+	// Nothing is built when explaining the .dockerignore file, which must be
+	// kept in the context even if it excludes itself
+	removeIgnored := config.Options.ExplainIgnore == ""
 
 	switch {
 	case remoteURL == "":
-		remote, dockerfile, err = newArchiveRemote(config.Source, dockerfilePath)
+		ignoreCheck := missingDockerignoreCheck{
+			out:     config.ProgressWriter.StdoutFormatter,
+			maxSize: config.Options.WarnMissingDockerignore,
+			strict:  config.Options.StrictMissingDockerignore,
+		}
+		remote, dockerfile, dockerfileDigest, err = newArchiveRemote(config.Source, dockerfilePath, removeIgnored, ignoreCheck)
 	case remoteURL == ClientSessionRemote:
-		res, err := parser.Parse(config.Source)
+		res, dgst, err := parseDockerfile(config.Source)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, "", err
 		}
-		return nil, res, nil
+		return nil, res, dgst, nil
 	case urlutil.IsGitURL(remoteURL):
-		remote, dockerfile, err = newGitRemote(remoteURL, dockerfilePath)
+		remote, dockerfile, dockerfileDigest, err = newGitRemote(remoteURL, dockerfilePath, removeIgnored)
 	case urlutil.IsURL(remoteURL):
-		remote, dockerfile, err = newURLRemote(remoteURL, dockerfilePath, config.ProgressWriter.ProgressReaderFunc)
+		remote, dockerfile, dockerfileDigest, err = newURLRemote(remoteURL, dockerfilePath, removeIgnored, config.ProgressWriter.ProgressReaderFunc)
 	default:
 		err = fmt.Errorf("remoteURL (%s) could not be recognized as URL", remoteURL)
 	}
 	return
 }
 
-func newArchiveRemote(rc io.ReadCloser, dockerfilePath string) (builder.Source, *parser.Result, error) {
+func newArchiveRemote(rc io.ReadCloser, dockerfilePath string, removeIgnored bool, ignoreCheck missingDockerignoreCheck) (builder.Source, *parser.Result, digest.Digest, error) {
 	defer rc.Close()
 	c, err := FromArchive(rc)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
+	}
+	// the .dockerignore file may exclude itself, so it is looked up before
+	// the ignored files are removed
+	if err := ignoreCheck.check(c); err != nil {
+		c.Close()
+		return nil, nil, "", err
 	}
 
-	return withDockerfileFromContext(c.(modifiableContext), dockerfilePath)
+	return withDockerfileFromContext(c.(modifiableContext), dockerfilePath, removeIgnored)
 }
 
-func withDockerfileFromContext(c modifiableContext, dockerfilePath string) (builder.Source, *parser.Result, error) {
+func withDockerfileFromContext(c modifiableContext, dockerfilePath string, removeIgnored bool) (builder.Source, *parser.Result, digest.Digest, error) {
+	if containsWildcards(dockerfilePath) {
+		resolved, err := resolveDockerfileGlob(c, dockerfilePath)
+		if err != nil {
+			c.Close()
+			return nil, nil, "", err
+		}
+		dockerfilePath = resolved
+	}
 	df, err := openAt(c, dockerfilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if dockerfilePath == builder.DefaultDockerfileName {
 				lowercase := strings.ToLower(dockerfilePath)
 				if _, err := StatAt(c, lowercase); err == nil {
-					return withDockerfileFromContext(c, lowercase)
+					return withDockerfileFromContext(c, lowercase, removeIgnored)
 				}
 			}
-			return nil, nil, errors.Errorf("Cannot locate specified Dockerfile: %s", dockerfilePath) // backwards compatible error
+			return nil, nil, "", errors.Errorf("Cannot locate specified Dockerfile: %s", dockerfilePath) // backwards compatible error
 		}
 		c.Close()
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
-	res, err := readAndParseDockerfile(dockerfilePath, df)
+	res, dgst, err := readAndParseDockerfile(dockerfilePath, df)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	df.Close()
 
-	if err := removeDockerfile(c, dockerfilePath); err != nil {
-		c.Close()
-		return nil, nil, err
+	if removeIgnored {
+		if err := removeDockerfile(c, dockerfilePath); err != nil {
+			c.Close()
+			return nil, nil, "", err
+		}
+	}
+
+	return c, res, dgst, nil
+}
+
+// missingDockerignoreCheck warns, or fails if strict, when a build context
+// larger than maxSize bytes has no .dockerignore file, so that all its files
+// were sent to the daemon. A maxSize of 0 disables the check.
+type missingDockerignoreCheck struct {
+	out     io.Writer
+	maxSize int64
+	strict  bool
+}
+
+func (ic missingDockerignoreCheck) check(c builder.Source) error {
+	if ic.maxSize <= 0 {
+		return nil
+	}
+	if _, err := StatAt(c, ".dockerignore"); !os.IsNotExist(errors.Cause(err)) {
+		return err
 	}
+	size, err := contextSize(c)
+	if err != nil {
+		return err
+	}
+	if size <= ic.maxSize {
+		return nil
+	}
+	msg := fmt.Sprintf("the build context is %s, more than %s, and has no .dockerignore file, all its files are sent to the daemon", units.HumanSize(float64(size)), units.HumanSize(float64(ic.maxSize)))
+	if ic.strict {
+		return errdefs.InvalidParameter(errors.New(msg))
+	}
+	fmt.Fprintf(ic.out, "[Warning] %s\n", msg)
+	return nil
+}
+
+// contextSize returns the total size of the regular files of the context
+func contextSize(c builder.Source) (int64, error) {
+	root := c.Root()
+	var size int64
+	err := root.Walk(root.Path(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func containsWildcards(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
 
-	return c, res, nil
+// resolveDockerfileGlob returns the path of the only file of the context that
+// matches pattern. Like in .dockerignore files, "**" matches any number of
+// directories.
+func resolveDockerfileGlob(c builder.Source, pattern string) (string, error) {
+	pm, err := fileutils.NewPatternMatcher([]string{pattern})
+	if err != nil {
+		return "", errdefs.InvalidParameter(errors.Wrapf(err, "invalid Dockerfile pattern %s", pattern))
+	}
+	p := pm.Patterns()[0]
+	root := c.Root()
+	var matches []string
+	err = root.Walk(root.Path(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if ok, err := p.Match(rel); err != nil || !ok {
+			return err
+		}
+		matches = append(matches, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", errdefs.InvalidParameter(errors.Errorf("Cannot locate a Dockerfile matching %s", pattern))
+	case 1:
+		return matches[0], nil
+	}
+	return "", errdefs.InvalidParameter(errors.Errorf("more than one Dockerfile matches %s: %s", pattern, strings.Join(matches, ", ")))
 }
 
-func newGitRemote(gitURL string, dockerfilePath string) (builder.Source, *parser.Result, error) {
+func newGitRemote(gitURL string, dockerfilePath string, removeIgnored bool) (builder.Source, *parser.Result, digest.Digest, error) {
 	c, err := MakeGitContext(gitURL) // TODO: change this to NewLazySource
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
-	return withDockerfileFromContext(c.(modifiableContext), dockerfilePath)
+	return withDockerfileFromContext(c.(modifiableContext), dockerfilePath, removeIgnored)
 }
 
-func newURLRemote(url string, dockerfilePath string, progressReader func(in io.ReadCloser) io.ReadCloser) (builder.Source, *parser.Result, error) {
+func newURLRemote(url string, dockerfilePath string, removeIgnored bool, progressReader func(in io.ReadCloser) io.ReadCloser) (builder.Source, *parser.Result, digest.Digest, error) {
 	contentType, content, err := downloadRemote(url)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	defer content.Close()
 
 	switch contentType {
 	case mimeTypes.TextPlain:
-		res, err := parser.Parse(progressReader(content))
-		return nil, res, err
+		res, dgst, err := parseDockerfile(progressReader(content))
+		return nil, res, dgst, err
 	default:
 		source, err := FromArchive(progressReader(content))
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, "", err
 		}
-		return withDockerfileFromContext(source.(modifiableContext), dockerfilePath)
+		return withDockerfileFromContext(source.(modifiableContext), dockerfilePath, removeIgnored)
 	}
 }
 
@@ -124,7 +245,9 @@ func removeDockerfile(c modifiableContext, filesToRemove ...string) error {
 	case err != nil:
 		return err
 	}
-	excludes, err := dockerignore.ReadAll(f)
+	excludes, err := dockerignore.ReadAllWithIncludes(f, func(path string) (io.ReadCloser, error) {
+		return openAt(c, path)
+	})
 	if err != nil {
 		f.Close()
 		return err
@@ -141,15 +264,71 @@ func removeDockerfile(c modifiableContext, filesToRemove ...string) error {
 	return nil
 }
 
-func readAndParseDockerfile(name string, rc io.Reader) (*parser.Result, error) {
+// ExplainIgnore returns the pattern of the .dockerignore file of the build
+// context that decides whether file is excluded from the context, which is
+// the last pattern matching file, and whether file is excluded. The pattern
+// is nil if the context has no .dockerignore file or if none of its patterns
+// match file.
+func ExplainIgnore(c builder.Source, file string) (*dockerignore.Pattern, bool, error) {
+	f, err := openAt(c, ".dockerignore")
+	switch {
+	case os.IsNotExist(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+	defer f.Close()
+	patterns, err := dockerignore.ReadPatternsWithIncludes(f, func(path string) (io.ReadCloser, error) {
+		return openAt(c, path)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	excludes := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		excludes = append(excludes, p.Pattern)
+	}
+	pm, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Like patterns, paths are relative to the root of the context, which
+	// cannot be excluded itself
+	file = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(file)), "/")
+	if file == "." || file == "" {
+		return nil, false, nil
+	}
+	excluded, ix, err := pm.MatchesWithIndex(file)
+	if err != nil || ix < 0 {
+		return nil, false, err
+	}
+	return &patterns[ix], excluded, nil
+}
+
+func readAndParseDockerfile(name string, rc io.Reader) (*parser.Result, digest.Digest, error) {
 	br := bufio.NewReader(rc)
 	if _, err := br.Peek(1); err != nil {
 		if err == io.EOF {
-			return nil, errors.Errorf("the Dockerfile (%s) cannot be empty", name)
+			return nil, "", errors.Errorf("the Dockerfile (%s) cannot be empty", name)
 		}
-		return nil, errors.Wrap(err, "unexpected error reading Dockerfile")
+		return nil, "", errors.Wrap(err, "unexpected error reading Dockerfile")
+	}
+	return parseDockerfile(br)
+}
+
+// parseDockerfile parses the Dockerfile read from r, and returns it with the
+// digest of its content
+func parseDockerfile(r io.Reader) (*parser.Result, digest.Digest, error) {
+	dt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unexpected error reading Dockerfile")
+	}
+	res, err := parser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		return nil, "", err
 	}
-	return parser.Parse(br)
+	return res, digest.FromBytes(dt), nil
 }
 
 func openAt(remote builder.Source, path string) (driver.File, error) {
@@ -1,15 +1,19 @@
 package remotecontext // import "github.com/docker/docker/builder/remotecontext"
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/pkg/containerfs"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -103,6 +107,164 @@ func TestProcessShouldLeaveAllFiles(t *testing.T) {
 
 }
 
+func TestExplainIgnore(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerignore-explain-test")
+	defer cleanup()
+
+	createTestTempFile(t, contextDir, dockerignoreFilename, "# comment\n.git\ndir\n!dir/e*\n#include extra.ignore\n", 0777)
+	createTestTempFile(t, contextDir, "extra.ignore", "*.md\n\n!README.md\n", 0777)
+	c := &stubRemote{root: containerfs.NewLocalContainerFS(contextDir)}
+
+	tests := []struct {
+		file     string
+		pattern  string
+		source   string
+		line     int
+		excluded bool
+	}{
+		{file: ".git/HEAD", pattern: ".git", source: dockerignoreFilename, line: 2, excluded: true},
+		{file: "dir/foo", pattern: "dir", source: dockerignoreFilename, line: 3, excluded: true},
+		{file: "/dir/e3", pattern: "!dir/e*", source: dockerignoreFilename, line: 4, excluded: false},
+		{file: "CHANGELOG.md", pattern: "*.md", source: "extra.ignore", line: 1, excluded: true},
+		{file: "README.md", pattern: "!README.md", source: "extra.ignore", line: 3, excluded: false},
+		{file: "Dockerfile"},
+		{file: "."},
+	}
+	for _, tc := range tests {
+		pattern, excluded, err := ExplainIgnore(c, tc.file)
+		if err != nil {
+			t.Fatalf("Error explaining %s: %s", tc.file, err)
+		}
+		if tc.pattern == "" {
+			if pattern != nil {
+				t.Fatalf("%s should not match any pattern, got %v", tc.file, *pattern)
+			}
+			continue
+		}
+		if pattern == nil {
+			t.Fatalf("%s should match %s, got no pattern", tc.file, tc.pattern)
+		}
+		if pattern.Pattern != tc.pattern || pattern.File != tc.source || pattern.Line != tc.line {
+			t.Fatalf("%s should match %s (%s:%d), got %v", tc.file, tc.pattern, tc.source, tc.line, *pattern)
+		}
+		if excluded != tc.excluded {
+			t.Fatalf("%s should have excluded=%v, got %v", tc.file, tc.excluded, excluded)
+		}
+	}
+}
+
+func TestExplainIgnoreNoDockerignore(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerignore-explain-test")
+	defer cleanup()
+
+	pattern, excluded, err := ExplainIgnore(&stubRemote{root: containerfs.NewLocalContainerFS(contextDir)}, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pattern != nil || excluded {
+		t.Fatalf("Nothing should be excluded without a .dockerignore file, got %v", pattern)
+	}
+}
+
+func TestResolveDockerfileGlob(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-glob-test")
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Join(contextDir, "app", "build"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	createTestTempFile(t, filepath.Join(contextDir, "app", "build"), "Dockerfile", dockerfileContents, 0777)
+	createTestTempFile(t, filepath.Join(contextDir, "app"), "app.Dockerfile", dockerfileContents, 0777)
+	createTestTempFile(t, contextDir, "test.Dockerfile", dockerfileContents, 0777)
+	c := &stubRemote{root: containerfs.NewLocalContainerFS(contextDir)}
+
+	testCases := []struct {
+		pattern     string
+		expected    string
+		expectedErr string
+	}{
+		{pattern: "**/Dockerfile", expected: "app/build/Dockerfile"},
+		{pattern: "app/*.Dockerfile", expected: "app/app.Dockerfile"},
+		{pattern: "t?st.Dockerfile", expected: "test.Dockerfile"},
+		{pattern: "**/*.Dockerfile", expectedErr: "more than one Dockerfile matches **/*.Dockerfile: app/app.Dockerfile, test.Dockerfile"},
+		{pattern: "*/Dockerfile", expectedErr: "Cannot locate a Dockerfile matching */Dockerfile"},
+	}
+	for _, tc := range testCases {
+		resolved, err := resolveDockerfileGlob(c, tc.pattern)
+		if tc.expectedErr != "" {
+			if err == nil || err.Error() != tc.expectedErr {
+				t.Fatalf("Expected error %q for %s, got %v", tc.expectedErr, tc.pattern, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error resolving %s: %v", tc.pattern, err)
+		}
+		if resolved != tc.expected {
+			t.Fatalf("Expected %s to resolve to %s, got %s", tc.pattern, tc.expected, resolved)
+		}
+	}
+}
+
+func TestReadAndParseDockerfileDigest(t *testing.T) {
+	content := "FROM busybox\nRUN echo hello\n"
+	res, dgst, err := readAndParseDockerfile("Dockerfile", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error parsing Dockerfile: %v", err)
+	}
+	if len(res.AST.Children) != 2 {
+		t.Fatalf("Expected 2 instructions, got %d", len(res.AST.Children))
+	}
+	if expected := digest.FromString(content); dgst != expected {
+		t.Fatalf("Expected digest %s, got %s", expected, dgst)
+	}
+}
+
+func TestMissingDockerignoreCheck(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-missing-dockerignore-test")
+	defer cleanup()
+
+	createTestTempFile(t, contextDir, builder.DefaultDockerfileName, dockerfileContents, 0777)
+	createTestTempFile(t, contextDir, "data", strings.Repeat("a", 2048), 0777)
+	c := &stubRemote{root: containerfs.NewLocalContainerFS(contextDir)}
+
+	warning := "[Warning] the build context is 2.06kB, more than 1kB, and has no .dockerignore file, all its files are sent to the daemon\n"
+	testCases := []struct {
+		maxSize     int64
+		strict      bool
+		expectedOut string
+		expectedErr string
+	}{
+		{maxSize: 0},
+		{maxSize: 4096},
+		{maxSize: 1000, expectedOut: warning},
+		{maxSize: 1000, strict: true, expectedErr: strings.TrimSuffix(strings.TrimPrefix(warning, "[Warning] "), "\n")},
+	}
+	for _, tc := range testCases {
+		out := bytes.NewBuffer(nil)
+		err := missingDockerignoreCheck{out: out, maxSize: tc.maxSize, strict: tc.strict}.check(c)
+		if tc.expectedErr != "" {
+			if err == nil || err.Error() != tc.expectedErr {
+				t.Fatalf("Expected error %q for a maximum of %d, got %v", tc.expectedErr, tc.maxSize, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error checking the context for a maximum of %d: %v", tc.maxSize, err)
+		}
+		if out.String() != tc.expectedOut {
+			t.Fatalf("Expected output %q for a maximum of %d, got %q", tc.expectedOut, tc.maxSize, out.String())
+		}
+	}
+
+	// a .dockerignore file, even one that excludes itself, disables the warning
+	createTestTempFile(t, contextDir, dockerignoreFilename, ".dockerignore\n", 0777)
+	out := bytes.NewBuffer(nil)
+	if err := (missingDockerignoreCheck{out: out, maxSize: 1000, strict: true}).check(c); err != nil || out.Len() != 0 {
+		t.Fatalf("Expected no warning with a .dockerignore file, got %q, %v", out.String(), err)
+	}
+}
+
 // TODO: remove after moving to a separate pkg
 type stubRemote struct {
 	root containerfs.ContainerFS
@@ -0,0 +1,68 @@
+package remotecontext // import "github.com/docker/docker/builder/remotecontext"
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// URLFetcher fetches the content of a remote source for ADD. The returned
+// response is consumed like the one of an HTTP download: its Body is read,
+// and the Last-Modified and Content-Disposition headers are used if set.
+//
+// Credentials needed to access the source should be taken from the daemon
+// environment by the fetcher, as the URL is recorded in the image history.
+type URLFetcher func(u *url.URL) (*http.Response, error)
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = make(map[string]URLFetcher)
+
+	urlSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.\-]*://`)
+)
+
+// RegisterURLFetcher registers fetch to download the sources of ADD that use
+// the given URL scheme, such as "s3".
+func RegisterURLFetcher(scheme string, fetch URLFetcher) error {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+
+	if scheme == "http" || scheme == "https" {
+		return errors.Errorf("URL scheme %s is handled by the builder", scheme)
+	}
+	if _, exists := fetchers[scheme]; exists {
+		return errors.Errorf("URL scheme %s is already registered", scheme)
+	}
+	fetchers[scheme] = fetch
+	return nil
+}
+
+// HasURLScheme returns true if str starts with a URL scheme, such as "s3://".
+// Whether a fetcher is registered for the scheme is checked by FetchURL.
+func HasURLScheme(str string) bool {
+	return urlSchemeRe.MatchString(str)
+}
+
+// FetchURL downloads address using the fetcher registered for its scheme, or
+// over HTTP for http and https URLs.
+func FetchURL(address string) (*http.Response, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errdefs.InvalidParameter(err)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return GetWithStatusError(address)
+	}
+
+	fetchersMu.RLock()
+	fetch, ok := fetchers[u.Scheme]
+	fetchersMu.RUnlock()
+	if !ok {
+		return nil, errdefs.InvalidParameter(errors.Errorf("unsupported URL scheme %s", u.Scheme))
+	}
+	return fetch(u)
+}
@@ -0,0 +1,45 @@
+package remotecontext // import "github.com/docker/docker/builder/remotecontext"
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRegisterURLFetcher(t *testing.T) {
+	fetch := func(u *url.URL) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          ioutil.NopCloser(strings.NewReader(u.Host + u.Path)),
+			ContentLength: -1,
+		}, nil
+	}
+	assert.NilError(t, RegisterURLFetcher("test-fetcher", fetch))
+	assert.Check(t, is.ErrorContains(RegisterURLFetcher("test-fetcher", fetch), "already registered"))
+	assert.Check(t, is.ErrorContains(RegisterURLFetcher("https", fetch), "handled by the builder"))
+
+	resp, err := FetchURL("test-fetcher://bucket/key")
+	assert.NilError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("bucket/key", string(body)))
+
+	_, err = FetchURL("unknown://bucket/key")
+	assert.Check(t, is.Error(err, "unsupported URL scheme unknown"))
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestHasURLScheme(t *testing.T) {
+	assert.Check(t, HasURLScheme("s3://bucket/key"))
+	assert.Check(t, HasURLScheme("git://github.com/docker/docker"))
+	assert.Check(t, HasURLScheme("http://example.com/file"))
+	assert.Check(t, !HasURLScheme("dir/file"))
+	assert.Check(t, !HasURLScheme("/abs/path"))
+	assert.Check(t, !HasURLScheme("c:/file"))
+}
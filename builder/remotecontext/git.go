@@ -9,13 +9,37 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// MakeGitContext returns a Context from gitURL that is cloned in a temporary directory.
+// VCSSource is a build context checked out from a version control system
+type VCSSource interface {
+	builder.Source
+	// VCSRevision returns the revision the context was checked out at
+	VCSRevision() string
+}
+
+// gitContext is the context of a git repository, at the commit revision
+type gitContext struct {
+	modifiableContext
+	revision string
+}
+
+func (c *gitContext) VCSRevision() string {
+	return c.revision
+}
+
+// MakeGitContext returns a Context from gitURL that is cloned in a temporary
+// directory. The context is a VCSSource.
 func MakeGitContext(gitURL string) (builder.Source, error) {
 	root, err := git.Clone(gitURL)
 	if err != nil {
 		return nil, err
 	}
 
+	revision, err := git.Revision(root)
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+
 	c, err := archive.Tar(root, archive.Uncompressed)
 	if err != nil {
 		return nil, err
@@ -31,5 +55,9 @@ func MakeGitContext(gitURL string) (builder.Source, error) {
 			logrus.WithField("action", "MakeGitContext").WithField("module", "builder").WithField("url", gitURL).WithError(err).Error("error while removing path and children of root")
 		}
 	}()
-	return FromArchive(c)
+	source, err := FromArchive(c)
+	if err != nil {
+		return nil, err
+	}
+	return &gitContext{modifiableContext: source.(modifiableContext), revision: revision}, nil
 }
@@ -75,6 +75,18 @@ func cloneGitRepo(repo gitRepo) (checkoutDir string, err error) {
 	return checkoutDir, nil
 }
 
+// Revision returns the commit checked out in dir, a directory of a repository
+// cloned by Clone.
+func Revision(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get the revision of %s: %s", dir, output)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 func parseRemoteURL(remoteURL string) (gitRepo, error) {
 	repo := gitRepo{}
 
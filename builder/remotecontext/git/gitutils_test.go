@@ -247,6 +247,12 @@ func TestCheckoutGit(t *testing.T) {
 		b, err := ioutil.ReadFile(filepath.Join(r, "Dockerfile"))
 		assert.NilError(t, err)
 		assert.Check(t, is.Equal(c.exp, string(b)))
+
+		revision, err := Revision(r)
+		assert.NilError(t, err)
+		expected, err := gitWithinDir(gitDir, "rev-parse", ref)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(strings.TrimSpace(string(expected)), revision), c.frag)
 	}
 }
 
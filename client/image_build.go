@@ -60,7 +60,12 @@ func (cli *Client) imageBuildOptionsToQuery(options types.ImageBuildOptions) (ur
 	if options.NoCache {
 		query.Set("nocache", "1")
 	}
-	if options.Remove {
+	if options.KeepOnFailure {
+		if err := cli.NewVersionError("1.38", "rm=on-failure"); err != nil {
+			return query, err
+		}
+		query.Set("rm", "on-failure")
+	} else if options.Remove {
 		query.Set("rm", "1")
 	} else {
 		query.Set("rm", "0")
@@ -81,6 +86,347 @@ func (cli *Client) imageBuildOptionsToQuery(options types.ImageBuildOptions) (ur
 		query.Set("squash", "1")
 	}
 
+	if options.SquashStages {
+		if err := cli.NewVersionError("1.38", "squash-stages"); err != nil {
+			return query, err
+		}
+		query.Set("squashstages", "1")
+	}
+
+	if options.ErrorOnDeprecated {
+		if err := cli.NewVersionError("1.38", "error-on-deprecated"); err != nil {
+			return query, err
+		}
+		query.Set("errorondeprecated", "1")
+	}
+
+	if options.CacheStats {
+		if err := cli.NewVersionError("1.38", "cache-stats"); err != nil {
+			return query, err
+		}
+		query.Set("cachestats", "1")
+	}
+
+	if options.RequireCmd {
+		if err := cli.NewVersionError("1.38", "require-cmd"); err != nil {
+			return query, err
+		}
+		query.Set("requirecmd", "1")
+	}
+
+	if options.ListStages {
+		if err := cli.NewVersionError("1.38", "list-stages"); err != nil {
+			return query, err
+		}
+		query.Set("liststages", "1")
+	}
+
+	if len(options.SkipOnBuild) > 0 {
+		if err := cli.NewVersionError("1.38", "skip-onbuild"); err != nil {
+			return query, err
+		}
+		for _, group := range options.SkipOnBuild {
+			query.Add("skiponbuild", group)
+		}
+	}
+
+	if len(options.TagByDigest) > 0 {
+		if err := cli.NewVersionError("1.38", "tag-by-digest"); err != nil {
+			return query, err
+		}
+		for _, repo := range options.TagByDigest {
+			query.Add("tagbydigest", repo)
+		}
+	}
+
+	if options.MaxParallelism > 0 {
+		if err := cli.NewVersionError("1.38", "max-parallelism"); err != nil {
+			return query, err
+		}
+		query.Set("maxparallelism", strconv.Itoa(options.MaxParallelism))
+	}
+
+	if options.QuietSteps {
+		if err := cli.NewVersionError("1.38", "quiet-steps"); err != nil {
+			return query, err
+		}
+		query.Set("quietsteps", "1")
+	}
+
+	if options.InlineCache {
+		if err := cli.NewVersionError("1.38", "inline-cache"); err != nil {
+			return query, err
+		}
+		query.Set("inlinecache", "1")
+	}
+
+	if options.LabelSchema {
+		if err := cli.NewVersionError("1.38", "label-schema"); err != nil {
+			return query, err
+		}
+		query.Set("labelschema", "1")
+		if options.LabelSchemaRevision != "" {
+			query.Set("labelschemarevision", options.LabelSchemaRevision)
+		}
+		if options.LabelSchemaSource != "" {
+			query.Set("labelschemasource", options.LabelSchemaSource)
+		}
+	}
+
+	if options.ExplainIgnore != "" {
+		if err := cli.NewVersionError("1.38", "explain-ignore"); err != nil {
+			return query, err
+		}
+		query.Set("explainignore", options.ExplainIgnore)
+	}
+
+	if options.StrictBuildArgs {
+		if err := cli.NewVersionError("1.38", "strict-build-args"); err != nil {
+			return query, err
+		}
+		query.Set("strictbuildargs", "1")
+	}
+
+	if options.AssertLabels != nil {
+		if err := cli.NewVersionError("1.38", "assert-labels"); err != nil {
+			return query, err
+		}
+		assertLabelsJSON, err := json.Marshal(options.AssertLabels)
+		if err != nil {
+			return query, err
+		}
+		query.Set("assertlabels", string(assertLabelsJSON))
+	}
+
+	if options.AssertPorts != nil {
+		if err := cli.NewVersionError("1.38", "assert-ports"); err != nil {
+			return query, err
+		}
+		assertPortsJSON, err := json.Marshal(options.AssertPorts)
+		if err != nil {
+			return query, err
+		}
+		query.Set("assertports", string(assertPortsJSON))
+	}
+
+	if options.LazyContext {
+		if err := cli.NewVersionError("1.38", "lazy-context"); err != nil {
+			return query, err
+		}
+		query.Set("lazycontext", "1")
+	}
+
+	if options.CacheTo {
+		if err := cli.NewVersionError("1.38", "cache-to"); err != nil {
+			return query, err
+		}
+		query.Set("cacheto", "1")
+	}
+
+	if options.OutputHistory {
+		if err := cli.NewVersionError("1.38", "output-history"); err != nil {
+			return query, err
+		}
+		query.Set("outputhistory", "1")
+	}
+
+	if options.StrictCase {
+		if err := cli.NewVersionError("1.38", "strict-case"); err != nil {
+			return query, err
+		}
+		query.Set("strictcase", "1")
+	}
+
+	if options.Created != "" {
+		if err := cli.NewVersionError("1.38", "created"); err != nil {
+			return query, err
+		}
+		query.Set("created", options.Created)
+	}
+
+	if len(options.TagStages) > 0 {
+		if err := cli.NewVersionError("1.38", "tag-stage"); err != nil {
+			return query, err
+		}
+		for _, stageTag := range options.TagStages {
+			query.Add("tagstage", stageTag)
+		}
+	}
+
+	if options.Lint {
+		if err := cli.NewVersionError("1.38", "lint"); err != nil {
+			return query, err
+		}
+		query.Set("lint", "1")
+	}
+
+	if options.ArgToEnvPrefix != "" {
+		if err := cli.NewVersionError("1.38", "arg-to-env-prefix"); err != nil {
+			return query, err
+		}
+		query.Set("argtoenvprefix", options.ArgToEnvPrefix)
+	}
+
+	if len(options.RedactArgs) > 0 {
+		if err := cli.NewVersionError("1.38", "redact-args"); err != nil {
+			return query, err
+		}
+		for _, pattern := range options.RedactArgs {
+			query.Add("redactargs", pattern)
+		}
+	}
+
+	if options.Warnings != "" {
+		if err := cli.NewVersionError("1.38", "warnings"); err != nil {
+			return query, err
+		}
+		query.Set("warnings", options.Warnings)
+	}
+
+	if len(options.WarnOverwrite) > 0 {
+		if err := cli.NewVersionError("1.38", "warn-overwrite"); err != nil {
+			return query, err
+		}
+		for _, p := range options.WarnOverwrite {
+			query.Add("warnoverwrite", p)
+		}
+	}
+
+	if len(options.DNS) > 0 || len(options.DNSSearch) > 0 || len(options.DNSOptions) > 0 {
+		if err := cli.NewVersionError("1.38", "dns"); err != nil {
+			return query, err
+		}
+		for _, server := range options.DNS {
+			query.Add("dns", server)
+		}
+		for _, search := range options.DNSSearch {
+			query.Add("dnssearch", search)
+		}
+		for _, option := range options.DNSOptions {
+			query.Add("dnsoption", option)
+		}
+	}
+
+	if options.AllowMutableTags {
+		if err := cli.NewVersionError("1.38", "allow-mutable-tags"); err != nil {
+			return query, err
+		}
+		query.Set("allowmutabletags", "1")
+	}
+
+	if options.WarnMissingDockerignore != 0 {
+		if err := cli.NewVersionError("1.38", "warn-missing-dockerignore"); err != nil {
+			return query, err
+		}
+		query.Set("warnmissingdockerignore", strconv.FormatInt(options.WarnMissingDockerignore, 10))
+	}
+
+	if options.StrictMissingDockerignore {
+		if err := cli.NewVersionError("1.38", "strict-missing-dockerignore"); err != nil {
+			return query, err
+		}
+		query.Set("strictmissingdockerignore", "1")
+	}
+
+	if options.BaseArgs {
+		if err := cli.NewVersionError("1.38", "base-args"); err != nil {
+			return query, err
+		}
+		query.Set("baseargs", "1")
+	}
+
+	if options.RequireRunnable {
+		if err := cli.NewVersionError("1.38", "require-runnable"); err != nil {
+			return query, err
+		}
+		query.Set("requirerunnable", "1")
+	}
+
+	if len(options.NoCacheFilter) > 0 {
+		if err := cli.NewVersionError("1.38", "no-cache-filter"); err != nil {
+			return query, err
+		}
+		for _, filter := range options.NoCacheFilter {
+			query.Add("nocachefilter", filter)
+		}
+	}
+
+	if options.SBOM {
+		if err := cli.NewVersionError("1.38", "sbom"); err != nil {
+			return query, err
+		}
+		query.Set("sbom", "1")
+	}
+
+	if options.RunReadonly {
+		if err := cli.NewVersionError("1.38", "run-readonly"); err != nil {
+			return query, err
+		}
+		query.Set("runreadonly", "1")
+	}
+
+	if options.MaxSteps > 0 {
+		if err := cli.NewVersionError("1.38", "max-steps"); err != nil {
+			return query, err
+		}
+		query.Set("maxsteps", strconv.Itoa(options.MaxSteps))
+	}
+
+	if options.ModeNormalize {
+		if err := cli.NewVersionError("1.38", "mode-normalize"); err != nil {
+			return query, err
+		}
+		query.Set("modenormalize", "1")
+	}
+
+	if options.ExportStages {
+		if err := cli.NewVersionError("1.38", "export-stages"); err != nil {
+			return query, err
+		}
+		query.Set("exportstages", "1")
+		if options.ExportAllStages {
+			query.Set("exportallstages", "1")
+		}
+	}
+
+	if options.PullRetries > 0 {
+		if err := cli.NewVersionError("1.38", "pull-retries"); err != nil {
+			return query, err
+		}
+		query.Set("pullretries", strconv.Itoa(options.PullRetries))
+		if options.PullRetryDelay > 0 {
+			query.Set("pullretrydelay", strconv.FormatInt(int64(options.PullRetryDelay), 10))
+		}
+	}
+
+	if options.MaxFilesPerLayer > 0 {
+		if err := cli.NewVersionError("1.38", "max-files-per-layer"); err != nil {
+			return query, err
+		}
+		query.Set("maxfilesperlayer", strconv.Itoa(options.MaxFilesPerLayer))
+	}
+
+	if options.DebugOnFailure {
+		if err := cli.NewVersionError("1.38", "debug-on-failure"); err != nil {
+			return query, err
+		}
+		query.Set("debugonfailure", "1")
+	}
+
+	if options.Provenance {
+		if err := cli.NewVersionError("1.38", "provenance"); err != nil {
+			return query, err
+		}
+		query.Set("provenance", "1")
+	}
+
+	if options.NanoCPUs != 0 {
+		if err := cli.NewVersionError("1.38", "cpus"); err != nil {
+			return query, err
+		}
+		query.Set("nanocpus", strconv.FormatInt(options.NanoCPUs, 10))
+	}
+
 	if !container.Isolation.IsDefault(options.Isolation) {
 		query.Set("isolation", string(options.Isolation))
 	}
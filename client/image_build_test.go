@@ -71,6 +71,17 @@ func TestImageBuild(t *testing.T) {
 			expectedTags:           []string{},
 			expectedRegistryConfig: emptyRegistryConfig,
 		},
+		{
+			buildOptions: types.ImageBuildOptions{
+				Remove:        true,
+				KeepOnFailure: true,
+			},
+			expectedQueryParams: map[string]string{
+				"rm": "on-failure",
+			},
+			expectedTags:           []string{},
+			expectedRegistryConfig: emptyRegistryConfig,
+		},
 		{
 			buildOptions: types.ImageBuildOptions{
 				RemoteContext: "remoteContext",
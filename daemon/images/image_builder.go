@@ -5,6 +5,7 @@ import (
 	"io"
 	"runtime"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
@@ -85,17 +86,34 @@ func (l *rwLayer) Root() containerfs.ContainerFS {
 }
 
 func (l *rwLayer) Commit() (builder.ROLayer, error) {
+	var chainID layer.ChainID
+	if parent := l.rwLayer.Parent(); parent != nil {
+		chainID = parent.ChainID()
+	}
+	return l.commit(chainID)
+}
+
+// CommitOnto registers the diff of the layer on top of parent. This allows a
+// layer created on an empty parent to be reused on top of any other image.
+func (l *rwLayer) CommitOnto(parent builder.ROLayer) (builder.ROLayer, error) {
+	p, ok := parent.(*roLayer)
+	if !ok {
+		return nil, errors.Errorf("unexpected layer type %T", parent)
+	}
+	var chainID layer.ChainID
+	if p.roLayer != nil {
+		chainID = p.roLayer.ChainID()
+	}
+	return l.commit(chainID)
+}
+
+func (l *rwLayer) commit(chainID layer.ChainID) (builder.ROLayer, error) {
 	stream, err := l.rwLayer.TarStream()
 	if err != nil {
 		return nil, err
 	}
 	defer stream.Close()
 
-	var chainID layer.ChainID
-	if parent := l.rwLayer.Parent(); parent != nil {
-		chainID = parent.ChainID()
-	}
-
 	newLayer, err := l.layerStore.Register(stream, chainID)
 	if err != nil {
 		return nil, err
@@ -186,6 +204,11 @@ func (i *ImageService) GetImageAndReleasableLayer(ctx context.Context, refOrID s
 			return nil, nil, err
 		}
 		// TODO: shouldn't we error out if error is different from "not found" ?
+		if image != nil && opts.PullOption == backend.PullOptionPreferLocal && opts.Platform != nil && !matchesPlatform(image, *opts.Platform) {
+			// the local image was built for a different platform than the
+			// one requested, pull the requested one instead
+			image = nil
+		}
 		if image != nil {
 			if !system.IsOSSupported(image.OperatingSystem()) {
 				return nil, nil, system.ErrNotSupportedOperatingSystem
@@ -206,6 +229,16 @@ func (i *ImageService) GetImageAndReleasableLayer(ctx context.Context, refOrID s
 	return image, layer, err
 }
 
+// matchesPlatform returns true if the operating system, architecture and
+// variant of img are the ones of platform.
+func matchesPlatform(img *image.Image, platform specs.Platform) bool {
+	return platforms.NewMatcher(platform).Match(specs.Platform{
+		OS:           img.OperatingSystem(),
+		Architecture: img.BaseImgArch(),
+		Variant:      img.Variant,
+	})
+}
+
 // CreateImage creates a new image by adding a config and ID to the image store.
 // This is similar to LoadImage() except that it receives JSON encoded bytes of
 // an image instead of a tar archive.
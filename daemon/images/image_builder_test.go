@@ -0,0 +1,37 @@
+package images // import "github.com/docker/docker/daemon/images"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/image"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/assert"
+)
+
+func TestMatchesPlatform(t *testing.T) {
+	newImage := func(os, arch, variant string) *image.Image {
+		img := &image.Image{Variant: variant}
+		img.OS = os
+		img.Architecture = arch
+		return img
+	}
+	testCases := []struct {
+		img      *image.Image
+		platform specs.Platform
+		expected bool
+	}{
+		{newImage("linux", "amd64", ""), specs.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{newImage("linux", "amd64", ""), specs.Platform{OS: "linux", Architecture: "arm64"}, false},
+		{newImage("linux", "amd64", ""), specs.Platform{OS: "windows", Architecture: "amd64"}, false},
+		{newImage("linux", "arm", "v6"), specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, true},
+		{newImage("linux", "arm", "v6"), specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, false},
+		// the variant of arm defaults to v7, and the one of arm64 to v8
+		{newImage("linux", "arm", ""), specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{newImage("linux", "arm64", "v8"), specs.Platform{OS: "linux", Architecture: "arm64"}, true},
+		{newImage("linux", "aarch64", ""), specs.Platform{OS: "linux", Architecture: "arm64"}, true},
+	}
+	for _, tc := range testCases {
+		actual := matchesPlatform(tc.img, tc.platform)
+		assert.Check(t, actual == tc.expected, "%s/%s/%s for %+v", tc.img.OS, tc.img.Architecture, tc.img.Variant, tc.platform)
+	}
+}
@@ -10,9 +10,15 @@ import (
 	"github.com/docker/docker/dockerversion"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
+// InlineCacheLabel is the label in which a build records the cache key of
+// every entry of the history of the image, so that the image can be used as a
+// cache source after it is pushed and pulled
+const InlineCacheLabel = "com.docker.build.inline-cache"
+
 // NewLocal returns a local image cache, based on parent chain
 func NewLocal(store image.Store) *LocalImageCache {
 	return &LocalImageCache{
@@ -75,7 +81,7 @@ func (ic *ImageCache) GetCache(parentID string, cfg *containertypes.Config) (str
 	}
 
 	for _, target := range ic.sources {
-		if !isValidParent(target, parent) || !isValidConfig(cfg, target.History[lenHistory]) {
+		if !isValidParent(target, parent) || !isValidConfig(cfg, target, lenHistory) {
 			continue
 		}
 
@@ -172,9 +178,53 @@ func getLayerForHistoryIndex(image *image.Image, index int) layer.DiffID {
 	return image.RootFS.DiffIDs[layerIndex] // validate?
 }
 
-func isValidConfig(cfg *containertypes.Config, h image.History) bool {
+func isValidConfig(cfg *containertypes.Config, target *image.Image, index int) bool {
+	if keys := InlineCacheKeys(target); keys != nil && keys[index] != "" {
+		return keys[index] == CacheKey(cfg)
+	}
 	// todo: make this format better than join that loses data
-	return strings.Join(cfg.Cmd, " ") == h.CreatedBy
+	return strings.Join(cfg.Cmd, " ") == target.History[index].CreatedBy
+}
+
+// CacheKey returns the cache key of a build step, based on the config the
+// step is probed with. The fields that depend on the ID of the image the step
+// is based on, and a recorded inline cache, are left out.
+func CacheKey(cfg *containertypes.Config) string {
+	c := *cfg
+	c.Image = ""
+	c.Hostname = ""
+	c.Domainname = ""
+	if _, ok := c.Labels[InlineCacheLabel]; ok {
+		c.Labels = make(map[string]string, len(cfg.Labels))
+		for k, v := range cfg.Labels {
+			if k != InlineCacheLabel {
+				c.Labels[k] = v
+			}
+		}
+	}
+	dt, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return digest.FromBytes(dt).String()
+}
+
+// InlineCacheKeys returns the cache keys recorded in the InlineCacheLabel of
+// img. nil is returned if there are none, or if they do not match the history
+// of the image, for example because the label was inherited from a base image.
+func InlineCacheKeys(img *image.Image) []string {
+	if img.Config == nil {
+		return nil
+	}
+	value, ok := img.Config.Labels[InlineCacheLabel]
+	if !ok {
+		return nil
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(value), &keys); err != nil || len(keys) != len(img.History) {
+		return nil
+	}
+	return keys
 }
 
 func isValidParent(img, parent *image.Image) bool {
@@ -0,0 +1,73 @@
+package cache // import "github.com/docker/docker/image/cache"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCacheKey(t *testing.T) {
+	cfg := &container.Config{
+		Image:    "sha256:aaaa",
+		Hostname: "host1",
+		Env:      []string{"PATH=/bin"},
+		Cmd:      strslice.StrSlice{"/bin/sh", "-c", "#(nop) ", "LABEL a=b"},
+		Labels:   map[string]string{"a": "b"},
+	}
+	key := CacheKey(cfg)
+	assert.Check(t, key != "")
+
+	// the parent image and an inherited inline cache do not matter
+	same := *cfg
+	same.Image = "sha256:bbbb"
+	same.Hostname = "host2"
+	same.Labels = map[string]string{"a": "b", InlineCacheLabel: `["x"]`}
+	assert.Check(t, is.Equal(key, CacheKey(&same)))
+	assert.Check(t, is.Len(same.Labels, 2))
+
+	different := *cfg
+	different.Env = []string{"PATH=/usr/bin"}
+	assert.Check(t, key != CacheKey(&different))
+}
+
+func TestInlineCacheKeys(t *testing.T) {
+	img := &image.Image{
+		V1Image: image.V1Image{Config: &container.Config{
+			Labels: map[string]string{InlineCacheLabel: `["", "sha256:aaaa"]`},
+		}},
+		History: []image.History{{}, {}},
+	}
+	assert.Check(t, is.DeepEqual([]string{"", "sha256:aaaa"}, InlineCacheKeys(img)))
+
+	// inherited from a base image
+	img.History = append(img.History, image.History{})
+	assert.Check(t, is.Nil(InlineCacheKeys(img)))
+
+	img.Config.Labels = nil
+	assert.Check(t, is.Nil(InlineCacheKeys(img)))
+}
+
+func TestIsValidConfigWithInlineCache(t *testing.T) {
+	cfg := &container.Config{Cmd: strslice.StrSlice{"/bin/sh", "-c", "true"}, User: "nobody"}
+	target := &image.Image{
+		V1Image: image.V1Image{Config: &container.Config{
+			Labels: map[string]string{InlineCacheLabel: `["", "` + CacheKey(cfg) + `"]`},
+		}},
+		History: []image.History{
+			{CreatedBy: "/bin/sh -c true"},
+			{CreatedBy: "/bin/sh -c true"},
+		},
+	}
+	// without a key only the command is compared
+	assert.Check(t, isValidConfig(cfg, target, 0))
+	assert.Check(t, isValidConfig(cfg, target, 1))
+
+	root := *cfg
+	root.User = "root"
+	assert.Check(t, isValidConfig(&root, target, 0))
+	assert.Check(t, !isValidConfig(&root, target, 1))
+}
@@ -67,6 +67,7 @@ type Image struct {
 	History    []History `json:"history,omitempty"`
 	OSVersion  string    `json:"os.version,omitempty"`
 	OSFeatures []string  `json:"os.features,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
 
 	// rawJSON caches the immutable JSON associated with this image.
 	rawJSON []byte
@@ -177,6 +178,7 @@ func NewChildImage(img *Image, child ChildConfig, platform string) *Image {
 		History:    append(img.History, imgHistory),
 		OSFeatures: img.OSFeatures,
 		OSVersion:  img.OSVersion,
+		Variant:    img.Variant,
 	}
 }
 
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/docker/docker/builder/dockerfile/command"
 	"github.com/docker/docker/integration-cli/checker"
 	"github.com/docker/docker/integration-cli/cli"
 	"github.com/docker/docker/integration-cli/cli/build"
@@ -25,7 +27,6 @@ import (
 	"github.com/docker/docker/internal/testutil"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/go-check/check"
-	"github.com/moby/buildkit/frontend/dockerfile/command"
 	"github.com/opencontainers/go-digest"
 	"gotest.tools/icmd"
 )
@@ -2049,6 +2050,34 @@ func (s *DockerSuite) TestBuildContextTarNoCompression(c *check.C) {
 	testContextTar(c, archive.Uncompressed)
 }
 
+// A tar context streamed on stdin can hold several Dockerfiles, -f selects the
+// one to build inside the tar
+func (s *DockerSuite) TestBuildContextTarWithF(c *check.C) {
+	ctx := fakecontext.New(c, "",
+		fakecontext.WithFiles(map[string]string{
+			"dockerfiles/Dockerfile.a": "FROM busybox\nRUN echo from Dockerfile.a\n",
+			"dockerfiles/Dockerfile.b": "FROM busybox\nCOPY foo /foo\nRUN echo from Dockerfile.b\n",
+			"foo":                      "bar",
+		}),
+	)
+	defer ctx.Close()
+	newContext := func() io.ReadCloser {
+		context, err := archive.Tar(ctx.Dir, archive.Uncompressed)
+		c.Assert(err, checker.IsNil)
+		return context
+	}
+
+	result := cli.BuildCmd(c, "contexttarwithf", cli.WithFlags("-f", "dockerfiles/Dockerfile.b"), build.WithStdinContext(newContext()))
+	c.Assert(result.Combined(), checker.Contains, "from Dockerfile.b")
+	c.Assert(result.Combined(), checker.Not(checker.Contains), "from Dockerfile.a")
+	c.Assert(cli.DockerCmd(c, "run", "--rm", "contexttarwithf", "cat", "/foo").Combined(), checker.Equals, "bar")
+
+	cli.Docker(cli.Build("contexttarwithf"), cli.WithFlags("-f", "dockerfiles/Dockerfile.c"), build.WithStdinContext(newContext())).Assert(c, icmd.Expected{
+		ExitCode: 1,
+		Err:      "Cannot locate specified Dockerfile: dockerfiles/Dockerfile.c",
+	})
+}
+
 func (s *DockerSuite) TestBuildNoContext(c *check.C) {
 	name := "nocontext"
 	icmd.RunCmd(icmd.Cmd{
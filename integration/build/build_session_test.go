@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/docker/docker/api/types/versions"
 	dclient "github.com/docker/docker/client"
 	"github.com/docker/docker/internal/test/fakecontext"
 	"github.com/docker/docker/internal/test/request"
@@ -84,7 +85,40 @@ func TestBuildWithSession(t *testing.T) {
 	assert.Check(t, is.Equal(du.BuilderSize, int64(0)))
 }
 
-func testBuildWithSession(t *testing.T, client dclient.APIClient, daemonHost string, dir, dockerfile string) (outStr string) {
+func TestBuildWithSessionLazyContext(t *testing.T) {
+	skip.If(t, !testEnv.DaemonInfo.ExperimentalBuild)
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "lazycontext was added in API v1.38")
+
+	client := testEnv.APIClient()
+	_, err := client.BuildCachePrune(context.TODO())
+	assert.NilError(t, err)
+
+	dockerfile := `
+		FROM busybox
+		COPY file /
+		RUN cat /file
+	`
+
+	fctx := fakecontext.New(t, "",
+		fakecontext.WithFile("file", "some content"),
+		fakecontext.WithFile("unreferenced", strings.Repeat("a", 10*1024*1024)),
+	)
+	defer fctx.Close()
+
+	out := testBuildWithSession(t, client, client.DaemonHost(), fctx.Dir, dockerfile, "&lazycontext=1")
+	assert.Check(t, is.Contains(out, "some content"))
+
+	// the size of the build cache is the size of the transferred files
+	du, err := client.DiskUsage(context.TODO())
+	assert.Check(t, err)
+	assert.Check(t, du.BuilderSize > 10)
+	assert.Check(t, du.BuilderSize < 1024*1024, "unreferenced file was transferred: %d bytes", du.BuilderSize)
+
+	_, err = client.BuildCachePrune(context.TODO())
+	assert.Check(t, err)
+}
+
+func testBuildWithSession(t *testing.T, client dclient.APIClient, daemonHost string, dir, dockerfile string, query ...string) (outStr string) {
 	ctx := context.Background()
 	sess, err := session.NewSession(ctx, "foo1", "foo")
 	assert.Check(t, err)
@@ -103,7 +137,7 @@ func testBuildWithSession(t *testing.T, client dclient.APIClient, daemonHost str
 	g.Go(func() error {
 		// FIXME use sock here
 		res, body, err := request.Do(
-			"/build?remote=client-session&session="+sess.ID(),
+			"/build?remote=client-session&session="+sess.ID()+strings.Join(query, ""),
 			request.Host(daemonHost),
 			request.Method(http.MethodPost),
 			request.With(func(req *http.Request) error {
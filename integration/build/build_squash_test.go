@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/integration/internal/container"
 	"github.com/docker/docker/internal/test/fakecontext"
 	"github.com/docker/docker/pkg/stdcopy"
@@ -101,3 +102,44 @@ func TestBuildSquashParent(t *testing.T) {
 	assert.Check(t, is.Len(testHistory, len(origHistory)+1))
 	assert.Check(t, is.Len(inspect.RootFS.Layers, 2))
 }
+
+func TestBuildSquashStages(t *testing.T) {
+	skip.If(t, !testEnv.DaemonInfo.ExperimentalBuild)
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "squashstages was added in API v1.38")
+
+	client := testEnv.APIClient()
+
+	dockerfile := `
+		FROM busybox AS base
+		RUN echo hello > /hello
+		RUN echo world >> /hello
+
+		FROM base
+		RUN echo hello > /remove_me
+		RUN rm /remove_me
+		`
+
+	ctx := context.Background()
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	name := "test-squash-stages"
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:       true,
+		ForceRemove:  true,
+		SquashStages: true,
+		Tags:         []string{name},
+	})
+
+	container.Run(t, ctx, client,
+		container.WithImage(name),
+		container.WithCmd("/bin/sh", "-c", "[ ! -f /remove_me ] && [ -f /hello ]"),
+	)
+
+	base, _, err := client.ImageInspectWithRaw(ctx, "busybox")
+	assert.NilError(t, err)
+	inspect, _, err := client.ImageInspectWithRaw(ctx, name)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(inspect.RootFS.Layers, len(base.RootFS.Layers)+1))
+	assert.Check(t, is.DeepEqual(base.RootFS.Layers, inspect.RootFS.Layers[:len(base.RootFS.Layers)]))
+}
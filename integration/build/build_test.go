@@ -5,19 +5,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/integration/internal/requirement"
 	"github.com/docker/docker/internal/test/fakecontext"
+	"github.com/docker/docker/internal/test/fakegit"
+	"github.com/docker/docker/internal/test/fakestorage"
 	"github.com/docker/docker/internal/test/request"
+	"github.com/docker/docker/opts"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stringid"
+	digest "github.com/opencontainers/go-digest"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/fs"
 	"gotest.tools/skip"
 )
 
@@ -115,6 +131,69 @@ func TestBuildWithRemoveAndForceRemove(t *testing.T) {
 	}
 }
 
+func TestBuildRemoveOnFailure(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "rm=on-failure was added in API v1.38")
+	defer setupTest(t)()
+
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(`FROM busybox
+RUN exit 0
+RUN exit 1`))
+	defer source.Close()
+
+	res, body, err := request.Post(
+		"/build?rm=on-failure&nocache=1",
+		request.RawContent(source.AsTarReader(t)),
+		request.ContentType("application/x-tar"))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(http.StatusOK, res.StatusCode))
+	out, err := request.ReadBody(body)
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(string(out), "Keeping intermediate container"))
+
+	filter, err := buildContainerIdsFilter(bytes.NewReader(out))
+	assert.NilError(t, err)
+	client := testEnv.APIClient()
+	remainingContainers, err := client.ContainerList(context.Background(), types.ContainerListOptions{Filters: filter, All: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(remainingContainers, 1))
+}
+
+func TestBuildDebugOnFailure(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "debugonfailure was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(`FROM busybox
+RUN echo debug > /state && exit 1`))
+	defer source.Close()
+
+	client := testEnv.APIClient()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:         true,
+		NoCache:        true,
+		DebugOnFailure: true,
+	})
+
+	m := regexp.MustCompile(`Keeping the container ([0-9a-f]{64}) of the failed step for debugging`).FindStringSubmatch(out)
+	assert.Assert(t, is.Len(m, 2), out)
+	assert.Check(t, is.Contains(out, "docker commit "+m[1]))
+
+	// the container is kept with the changes of the failed command
+	changes, err := client.ContainerDiff(ctx, m[1])
+	assert.NilError(t, err)
+	var found bool
+	for _, c := range changes {
+		found = found || c.Path == "/state"
+	}
+	assert.Check(t, found, "%v", changes)
+
+	_, err = client.ImageBuild(ctx, source.AsTarReader(t), types.ImageBuildOptions{
+		ForceRemove:    true,
+		DebugOnFailure: true,
+	})
+	assert.Check(t, is.ErrorContains(err, "debug-on-failure cannot be used with force-rm"))
+}
+
 func buildContainerIdsFilter(buildOutput io.Reader) (filters.Args, error) {
 	const intermediateContainerPrefix = " ---> Running in "
 	filter := filters.NewArgs()
@@ -423,16 +502,2808 @@ RUN [ ! -f foo ]
 	assert.Check(t, is.Contains(out.String(), "Successfully built"))
 }
 
-func writeTarRecord(t *testing.T, w *tar.Writer, fn, contents string) {
-	err := w.WriteHeader(&tar.Header{
-		Name:     fn,
-		Mode:     0600,
-		Size:     int64(len(contents)),
-		Typeflag: '0',
+func TestBuildCopyLinkSharesLayer(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "broken in earlier versions")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	// both stages copy the same content on top of different parents
+	dockerfile := `FROM busybox
+COPY --link foo /linked/
+FROM scratch
+COPY bar /
+COPY --link foo /linked/
+`
+
+	source := fakecontext.New(t, "",
+		fakecontext.WithFile("foo", "0"),
+		fakecontext.WithFile("bar", "1"),
+		fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
 	})
+
+	imageIDs, err := getImageIDsFromBuild([]byte(out))
 	assert.NilError(t, err)
-	_, err = w.Write([]byte(contents))
+	assert.Assert(t, is.Len(imageIDs, 2))
+
+	first, _, err := apiclient.ImageInspectWithRaw(ctx, imageIDs[0])
+	assert.NilError(t, err)
+	second, _, err := apiclient.ImageInspectWithRaw(ctx, imageIDs[1])
+	assert.NilError(t, err)
+
+	firstLayers, secondLayers := first.RootFS.Layers, second.RootFS.Layers
+	assert.Check(t, is.Equal(firstLayers[len(firstLayers)-1], secondLayers[len(secondLayers)-1]))
+}
+
+func TestBuildCopyLinkReplacesDirectory(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "broken in earlier versions")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN mkdir /dest && touch /dest/old
+COPY --link dir/ /dest/
+RUN [ -f /dest/new ] && [ ! -e /dest/old ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithFile("dir/new", ""),
+		fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+// TestBuildFromContextFile checks that a pre-built, compressed context tarball
+// read from disk can be sent as-is, with the Dockerfile resolved inside of it.
+func TestBuildFromContextFile(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY foo /
+RUN [ "$(cat /foo)" = "bar" ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithFile("foo", "bar"),
+		fakecontext.WithFile("build/Dockerfile", dockerfile))
+	defer source.Close()
+
+	tarball, err := archive.Tar(source.Dir, archive.Gzip)
+	assert.NilError(t, err)
+	contextFile, err := ioutil.TempFile("", "build-context")
+	assert.NilError(t, err)
+	defer os.Remove(contextFile.Name())
+	_, err = io.Copy(contextFile, tarball)
+	tarball.Close()
+	assert.NilError(t, err)
+	assert.NilError(t, contextFile.Close())
+
+	contextFile, err = os.Open(contextFile.Name())
+	assert.NilError(t, err)
+	defer contextFile.Close()
+
+	buildImage(ctx, t, contextFile, types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Dockerfile:  "build/Dockerfile",
+	})
+}
+
+func TestBuildRunNoCache(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --no-cache was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN echo cached > /cached
+RUN --no-cache date > /uncached
+RUN echo after > /after
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	build := func() string {
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	build()
+	out := build()
+	// only the first RUN is taken from cache; the --no-cache step and
+	// everything after it is executed again
+	assert.Check(t, is.Equal(strings.Count(out, "Using cache"), 1))
+}
+
+func TestBuildAddSpecialFiles(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "special files are not supported on Windows")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	err := w.WriteHeader(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644})
+	assert.NilError(t, err)
+	writeTarRecord(t, w, "file", "contents")
+	assert.NilError(t, w.Close())
+
+	dockerfile := `FROM busybox
+ADD special.tar /dest/
+RUN [ -p /dest/fifo ] && [ -f /dest/file ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithBinaryFiles(map[string]*bytes.Buffer{
+			"special.tar": buf,
+		}))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildAddKeepNewer(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "ADD --keep-newer was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	// the files of the archive are older than the ones written by the build
+	archived := time.Now().Add(-24 * time.Hour)
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	for _, name := range []string{"existing", "extracted"} {
+		err := w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 8, ModTime: archived})
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("archived"))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, w.Close())
+
+	dockerfile := `FROM busybox
+RUN mkdir /dest && echo new > /dest/existing
+ADD --keep-newer archive.tar /dest/
+RUN [ "$(cat /dest/existing)" = new ] && [ "$(cat /dest/extracted)" = archived ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithBinaryFiles(map[string]*bytes.Buffer{
+			"archive.tar": buf,
+		}))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildCopyPreserveDirMode(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "COPY --preserve-dir-mode is not supported for Windows images")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY --preserve-dir-mode private /private
+COPY private /default
+RUN [ "$(stat -c %a /private)" = 700 ] && [ "$(stat -c %a /default)" = 755 ] && [ -f /private/secret ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFiles(map[string]string{"private/secret": "secret"}))
+	defer source.Close()
+	assert.NilError(t, os.Chmod(filepath.Join(source.Dir, "private"), 0700))
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildAddIntoNamed(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	err := w.WriteHeader(&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 8})
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("archived"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	archive := buf.Bytes()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithBinaryFiles(map[string]*bytes.Buffer{
+				"foo.tar": bytes.NewBuffer(archive),
+			}))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	out := build(`FROM busybox
+ADD --into-named foo.tar /opt/
+RUN [ "$(cat /opt/foo/bin/app)" = archived ] && [ ! -e /opt/bin ]
+`)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(`FROM busybox
+RUN mkdir /opt && touch /opt/foo
+ADD --into-named foo.tar /opt/
+`)
+	assert.Check(t, is.Contains(out, "ADD --into-named: cannot extract foo.tar, foo exists in the destination and is not a directory"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildFromPlatform(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "FROM --platform was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType != "linux")
+	skip.If(t, !requirement.HasHubConnectivity(t))
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	arch := "arm64"
+	if testEnv.DaemonInfo.Architecture == "aarch64" {
+		arch = "amd64"
+	}
+	dockerfile := `FROM --platform=linux/` + arch + ` busybox
+LABEL platform=` + arch + `
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	_, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, imageID)
 	assert.NilError(t, err)
+	assert.Check(t, is.Equal(arch, inspect.Architecture))
+}
+
+func TestBuildCacheStats(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "cache-stats was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN echo foo > /foo
+COPY bar /
+`
+	build := func(contents string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("bar", contents))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			CacheStats:  true,
+		})
+	}
+
+	build("bar0")
+	out := build("bar1")
+	assert.Check(t, is.Contains(out, "Cache: 1/3 steps reused"))
+}
+
+func TestBuildArgsUnconsumedWarning(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG FOO
+ARG BAR=default
+RUN [ "$FOO" = "fromflag" ] && [ "$BAR" = "fromfile" ]
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	foo, bar, unused := "fromflag", "fromfile", "fromfile"
+	out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		BuildArgs: map[string]*string{
+			"FOO":    &foo,
+			"BAR":    &bar,
+			"UNUSED": &unused,
+		},
+	})
+
+	assert.Check(t, is.Contains(out, "[Warning] One or more build-args [UNUSED] were not consumed"))
+}
+
+func TestBuildRunRetry(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --retry was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			NoCache:     true,
+		})
+	}
+
+	// fails on the first two attempts, and succeeds on the third one
+	out := build(`FROM busybox
+RUN --retry=3 --retry-delay=100ms n=$(($(cat /count 2>/dev/null || echo 0) + 1)); echo $n > /count; [ $n -ge 3 ]
+RUN [ "$(cat /count)" = "3" ]
+`)
+	assert.Check(t, is.Contains(out, "Command failed, retrying in 100ms (2/3)"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(`FROM busybox
+RUN --retry=1 false
+`)
+	assert.Check(t, is.Contains(out, "Command failed, retrying in 0s (1/1)"))
+	assert.Check(t, is.Contains(out, "returned a non-zero code: 1"))
+}
+
+func TestBuildRequireCmd(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "requirecmd was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "Windows does not support FROM scratch")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("foo", "bar"))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			RequireCmd:  true,
+		})
+	}
+
+	out := build(`FROM scratch
+ADD foo /
+`)
+	assert.Check(t, is.Contains(out, "image built from scratch has neither a CMD nor an ENTRYPOINT"))
+
+	out = build(`FROM scratch
+ADD foo /
+CMD ["/foo"]
+`)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildRequireRunnable(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "requirerunnable was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string, requireRunnable bool) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:          true,
+			ForceRemove:     true,
+			RequireRunnable: requireRunnable,
+		})
+	}
+
+	dockerfile := "FROM busybox\nCMD []\n"
+	out := build(dockerfile, true)
+	assert.Check(t, is.Contains(out, "image has neither a CMD nor an ENTRYPOINT, it cannot be run without a command"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+
+	out = build(dockerfile, false)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build("FROM busybox\nCMD []\nENTRYPOINT [\"top\"]\n", true)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildAssertLabels(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "assertlabels was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+LABEL maintainer=me version=1.0
+`
+	build := func(assertLabels map[string]string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:       true,
+			ForceRemove:  true,
+			Labels:       map[string]string{"vendor": "acme"},
+			AssertLabels: assertLabels,
+		})
+	}
+
+	out := build(map[string]string{"maintainer": "me", "version": "1.0", "vendor": "acme"})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(map[string]string{"maintainer": "me", "version": "2.0"})
+	assert.Check(t, is.Contains(out, `image labels do not match the asserted labels: version is "1.0", expected "2.0", unexpected vendor=acme`))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildAssertPorts(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "assertports was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+EXPOSE 80 443/tcp
+`
+	build := func(assertPorts []string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			AssertPorts: assertPorts,
+		})
+	}
+
+	out := build([]string{"80/tcp", "443/tcp"})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build([]string{"80/tcp", "8080/tcp"})
+	assert.Check(t, is.Contains(out, "image exposed ports do not match the asserted ports: missing 8080/tcp, unexpected 443/tcp"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildCopyRename(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "COPY --rename was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	baseImage := testEnv.PlatformDefaults.BaseImage
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("src/sub/file", "contents"))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	// the renamed directories are copied from another stage to check that
+	// they exist, without relying on the commands of the base image
+	out := build(fmt.Sprintf(`FROM %[1]s AS renamed
+COPY --rename src app /opt/
+COPY --rename src/sub data /opt
+FROM %[1]s
+COPY --from=renamed /opt/app/sub/file /app-file
+COPY --from=renamed /opt/data/file /data-file
+`, baseImage))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(fmt.Sprintf(`FROM %s
+COPY --rename src/sub/file app /opt/
+`, baseImage))
+	assert.Check(t, is.Contains(out, "COPY --rename requires a source directory"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildCopyFromWildcard(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS builder
+RUN mkdir /out && echo a > /out/a.so && echo b > /out/b.so && echo c > /out/c.txt
+
+FROM busybox
+COPY --from=builder /out/*.so /libs/
+RUN [ "$(cat /libs/a.so)" = "a" ] && [ "$(cat /libs/b.so)" = "b" ] && [ ! -e /libs/c.txt ]
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildSkipOnBuildGroup(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "skip-onbuild was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string, options types.ImageBuildOptions) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		options.Remove = true
+		options.ForceRemove = true
+		return buildOutput(ctx, t, source.AsTarReader(t), options)
+	}
+
+	out := build(`FROM busybox
+ONBUILD RUN echo trigger-$((1+1))-always
+ONBUILD [group=dev] RUN echo trigger-$((1+1))-dev
+ONBUILD [group=test] RUN echo trigger-$((1+1))-test
+`, types.ImageBuildOptions{Tags: []string{"onbuild-groups-parent"}})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	// the triggers are kept as plain instructions, which other builders can run
+	apiclient := testEnv.APIClient()
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "onbuild-groups-parent")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("RUN echo trigger-$((1+1))-dev", inspect.Config.OnBuild[1]))
+
+	out = build("FROM onbuild-groups-parent\n", types.ImageBuildOptions{
+		SkipOnBuild: []string{"dev"},
+		Tags:        []string{"onbuild-groups-child"},
+	})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	assert.Check(t, is.Contains(out, "# Executing 2 build triggers"))
+	assert.Check(t, is.Contains(out, "# Skipping build trigger of group dev"))
+	assert.Check(t, is.Contains(out, "trigger-2-always"))
+	assert.Check(t, is.Contains(out, "trigger-2-test"))
+	assert.Check(t, !strings.Contains(out, "trigger-2-dev"))
+
+	inspect, _, err = apiclient.ImageInspectWithRaw(ctx, "onbuild-groups-child")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(inspect.Config.Labels, 0))
+}
+
+func TestBuildTagByDigest(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "tagbydigest was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM busybox\nLABEL tagbydigest=1\n"))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"tagbydigest:latest"},
+		TagByDigest: []string{"tagbydigest-app"},
+	})
+
+	img, _, err := apiclient.ImageInspectWithRaw(ctx, "tagbydigest:latest")
+	assert.NilError(t, err)
+	digestTag := "tagbydigest-app:" + strings.Replace(img.ID, ":", "-", 1)
+	assert.Check(t, is.Contains(img.RepoTags, digestTag))
+	assert.Check(t, is.Contains(out, "Successfully tagged "+digestTag))
+}
+
+func TestBuildCopyDestPatternSubstitution(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ENV FOO=archive.tar
+COPY foo /dest/${FOO%.tar}/
+RUN [ "$(cat /dest/archive/foo)" = "bar" ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("foo", "bar"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildParallelStages(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "max-parallelism was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS first
+RUN sleep 5 && echo first > /first
+
+FROM busybox AS second
+RUN sleep 5 && echo second > /second
+
+FROM busybox
+COPY --from=first /first /
+COPY --from=second /second /
+RUN [ "$(cat /first)" = "first" ] && [ "$(cat /second)" = "second" ]
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	start := time.Now()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:         true,
+		ForceRemove:    true,
+		NoCache:        true,
+		MaxParallelism: 2,
+	})
+	elapsed := time.Since(start)
+
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	assert.Check(t, is.Contains(out, "[first] "))
+	assert.Check(t, is.Contains(out, "[second] "))
+	// Both stages sleep 5 seconds, building them one after the other would
+	// take at least 10 seconds
+	assert.Check(t, elapsed < 10*time.Second, "build took %s", elapsed)
+}
+
+func TestBuildCopyExclude(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "COPY --exclude was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY --exclude=*.md --exclude=node_modules src /excluded/
+RUN [ -f /excluded/main.go ] && [ ! -e /excluded/README.md ] && [ ! -e /excluded/node_modules ]
+COPY src /all/
+RUN [ -f /all/main.go ] && [ -f /all/README.md ] && [ -f /all/node_modules/module.js ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("src/main.go", "package main"),
+		fakecontext.WithFile("src/README.md", "readme"),
+		fakecontext.WithFile("src/node_modules/module.js", "js"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildQuietSteps(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "quiet-steps was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			NoCache:     true,
+			QuietSteps:  true,
+		})
+	}
+
+	out := build(`FROM busybox
+RUN echo quiet-$((1+1))-first
+RUN echo quiet-$((1+1))-second
+`)
+	assert.Check(t, is.Contains(out, "Step 2/3 : RUN echo quiet-$((1+1))-first"))
+	assert.Check(t, is.Contains(out, "Step 3/3 : RUN echo quiet-$((1+1))-second"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	assert.Check(t, !strings.Contains(out, "quiet-2-first"))
+	assert.Check(t, !strings.Contains(out, "Running in"))
+
+	out = build(`FROM busybox
+RUN echo quiet-$((1+1))-ok
+RUN echo quiet-$((1+1))-failed && false
+`)
+	assert.Check(t, !strings.Contains(out, "quiet-2-ok"))
+	assert.Check(t, is.Contains(out, "quiet-2-failed"))
+	assert.Check(t, is.Contains(out, "returned a non-zero code: 1"))
+}
+
+func TestBuildAddCreatesParentDirsAsUser(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN mkdir -p /existing
+USER nobody
+ADD file /existing/new/deep/
+RUN [ "$(stat -c %u:%g /existing)" = "0:0" ]
+RUN [ "$(stat -c %u:%g /existing/new /existing/new/deep)" = "$(printf '65534:65534\n65534:65534')" ]
+RUN touch /existing/new/deep/written
+ADD --chmod=0700 file /private/dir/
+RUN [ "$(stat -c %u:%g:%a /private/dir)" = "65534:65534:700" ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("file", "contents"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildMinVersionDirective(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "the min-version directive was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	version, err := apiclient.ServerVersion(ctx)
+	assert.NilError(t, err)
+	skip.If(t, !strings.ContainsAny(version.Version[:1], "0123456789"), "development daemons satisfy any min-version")
+
+	build := func(dockerfile string) (string, error) {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx,
+			source.AsTarReader(t),
+			types.ImageBuildOptions{
+				Remove:      true,
+				ForceRemove: true,
+			})
+		if err != nil {
+			return "", err
+		}
+		out := bytes.NewBuffer(nil)
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		assert.NilError(t, err)
+		return out.String(), nil
+	}
+
+	out, err := build("# min-version=17.09\nFROM busybox\n")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out, err = build("# min-version=9999.0\nFROM busybox\n")
+	if err == nil {
+		assert.Check(t, is.Contains(out, "requires builder version 9999.0 or newer"))
+		assert.Check(t, !strings.Contains(out, "Step 1/1"))
+	} else {
+		assert.Check(t, is.ErrorContains(err, "requires builder version 9999.0 or newer"))
+	}
+}
+
+func TestBuildCopyToSymlinkDest(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN mkdir /target && ln -s /target /existing && ln -s /missing /dangling
+COPY foo /existing/
+RUN [ -f /target/foo ] && [ -L /existing ]
+COPY foo /dangling/
+RUN [ -f /missing/foo ] && [ -L /dangling ]
+COPY --link foo /existing/linked/
+RUN [ -f /target/linked/foo ] && [ -L /existing ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("foo", "hello"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildMemoryLimit(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType != "linux")
+	skip.If(t, !testEnv.DaemonInfo.MemoryLimit, "memory limit is not supported")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN head -c 64m /dev/zero | tail
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	_, err := apiclient.ImageBuild(ctx,
+		source.AsTarReader(t),
+		types.ImageBuildOptions{
+			Memory: 1024,
+		})
+	assert.Check(t, is.ErrorContains(err, "minimum memory limit allowed is 4MB"))
+
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Memory:      8 * 1024 * 1024,
+		MemorySwap:  8 * 1024 * 1024,
+	})
+	assert.Check(t, is.Contains(out, "killed, possibly out of memory: the memory limit of the build is 8MiB"))
+}
+
+func TestBuildInlineCache(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "inline-cache was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ENV FOO=bar
+RUN echo foo > /foo
+COPY file /file
+`
+	apiclient := testEnv.APIClient()
+	build := func(options types.ImageBuildOptions) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("file", "contents"))
+		defer source.Close()
+
+		options.Remove = true
+		options.ForceRemove = true
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), options)
+		return out
+	}
+
+	inlineCache := "1"
+	build(types.ImageBuildOptions{
+		Tags:      []string{"build-inline-cache"},
+		BuildArgs: map[string]*string{"BUILDKIT_INLINE_CACHE": &inlineCache},
+	})
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-inline-cache")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Labels, "com.docker.build.inline-cache"))
+
+	// drop the intermediate images, like after a push and pull
+	saved, err := apiclient.ImageSave(ctx, []string{"build-inline-cache"})
+	assert.NilError(t, err)
+	defer saved.Close()
+	_, err = apiclient.ImageRemove(ctx, "build-inline-cache", types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	assert.NilError(t, err)
+	loaded, err := apiclient.ImageLoad(ctx, saved, true)
+	assert.NilError(t, err)
+	loaded.Body.Close()
+
+	out := build(types.ImageBuildOptions{
+		CacheFrom:   []string{"build-inline-cache"},
+		InlineCache: true,
+	})
+	assert.Check(t, is.Equal(3, strings.Count(out, "Using cache")))
+	assert.Check(t, is.Contains(out, "Successfully built "+stringid.TruncateID(inspect.ID)))
+
+	// the inline cache is not inherited by the images built from the image
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM build-inline-cache\nLABEL child=1\n"))
+	defer source.Close()
+	_, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	inspect, _, err = apiclient.ImageInspectWithRaw(ctx, imageID)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(map[string]string{"child": "1"}, inspect.Config.Labels))
+}
+
+func TestBuildLocalCache(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "cacheto was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	cacheDir := fs.NewDir(t, "build-local-cache")
+	defer cacheDir.Remove()
+	cache := filepath.Join(cacheDir.Path(), "image.tar")
+
+	dockerfile := `FROM busybox
+ENV FOO=bar
+RUN echo foo > /foo
+COPY file /file
+`
+	apiclient := testEnv.APIClient()
+	build := func(options types.ImageBuildOptions) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("file", "contents"))
+		defer source.Close()
+
+		options.Remove = true
+		options.ForceRemove = true
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), options)
+		return out
+	}
+
+	out := build(types.ImageBuildOptions{
+		Tags:    []string{"build-local-cache"},
+		CacheTo: true,
+	})
+	var imageIDs []string
+	assert.Assert(t, buildAux(t, out, "moby.cache.images", &imageIDs), out)
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-local-cache")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(imageIDs, inspect.ID))
+
+	// the client saves the cache, the daemon does not write it
+	rc, err := apiclient.ImageSave(ctx, imageIDs)
+	assert.NilError(t, err)
+	f, err := os.Create(cache)
+	assert.NilError(t, err)
+	_, err = io.Copy(f, rc)
+	rc.Close()
+	f.Close()
+	assert.NilError(t, err)
+
+	// drop the image and its intermediate images, like on a fresh daemon
+	_, err = apiclient.ImageRemove(ctx, "build-local-cache", types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	assert.NilError(t, err)
+
+	f, err = os.Open(cache)
+	assert.NilError(t, err)
+	resp, err := apiclient.ImageLoad(ctx, f, true)
+	f.Close()
+	assert.NilError(t, err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+
+	out = build(types.ImageBuildOptions{
+		CacheFrom: imageIDs,
+	})
+	assert.Check(t, is.Equal(3, strings.Count(out, "Using cache")))
+	assert.Check(t, is.Contains(out, "Successfully built "+stringid.TruncateID(inspect.ID)))
+}
+
+func TestBuildLabelSchema(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "label-schema was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+LABEL org.opencontainers.image.revision=from-dockerfile
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	resp, err := apiclient.ImageBuild(ctx,
+		source.AsTarReader(t),
+		types.ImageBuildOptions{
+			Remove:              true,
+			ForceRemove:         true,
+			Tags:                []string{"build-label-schema"},
+			Labels:              map[string]string{"org.opencontainers.image.source": "explicit"},
+			LabelSchema:         true,
+			LabelSchemaRevision: "abc123",
+			LabelSchemaSource:   "https://example.com/repo.git",
+		})
+	assert.NilError(t, err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-label-schema")
+	assert.NilError(t, err)
+	labels := inspect.Config.Labels
+	created, err := time.Parse(time.RFC3339, labels["org.opencontainers.image.created"])
+	assert.NilError(t, err)
+	assert.Check(t, time.Since(created) < time.Hour)
+	assert.Check(t, is.Equal("from-dockerfile", labels["org.opencontainers.image.revision"]))
+	assert.Check(t, is.Equal("explicit", labels["org.opencontainers.image.source"]))
+}
+
+func TestBuildErrorCodes(t *testing.T) {
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "error codes are set from API 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	buildError := func(dockerfile string) *jsonmessage.JSONError {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx,
+			source.AsTarReader(t),
+			types.ImageBuildOptions{
+				Remove:      true,
+				ForceRemove: true,
+			})
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			m := jsonmessage.JSONMessage{}
+			err := dec.Decode(&m)
+			if err == io.EOF {
+				return nil
+			}
+			assert.NilError(t, err)
+			if m.Error != nil {
+				return m.Error
+			}
+		}
+	}
+
+	jsonErr := buildError("FROM busybox\nRUN exit 42\n")
+	assert.Assert(t, jsonErr != nil)
+	assert.Check(t, is.Equal(42, jsonErr.Code))
+	assert.Check(t, is.Contains(jsonErr.Message, "returned a non-zero code: 42"))
+
+	jsonErr = buildError("FROM busybox\nFROM no-such-image-for-build-error-codes\n")
+	assert.Assert(t, jsonErr != nil)
+	assert.Check(t, is.Equal(125, jsonErr.Code))
+}
+
+func TestBuildAddCompressedTars(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	for _, tool := range []string{"bzip2", "zstd"} {
+		_, err := exec.LookPath(tool)
+		skip.If(t, err != nil, "%s is not installed", tool)
+	}
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	tarball := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarball)
+	writeTarRecord(t, tw, "test", "test")
+	assert.NilError(t, tw.Close())
+	compress := func(tool string) string {
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader(tarball.Bytes())
+		out, err := cmd.Output()
+		assert.NilError(t, err)
+		return string(out)
+	}
+
+	dockerfile := `FROM busybox
+ADD test.tar.bz2 /bz2/
+ADD test.tar.zst /zst/
+ADD fake.tar.zst /fake/
+RUN [ "$(cat /bz2/test)" = test ] && [ "$(cat /zst/test)" = test ] && [ "$(cat /fake/fake.tar.zst)" = "not zstd" ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("test.tar.bz2", compress("bzip2")),
+		fakecontext.WithFile("test.tar.zst", compress("zstd")),
+		fakecontext.WithFile("fake.tar.zst", "not zstd"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildExplainIgnore(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "explain-ignore was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerignore := `# the ignore file itself is kept when explaining
+.dockerignore
+dir
+!dir/e*
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile("FROM busybox\n"),
+		fakecontext.WithFile(".dockerignore", dockerignore))
+	defer source.Close()
+
+	explain := func(file string) string {
+		out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			ExplainIgnore: file,
+		})
+		assert.Check(t, !strings.Contains(out, "Successfully built"))
+		return out
+	}
+
+	assert.Check(t, is.Contains(explain("dir/foo"), `dir/foo is excluded by \"dir\" at .dockerignore:3`))
+	assert.Check(t, is.Contains(explain("dir/e3"), `dir/e3 is re-included by \"!dir/e*\" at .dockerignore:4`))
+	assert.Check(t, is.Contains(explain("Dockerfile"), "Dockerfile is not matched by any .dockerignore pattern"))
+}
+
+func TestBuildEnvUnset(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "ENV --unset was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS base
+ENV FOO=bar BAZ=qux
+FROM base
+ENV --unset FOO
+RUN test -z "${FOO+set}" && test "$BAZ" = qux
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"build-env-unset"},
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-env-unset")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Env, "BAZ=qux"))
+	for _, env := range inspect.Config.Env {
+		assert.Check(t, !strings.HasPrefix(env, "FOO="), env)
+	}
+}
+
+func TestBuildEnvInherit(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS base
+ENV FOO=bar
+FROM base
+ENV FOO=changed BAZ=qux
+ENV --inherit FOO
+RUN test "$FOO" = bar && test "$BAZ" = qux
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"build-env-inherit"},
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-env-inherit")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Env, "FOO=bar"))
+	assert.Check(t, is.Contains(inspect.Config.Env, "BAZ=qux"))
+}
+
+func TestBuildStrictBuildArgs(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "strict-build-args was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG USED
+RUN echo $USED
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	build := func(strict bool) string {
+		used, typo := "used", "typo"
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:          true,
+			ForceRemove:     true,
+			BuildArgs:       map[string]*string{"USED": &used, "UNSED": &typo},
+			StrictBuildArgs: strict,
+		})
+	}
+
+	out := build(false)
+	assert.Check(t, is.Contains(out, "[Warning] One or more build-args [UNSED] were not consumed"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(true)
+	assert.Check(t, is.Contains(out, "one or more build-args [UNSED] were not consumed"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildContextFileOrderCache(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY . /ctx/
+`
+	files := [][2]string{
+		{"a.txt", "a"},
+		{"dir/1", "1"},
+		{"dir/2", "2"},
+		{"b.txt", "b"},
+	}
+	apiclient := testEnv.APIClient()
+	build := func(order []int) (string, string) {
+		ops := []func(*fakecontext.Fake) error{fakecontext.WithDockerfile(dockerfile)}
+		for _, i := range order {
+			ops = append(ops, fakecontext.WithFile(files[i][0], files[i][1]))
+		}
+		source := fakecontext.New(t, "", ops...)
+		defer source.Close()
+
+		out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			Tags:        []string{"build-context-order"},
+		})
+		assert.Assert(t, is.Contains(out, "Successfully built"))
+
+		inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-context-order")
+		assert.NilError(t, err)
+		return out, inspect.ID
+	}
+
+	_, imageID := build([]int{0, 1, 2, 3})
+	out, cachedID := build([]int{3, 2, 0, 1})
+	assert.Check(t, is.Contains(out, "Using cache"))
+	assert.Check(t, is.Equal(imageID, cachedID))
+}
+
+func TestBuildEnvFromFile(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "ENV --from-file was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ENV --from-file VERSION=VERSION.txt
+RUN test "$VERSION" = 1.2.3
+`
+	apiclient := testEnv.APIClient()
+	build := func(version string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("VERSION.txt", version))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			Tags:        []string{"build-env-from-file"},
+		})
+	}
+
+	out := build("1.2.3\n")
+	assert.Assert(t, is.Contains(out, "Successfully built"))
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-env-from-file")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Env, "VERSION=1.2.3"))
+
+	// the content of the file is part of the cache key
+	out = build("1.2.4\n")
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+	assert.Check(t, is.Contains(out, "returned a non-zero code"))
+}
+
+func TestBuildEntrypointExpand(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG APP_BIN
+ENTRYPOINT --expand ["${APP_BIN}", "\\$HOME"]
+CMD ["$APP_BIN"]
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	appBin := "/bin/echo"
+	apiclient := testEnv.APIClient()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		BuildArgs:   map[string]*string{"APP_BIN": &appBin},
+		Tags:        []string{"build-entrypoint-expand"},
+	})
+	assert.Assert(t, is.Contains(out, "Successfully built"))
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-entrypoint-expand")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"/bin/echo", "$HOME"}, inspect.Config.Entrypoint))
+	assert.Check(t, is.DeepEqual(strslice.StrSlice{"$APP_BIN"}, inspect.Config.Cmd))
+}
+
+func TestBuildDuplicateStageName(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS build
+RUN echo first > /out
+FROM busybox AS build
+RUN echo second > /out
+FROM busybox
+COPY --from=build /out /out
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	assert.Check(t, is.Contains(out, "duplicate stage name build: the stages of lines 1 and 3 have the same name"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildWithExtraHostsFile(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	hostsFile := fs.NewFile(t, "build-hosts", fs.WithContent(`# hosts for the build
+127.0.0.1 fromfile fromfile.local
+`))
+	defer hostsFile.Remove()
+	extraHosts, err := opts.ParseHostsFile(hostsFile.Path())
+	assert.NilError(t, err)
+
+	dockerfile := `FROM busybox
+RUN ping -c 1 fromfile
+RUN ping -c 1 fromfile.local
+RUN ping -c 1 fromflag
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		ExtraHosts:  append(extraHosts, "fromflag:127.0.0.1"),
+	})
+}
+
+func TestBuildWithDNS(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "dns was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN grep "^nameserver 127.0.0.1$" /etc/resolv.conf
+RUN grep "^search build.example.com$" /etc/resolv.conf
+RUN grep "^options ndots:2$" /etc/resolv.conf
+`
+	apiclient := testEnv.APIClient()
+	build := func(dns []string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx,
+			source.AsTarReader(t),
+			types.ImageBuildOptions{
+				Remove:      true,
+				ForceRemove: true,
+				DNS:         dns,
+				DNSSearch:   []string{"build.example.com"},
+				DNSOptions:  []string{"ndots:2"},
+			})
+		if err != nil {
+			return err.Error()
+		}
+		out := bytes.NewBuffer(nil)
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		assert.NilError(t, err)
+		return out.String()
+	}
+
+	assert.Check(t, is.Contains(build([]string{"127.0.0.1"}), "Successfully built"))
+
+	out := build([]string{"not-an-ip"})
+	assert.Check(t, is.Contains(out, "invalid dns: not-an-ip is not an ip address"))
+	assert.Check(t, !strings.Contains(out, "Step 1/4"), out)
+}
+
+func TestBuildRunIf(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --if was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG DEBUG
+RUN --if=${DEBUG} echo debug-step-ran
+`
+	build := func(buildArgs map[string]*string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			BuildArgs:   buildArgs,
+		})
+		return out
+	}
+
+	debug := "1"
+	out := build(map[string]*string{"DEBUG": &debug})
+	assert.Check(t, is.Contains(out, "Step 3/3 : RUN --if=${DEBUG} echo debug-step-ran"))
+	assert.Check(t, is.Contains(out, "\ndebug-step-ran"))
+
+	out = build(nil)
+	assert.Check(t, is.Contains(out, "Step 3/3 : RUN --if=${DEBUG} echo debug-step-ran"))
+	assert.Check(t, is.Contains(out, "Skipping, the condition ${DEBUG} is false"))
+	assert.Check(t, !strings.Contains(out, "\ndebug-step-ran"))
+}
+
+func TestBuildRunUser(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --user was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			Tags:        []string{"build-run-user"},
+		})
+	}
+
+	out := build(`FROM busybox
+RUN --user=1001 id -u > /tmp/uid
+RUN [ "$(cat /tmp/uid)" = 1001 ] && [ "$(id -u)" = 0 ]
+`)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-run-user")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("", inspect.Config.User))
+
+	out = build("FROM busybox\nRUN --user=nosuchuser id\n")
+	assert.Check(t, is.Contains(out, "nosuchuser"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildRedactArgs(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "redactargs was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG API_TOKEN
+ARG VERSION
+RUN echo "$VERSION" > /version
+ENV DB_TOKEN=my-db-token
+RUN [ "$API_TOKEN" = my-api-token ]
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	token, version := "my-api-token", "1.0"
+	apiclient := testEnv.APIClient()
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"build-redact-args"},
+		BuildArgs:   map[string]*string{"API_TOKEN": &token, "VERSION": &version},
+		RedactArgs:  []string{"*_TOKEN"},
+	})
+
+	history, err := apiclient.ImageHistory(ctx, "build-redact-args")
+	assert.NilError(t, err)
+	var createdBy []string
+	for _, h := range history {
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	allCreatedBy := strings.Join(createdBy, "\n")
+	assert.Check(t, is.Contains(allCreatedBy, "API_TOKEN=***"))
+	assert.Check(t, is.Contains(allCreatedBy, "DB_TOKEN=***"))
+	assert.Check(t, is.Contains(allCreatedBy, "VERSION=1.0"))
+	assert.Check(t, !strings.Contains(allCreatedBy, "my-api-token"), allCreatedBy)
+	assert.Check(t, !strings.Contains(allCreatedBy, "my-db-token"), allCreatedBy)
+
+	// the environment of the containers is unchanged
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-redact-args")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Env, "DB_TOKEN=my-db-token"))
+}
+
+func TestBuildOutputHistory(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "outputhistory was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(dockerfile string) []types.BuildHistoryItem {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			OutputHistory: true,
+		})
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		var history []types.BuildHistoryItem
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg jsonmessage.JSONMessage
+			if err := dec.Decode(&msg); err == io.EOF {
+				break
+			} else {
+				assert.NilError(t, err)
+			}
+			if msg.ID == "moby.image.history" && msg.Aux != nil {
+				assert.NilError(t, json.Unmarshal(*msg.Aux, &history))
+			}
+		}
+		return history
+	}
+
+	history := build("FROM busybox\nENV FOO=bar\nRUN echo foo > /foo\n")
+	assert.Assert(t, len(history) > 2)
+	env, run := history[len(history)-2], history[len(history)-1]
+	assert.Check(t, is.Contains(env.CreatedBy, "ENV FOO=bar"))
+	assert.Check(t, env.EmptyLayer)
+	assert.Check(t, is.Contains(run.CreatedBy, "echo foo > /foo"))
+	assert.Check(t, !run.EmptyLayer)
+	assert.Check(t, run.Size > 0)
+
+	// failed builds have no history
+	history = build("FROM busybox\nRUN exit 1\n")
+	assert.Check(t, is.Len(history, 0))
+}
+
+func TestBuildCopySourceCase(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "the test relies on a case-sensitive filesystem")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile("FROM busybox\nCOPY Foo.txt /\n"),
+		fakecontext.WithFile("foo.txt", "contents"))
+	defer source.Close()
+
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	assert.Check(t, is.Contains(out, "no such file or directory (foo.txt only differs in case)"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildCopyDestTemplate(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY *.conf /etc/app/{basename}.bak
+RUN [ "$(cat /etc/app/a.conf.bak)" = a ] && [ "$(cat /etc/app/b.conf.bak)" = b ] && [ ! -e /etc/app/c.txt.bak ]
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("a.conf", "a"),
+		fakecontext.WithFile("b.conf", "b"),
+		fakecontext.WithFile("c.txt", "c"))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+}
+
+func TestBuildDeferredWarnings(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "warnings was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(warnings string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM busybox\nMAINTAINER foo\nLABEL foo=bar\n"))
+		defer source.Close()
+
+		foo := "bar"
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:           true,
+			ForceRemove:      true,
+			BuildArgs:        map[string]*string{"FOO": &foo},
+			Warnings:         warnings,
+			AllowMutableTags: true,
+		})
+		return out
+	}
+
+	maintainerWarning := "[Warning] MAINTAINER instruction is deprecated, use LABEL maintainer= instead\n"
+	buildArgWarning := "[Warning] One or more build-args [FOO] were not consumed\n"
+
+	out := build("")
+	assert.Check(t, is.Contains(out, maintainerWarning))
+	assert.Check(t, is.Contains(out, buildArgWarning))
+	assert.Check(t, !strings.Contains(out, "Warnings:"))
+	assert.Check(t, strings.Index(out, maintainerWarning) < strings.Index(out, "Step 3/3"), out)
+
+	out = build("deferred")
+	assert.Check(t, is.Contains(out, "Warnings:\n"+maintainerWarning+buildArgWarning))
+	assert.Check(t, strings.Index(out, "Step 3/3") < strings.Index(out, "Warnings:"), out)
+}
+
+func TestBuildShellOS(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "SHELL --os was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := fmt.Sprintf(`FROM %s
+SHELL --os=windows ["powershell", "-command"]
+SHELL --os=linux ["/bin/sh", "-ec"]
+LABEL foo=bar
+`, testEnv.PlatformDefaults.BaseImage)
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"build-shell-os"},
+	})
+
+	expected := []string{"/bin/sh", "-ec"}
+	if testEnv.DaemonInfo.OSType == "windows" {
+		expected = []string{"powershell", "-command"}
+	}
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-shell-os")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(strslice.StrSlice(expected), inspect.Config.Shell))
+}
+
+func TestBuildWarnOverwrite(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "warnoverwrite was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(warnOverwrite []string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile("FROM busybox\nCOPY passwd /etc/passwd\nCOPY new /etc/new\n"),
+			fakecontext.WithFile("passwd", "root:x:0:0:root:/root:/bin/sh\n"),
+			fakecontext.WithFile("new", "new"))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			NoCache:       true,
+			WarnOverwrite: warnOverwrite,
+		})
+		return out
+	}
+
+	out := build([]string{"/etc"})
+	assert.Check(t, is.Contains(out, "[Warning] COPY overwrites /etc/passwd\n"))
+	assert.Check(t, !strings.Contains(out, "overwrites /etc/new"), out)
+
+	out = build(nil)
+	assert.Check(t, !strings.Contains(out, "overwrites"), out)
+}
+
+func TestBuildBaseArgs(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "baseargs was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string, options types.ImageBuildOptions) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		options.Remove = true
+		options.ForceRemove = true
+		return buildOutput(ctx, t, source.AsTarReader(t), options)
+	}
+
+	out := build("FROM busybox\nARG VERSION=1.0\nRUN echo $VERSION > /version\n", types.ImageBuildOptions{Tags: []string{"build-base-args"}})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	version := "2.0"
+	out = build("FROM build-base-args\nRUN [ \"$VERSION\" = 2.0 ]\n", types.ImageBuildOptions{
+		BuildArgs: map[string]*string{"VERSION": &version},
+		BaseArgs:  true,
+	})
+	assert.Check(t, is.Contains(out, "Using build-arg VERSION declared by the base image"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	assert.Check(t, !strings.Contains(out, "were not consumed"), out)
+
+	// without the option, the ARG must be declared again
+	out = build("FROM build-base-args\nRUN [ -z \"$VERSION\" ]\n", types.ImageBuildOptions{
+		BuildArgs: map[string]*string{"VERSION": &version},
+	})
+	assert.Check(t, is.Contains(out, "[Warning] One or more build-args [VERSION] were not consumed"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildNoCacheFilter(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "nocachefilter was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS builder
+RUN echo build > /out
+FROM busybox
+RUN echo final > /final
+LABEL foo=bar
+`
+	build := func(noCacheFilter []string) []string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			NoCacheFilter: noCacheFilter,
+		})
+		// the output of each step, from "Step 1/5" to "Step 5/5"
+		return strings.Split(out, "Step ")[1:]
+	}
+
+	build(nil)
+	steps := build([]string{"builder"})
+	assert.Assert(t, is.Len(steps, 5))
+	assert.Check(t, !strings.Contains(steps[1], "Using cache"), steps[1])
+	assert.Check(t, is.Contains(steps[3], "Using cache"))
+	assert.Check(t, is.Contains(steps[4], "Using cache"))
+
+	steps = build([]string{"step:4"})
+	assert.Assert(t, is.Len(steps, 5))
+	assert.Check(t, is.Contains(steps[1], "Using cache"))
+	assert.Check(t, !strings.Contains(steps[3], "Using cache"), steps[3])
+	// the step after the rebuilt one has a new parent
+	assert.Check(t, !strings.Contains(steps[4], "Using cache"), steps[4])
+}
+
+func TestBuildSBOM(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "sbom was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(dockerfile string) []types.BuildSBOMFile {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFiles(map[string]string{
+				"app/main.go": "package main",
+				"app/lib.go":  "package lib",
+				"config.json": "{}",
+			}))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			SBOM:        true,
+		})
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		var files []types.BuildSBOMFile
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg jsonmessage.JSONMessage
+			if err := dec.Decode(&msg); err == io.EOF {
+				break
+			} else {
+				assert.NilError(t, err)
+			}
+			if msg.ID == "moby.image.sbom" && msg.Aux != nil {
+				assert.NilError(t, json.Unmarshal(*msg.Aux, &files))
+			}
+		}
+		return files
+	}
+
+	dockerfile := `FROM busybox
+COPY app /src/
+COPY config.json /etc/app/
+`
+	// the second build takes the steps from the cache
+	for i := 0; i < 2; i++ {
+		files := build(dockerfile)
+		assert.Assert(t, is.Len(files, 3))
+		paths := map[string]types.BuildSBOMFile{}
+		for _, f := range files {
+			paths[f.Path] = f
+		}
+		for p, contents := range map[string]string{"/src/main.go": "package main", "/src/lib.go": "package lib", "/etc/app/config.json": "{}"} {
+			f, ok := paths[p]
+			assert.Assert(t, ok, p)
+			assert.Check(t, is.Equal(digest.FromString(contents).String(), f.Digest), p)
+			assert.Check(t, is.Equal(int64(len(contents)), f.Size), p)
+		}
+		assert.Check(t, is.Equal("COPY app /src/", paths["/src/main.go"].Instruction))
+		assert.Check(t, is.Equal("COPY config.json /etc/app/", paths["/etc/app/config.json"].Instruction))
+		assert.Check(t, paths["/src/main.go"].Layer != paths["/etc/app/config.json"].Layer)
+	}
+
+	// failed builds have no SBOM
+	files := build(dockerfile + "RUN exit 1\n")
+	assert.Check(t, is.Len(files, 0))
+}
+
+func TestBuildRunCacheKeyFrom(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --cache-key-from was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN --cache-key-from=package-lock.json echo install
+`
+	build := func(lockfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFiles(map[string]string{"package-lock.json": lockfile}))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+		return out
+	}
+
+	build(`{"lockfileVersion": 1}`)
+	out := build(`{"lockfileVersion": 1}`)
+	assert.Check(t, is.Contains(out, "Using cache"))
+	// the command is the same, but the lockfile changed
+	out = build(`{"lockfileVersion": 2}`)
+	assert.Check(t, !strings.Contains(out, "Using cache"), out)
+}
+
+func TestBuildRunReadonly(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "runreadonly was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType != "linux")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			NoCache:     true,
+			RunReadonly: true,
+		})
+	}
+
+	out := build("FROM busybox\nRUN touch /file\n")
+	assert.Check(t, is.Contains(out, "Read-only file system"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"), out)
+
+	// /dev/shm is a tmpfs mount of the container
+	out = build("FROM busybox\nRUN touch /dev/shm/file\n")
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+// TestBuildCopyFromImage checks that COPY --from accepts an image reference
+// that is not a stage of the Dockerfile, and that the cache of the step is
+// not used once the files of the image change.
+func TestBuildCopyFromImage(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string, tag string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			Tags:        []string{tag},
+		})
+		return out
+	}
+
+	dockerfile := `FROM busybox
+COPY --from=copy-from-source:latest /certs/ca.pem /certs/
+RUN cat /certs/ca.pem
+`
+	build("FROM busybox\nRUN mkdir /certs && echo first > /certs/ca.pem\n", "copy-from-source:latest")
+	out := build(dockerfile, "copy-from-target")
+	assert.Check(t, is.Contains(out, "first"))
+	out = build(dockerfile, "copy-from-target")
+	assert.Check(t, is.Equal(2, strings.Count(out, "Using cache")), out)
+
+	// the copied file changed in the image
+	build("FROM busybox\nRUN mkdir /certs && echo second > /certs/ca.pem\n", "copy-from-source:latest")
+	out = build(dockerfile, "copy-from-target")
+	assert.Check(t, !strings.Contains(out, "Using cache"), out)
+	assert.Check(t, is.Contains(out, "second"))
+}
+
+func TestBuildMaxSteps(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "maxsteps was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	// a generated Dockerfile with a step for each port
+	dockerfile := bytes.NewBufferString("FROM busybox\n")
+	for port := 8000; port < 8100; port++ {
+		fmt.Fprintf(dockerfile, "EXPOSE %d\n", port)
+	}
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile.String()))
+	defer source.Close()
+
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		MaxSteps:    50,
+	})
+	assert.Check(t, is.Contains(out, "the Dockerfile has 101 steps, more than the maximum of 50"))
+	// the build is aborted before the first step
+	assert.Check(t, !strings.Contains(out, "Step 1/101"), out)
+}
+
+func TestBuildLabelBuildArgs(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG VER
+LABEL version=${VER} stage=${VER:-none}
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	ver := "1.2"
+	apiclient := testEnv.APIClient()
+	_, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		BuildArgs:   map[string]*string{"VER": &ver},
+		Labels:      map[string]string{"stage": "from-flag"},
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, imageID)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("1.2", inspect.Config.Labels["version"]))
+	// the --label option takes precedence over the Dockerfile
+	assert.Check(t, is.Equal("from-flag", inspect.Config.Labels["stage"]))
+}
+
+func TestBuildLabelHeredoc(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+LABEL description=<<EOF
+first line
+second line
+EOF
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	_, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, imageID)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("first line\nsecond line", inspect.Config.Labels["description"]))
+}
+
+func TestBuildModeNormalize(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "modenormalize was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "mode-normalize is not supported for Windows images")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	modTime := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	apiclient := testEnv.APIClient()
+	// build copies the same files with the modes of a checkout made with
+	// another umask
+	build := func(scriptMode, configMode int64) string {
+		buf := bytes.NewBuffer(nil)
+		w := tar.NewWriter(buf)
+		for _, f := range []struct {
+			name     string
+			mode     int64
+			contents string
+		}{
+			{name: "Dockerfile", mode: 0644, contents: "FROM busybox\nCOPY run.sh config /\nRUN stat -c '%a %n' /run.sh /config\n"},
+			{name: "run.sh", mode: scriptMode, contents: "#!/bin/sh\n"},
+			{name: "config", mode: configMode, contents: "key=value\n"},
+		} {
+			err := w.WriteHeader(&tar.Header{Name: f.name, Mode: f.mode, Size: int64(len(f.contents)), ModTime: modTime, Typeflag: tar.TypeReg})
+			assert.NilError(t, err)
+			_, err = w.Write([]byte(f.contents))
+			assert.NilError(t, err)
+		}
+		assert.NilError(t, w.Close())
+
+		out := buildOutput(ctx, t, buf, types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			NoCache:       true,
+			ModeNormalize: true,
+		})
+		assert.Check(t, is.Contains(out, "755 /run.sh"))
+		assert.Check(t, is.Contains(out, "644 /config"))
+
+		imageIDs, err := getImageIDsFromBuild([]byte(out))
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(imageIDs, 1))
+		inspect, _, err := apiclient.ImageInspectWithRaw(ctx, imageIDs[0])
+		assert.NilError(t, err)
+		// the layer of the COPY, before the one of the RUN
+		layers := inspect.RootFS.Layers
+		assert.Assert(t, len(layers) > 2)
+		return layers[len(layers)-2]
+	}
+
+	assert.Check(t, is.Equal(build(0700, 0600), build(0775, 0664)))
+}
+
+func TestBuildRequiredArg(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN echo before the argument
+ARG --required DB_PASSWORD
+RUN [ -n "$DB_PASSWORD" ]
+`
+	build := func(buildArgs map[string]*string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			BuildArgs:   buildArgs,
+		})
+	}
+
+	out := build(nil)
+	assert.Check(t, is.Contains(out, "missing required build-args, set them with --build-arg: DB_PASSWORD"))
+	// the build fails before its first step
+	assert.Check(t, !strings.Contains(out, "Step 1/4"), out)
+
+	password := "secret"
+	out = build(map[string]*string{"DB_PASSWORD": &password})
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildCopyNewerThan(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "COPY --newer-than was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	lastBuild := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	for _, f := range []struct {
+		name     string
+		modTime  time.Time
+		contents string
+	}{
+		{name: "Dockerfile", modTime: lastBuild, contents: "FROM busybox\nCOPY --newer-than=.lastbuild src /dest/\nRUN find /dest -type f\n"},
+		{name: ".lastbuild", modTime: lastBuild},
+		{name: "src/unchanged.css", modTime: lastBuild.Add(-time.Hour), contents: "body {}"},
+		{name: "src/js/touched.js", modTime: lastBuild.Add(time.Hour), contents: "main()"},
+		{name: "src/js/unchanged.js", modTime: lastBuild.Add(-time.Hour), contents: "lib()"},
+	} {
+		err := w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents)), ModTime: f.modTime, Typeflag: tar.TypeReg})
+		assert.NilError(t, err)
+		_, err = w.Write([]byte(f.contents))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, w.Close())
+
+	out := buildOutput(ctx, t, buf, types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	assert.Check(t, is.Contains(out, "/dest/js/touched.js"))
+	assert.Check(t, !strings.Contains(out, "unchanged"), out)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildExportStages(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "exportstages was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox AS builder
+RUN echo built > /artifact
+FROM busybox AS final
+COPY --from=builder /artifact /artifact
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	out, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:       true,
+		ForceRemove:  true,
+		ExportStages: true,
+	})
+	var stages []types.BuildStage
+	assert.Assert(t, buildAux(t, out, "moby.build.stages", &stages), out)
+	var names []string
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+	}
+	assert.Assert(t, is.DeepEqual([]string{"builder", "final"}, names))
+	assert.Check(t, is.Equal(imageID, stages[1].ID))
+
+	// the client saves the image of the builder stage like docker save
+	rc, err := testEnv.APIClient().ImageSave(ctx, []string{stages[0].ID})
+	assert.NilError(t, err)
+	defer rc.Close()
+	var manifest bool
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		manifest = manifest || hdr.Name == "manifest.json"
+	}
+	assert.Check(t, manifest)
+}
+
+func TestBuildMaxFilesPerLayer(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "maxfilesperlayer was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+COPY files /files/
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFiles(map[string]string{
+			"files/a": "a",
+			"files/b": "b",
+			"files/c": "c",
+		}))
+	defer source.Close()
+
+	build := func(maxFiles int) string {
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:           true,
+			ForceRemove:      true,
+			NoCache:          true,
+			MaxFilesPerLayer: maxFiles,
+		})
+	}
+
+	out := build(3)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build(2)
+	assert.Check(t, is.Contains(out, "COPY files /files/ adds or modifies 3 files, more than the maximum of 2 files per layer"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+func TestBuildProvenance(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "provenance was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ARG VERSION
+ARG API_TOKEN
+RUN echo $VERSION $API_TOKEN > /version
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	version, token := "1.2", "secret"
+	apiclient := testEnv.APIClient()
+	_, imageID := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		BuildArgs:   map[string]*string{"VERSION": &version, "API_TOKEN": &token},
+		RedactArgs:  []string{"*_TOKEN"},
+		Provenance:  true,
+	})
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, imageID)
+	assert.NilError(t, err)
+	base, _, err := apiclient.ImageInspectWithRaw(ctx, "busybox")
+	assert.NilError(t, err)
+
+	var provenance types.BuildProvenance
+	err = json.Unmarshal([]byte(inspect.Config.Labels["com.docker.build.provenance"]), &provenance)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(digest.FromString(dockerfile).String(), provenance.DockerfileDigest))
+	assert.Check(t, is.DeepEqual(map[string]string{"VERSION": "1.2", "API_TOKEN": "***"}, provenance.BuildArgs))
+	assert.Check(t, is.DeepEqual([]types.BuildProvenanceImage{{Name: "busybox", ID: base.ID}}, provenance.BaseImages))
+	_, err = time.Parse(time.RFC3339Nano, provenance.Created)
+	assert.Check(t, err)
+
+	// the provenance is not inherited by the images built from the image
+	child := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM "+imageID+"\nLABEL child=1\n"))
+	defer child.Close()
+	_, imageID = buildImage(ctx, t, child.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	inspect, _, err = apiclient.ImageInspectWithRaw(ctx, imageID)
+	assert.NilError(t, err)
+	_, ok := inspect.Config.Labels["com.docker.build.provenance"]
+	assert.Check(t, !ok)
+}
+
+func TestBuildDelete(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "DELETE was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "DELETE is not supported for Windows images")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+ADD secret.txt config.txt /app/
+WORKDIR /app
+DELETE secret.txt /missing
+RUN test ! -e /app/secret.txt && test -f /app/config.txt
+`
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("secret.txt", "secret"),
+			fakecontext.WithFile("config.txt", "config"))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	out := build(dockerfile)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build("FROM busybox\nDELETE --strict /missing\n")
+	assert.Check(t, is.Contains(out, "DELETE: /missing does not exist"))
+}
+
+func TestBuildMutableTagWarning(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "allowmutabletags was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(baseName string, allowMutableTags bool) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM "+baseName+"\nLABEL foo=bar\n"))
+		defer source.Close()
+
+		out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:           true,
+			ForceRemove:      true,
+			AllowMutableTags: allowMutableTags,
+		})
+		return out
+	}
+
+	out := build("busybox:latest", false)
+	assert.Check(t, is.Contains(out, "[Warning] FROM busybox:latest uses mutable tag; consider pinning by digest"))
+
+	out = build("busybox:latest", true)
+	assert.Check(t, !strings.Contains(out, "mutable tag"), out)
+
+	// the frozen images have no repository digest when they are loaded
+	// instead of pulled, an image ID is pinned too
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "busybox:latest")
+	assert.NilError(t, err)
+	pinned := inspect.ID
+	if len(inspect.RepoDigests) > 0 {
+		pinned = inspect.RepoDigests[0]
+	}
+	out = build(pinned, false)
+	assert.Check(t, !strings.Contains(out, "mutable tag"), out)
+}
+
+func TestBuildCopyChownFrom(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "COPY --chown-from is not supported for Windows images")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN mkdir -p /var/lib/app && chown 1001:1002 /var/lib/app
+COPY --chown-from=/var/lib/app file /var/lib/app/
+RUN [ "$(stat -c %u:%g /var/lib/app/file)" = 1001:1002 ]
+`
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "",
+			fakecontext.WithDockerfile(dockerfile),
+			fakecontext.WithFile("file", "content"))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	out := build(dockerfile)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out = build("FROM busybox\nCOPY --chown-from=/missing file /\n")
+	assert.Check(t, is.Contains(out, "COPY --chown-from: /missing does not exist in the image"))
+}
+
+func TestBuildWarnMissingDockerignore(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "warnmissingdockerignore was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(strict bool, files ...func(*fakecontext.Fake) error) (string, error) {
+		opts := append([]func(*fakecontext.Fake) error{
+			fakecontext.WithDockerfile("FROM busybox\nLABEL foo=bar\n"),
+			fakecontext.WithFile("data", strings.Repeat("a", 1024*1024)),
+		}, files...)
+		source := fakecontext.New(t, "", opts...)
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx,
+			source.AsTarReader(t),
+			types.ImageBuildOptions{
+				Remove:                    true,
+				ForceRemove:               true,
+				WarnMissingDockerignore:   512 * 1024,
+				StrictMissingDockerignore: strict,
+			})
+		if err != nil {
+			return "", err
+		}
+		out := bytes.NewBuffer(nil)
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		assert.NilError(t, err)
+		return out.String(), nil
+	}
+
+	warning := "has no .dockerignore file, all its files are sent to the daemon"
+	out, err := build(false)
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "[Warning] the build context is"))
+	assert.Check(t, is.Contains(out, warning))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	out, err = build(false, fakecontext.WithFile(".dockerignore", "*.log\n"))
+	assert.NilError(t, err)
+	assert.Check(t, !strings.Contains(out, warning), out)
+
+	out, err = build(true)
+	if err == nil {
+		assert.Check(t, is.Contains(out, warning))
+		assert.Check(t, !strings.Contains(out, "Successfully built"), out)
+	} else {
+		assert.Check(t, is.ErrorContains(err, warning))
+	}
+}
+
+func TestBuildUserStrict(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "USER --strict was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "USER --strict is not supported for Windows images")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	build := func(dockerfile string) string {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+		defer source.Close()
+
+		return buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+		})
+	}
+
+	out := build(`FROM busybox
+RUN echo 'app:x:1042:1043::/app:/bin/sh' >> /etc/passwd && echo 'app:x:1043:' >> /etc/group
+USER --strict app:app
+RUN [ "$(id -u):$(id -g)" = 1042:1043 ]
+`)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	// the user exists, and its group is created before USER
+	out = build(`FROM busybox
+RUN echo 'app:x:1042:1043::/app:/bin/sh' >> /etc/passwd && echo 'devs:x:1044:' >> /etc/group
+USER --strict app:devs
+RUN [ "$(id -u):$(id -g)" = 1042:1044 ]
+`)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	// the user exists, but its group is missing
+	out = build(`FROM busybox
+RUN echo 'app:x:1042:1043::/app:/bin/sh' >> /etc/passwd
+USER --strict app:devs
+`)
+	assert.Check(t, is.Contains(out, "USER --strict: group devs not found in /etc/group of the image, create it in a RUN instruction before USER"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+
+	out = build("FROM busybox\nUSER --strict bob:devs\n")
+	assert.Check(t, is.Contains(out, "USER --strict: user bob not found in /etc/passwd and group devs not found in /etc/group of the image"))
+}
+
+func TestBuildCreated(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "created was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	apiclient := testEnv.APIClient()
+	build := func(created string) (string, error) {
+		source := fakecontext.New(t, "", fakecontext.WithDockerfile("FROM busybox\nRUN echo foo > /foo\nLABEL foo=bar\n"))
+		defer source.Close()
+
+		resp, err := apiclient.ImageBuild(ctx, source.AsTarReader(t), types.ImageBuildOptions{
+			Remove:      true,
+			ForceRemove: true,
+			Tags:        []string{"build-created"},
+			Created:     created,
+		})
+		if err != nil {
+			return "", err
+		}
+		out := bytes.NewBuffer(nil)
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		assert.NilError(t, err)
+		return out.String(), nil
+	}
+
+	out, err := build("2018-06-01T10:00:00+02:00")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "Successfully built"))
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-created")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("2018-06-01T08:00:00Z", inspect.Created))
+	history, err := apiclient.ImageHistory(ctx, "build-created")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(time.Date(2018, 6, 1, 8, 0, 0, 0, time.UTC).Unix(), history[0].Created))
+
+	out, err = build("yesterday")
+	if err == nil {
+		assert.Check(t, is.Contains(out, `invalid created timestamp \"yesterday\"`))
+		assert.Check(t, !strings.Contains(out, "Step 1/3"))
+	} else {
+		assert.Check(t, is.ErrorContains(err, `invalid created timestamp "yesterday"`))
+	}
+}
+
+func TestBuildTagStages(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "tagstage was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM scratch AS build
+COPY build.txt /
+FROM scratch AS runtime
+COPY runtime.txt /
+FROM scratch
+COPY final.txt /
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("build.txt", "build"),
+		fakecontext.WithFile("runtime.txt", "runtime"),
+		fakecontext.WithFile("final.txt", "final"))
+	defer source.Close()
+
+	apiclient := testEnv.APIClient()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+		Tags:        []string{"build-tag-stages"},
+		TagStages:   []string{"build=build-tag-stages/build", "runtime=build-tag-stages/runtime:1.0"},
+	})
+	assert.Check(t, is.Contains(out, "Successfully tagged build-tag-stages/runtime:1.0 with the image of stage runtime"))
+
+	ids := make(map[string]bool)
+	for _, name := range []string{"build-tag-stages", "build-tag-stages/build", "build-tag-stages/runtime:1.0"} {
+		inspect, _, err := apiclient.ImageInspectWithRaw(ctx, name)
+		assert.NilError(t, err, name)
+		ids[inspect.ID] = true
+	}
+	assert.Check(t, is.Len(ids, 3))
+}
+
+func TestBuildArgToEnvPrefix(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "argtoenvprefix was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+RUN [ "$APP_MODE" = prod ]
+ENV APP_LEVEL=debug
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	mode, level, other := "prod", "info", "other"
+	apiclient := testEnv.APIClient()
+	out, _ := buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:         true,
+		ForceRemove:    true,
+		Tags:           []string{"build-arg-to-env-prefix"},
+		BuildArgs:      map[string]*string{"APP_MODE": &mode, "APP_LEVEL": &level, "OTHER": &other},
+		ArgToEnvPrefix: "APP_",
+	})
+	assert.Check(t, is.Contains(out, "build-args [OTHER] were not consumed"))
+
+	inspect, _, err := apiclient.ImageInspectWithRaw(ctx, "build-arg-to-env-prefix")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(inspect.Config.Env, "APP_MODE=prod"))
+	assert.Check(t, is.Contains(inspect.Config.Env, "APP_LEVEL=debug"))
+	for _, env := range inspect.Config.Env {
+		assert.Check(t, !strings.HasPrefix(env, "OTHER="), env)
+	}
+}
+
+func TestBuildRunNetwork(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "RUN --network was added in API v1.38")
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows", "FIXME")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	// Only the loopback interface exists in a container without network
+	dockerfile := `FROM busybox
+RUN ip link show eth0
+RUN --network=none sh -c '! ip link show eth0 && ip link show lo'
+RUN ip link show eth0
+`
+	source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+	defer source.Close()
+
+	buildImage(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+
+	source = fakecontext.New(t, "", fakecontext.WithDockerfile("FROM busybox\nRUN --network=host true\n"))
+	defer source.Close()
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	assert.Check(t, is.Contains(out, "invalid RUN --network=host"))
+}
+
+func TestBuildInclude(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "INCLUDE was added in API v1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := `FROM busybox
+INCLUDE snippets/setup.df
+RUN test -f /included
+`
+	source := fakecontext.New(t, "",
+		fakecontext.WithDockerfile(dockerfile),
+		fakecontext.WithFile("snippets/setup.df", "# shared setup\nRUN echo from-fragment > /included\n"))
+	defer source.Close()
+
+	out := buildOutput(ctx, t, source.AsTarReader(t), types.ImageBuildOptions{
+		Remove:      true,
+		ForceRemove: true,
+	})
+	assert.Check(t, is.Contains(out, "RUN echo from-fragment > /included"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+}
+
+func TestBuildVCSRefFromGit(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	dockerfile := "FROM busybox\nARG BUILD_VCS_REF\nRUN echo revision=$BUILD_VCS_REF\n"
+	git := fakegit.New(fakegitT{t}, "repo", map[string]string{
+		"Dockerfile": dockerfile,
+	}, true)
+	defer git.Close()
+
+	build := func(options types.ImageBuildOptions) string {
+		options.Remove = true
+		options.ForceRemove = true
+		options.NoCache = true
+		var buildContext io.Reader
+		if options.RemoteContext == "" {
+			source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+			defer source.Close()
+			buildContext = source.AsTarReader(t)
+		}
+		out, _ := buildImage(ctx, t, buildContext, options)
+		return out
+	}
+
+	out := build(types.ImageBuildOptions{RemoteContext: git.RepoURL})
+	assert.Check(t, is.Contains(out, "revision="+git.Revision+"\n"))
+
+	explicit := "v1.0.0"
+	out = build(types.ImageBuildOptions{
+		RemoteContext: git.RepoURL,
+		BuildArgs:     map[string]*string{"BUILD_VCS_REF": &explicit},
+	})
+	assert.Check(t, is.Contains(out, "revision=v1.0.0\n"))
+
+	// the build-arg is not set for a context that is not a git repository
+	out = build(types.ImageBuildOptions{})
+	assert.Check(t, is.Contains(out, "revision=\n"))
+}
+
+func TestBuildFromGitWithDockerfileGlob(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	git := fakegit.New(fakegitT{t}, "repo", map[string]string{
+		"myApp/build/myDockerfile": "FROM busybox\nRUN echo hi from myApp\n",
+		"other/Dockerfile":         "FROM busybox\n",
+		"tools/Dockerfile":         "FROM busybox\n",
+	}, true)
+	defer git.Close()
+
+	apiclient := testEnv.APIClient()
+	out := buildOutput(ctx, t, nil, types.ImageBuildOptions{
+		Remove:        true,
+		ForceRemove:   true,
+		RemoteContext: git.RepoURL,
+		Dockerfile:    "**/myDockerfile",
+	})
+	assert.Check(t, is.Contains(out, "hi from myApp"))
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	_, err := apiclient.ImageBuild(ctx, nil,
+		types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			RemoteContext: git.RepoURL,
+			Dockerfile:    "*/Dockerfile",
+		})
+	assert.Check(t, is.ErrorContains(err, "more than one Dockerfile matches */Dockerfile: other/Dockerfile, tools/Dockerfile"))
+}
+
+func TestBuildDockerfileFromURL(t *testing.T) {
+	skip.If(t, versions.LessThan(testEnv.DaemonAPIVersion(), "1.38"), "test added after 1.38")
+	ctx := context.TODO()
+	defer setupTest(t)()
+
+	server := fakestorage.New(fakegitT{t}, "", fakecontext.WithFiles(map[string]string{
+		"Dockerfile":      "FROM busybox\nENV foo=bar\nRUN [ \"$foo\" = bar ]\n",
+		"copy.Dockerfile": "FROM busybox\nCOPY foo /foo\n",
+	}))
+	defer server.Close()
+
+	build := func(name string) string {
+		return buildOutput(ctx, t, nil, types.ImageBuildOptions{
+			Remove:        true,
+			ForceRemove:   true,
+			RemoteContext: server.URL() + "/" + name,
+		})
+	}
+
+	out := build("Dockerfile")
+	assert.Check(t, is.Contains(out, "Successfully built"))
+
+	// there is no build context to copy files from
+	out = build("copy.Dockerfile")
+	assert.Check(t, is.Contains(out, "no build context to copy foo from, the Dockerfile was sent without a context"))
+	assert.Check(t, !strings.Contains(out, "Successfully built"))
+}
+
+// fakegitT adapts testing.T to the go-check style testing interface of
+// fakegit and fakestorage
+type fakegitT struct {
+	*testing.T
+}
+
+func (t fakegitT) Skip(reason string) {
+	t.T.Skip(reason)
+}
+
+func writeTarRecord(t *testing.T, w *tar.Writer, fn, contents string) {
+	err := w.WriteHeader(&tar.Header{
+		Name:     fn,
+		Mode:     0600,
+		Size:     int64(len(contents)),
+		Typeflag: '0',
+	})
+	assert.NilError(t, err)
+	_, err = w.Write([]byte(contents))
+	assert.NilError(t, err)
+}
+
+// buildOutput builds buildContext with options, and returns the output of the
+// build whether it succeeds or not
+func buildOutput(ctx context.Context, t *testing.T, buildContext io.Reader, options types.ImageBuildOptions) string {
+	resp, err := testEnv.APIClient().ImageBuild(ctx, buildContext, options)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	out := bytes.NewBuffer(nil)
+	_, err = io.Copy(out, resp.Body)
+	assert.NilError(t, err)
+	return out.String()
+}
+
+// buildImage builds buildContext with options, checks that the build
+// succeeds, and returns its output and the ID of the built image
+func buildImage(ctx context.Context, t *testing.T, buildContext io.Reader, options types.ImageBuildOptions) (string, string) {
+	out := buildOutput(ctx, t, buildContext, options)
+	assert.Assert(t, is.Contains(out, "Successfully built"))
+
+	var result types.BuildResult
+	buildAux(t, out, "moby.image.id", &result)
+	assert.Assert(t, result.ID != "", out)
+	return out, result.ID
+}
+
+// buildAux decodes the aux message of ID id of the build output out into v,
+// and returns whether the output has one
+func buildAux(t *testing.T, out string, id string, v interface{}) bool {
+	var found bool
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var m jsonmessage.JSONMessage
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		if m.ID == id && m.Aux != nil {
+			assert.NilError(t, json.Unmarshal(*m.Aux, v))
+			found = true
+		}
+	}
+	return found
 }
 
 type buildLine struct {
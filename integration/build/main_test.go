@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/docker/docker/internal/test/environment"
+	"github.com/docker/docker/internal/test/fakestorage"
 )
 
 var testEnv *environment.Execution
@@ -23,6 +24,7 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	fakestorage.SetTestEnvironment(testEnv)
 	testEnv.Print()
 	os.Exit(m.Run())
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/docker/docker/internal/test"
 	"github.com/docker/docker/internal/test/fakecontext"
@@ -54,6 +55,8 @@ type FakeGit struct {
 	root    string
 	server  gitServer
 	RepoURL string
+	// Revision is the commit of the files of the repository
+	Revision string
 }
 
 // Close closes the server, implements Closer interface
@@ -94,6 +97,10 @@ func New(c testingT, name string, files map[string]string, enforceLocalServer bo
 	if output, err := exec.Command("git", "commit", "-a", "-m", "Initial commit").CombinedOutput(); err != nil {
 		c.Fatalf("error trying to commit to repo: %s (%s)", err, output)
 	}
+	revision, err := exec.Command("git", "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		c.Fatalf("error trying to get the revision of the repo: %s (%s)", err, revision)
+	}
 
 	root, err := ioutil.TempDir("", "docker-test-git-repo")
 	if err != nil {
@@ -131,6 +138,7 @@ func New(c testingT, name string, files map[string]string, enforceLocalServer bo
 	return &FakeGit{
 		root:    root,
 		server:  server,
-		RepoURL: fmt.Sprintf("%s/%s.git", server.URL(), name),
+		RepoURL:  fmt.Sprintf("%s/%s.git", server.URL(), name),
+		Revision: strings.TrimSpace(string(revision)),
 	}
 }
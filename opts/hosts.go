@@ -1,9 +1,12 @@
 package opts // import "github.com/docker/docker/opts"
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -163,3 +166,46 @@ func ValidateExtraHost(val string) (string, error) {
 	}
 	return val, nil
 }
+
+// ParseHostsFile reads a file in the /etc/hosts format, where each line is an
+// IP address followed by one or more host names, and returns its entries as
+// extra hosts in the form of name:ip, the form of --add-host. Comments start
+// with a #. An error is returned with the line number of the first invalid
+// entry.
+func ParseHostsFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseHostsFile(f, filename)
+}
+
+func parseHostsFile(r io.Reader, filename string) ([]string, error) {
+	var extraHosts []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s line %d: missing host name for %s", filename, line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			extraHost, err := ValidateExtraHost(name + ":" + fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", filename, line, err)
+			}
+			extraHosts = append(extraHosts, extraHost)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return extraHosts, nil
+}
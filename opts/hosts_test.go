@@ -179,3 +179,31 @@ func TestValidateExtraHosts(t *testing.T) {
 		}
 	}
 }
+
+func TestParseHostsFile(t *testing.T) {
+	hosts := `# comment
+127.0.0.1	localhost
+10.0.2.1 thathost thathost.local # with an alias
+
+2003:ab34:e::1 anipv6host
+`
+	extraHosts, err := parseHostsFile(strings.NewReader(hosts), "hosts.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"localhost:127.0.0.1", "thathost:10.0.2.1", "thathost.local:10.0.2.1", "anipv6host:2003:ab34:e::1"}
+	if strings.Join(extraHosts, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, extraHosts)
+	}
+
+	invalid := map[string]string{
+		"127.0.0.1 localhost\n10.0.2\n":           `hosts.txt line 2: missing host name for 10.0.2`,
+		"127.0.0.1 localhost\n\n101.10.2 myhost\n": `hosts.txt line 3: invalid IP address in add-host: "101.10.2"`,
+		"myhost 10.0.2.1\n":                        `hosts.txt line 1: invalid IP address in add-host: "myhost"`,
+	}
+	for hosts, expectedError := range invalid {
+		if _, err := parseHostsFile(strings.NewReader(hosts), "hosts.txt"); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected error %q for %q, got %v", expectedError, hosts, err)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -65,6 +66,9 @@ type (
 		// replaced with the matching name from this map.
 		RebaseNames map[string]string
 		InUserNS    bool
+		// When unpacking, keep the existing non-directories that were
+		// modified after the files of the archive instead of replacing them.
+		KeepNewer bool
 	}
 )
 
@@ -95,6 +99,8 @@ const (
 	Gzip
 	// Xz is xz compression algorithm.
 	Xz
+	// Zstd is zstd compression algorithm.
+	Zstd
 )
 
 const (
@@ -139,6 +145,7 @@ func DetectCompression(source []byte) Compression {
 		Bzip2: {0x42, 0x5A, 0x68},
 		Gzip:  {0x1F, 0x8B, 0x08},
 		Xz:    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
 	} {
 		if len(source) < len(m) {
 			logrus.Debug("Len too short")
@@ -157,6 +164,12 @@ func xzDecompress(ctx context.Context, archive io.Reader) (io.ReadCloser, error)
 	return cmdStream(exec.CommandContext(ctx, args[0], args[1:]...), archive)
 }
 
+func zstdDecompress(ctx context.Context, archive io.Reader) (io.ReadCloser, error) {
+	args := []string{"zstd", "-d", "-c", "-q"}
+
+	return cmdStream(exec.CommandContext(ctx, args[0], args[1:]...), archive)
+}
+
 func gzDecompress(ctx context.Context, buf io.Reader) (io.ReadCloser, error) {
 	if unpigzPath == "" {
 		return gzip.NewReader(buf)
@@ -225,6 +238,16 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 		}
 		readBufWrapper := p.NewReadCloserWrapper(buf, xzReader)
 		return wrapReadCloser(readBufWrapper, cancel), nil
+	case Zstd:
+		ctx, cancel := context.WithCancel(context.Background())
+
+		zstdReader, err := zstdDecompress(ctx, buf)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		readBufWrapper := p.NewReadCloserWrapper(buf, zstdReader)
+		return wrapReadCloser(readBufWrapper, cancel), nil
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	}
@@ -242,8 +265,8 @@ func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, er
 		gzWriter := gzip.NewWriter(dest)
 		writeBufWrapper := p.NewWriteCloserWrapper(buf, gzWriter)
 		return writeBufWrapper, nil
-	case Bzip2, Xz:
-		// archive/bzip2 does not support writing, and there is no xz support at all
+	case Bzip2, Xz, Zstd:
+		// archive/bzip2 does not support writing, and there is no xz or zstd support at all
 		// However, this is not a problem as docker only currently generates gzipped tars
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	default:
@@ -349,6 +372,8 @@ func (compression *Compression) Extension() string {
 		return "tar.gz"
 	case Xz:
 		return "tar.xz"
+	case Zstd:
+		return "tar.zst"
 	}
 	return ""
 }
@@ -721,6 +746,9 @@ func Tar(path string, compression Compression) (io.ReadCloser, error) {
 
 // TarWithOptions creates an archive from the directory at `path`, only including files whose relative
 // paths are included in `options.IncludeFiles` (if non-nil) or not in `options.ExcludePatterns`.
+// Includes and the entries of each directory are archived in lexical order, regardless of the
+// order of `options.IncludeFiles` or of the order the files were created in, so that the same
+// set of files always produces the same sequence of entries.
 func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error) {
 
 	// Fix the source path to work with long path names. This is a no-op
@@ -791,9 +819,14 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 			options.IncludeFiles = []string{"."}
 		}
 
+		// filepath.Walk visits the files of each include in lexical order
+		includes := make([]string, len(options.IncludeFiles))
+		copy(includes, options.IncludeFiles)
+		sort.Strings(includes)
+
 		seen := make(map[string]bool)
 
-		for _, include := range options.IncludeFiles {
+		for _, include := range includes {
 			rebaseName := options.RebaseNames[include]
 
 			walkRoot := getWalkRoot(srcPath, include)
@@ -973,6 +1006,10 @@ loop:
 				continue
 			}
 
+			if options.KeepNewer && !fi.IsDir() && fi.ModTime().After(hdr.ModTime) {
+				continue
+			}
+
 			if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
 				if err := os.RemoveAll(path); err != nil {
 					return err
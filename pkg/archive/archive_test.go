@@ -134,6 +134,13 @@ func TestDecompressStreamXz(t *testing.T) {
 	testDecompressStream(t, "xz", "xz -f")
 }
 
+func TestDecompressStreamZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not present")
+	}
+	testDecompressStream(t, "zst", "zstd -f -q")
+}
+
 func TestCompressStreamXzUnsupported(t *testing.T) {
 	dest, err := os.Create(tmp + "dest")
 	if err != nil {
@@ -210,6 +217,14 @@ func TestExtensionXz(t *testing.T) {
 	}
 }
 
+func TestExtensionZstd(t *testing.T) {
+	compression := Zstd
+	output := compression.Extension()
+	if output != "tar.zst" {
+		t.Fatalf("The extension of a zstd archive should be 'tar.zst'")
+	}
+}
+
 func TestCmdStreamLargeStderr(t *testing.T) {
 	cmd := exec.Command("sh", "-c", "dd if=/dev/zero bs=1k count=1000 of=/dev/stderr; echo hello")
 	out, err := cmdStream(cmd, nil)
@@ -821,6 +836,40 @@ func TestTarWithOptions(t *testing.T) {
 	}
 }
 
+func TestTarWithOptionsOrder(t *testing.T) {
+	files := []string{"b/2", "a", "b/1", "c.txt", "b.txt"}
+	tarEntries := func(order []string, includes []string) []string {
+		origin, err := ioutil.TempDir("", "docker-test-tar-order")
+		assert.NilError(t, err)
+		defer os.RemoveAll(origin)
+		for _, name := range order {
+			p := filepath.Join(origin, filepath.FromSlash(name))
+			assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			assert.NilError(t, ioutil.WriteFile(p, []byte(name), 0644))
+		}
+
+		rc, err := TarWithOptions(origin, &TarOptions{IncludeFiles: includes})
+		assert.NilError(t, err)
+		defer rc.Close()
+		var entries []string
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NilError(t, err)
+			entries = append(entries, hdr.Name)
+		}
+		return entries
+	}
+
+	expected := tarEntries(files, []string{"a", "b", "b.txt", "c.txt"})
+	assert.Check(t, is.DeepEqual([]string{"a", "b/", "b/1", "b/2", "b.txt", "c.txt"}, expected))
+	reversed := []string{"c.txt", "b.txt", "b/1", "a", "b/2"}
+	assert.Check(t, is.DeepEqual(expected, tarEntries(reversed, []string{"c.txt", "b.txt", "b", "a"})))
+}
+
 // Some tar archives such as http://haproxy.1wt.eu/download/1.5/src/devel/haproxy-1.5-dev21.tar.gz
 // use PAX Global Extended Headers.
 // Failing prevents the archives from being uncompressed during ADD
@@ -3,6 +3,7 @@
 package archive // import "github.com/docker/docker/pkg/archive"
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/pkg/system"
 	"golang.org/x/sys/unix"
@@ -219,6 +221,36 @@ func TestTarWithBlockCharFifo(t *testing.T) {
 	}
 }
 
+func TestUntarKeepNewer(t *testing.T) {
+	archived := time.Now().Add(-time.Hour).Truncate(time.Second)
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"newer", "older", "new"} {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 8, ModTime: archived}))
+		_, err := tw.Write([]byte("archived"))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+
+	dest, err := ioutil.TempDir("", "docker-test-untar-keep-newer")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dest)
+	for _, name := range []string{"newer", "older"} {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dest, name), []byte("existing"), 0644))
+	}
+	older := archived.Add(-time.Hour)
+	assert.NilError(t, os.Chtimes(filepath.Join(dest, "older"), older, older))
+
+	err = Untar(buf, dest, &TarOptions{KeepNewer: true})
+	assert.NilError(t, err)
+
+	for name, expected := range map[string]string{"newer": "existing", "older": "archived", "new": "archived"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(expected, string(content)), name)
+	}
+}
+
 // TestTarUntarWithXattr is Unix as Lsetxattr is not supported on Windows
 func TestTarUntarWithXattr(t *testing.T) {
 	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
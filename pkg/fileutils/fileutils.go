@@ -25,14 +25,14 @@ func NewPatternMatcher(patterns []string) (*PatternMatcher, error) {
 	pm := &PatternMatcher{
 		patterns: make([]*Pattern, 0, len(patterns)),
 	}
-	for _, p := range patterns {
+	for i, p := range patterns {
 		// Eliminate leading and trailing whitespace.
 		p = strings.TrimSpace(p)
 		if p == "" {
 			continue
 		}
 		p = filepath.Clean(p)
-		newp := &Pattern{}
+		newp := &Pattern{index: i}
 		if p[0] == '!' {
 			if len(p) == 1 {
 				return nil, errors.New("illegal exclusion pattern: \"!\"")
@@ -60,7 +60,20 @@ func NewPatternMatcher(patterns []string) (*PatternMatcher, error) {
 // Matches matches path against all the patterns. Matches is not safe to be
 // called concurrently
 func (pm *PatternMatcher) Matches(file string) (bool, error) {
+	matched, _, err := pm.MatchesWithIndex(file)
+	if matched {
+		logrus.Debugf("Skipping excluded path: %s", file)
+	}
+	return matched, err
+}
+
+// MatchesWithIndex is like Matches, but also returns the index, in the list
+// of patterns the matcher was created with, of the last pattern matching
+// path, which is the one deciding whether path is excluded. The index is -1
+// if no pattern matches path.
+func (pm *PatternMatcher) MatchesWithIndex(file string) (bool, int, error) {
 	matched := false
+	index := -1
 	file = filepath.FromSlash(file)
 	parentPath := filepath.Dir(file)
 	parentPathDirs := strings.Split(parentPath, string(os.PathSeparator))
@@ -74,7 +87,7 @@ func (pm *PatternMatcher) Matches(file string) (bool, error) {
 
 		match, err := pattern.match(file)
 		if err != nil {
-			return false, err
+			return false, -1, err
 		}
 
 		if !match && parentPath != "." {
@@ -86,14 +99,11 @@ func (pm *PatternMatcher) Matches(file string) (bool, error) {
 
 		if match {
 			matched = !negative
+			index = pattern.index
 		}
 	}
 
-	if matched {
-		logrus.Debugf("Skipping excluded path: %s", file)
-	}
-
-	return matched, nil
+	return matched, index, nil
 }
 
 // Exclusions returns true if any of the patterns define exclusions
@@ -112,6 +122,7 @@ type Pattern struct {
 	dirs           []string
 	regexp         *regexp.Regexp
 	exclusion      bool
+	index          int
 }
 
 func (p *Pattern) String() string {
@@ -123,6 +134,12 @@ func (p *Pattern) Exclusion() bool {
 	return p.exclusion
 }
 
+// Match matches path against the pattern. Unlike PatternMatcher.Matches,
+// the parent directories of path are not matched.
+func (p *Pattern) Match(path string) (bool, error) {
+	return p.match(filepath.FromSlash(path))
+}
+
 func (p *Pattern) match(path string) (bool, error) {
 
 	if p.regexp == nil {
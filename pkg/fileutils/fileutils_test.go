@@ -303,6 +303,30 @@ func TestMatchesWithMalformedPatterns(t *testing.T) {
 	}
 }
 
+func TestMatchesWithIndex(t *testing.T) {
+	patterns := []string{"docs", "", "!docs/README.md", "*.go", "!docs/README*"}
+	pm, err := NewPatternMatcher(patterns)
+	assert.NilError(t, err)
+
+	tests := []struct {
+		file    string
+		matched bool
+		index   int
+	}{
+		{file: "docs/index.md", matched: true, index: 0},
+		{file: "docs/README.md", matched: false, index: 4},
+		{file: "fileutils.go", matched: true, index: 3},
+		{file: "docs/main.go", matched: true, index: 0},
+		{file: "README.md", matched: false, index: -1},
+	}
+	for _, tc := range tests {
+		matched, index, err := pm.MatchesWithIndex(tc.file)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(tc.matched, matched), tc.file)
+		assert.Check(t, is.Equal(tc.index, index), tc.file)
+	}
+}
+
 type matchesTestCase struct {
 	pattern string
 	text    string